@@ -0,0 +1,217 @@
+// Command eventgen writes TypeScript definitions for gateway events and close
+// codes from the payload registry in internal/events.
+//
+//	go run ./cmd/eventgen -out ../frontend/src/types/events.gen.ts
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+)
+
+var (
+	timeType       = reflect.TypeFor[time.Time]()
+	rawMessageType = reflect.TypeFor[json.RawMessage]()
+)
+
+func main() {
+	out := flag.String("out", "", "file to write (default stdout)")
+	flag.Parse()
+
+	src := generate()
+	if *out == "" {
+		os.Stdout.Write(src)
+		return
+	}
+	if err := os.WriteFile(*out, src, 0o644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// generator emits an interface for every named type reachable from a
+// payload, in the order they are first reached.
+type generator struct {
+	decls bytes.Buffer
+	seen  map[reflect.Type]string
+}
+
+func generate() []byte {
+	g := &generator{seen: make(map[reflect.Type]string)}
+
+	var eventMap bytes.Buffer
+	for _, t := range events.EventTypes() {
+		p, _ := events.Lookup(t)
+		fmt.Fprintf(&eventMap, "  %s: %s;\n", t, g.typeOf(p.Type))
+	}
+
+	var b bytes.Buffer
+	b.WriteString("// Code generated by eventgen from backend/internal/events. DO NOT EDIT.\n\n")
+	b.Write(g.decls.Bytes())
+	b.WriteString("/** Payload of each gateway event type. */\n")
+	b.WriteString("export interface GatewayEventMap {\n")
+	b.Write(eventMap.Bytes())
+	b.WriteString("}\n\n")
+	b.WriteString("export type GatewayEventType = keyof GatewayEventMap;\n\n")
+	b.WriteString("/** Close codes the gateway ends connections with. */\n")
+	b.WriteString("export const GatewayCloseCode = {\n")
+	for _, c := range events.CloseCodes() {
+		fmt.Fprintf(&b, "  %s: %d,\n", pascalCase(c.String()), c)
+	}
+	b.WriteString("} as const;\n\n")
+	b.WriteString(`/** A gateway event, discriminated by its type. */
+export type GatewayEvent = {
+  [T in GatewayEventType]: {
+    t: T;
+    d: GatewayEventMap[T];
+    /** Payload version. */
+    v?: number;
+    s?: string;
+    /** Sequence number within the gateway session. */
+    q?: number;
+    /** Idempotency key; repeats of an event share it. */
+    k?: string;
+  };
+}[GatewayEventType];
+`)
+	return b.Bytes()
+}
+
+// typeOf returns the TypeScript type for t, declaring it first if it is a
+// named struct or string type.
+func (g *generator) typeOf(t reflect.Type) string {
+	switch t {
+	case timeType:
+		return "string"
+	case rawMessageType:
+		return "unknown"
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.typeOf(t.Elem())
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return g.named(t, "number")
+	case reflect.String:
+		return g.named(t, "string")
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "string" // base64
+		}
+		return g.typeOf(t.Elem()) + "[]"
+	case reflect.Map:
+		return fmt.Sprintf("Record<string, %s>", g.typeOf(t.Elem()))
+	case reflect.Struct:
+		return g.structType(t)
+	default:
+		return "unknown"
+	}
+}
+
+// named declares an alias for a named basic type such as model.UserStatus.
+func (g *generator) named(t reflect.Type, base string) string {
+	if t.Name() == "" || t.PkgPath() == "" {
+		return base
+	}
+	if name, ok := g.seen[t]; ok {
+		return name
+	}
+	g.seen[t] = t.Name()
+	fmt.Fprintf(&g.decls, "export type %s = %s;\n\n", t.Name(), base)
+	return t.Name()
+}
+
+func (g *generator) structType(t reflect.Type) string {
+	if name, ok := g.seen[t]; ok {
+		return name
+	}
+	name := t.Name()
+	if name == "" {
+		return "{ " + strings.Join(g.fields(t), " ") + " }"
+	}
+	g.seen[t] = name
+
+	// Fields may declare further types, which must not interleave with this one.
+	fields := g.fields(t)
+	if len(fields) == 0 {
+		fmt.Fprintf(&g.decls, "export type %s = Record<string, never>;\n\n", name)
+		return name
+	}
+	fmt.Fprintf(&g.decls, "export interface %s {\n", name)
+	for _, f := range fields {
+		fmt.Fprintf(&g.decls, "  %s\n", f)
+	}
+	g.decls.WriteString("}\n\n")
+	return name
+}
+
+// fields returns t's fields as they are encoded by encoding/json.
+func (g *generator) fields(t reflect.Type) []string {
+	var out []string
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			out = append(out, g.fields(f.Type)...)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		var ts string
+		if hasOption(opts, "string") {
+			ts = "string"
+		} else {
+			ts = g.typeOf(f.Type)
+		}
+
+		optional := hasOption(opts, "omitempty")
+		if f.Type.Kind() == reflect.Pointer && !optional {
+			ts += " | null"
+		}
+		if optional {
+			out = append(out, fmt.Sprintf("%s?: %s;", name, ts))
+		} else {
+			out = append(out, fmt.Sprintf("%s: %s;", name, ts))
+		}
+	}
+	return out
+}
+
+// pascalCase turns a close reason such as "session timed out" into an
+// identifier.
+func pascalCase(s string) string {
+	var b strings.Builder
+	for _, word := range strings.Fields(s) {
+		b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+	return b.String()
+}
+
+func hasOption(opts, want string) bool {
+	for opts != "" {
+		var opt string
+		opt, opts, _ = strings.Cut(opts, ",")
+		if opt == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,350 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/robwittman/possessive-potato/backend/internal/config"
+	"github.com/robwittman/possessive-potato/backend/internal/mail"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	EmailVerificationTokenDuration = 24 * time.Hour
+	PasswordResetTokenDuration     = 1 * time.Hour
+
+	// MailTimeout bounds sending an email the caller does not wait for.
+	MailTimeout = 30 * time.Second
+
+	// KnownDeviceDuration is how long a login device is remembered before a
+	// login from it is reported as new again.
+	KnownDeviceDuration = 90 * 24 * time.Hour
+
+	MinPasswordLength = 8
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrInvalidToken       = errors.New("token expired or invalid")
+	ErrPasswordTooShort   = fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	ErrEmailNotVerified   = errors.New("a verified email address is required to send messages")
+	ErrAlreadyVerified    = errors.New("email address is already verified")
+	ErrBotAccount         = errors.New("bot accounts cannot use this flow")
+)
+
+// AccountService implements the email-based account flows: proving ownership
+// of an address and recovering an account through it. Tokens are random,
+// single-use and stored in Redis with a TTL.
+type AccountService struct {
+	auth            *Service
+	users           store.UserStoreInterface
+	securityEvents  store.SecurityEventStoreInterface
+	mailer          mail.Mailer
+	publicURL       string
+	notifyNewDevice bool
+}
+
+func NewAccountService(authService *Service, users store.UserStoreInterface, securityEvents store.SecurityEventStoreInterface, mailer mail.Mailer, cfg *config.Config) *AccountService {
+	return &AccountService{
+		auth:            authService,
+		users:           users,
+		securityEvents:  securityEvents,
+		mailer:          mailer,
+		publicURL:       cfg.PublicURL,
+		notifyNewDevice: cfg.NotifyNewDeviceLogin,
+	}
+}
+
+// LoginAttempt is an email/password login along with the client it came from.
+type LoginAttempt struct {
+	Email     string
+	Password  string
+	IP        string
+	UserAgent string
+}
+
+// Authenticate checks an email/password login, enforcing the lockout policy
+// and recording the outcome in the user's security event log. On success, a
+// hash produced by a weaker algorithm or weaker parameters is transparently
+// replaced with one from the current hasher.
+func (a *AccountService) Authenticate(ctx context.Context, attempt LoginAttempt) (*model.User, error) {
+	if err := a.auth.CheckLoginAllowed(ctx, attempt.Email, attempt.IP); err != nil {
+		return nil, err
+	}
+
+	user, err := a.users.GetByEmail(ctx, attempt.Email)
+	if err != nil {
+		return nil, err
+	}
+	valid := false
+	if user != nil && !user.Bot {
+		valid = a.auth.CheckPassword(user.PasswordHash, attempt.Password)
+	} else {
+		a.auth.CheckNoPassword(attempt.Password)
+	}
+	if !valid {
+		locked, err := a.auth.RecordLoginFailure(ctx, attempt.Email, attempt.IP)
+		if err != nil {
+			return nil, err
+		}
+		if user != nil {
+			a.recordSecurityEvent(ctx, user.ID, model.SecurityEventLoginFailed, attempt)
+			if locked {
+				a.recordSecurityEvent(ctx, user.ID, model.SecurityEventAccountLocked, attempt)
+			}
+		}
+		return nil, ErrInvalidCredentials
+	}
+
+	if err := a.auth.ResetLoginFailures(ctx, attempt.Email); err != nil {
+		log.Warn().Err(err).Int64("user_id", user.ID).Msg("failed to reset login failures")
+	}
+	a.recordSecurityEvent(ctx, user.ID, model.SecurityEventLoginSuccess, attempt)
+	a.checkNewDevice(ctx, user, attempt)
+
+	if a.auth.NeedsRehash(user.PasswordHash) {
+		hash, err := a.auth.HashPassword(attempt.Password)
+		if err == nil {
+			err = a.users.UpdatePassword(ctx, user.ID, hash)
+		}
+		if err != nil {
+			log.Warn().Err(err).Int64("user_id", user.ID).Msg("failed to upgrade password hash")
+		} else {
+			user.PasswordHash = hash
+		}
+	}
+	return user, nil
+}
+
+// SendVerificationEmail issues a verification token and mails a link to the user.
+func (a *AccountService) SendVerificationEmail(ctx context.Context, user *model.User) error {
+	if user.Bot {
+		return ErrBotAccount
+	}
+	if user.EmailVerified() {
+		return ErrAlreadyVerified
+	}
+
+	token, err := a.issueToken(ctx, "email_verify", user.ID, EmailVerificationTokenDuration)
+	if err != nil {
+		return err
+	}
+
+	msg, err := mail.Render(mail.TemplateVerifyEmail, mail.TemplateData{
+		DisplayName: user.DisplayName,
+		Email:       user.Email,
+		Link:        a.link("/verify-email", token),
+		ExpiresIn:   "24 hours",
+	})
+	if err != nil {
+		return err
+	}
+	return a.mailer.Send(ctx, msg)
+}
+
+// VerifyEmail consumes a verification token and marks the owning user's email as verified.
+func (a *AccountService) VerifyEmail(ctx context.Context, token string) (int64, error) {
+	userID, err := a.consumeToken(ctx, "email_verify", token)
+	if err != nil {
+		return 0, err
+	}
+	if err := a.users.MarkEmailVerified(ctx, userID); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// RequestPasswordReset mails a reset link if an account exists for email. It
+// reports success either way so callers cannot probe for registered addresses:
+// the link is issued and mailed in the background, so a known address takes
+// no longer to answer than an unknown one, and a failure to send is logged
+// rather than returned.
+func (a *AccountService) RequestPasswordReset(ctx context.Context, email string) error {
+	user, err := a.users.GetByEmail(ctx, email)
+	if err != nil {
+		return err
+	}
+	if user == nil || user.Bot {
+		return nil
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), MailTimeout)
+		defer cancel()
+		if err := a.sendPasswordReset(ctx, user); err != nil {
+			log.Warn().Err(err).Int64("user_id", user.ID).Msg("failed to send password reset email")
+		}
+	}()
+	return nil
+}
+
+func (a *AccountService) sendPasswordReset(ctx context.Context, user *model.User) error {
+	token, err := a.issueToken(ctx, "password_reset", user.ID, PasswordResetTokenDuration)
+	if err != nil {
+		return err
+	}
+
+	msg, err := mail.Render(mail.TemplateResetPassword, mail.TemplateData{
+		DisplayName: user.DisplayName,
+		Email:       user.Email,
+		Link:        a.link("/reset-password", token),
+		ExpiresIn:   "1 hour",
+	})
+	if err != nil {
+		return err
+	}
+	return a.mailer.Send(ctx, msg)
+}
+
+// ResetPassword consumes a reset token, sets the new password and revokes
+// every refresh token so existing sessions must log in again. Following a
+// reset link also proves ownership of the email address.
+func (a *AccountService) ResetPassword(ctx context.Context, token, newPassword string) error {
+	if len(newPassword) < MinPasswordLength {
+		return ErrPasswordTooShort
+	}
+
+	userID, err := a.consumeToken(ctx, "password_reset", token)
+	if err != nil {
+		return err
+	}
+
+	hash, err := a.auth.HashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	if err := a.users.UpdatePassword(ctx, userID, hash); err != nil {
+		return err
+	}
+	if err := a.users.MarkEmailVerified(ctx, userID); err != nil {
+		return err
+	}
+	if err := a.auth.RevokeAllRefreshTokens(ctx, userID); err != nil {
+		return err
+	}
+	a.recordSecurityEvent(ctx, userID, model.SecurityEventPasswordReset, LoginAttempt{})
+	return nil
+}
+
+// ListSecurityEvents returns the user's account activity log, newest first.
+func (a *AccountService) ListSecurityEvents(ctx context.Context, userID int64, before int64, limit int) ([]model.SecurityEvent, error) {
+	return a.securityEvents.ListByUser(ctx, userID, before, limit)
+}
+
+// recordSecurityEvent appends to the user's security log. Failures are logged
+// rather than returned so auditing can never block a login.
+func (a *AccountService) recordSecurityEvent(ctx context.Context, userID int64, typ model.SecurityEventType, attempt LoginAttempt) {
+	event := &model.SecurityEvent{
+		ID:     model.NewID().Int64(),
+		UserID: userID,
+		Type:   typ,
+	}
+	if attempt.IP != "" {
+		event.IPAddress = &attempt.IP
+	}
+	if attempt.UserAgent != "" {
+		event.UserAgent = &attempt.UserAgent
+	}
+	if err := a.securityEvents.Create(ctx, event); err != nil {
+		log.Warn().Err(err).Int64("user_id", userID).Str("type", string(typ)).Msg("failed to record security event")
+	}
+}
+
+// checkNewDevice remembers the device a user logged in from and, if enabled,
+// emails them the first time a new one is seen. A user's very first device is
+// never reported.
+func (a *AccountService) checkNewDevice(ctx context.Context, user *model.User, attempt LoginAttempt) {
+	sum := sha256.Sum256([]byte(attempt.UserAgent))
+	device := hex.EncodeToString(sum[:16])
+	key := fmt.Sprintf("known_devices:%d", user.ID)
+
+	pipe := a.auth.redis.TxPipeline()
+	seen := pipe.SCard(ctx, key)
+	added := pipe.SAdd(ctx, key, device)
+	pipe.Expire(ctx, key, KnownDeviceDuration)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Warn().Err(err).Int64("user_id", user.ID).Msg("failed to track login device")
+		return
+	}
+	if added.Val() == 0 || seen.Val() == 0 {
+		return
+	}
+
+	a.recordSecurityEvent(ctx, user.ID, model.SecurityEventNewDevice, attempt)
+	if !a.notifyNewDevice {
+		return
+	}
+
+	msg, err := mail.Render(mail.TemplateNewLogin, mail.TemplateData{
+		DisplayName: user.DisplayName,
+		Email:       user.Email,
+		Link:        a.publicURL + "/forgot-password",
+		IPAddress:   attempt.IP,
+		UserAgent:   attempt.UserAgent,
+	})
+	if err == nil {
+		err = a.mailer.Send(ctx, msg)
+	}
+	if err != nil {
+		log.Warn().Err(err).Int64("user_id", user.ID).Msg("failed to send new device notification")
+	}
+}
+
+// issueToken stores a new single-use token for userID. Only the most recent
+// token of each kind stays valid; issuing another replaces it.
+func (a *AccountService) issueToken(ctx context.Context, kind string, userID int64, ttl time.Duration) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", fmt.Errorf("generate %s token: %w", kind, err)
+	}
+
+	userKey := fmt.Sprintf("%s_user:%d", kind, userID)
+	if prev, err := a.auth.redis.Get(ctx, userKey).Result(); err == nil {
+		a.auth.redis.Del(ctx, fmt.Sprintf("%s:%s", kind, prev))
+	}
+
+	pipe := a.auth.redis.TxPipeline()
+	pipe.Set(ctx, fmt.Sprintf("%s:%s", kind, token), userID, ttl)
+	pipe.Set(ctx, userKey, token, ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return "", fmt.Errorf("store %s token: %w", kind, err)
+	}
+	return token, nil
+}
+
+func (a *AccountService) consumeToken(ctx context.Context, kind, token string) (int64, error) {
+	userID, err := a.auth.redis.GetDel(ctx, fmt.Sprintf("%s:%s", kind, token)).Int64()
+	if err == redis.Nil {
+		return 0, ErrInvalidToken
+	}
+	if err != nil {
+		return 0, fmt.Errorf("consume %s token: %w", kind, err)
+	}
+	a.auth.redis.Del(ctx, fmt.Sprintf("%s_user:%d", kind, userID))
+	return userID, nil
+}
+
+func (a *AccountService) link(path, token string) string {
+	return a.publicURL + path + "?token=" + url.QueryEscape(token)
+}
+
+// RequireVerifiedEmail returns ErrEmailNotVerified if the instance or the
+// server requires a verified email and user does not have one. Bots have no
+// email and are always allowed.
+func RequireVerifiedEmail(instanceRequired bool, server *model.Server, user *model.User) error {
+	if user.Bot || user.EmailVerified() {
+		return nil
+	}
+	if instanceRequired || (server != nil && server.RequireVerifiedEmail) {
+		return ErrEmailNotVerified
+	}
+	return nil
+}
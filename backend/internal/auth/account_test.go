@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/robwittman/possessive-potato/backend/internal/config"
+	"github.com/robwittman/possessive-potato/backend/internal/mail"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeUsers struct {
+	store.UserStoreInterface
+	mu    sync.Mutex
+	users map[string]*model.User
+}
+
+func (f *fakeUsers) GetByEmail(_ context.Context, email string) (*model.User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if u, ok := f.users[email]; ok {
+		copied := *u
+		return &copied, nil
+	}
+	return nil, nil
+}
+
+func (f *fakeUsers) UpdatePassword(_ context.Context, id int64, hash string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, u := range f.users {
+		if u.ID == id {
+			u.PasswordHash = hash
+		}
+	}
+	return nil
+}
+
+func (f *fakeUsers) MarkEmailVerified(_ context.Context, id int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	for _, u := range f.users {
+		if u.ID == id {
+			u.EmailVerifiedAt = &now
+		}
+	}
+	return nil
+}
+
+func (f *fakeUsers) get(email string) model.User {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return *f.users[email]
+}
+
+type fakeSecurityEvents struct {
+	store.SecurityEventStoreInterface
+	mu     sync.Mutex
+	events []model.SecurityEventType
+}
+
+func (f *fakeSecurityEvents) Create(_ context.Context, event *model.SecurityEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, event.Type)
+	return nil
+}
+
+// countingHasher counts the hashes it verifies.
+type countingHasher struct {
+	PasswordHasher
+	mu       sync.Mutex
+	verified int
+}
+
+func (h *countingHasher) Verify(encoded, password string) (bool, error) {
+	h.mu.Lock()
+	h.verified++
+	h.mu.Unlock()
+	return h.PasswordHasher.Verify(encoded, password)
+}
+
+func newTestAccountService(t *testing.T) (*AccountService, *countingHasher, *fakeUsers, *fakeSecurityEvents) {
+	t.Helper()
+	s, _ := newTestService(t, nil)
+	hasher := &countingHasher{PasswordHasher: NewArgon2idHasher(testArgon2Params)}
+	s.WithHasher(hasher)
+
+	hash, err := hasher.Hash("correct horse")
+	require.NoError(t, err)
+	users := &fakeUsers{users: map[string]*model.User{
+		"a@example.com":   {ID: 1, Email: "a@example.com", PasswordHash: hash},
+		"bot@example.com": {ID: 2, Email: "bot@example.com", Bot: true},
+	}}
+	events := &fakeSecurityEvents{}
+	return NewAccountService(s, users, events, nil, &config.Config{}), hasher, users, events
+}
+
+// fakeMailer hands sent messages to the test, or fails to send them if err
+// is set.
+type fakeMailer struct {
+	sent chan mail.Message
+	err  error
+}
+
+func (m *fakeMailer) Send(_ context.Context, msg mail.Message) error {
+	m.sent <- msg
+	return m.err
+}
+
+var linkToken = regexp.MustCompile(`\?token=([^\s"]+)`)
+
+// next returns the token linked in the next message sent.
+func (m *fakeMailer) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case msg := <-m.sent:
+		match := linkToken.FindStringSubmatch(msg.Text)
+		require.NotNil(t, match, "no link in %q", msg.Text)
+		token, err := url.QueryUnescape(match[1])
+		require.NoError(t, err)
+		return token
+	case <-time.After(2 * time.Second):
+		t.Fatal("no email sent")
+		return ""
+	}
+}
+
+func (m *fakeMailer) none(t *testing.T) {
+	t.Helper()
+	select {
+	case msg := <-m.sent:
+		t.Fatalf("unexpected email to %s", msg.To)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func newTestMailingAccountService(t *testing.T) (*AccountService, *fakeUsers, *fakeMailer, *miniredis.Miniredis) {
+	t.Helper()
+	s, mr := newTestService(t, nil)
+	users := &fakeUsers{users: map[string]*model.User{
+		"a@example.com":   {ID: 1, Email: "a@example.com"},
+		"bot@example.com": {ID: 2, Email: "bot@example.com", Bot: true},
+	}}
+	mailer := &fakeMailer{sent: make(chan mail.Message, 4)}
+	cfg := &config.Config{PublicURL: "https://potato.test"}
+	return NewAccountService(s, users, &fakeSecurityEvents{}, mailer, cfg), users, mailer, mr
+}
+
+func TestAuthenticate(t *testing.T) {
+	a, _, _, events := newTestAccountService(t)
+	ctx := context.Background()
+
+	_, err := a.Authenticate(ctx, LoginAttempt{Email: "a@example.com", Password: "battery staple"})
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+	user, err := a.Authenticate(ctx, LoginAttempt{Email: "a@example.com", Password: "correct horse"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), user.ID)
+	assert.Equal(t, []model.SecurityEventType{model.SecurityEventLoginFailed, model.SecurityEventLoginSuccess}, events.events)
+}
+
+func TestAuthenticateVerifiesUnknownEmails(t *testing.T) {
+	a, hasher, _, events := newTestAccountService(t)
+	ctx := context.Background()
+
+	for _, email := range []string{"nobody@example.com", "bot@example.com"} {
+		hasher.verified = 0
+		_, err := a.Authenticate(ctx, LoginAttempt{Email: email, Password: "correct horse"})
+		assert.ErrorIs(t, err, ErrInvalidCredentials)
+		assert.Equal(t, 1, hasher.verified, "%s should cost a hash verification", email)
+	}
+	// Only the bot account exists to record the failure against.
+	assert.Equal(t, []model.SecurityEventType{model.SecurityEventLoginFailed}, events.events)
+}
+
+func TestAuthenticateUpgradesLegacyHash(t *testing.T) {
+	a, _, users, _ := newTestAccountService(t)
+	weakHash, err := NewArgon2idHasher(Argon2Params{MemoryKiB: 8, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}).Hash("correct horse")
+	require.NoError(t, err)
+	users.users["a@example.com"].PasswordHash = weakHash
+
+	user, err := a.Authenticate(context.Background(), LoginAttempt{Email: "a@example.com", Password: "correct horse"})
+	require.NoError(t, err)
+	assert.NotEqual(t, weakHash, user.PasswordHash)
+	assert.Equal(t, user.PasswordHash, users.users["a@example.com"].PasswordHash)
+	assert.Contains(t, user.PasswordHash, "$m=1024,t=1,p=1$")
+}
+
+func TestRequestPasswordResetHidesRegisteredAddresses(t *testing.T) {
+	a, _, mailer, _ := newTestMailingAccountService(t)
+	ctx := context.Background()
+
+	for _, email := range []string{"nobody@example.com", "bot@example.com"} {
+		require.NoError(t, a.RequestPasswordReset(ctx, email))
+	}
+	mailer.none(t)
+
+	// Failing to send is not reported either.
+	mailer.err = errors.New("relay down")
+	require.NoError(t, a.RequestPasswordReset(ctx, "a@example.com"))
+	mailer.next(t)
+}
+
+func TestResetPassword(t *testing.T) {
+	a, users, mailer, _ := newTestMailingAccountService(t)
+	ctx := context.Background()
+	refresh, err := a.auth.GenerateRefreshToken(ctx, 1)
+	require.NoError(t, err)
+
+	// Only the latest link works.
+	require.NoError(t, a.RequestPasswordReset(ctx, "a@example.com"))
+	stale := mailer.next(t)
+	require.NoError(t, a.RequestPasswordReset(ctx, "a@example.com"))
+	token := mailer.next(t)
+	assert.ErrorIs(t, a.ResetPassword(ctx, stale, "new password"), ErrInvalidToken)
+
+	assert.ErrorIs(t, a.ResetPassword(ctx, token, "short"), ErrPasswordTooShort)
+	require.NoError(t, a.ResetPassword(ctx, token, "new password"))
+	user := users.get("a@example.com")
+	assert.True(t, a.auth.CheckPassword(user.PasswordHash, "new password"))
+	assert.True(t, user.EmailVerified(), "a reset proves the address")
+	_, err = a.auth.ValidateRefreshToken(ctx, refresh)
+	assert.Error(t, err, "refresh token survived the reset")
+
+	// Links are single-use.
+	assert.ErrorIs(t, a.ResetPassword(ctx, token, "another password"), ErrInvalidToken)
+}
+
+func TestResetPasswordTokenExpires(t *testing.T) {
+	a, _, mailer, mr := newTestMailingAccountService(t)
+	ctx := context.Background()
+
+	require.NoError(t, a.RequestPasswordReset(ctx, "a@example.com"))
+	token := mailer.next(t)
+	mr.FastForward(PasswordResetTokenDuration + time.Second)
+	assert.ErrorIs(t, a.ResetPassword(ctx, token, "new password"), ErrInvalidToken)
+}
+
+func TestVerifyEmail(t *testing.T) {
+	a, users, mailer, mr := newTestMailingAccountService(t)
+	ctx := context.Background()
+	user := users.get("a@example.com")
+
+	require.NoError(t, a.SendVerificationEmail(ctx, &user))
+	expired := mailer.next(t)
+	mr.FastForward(EmailVerificationTokenDuration + time.Second)
+	_, err := a.VerifyEmail(ctx, expired)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	require.NoError(t, a.SendVerificationEmail(ctx, &user))
+	token := mailer.next(t)
+	userID, err := a.VerifyEmail(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), userID)
+	user = users.get("a@example.com")
+	assert.True(t, user.EmailVerified())
+	_, err = a.VerifyEmail(ctx, token)
+	assert.ErrorIs(t, err, ErrInvalidToken, "token reused")
+
+	assert.ErrorIs(t, a.SendVerificationEmail(ctx, &user), ErrAlreadyVerified)
+	bot := users.get("bot@example.com")
+	assert.ErrorIs(t, a.SendVerificationEmail(ctx, &bot), ErrBotAccount)
+}
@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// APITokenPrefix marks a bearer credential as a personal access token
+	// rather than a JWT.
+	APITokenPrefix = "ppat_"
+
+	// BotTokenPrefix marks a bearer credential as an application's bot token.
+	BotTokenPrefix = "ppbot_"
+
+	// apiTokenTouchInterval limits how often last_used_at is written.
+	apiTokenTouchInterval = time.Minute
+)
+
+var (
+	ErrInvalidAPIToken = errors.New("api token expired or invalid")
+	ErrInvalidScope    = errors.New("invalid api token scope")
+	ErrTokenNotFound   = errors.New("api token not found")
+)
+
+// Principal is the authenticated caller of a request. For a JWT login or a
+// bot token Scopes is nil and the principal has full access as its user; for
+// an API token it is limited to the token's scopes and, if set, a single server.
+type Principal struct {
+	UserID   int64
+	TokenID  int64
+	Scopes   []string
+	ServerID *int64
+	Bot      bool
+}
+
+// IsAPIToken reports whether the principal authenticated with an API token.
+func (p *Principal) IsAPIToken() bool {
+	return p.TokenID != 0
+}
+
+// Can reports whether the principal may perform an action requiring scope
+// on serverID. Pass serverID=0 for actions not tied to a server.
+func (p *Principal) Can(scope string, serverID int64) bool {
+	if !p.IsAPIToken() {
+		return true
+	}
+	if p.ServerID != nil && *p.ServerID != serverID {
+		return false
+	}
+	return slices.Contains(p.Scopes, scope)
+}
+
+// HasScope reports whether the principal may perform actions requiring scope
+// on at least one server.
+func (p *Principal) HasScope(scope string) bool {
+	return !p.IsAPIToken() || slices.Contains(p.Scopes, scope)
+}
+
+// APITokenService manages personal access tokens and resolves bearer
+// credentials of any kind into a Principal.
+type APITokenService struct {
+	auth   *Service
+	tokens store.APITokenStoreInterface
+	apps   store.ApplicationStoreInterface
+	bus    events.Publisher
+}
+
+func NewAPITokenService(authService *Service, tokens store.APITokenStoreInterface, apps store.ApplicationStoreInterface, bus events.Publisher) *APITokenService {
+	return &APITokenService{
+		auth:   authService,
+		tokens: tokens,
+		apps:   apps,
+		bus:    bus,
+	}
+}
+
+// CreateAPITokenParams describes a new token. ExpiresAt and ServerID are optional.
+type CreateAPITokenParams struct {
+	UserID    int64
+	Name      string
+	Scopes    []string
+	ServerID  *int64
+	ExpiresAt *time.Time
+}
+
+// Create issues a new token. The plaintext secret is returned once and never stored.
+func (s *APITokenService) Create(ctx context.Context, params CreateAPITokenParams) (*model.APIToken, string, error) {
+	if len(params.Scopes) == 0 {
+		return nil, "", ErrInvalidScope
+	}
+	for _, scope := range params.Scopes {
+		if !slices.Contains(model.ValidScopes, scope) {
+			return nil, "", fmt.Errorf("%w: %q", ErrInvalidScope, scope)
+		}
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return nil, "", fmt.Errorf("generate api token: %w", err)
+	}
+	raw := APITokenPrefix + secret
+
+	token := &model.APIToken{
+		ID:          model.NewID().Int64(),
+		UserID:      params.UserID,
+		Name:        params.Name,
+		TokenHash:   HashToken(raw),
+		TokenPrefix: raw[:len(APITokenPrefix)+6],
+		Scopes:      params.Scopes,
+		ServerID:    params.ServerID,
+		ExpiresAt:   params.ExpiresAt,
+		CreatedAt:   time.Now(),
+	}
+	if err := s.tokens.Create(ctx, token); err != nil {
+		return nil, "", err
+	}
+	return token, raw, nil
+}
+
+func (s *APITokenService) List(ctx context.Context, userID int64) ([]model.APIToken, error) {
+	return s.tokens.ListByUser(ctx, userID)
+}
+
+// Revoke deletes a token and tells every gateway to drop connections that
+// authenticated with it. API requests stop working immediately because each
+// one looks the token up.
+func (s *APITokenService) Revoke(ctx context.Context, userID, tokenID int64) error {
+	deleted, err := s.tokens.Delete(ctx, tokenID, userID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrTokenNotFound
+	}
+
+	event := events.Event{
+		Type: events.SessionInvalidate,
+		Data: events.SessionInvalidatePayload{TokenID: &tokenID},
+	}
+	if err := s.bus.Publish(ctx, fmt.Sprintf("user:%d", userID), event); err != nil {
+		log.Warn().Err(err).Int64("token_id", tokenID).Msg("failed to publish api token revocation")
+	}
+	return nil
+}
+
+// Authenticate resolves the credential from an "Authorization: Bearer ..."
+// header, accepting a JWT access token, an API token or a bot token.
+func (s *APITokenService) Authenticate(ctx context.Context, bearer string) (*Principal, error) {
+	if strings.HasPrefix(bearer, BotTokenPrefix) {
+		app, err := s.apps.GetByBotTokenHash(ctx, HashToken(bearer))
+		if err != nil {
+			return nil, err
+		}
+		if app == nil {
+			return nil, ErrInvalidAPIToken
+		}
+		return &Principal{UserID: app.BotUserID, Bot: true}, nil
+	}
+
+	if !strings.HasPrefix(bearer, APITokenPrefix) {
+		claims, err := s.auth.ValidateAccessToken(bearer)
+		if err != nil {
+			return nil, err
+		}
+		return &Principal{UserID: claims.UserID}, nil
+	}
+
+	token, err := s.tokens.GetByHash(ctx, HashToken(bearer))
+	if err != nil {
+		return nil, err
+	}
+	if token == nil || token.Expired() {
+		return nil, ErrInvalidAPIToken
+	}
+
+	s.touch(ctx, token.ID)
+	return &Principal{
+		UserID:   token.UserID,
+		TokenID:  token.ID,
+		Scopes:   token.Scopes,
+		ServerID: token.ServerID,
+	}, nil
+}
+
+// touch records token use, writing at most once per apiTokenTouchInterval.
+func (s *APITokenService) touch(ctx context.Context, tokenID int64) {
+	key := fmt.Sprintf("api_token_touch:%d", tokenID)
+	ok, err := s.auth.redis.SetNX(ctx, key, 1, apiTokenTouchInterval).Result()
+	if err != nil || !ok {
+		return
+	}
+	if err := s.tokens.TouchLastUsed(ctx, tokenID); err != nil {
+		log.Warn().Err(err).Int64("token_id", tokenID).Msg("failed to update api token last used")
+	}
+}
+
+// HashToken hashes an API or bot token for storage. Tokens carry 256 bits of
+// entropy, so a fast unsalted hash is sufficient and allows lookup by hash.
+func HashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateBotToken returns a new bot token and the hash to store for it.
+func GenerateBotToken() (string, string, error) {
+	return GenerateSecret(BotTokenPrefix)
+}
+
+// GenerateSecret returns a new random secret with the given prefix and the
+// hash to store for it.
+func GenerateSecret(prefix string) (string, string, error) {
+	secret, err := randomToken()
+	if err != nil {
+		return "", "", fmt.Errorf("generate secret: %w", err)
+	}
+	raw := prefix + secret
+	return raw, HashToken(raw), nil
+}
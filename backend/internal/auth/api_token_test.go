@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrincipalCan(t *testing.T) {
+	serverID := int64(7)
+	jwt := &Principal{UserID: 1}
+	scoped := &Principal{UserID: 1, TokenID: 2, Scopes: []string{model.ScopeReadMessages}}
+	pinned := &Principal{UserID: 1, TokenID: 3, Scopes: []string{model.ScopeReadMessages}, ServerID: &serverID}
+
+	assert.True(t, jwt.Can(model.ScopeSendMessages, 7))
+	assert.True(t, scoped.Can(model.ScopeReadMessages, 7))
+	assert.False(t, scoped.Can(model.ScopeSendMessages, 7))
+	assert.True(t, pinned.Can(model.ScopeReadMessages, 7))
+	assert.False(t, pinned.Can(model.ScopeReadMessages, 8))
+	assert.False(t, pinned.Can(model.ScopeReadMessages, 0))
+
+	assert.True(t, jwt.HasScope(model.ScopeManageServer))
+	assert.True(t, pinned.HasScope(model.ScopeReadMessages))
+	assert.False(t, scoped.HasScope(model.ScopeSendMessages))
+}
+
+func TestHashToken(t *testing.T) {
+	raw, hash, err := GenerateSecret(APITokenPrefix)
+	assert.NoError(t, err)
+	assert.Regexp(t, "^"+APITokenPrefix+"[0-9a-f]{64}$", raw)
+	assert.Equal(t, hash, HashToken(raw))
+	assert.NotEqual(t, hash, HashToken(raw+"x"))
+}
@@ -5,11 +5,13 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/redis/go-redis/v9"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/robwittman/possessive-potato/backend/internal/config"
+	"github.com/rs/zerolog/log"
 )
 
 const (
@@ -25,25 +27,64 @@ type Claims struct {
 type Service struct {
 	jwtSecret []byte
 	redis     *redis.Client
+	hasher    PasswordHasher
+	lockout   LockoutPolicy
+
+	dummyOnce sync.Once
+	dummyHash string
 }
 
-func NewService(jwtSecret string, redisClient *redis.Client) *Service {
+// NewService creates an auth service that hashes passwords with argon2id
+// using the cost parameters in cfg, and throttles logins with the lockout
+// policy in cfg. Use WithHasher and WithLockoutPolicy to override.
+func NewService(cfg *config.Config, redisClient *redis.Client) *Service {
 	return &Service{
-		jwtSecret: []byte(jwtSecret),
+		jwtSecret: []byte(cfg.JWTSecret),
 		redis:     redisClient,
+		hasher:    NewArgon2idHasher(Argon2ParamsFromConfig(cfg)),
+		lockout:   LockoutPolicyFromConfig(cfg),
 	}
 }
 
+// WithHasher replaces the password hasher and returns the service.
+func (s *Service) WithHasher(h PasswordHasher) *Service {
+	s.hasher = h
+	return s
+}
+
 func (s *Service) HashPassword(password string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hash, err := s.hasher.Hash(password)
 	if err != nil {
 		return "", fmt.Errorf("hash password: %w", err)
 	}
-	return string(hash), nil
+	return hash, nil
 }
 
 func (s *Service) CheckPassword(hash, password string) bool {
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	ok, err := s.hasher.Verify(hash, password)
+	return err == nil && ok
+}
+
+// CheckNoPassword takes as long as CheckPassword does for a real account, so
+// logins for unknown emails cannot be told apart by timing.
+func (s *Service) CheckNoPassword(password string) {
+	s.dummyOnce.Do(func() {
+		secret, err := randomToken()
+		if err == nil {
+			s.dummyHash, err = s.hasher.Hash(secret)
+		}
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to create dummy password hash")
+		}
+	})
+	s.CheckPassword(s.dummyHash, password)
+}
+
+// NeedsRehash reports whether a stored hash should be replaced with one from
+// the current hasher. Call it after a successful CheckPassword, while the
+// plaintext password is still available.
+func (s *Service) NeedsRehash(hash string) bool {
+	return s.hasher.NeedsRehash(hash)
 }
 
 func (s *Service) GenerateAccessToken(userID int64) (string, error) {
@@ -76,14 +117,18 @@ func (s *Service) ValidateAccessToken(tokenStr string) (*Claims, error) {
 }
 
 func (s *Service) GenerateRefreshToken(ctx context.Context, userID int64) (string, error) {
-	b := make([]byte, 32)
-	if _, err := rand.Read(b); err != nil {
+	token, err := randomToken()
+	if err != nil {
 		return "", fmt.Errorf("generate refresh token: %w", err)
 	}
-	token := hex.EncodeToString(b)
 
 	key := fmt.Sprintf("refresh:%s", token)
-	if err := s.redis.Set(ctx, key, userID, RefreshTokenDuration).Err(); err != nil {
+	userKey := fmt.Sprintf("refresh_user:%d", userID)
+	pipe := s.redis.TxPipeline()
+	pipe.Set(ctx, key, userID, RefreshTokenDuration)
+	pipe.SAdd(ctx, userKey, token)
+	pipe.Expire(ctx, userKey, RefreshTokenDuration)
+	if _, err := pipe.Exec(ctx); err != nil {
 		return "", fmt.Errorf("store refresh token: %w", err)
 	}
 	return token, nil
@@ -103,5 +148,39 @@ func (s *Service) ValidateRefreshToken(ctx context.Context, token string) (int64
 
 func (s *Service) RevokeRefreshToken(ctx context.Context, token string) error {
 	key := fmt.Sprintf("refresh:%s", token)
-	return s.redis.Del(ctx, key).Err()
+	userID, err := s.redis.GetDel(ctx, key).Int64()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("revoke refresh token: %w", err)
+	}
+	return s.redis.SRem(ctx, fmt.Sprintf("refresh_user:%d", userID), token).Err()
+}
+
+// RevokeAllRefreshTokens signs a user out of every device.
+func (s *Service) RevokeAllRefreshTokens(ctx context.Context, userID int64) error {
+	userKey := fmt.Sprintf("refresh_user:%d", userID)
+	tokens, err := s.redis.SMembers(ctx, userKey).Result()
+	if err != nil {
+		return fmt.Errorf("list refresh tokens: %w", err)
+	}
+
+	keys := make([]string, 0, len(tokens)+1)
+	for _, t := range tokens {
+		keys = append(keys, fmt.Sprintf("refresh:%s", t))
+	}
+	keys = append(keys, userKey)
+	if err := s.redis.Del(ctx, keys...).Err(); err != nil {
+		return fmt.Errorf("revoke refresh tokens: %w", err)
+	}
+	return nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
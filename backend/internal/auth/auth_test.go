@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/robwittman/possessive-potato/backend/internal/config"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+)
+
+func init() {
+	if err := model.InitSnowflake(0); err != nil {
+		panic(err)
+	}
+}
+
+// newTestService returns a Service backed by an in-memory Redis, with cheap
+// argon2id parameters.
+func newTestService(t *testing.T, cfg *config.Config) (*Service, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	if cfg == nil {
+		cfg = &config.Config{}
+	}
+	cfg.JWTSecret = "secret"
+	s := NewService(cfg, client).WithHasher(NewArgon2idHasher(testArgon2Params))
+	return s, mr
+}
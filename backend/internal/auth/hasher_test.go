@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/robwittman/possessive-potato/backend/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2Params keep hashing fast in tests.
+var testArgon2Params = Argon2Params{
+	MemoryKiB:   1024,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func TestArgon2idHasherRoundTrip(t *testing.T) {
+	h := NewArgon2idHasher(testArgon2Params)
+
+	encoded, err := h.Hash("correct horse")
+	require.NoError(t, err)
+	assert.Regexp(t, `^\$argon2id\$v=19\$m=1024,t=1,p=1\$[^$]+\$[^$]+$`, encoded)
+
+	ok, err := h.Verify(encoded, "correct horse")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = h.Verify(encoded, "battery staple")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	other, err := h.Hash("correct horse")
+	require.NoError(t, err)
+	assert.NotEqual(t, encoded, other, "salts should differ")
+}
+
+func TestArgon2idHasherVerifiesBcrypt(t *testing.T) {
+	h := NewArgon2idHasher(testArgon2Params)
+	legacy, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	ok, err := h.Verify(string(legacy), "correct horse")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = h.Verify(string(legacy), "battery staple")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.True(t, h.NeedsRehash(string(legacy)))
+}
+
+func TestArgon2idHasherRejectsUnknownFormat(t *testing.T) {
+	h := NewArgon2idHasher(testArgon2Params)
+	_, err := h.Verify("plaintext", "plaintext")
+	assert.ErrorIs(t, err, ErrUnknownHashFormat)
+	assert.True(t, h.NeedsRehash("plaintext"))
+}
+
+func TestArgon2idHasherNeedsRehash(t *testing.T) {
+	weak := NewArgon2idHasher(testArgon2Params)
+	encoded, err := weak.Hash("correct horse")
+	require.NoError(t, err)
+	assert.False(t, weak.NeedsRehash(encoded))
+
+	stronger := testArgon2Params
+	stronger.Iterations = 2
+	assert.True(t, NewArgon2idHasher(stronger).NeedsRehash(encoded))
+
+	more := testArgon2Params
+	more.MemoryKiB = 2048
+	assert.True(t, NewArgon2idHasher(more).NeedsRehash(encoded))
+
+	// Stronger stored parameters than today's are kept.
+	weaker := testArgon2Params
+	weaker.MemoryKiB = 512
+	assert.False(t, NewArgon2idHasher(weaker).NeedsRehash(encoded))
+}
+
+func TestArgon2ParamsFromConfig(t *testing.T) {
+	params := Argon2ParamsFromConfig(&config.Config{})
+	assert.Equal(t, DefaultArgon2Params, params)
+
+	params = Argon2ParamsFromConfig(&config.Config{
+		Argon2MemoryKiB:   19 * 1024,
+		Argon2Iterations:  2,
+		Argon2Parallelism: 1,
+	})
+	assert.Equal(t, uint32(19*1024), params.MemoryKiB)
+	assert.Equal(t, uint32(2), params.Iterations)
+	assert.Equal(t, uint8(1), params.Parallelism)
+	assert.Equal(t, DefaultArgon2Params.SaltLength, params.SaltLength)
+}
+
+func TestNewServiceUsesConfiguredArgon2Params(t *testing.T) {
+	s := NewService(&config.Config{
+		JWTSecret:         "secret",
+		Argon2MemoryKiB:   1024,
+		Argon2Iterations:  1,
+		Argon2Parallelism: 1,
+	}, nil)
+
+	hash, err := s.HashPassword("correct horse")
+	require.NoError(t, err)
+	assert.Contains(t, hash, "$m=1024,t=1,p=1$")
+	assert.True(t, s.CheckPassword(hash, "correct horse"))
+	assert.False(t, s.NeedsRehash(hash))
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robwittman/possessive-potato/backend/internal/config"
+)
+
+// LockoutPolicy controls how failed logins are throttled. Failures are counted
+// separately per account and per client IP within Window. The first
+// FreeAttempts failures cost nothing; each one after that blocks further
+// attempts for an exponentially growing delay starting at BaseBackoff and
+// capped at MaxBackoff. Reaching MaxAttempts locks the account (or IP) for
+// LockoutDuration.
+type LockoutPolicy struct {
+	FreeAttempts     int
+	MaxAttempts      int
+	MaxAttemptsPerIP int
+	Window           time.Duration
+	BaseBackoff      time.Duration
+	MaxBackoff       time.Duration
+	LockoutDuration  time.Duration
+}
+
+var DefaultLockoutPolicy = LockoutPolicy{
+	FreeAttempts:     3,
+	MaxAttempts:      10,
+	MaxAttemptsPerIP: 50,
+	Window:           15 * time.Minute,
+	BaseBackoff:      1 * time.Second,
+	MaxBackoff:       1 * time.Minute,
+	LockoutDuration:  15 * time.Minute,
+}
+
+// LockoutPolicyFromConfig overrides the default policy with any values set in cfg.
+func LockoutPolicyFromConfig(cfg *config.Config) LockoutPolicy {
+	p := DefaultLockoutPolicy
+	if cfg.LoginMaxAttempts > 0 {
+		p.MaxAttempts = cfg.LoginMaxAttempts
+	}
+	if cfg.LoginMaxAttemptsPerIP > 0 {
+		p.MaxAttemptsPerIP = cfg.LoginMaxAttemptsPerIP
+	}
+	if cfg.LoginLockoutDuration > 0 {
+		p.LockoutDuration = cfg.LoginLockoutDuration
+	}
+	return p
+}
+
+// LoginThrottledError is returned when a login is refused because of earlier
+// failures. RetryAfter is how long the caller must wait.
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *LoginThrottledError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("too many failed login attempts, locked for %s", e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("too many failed login attempts, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+// WithLockoutPolicy replaces the login throttling policy and returns the service.
+func (s *Service) WithLockoutPolicy(p LockoutPolicy) *Service {
+	s.lockout = p
+	return s
+}
+
+// CheckLoginAllowed returns a *LoginThrottledError if login attempts for the
+// account or from the IP are currently blocked.
+func (s *Service) CheckLoginAllowed(ctx context.Context, account, ip string) error {
+	var worst time.Duration
+	locked := false
+	for _, scope := range loginScopes(account, ip) {
+		ttl, err := s.redis.PTTL(ctx, "login_block:"+scope).Result()
+		if err != nil {
+			return fmt.Errorf("check login block: %w", err)
+		}
+		if ttl > worst {
+			worst = ttl
+		}
+		l, err := s.redis.Exists(ctx, "login_locked:"+scope).Result()
+		if err != nil {
+			return fmt.Errorf("check login lock: %w", err)
+		}
+		locked = locked || l > 0
+	}
+	if worst > 0 {
+		return &LoginThrottledError{RetryAfter: worst, Locked: locked}
+	}
+	return nil
+}
+
+// RecordLoginFailure counts a failed attempt against the account and IP and
+// applies backoff. It reports whether the account became locked as a result.
+func (s *Service) RecordLoginFailure(ctx context.Context, account, ip string) (bool, error) {
+	accountLocked := false
+	for _, scope := range loginScopes(account, ip) {
+		isIP := strings.HasPrefix(scope, "ip:")
+		limit := s.lockout.MaxAttempts
+		if isIP {
+			limit = s.lockout.MaxAttemptsPerIP
+		}
+
+		countKey := "login_fail:" + scope
+		pipe := s.redis.TxPipeline()
+		incr := pipe.Incr(ctx, countKey)
+		pipe.ExpireNX(ctx, countKey, s.lockout.Window)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return false, fmt.Errorf("record login failure: %w", err)
+		}
+		n := int(incr.Val())
+
+		var block time.Duration
+		switch {
+		case n >= limit:
+			block = s.lockout.LockoutDuration
+			if err := s.redis.Set(ctx, "login_locked:"+scope, 1, block).Err(); err != nil {
+				return false, fmt.Errorf("lock login: %w", err)
+			}
+			if !isIP && n == limit {
+				accountLocked = true
+			}
+		case n > s.lockout.FreeAttempts:
+			block = s.lockout.BaseBackoff << (n - s.lockout.FreeAttempts - 1)
+			if block <= 0 || block > s.lockout.MaxBackoff {
+				block = s.lockout.MaxBackoff
+			}
+		}
+
+		if block > 0 {
+			if err := s.redis.Set(ctx, "login_block:"+scope, 1, block).Err(); err != nil {
+				return false, fmt.Errorf("block login: %w", err)
+			}
+		}
+	}
+	return accountLocked, nil
+}
+
+// ResetLoginFailures clears the account's failure counter after a successful
+// login. The IP counter is left alone so a valid login cannot be used to
+// reset throttling for a credential-stuffing source.
+func (s *Service) ResetLoginFailures(ctx context.Context, account string) error {
+	scope := "account:" + normalizeAccount(account)
+	return s.redis.Del(ctx, "login_fail:"+scope, "login_block:"+scope, "login_locked:"+scope).Err()
+}
+
+func loginScopes(account, ip string) []string {
+	scopes := []string{"account:" + normalizeAccount(account)}
+	if ip != "" {
+		scopes = append(scopes, "ip:"+ip)
+	}
+	return scopes
+}
+
+func normalizeAccount(account string) string {
+	return strings.ToLower(strings.TrimSpace(account))
+}
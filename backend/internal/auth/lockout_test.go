@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/robwittman/possessive-potato/backend/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockoutPolicyFromConfig(t *testing.T) {
+	assert.Equal(t, DefaultLockoutPolicy, LockoutPolicyFromConfig(&config.Config{}))
+
+	p := LockoutPolicyFromConfig(&config.Config{
+		LoginMaxAttempts:      5,
+		LoginMaxAttemptsPerIP: 20,
+		LoginLockoutDuration:  time.Hour,
+	})
+	assert.Equal(t, 5, p.MaxAttempts)
+	assert.Equal(t, 20, p.MaxAttemptsPerIP)
+	assert.Equal(t, time.Hour, p.LockoutDuration)
+	assert.Equal(t, DefaultLockoutPolicy.FreeAttempts, p.FreeAttempts)
+}
+
+func TestNewServiceUsesConfiguredLockoutPolicy(t *testing.T) {
+	s, _ := newTestService(t, &config.Config{LoginMaxAttempts: 2})
+	ctx := context.Background()
+
+	locked, err := s.RecordLoginFailure(ctx, "a@example.com", "")
+	require.NoError(t, err)
+	assert.False(t, locked)
+	locked, err = s.RecordLoginFailure(ctx, "a@example.com", "")
+	require.NoError(t, err)
+	assert.True(t, locked)
+}
+
+func TestLoginBackoff(t *testing.T) {
+	s, mr := newTestService(t, nil)
+	ctx := context.Background()
+	const account, ip = "A@example.com ", "192.0.2.1"
+
+	for range DefaultLockoutPolicy.FreeAttempts {
+		_, err := s.RecordLoginFailure(ctx, account, ip)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.CheckLoginAllowed(ctx, account, ip), "free attempts should not block")
+
+	_, err := s.RecordLoginFailure(ctx, account, ip)
+	require.NoError(t, err)
+	err = s.CheckLoginAllowed(ctx, "a@example.com", ip)
+	var throttled *LoginThrottledError
+	require.ErrorAs(t, err, &throttled)
+	assert.False(t, throttled.Locked)
+	assert.InDelta(t, DefaultLockoutPolicy.BaseBackoff, throttled.RetryAfter, float64(100*time.Millisecond))
+
+	_, err = s.RecordLoginFailure(ctx, account, ip)
+	require.NoError(t, err)
+	assert.Equal(t, 2*DefaultLockoutPolicy.BaseBackoff, mr.TTL("login_block:account:a@example.com"))
+
+	mr.FastForward(time.Minute)
+	assert.NoError(t, s.CheckLoginAllowed(ctx, account, ip))
+}
+
+func TestLoginBackoffIsCapped(t *testing.T) {
+	s, mr := newTestService(t, nil)
+	s.WithLockoutPolicy(LockoutPolicy{
+		FreeAttempts:     0,
+		MaxAttempts:      100,
+		MaxAttemptsPerIP: 100,
+		Window:           time.Hour,
+		BaseBackoff:      time.Second,
+		MaxBackoff:       10 * time.Second,
+		LockoutDuration:  time.Hour,
+	})
+	ctx := context.Background()
+	for range 70 {
+		_, err := s.RecordLoginFailure(ctx, "a@example.com", "")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 10*time.Second, mr.TTL("login_block:account:a@example.com"))
+}
+
+func TestLoginLockout(t *testing.T) {
+	s, _ := newTestService(t, nil)
+	ctx := context.Background()
+	const account = "a@example.com"
+
+	var locked bool
+	for i := range DefaultLockoutPolicy.MaxAttempts {
+		var err error
+		locked, err = s.RecordLoginFailure(ctx, account, "")
+		require.NoError(t, err)
+		if i < DefaultLockoutPolicy.MaxAttempts-1 {
+			assert.False(t, locked)
+		}
+	}
+	assert.True(t, locked)
+
+	var throttled *LoginThrottledError
+	require.ErrorAs(t, s.CheckLoginAllowed(ctx, account, ""), &throttled)
+	assert.True(t, throttled.Locked)
+	assert.Equal(t, DefaultLockoutPolicy.LockoutDuration, throttled.RetryAfter.Round(time.Minute))
+
+	require.NoError(t, s.ResetLoginFailures(ctx, account))
+	assert.NoError(t, s.CheckLoginAllowed(ctx, account, ""))
+}
+
+func TestResetLoginFailuresKeepsIPCount(t *testing.T) {
+	s, mr := newTestService(t, nil)
+	ctx := context.Background()
+	for range 2 {
+		_, err := s.RecordLoginFailure(ctx, "a@example.com", "192.0.2.1")
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.ResetLoginFailures(ctx, "a@example.com"))
+	assert.False(t, mr.Exists("login_fail:account:a@example.com"))
+	count, err := mr.Get("login_fail:ip:192.0.2.1")
+	require.NoError(t, err)
+	assert.Equal(t, "2", count)
+}
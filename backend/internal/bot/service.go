@@ -0,0 +1,307 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robwittman/possessive-potato/backend/internal/auth"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/permission"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrApplicationNotFound = errors.New("application not found")
+	ErrNotOwner            = errors.New("only the application owner can do this")
+	ErrMissingPermission   = errors.New("you need the Manage Server permission to add bots")
+	ErrExceedsPermissions  = errors.New("cannot grant a bot permissions you do not have")
+	ErrInvalidName         = errors.New("application name must contain at least two letters or digits")
+)
+
+var usernameUnsafeChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// Service manages applications and their bot users.
+type Service struct {
+	apps      store.ApplicationStoreInterface
+	users     store.UserStoreInterface
+	servers   store.ServerStoreInterface
+	roles     store.RoleStoreInterface
+	perms     *permission.Checker
+	bus       events.Publisher
+	publicURL string
+}
+
+func NewService(
+	apps store.ApplicationStoreInterface,
+	users store.UserStoreInterface,
+	servers store.ServerStoreInterface,
+	roles store.RoleStoreInterface,
+	perms *permission.Checker,
+	bus events.Publisher,
+	publicURL string,
+) *Service {
+	return &Service{
+		apps:      apps,
+		users:     users,
+		servers:   servers,
+		roles:     roles,
+		perms:     perms,
+		bus:       bus,
+		publicURL: publicURL,
+	}
+}
+
+// Create registers an application and its bot user. The bot token is
+// returned once and only its hash is stored.
+func (s *Service) Create(ctx context.Context, ownerID int64, name string, description *string) (*model.Application, string, error) {
+	username := usernameUnsafeChars.ReplaceAllString(strings.ToLower(name), "_")
+	username = strings.Trim(username, "_")
+	if len(username) < 2 {
+		return nil, "", ErrInvalidName
+	}
+	if len(username) > 27 {
+		username = username[:27]
+	}
+
+	botID := model.NewID().Int64()
+	// Suffix with part of the snowflake so bots never collide with each other
+	// or with human usernames.
+	id := strconv.FormatInt(botID, 36)
+	username = username + "_" + id[len(id)-4:]
+
+	raw, hash, err := auth.GenerateBotToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	bot := &model.User{
+		ID:          botID,
+		Username:    username,
+		DisplayName: name,
+		Bot:         true,
+		Status:      model.UserStatusOnline,
+	}
+	app := &model.Application{
+		ID:           model.NewID().Int64(),
+		OwnerID:      ownerID,
+		Name:         name,
+		Description:  description,
+		BotUserID:    botID,
+		BotTokenHash: hash,
+	}
+	if err := s.apps.Create(ctx, app, bot); err != nil {
+		return nil, "", err
+	}
+	return app, raw, nil
+}
+
+func (s *Service) List(ctx context.Context, ownerID int64) ([]model.Application, error) {
+	return s.apps.ListByOwner(ctx, ownerID)
+}
+
+// ResetToken invalidates the bot's current token and returns a new one.
+func (s *Service) ResetToken(ctx context.Context, ownerID, appID int64) (string, error) {
+	app, err := s.ownedApplication(ctx, ownerID, appID)
+	if err != nil {
+		return "", err
+	}
+
+	raw, hash, err := auth.GenerateBotToken()
+	if err != nil {
+		return "", err
+	}
+	if err := s.apps.UpdateBotTokenHash(ctx, app.ID, hash); err != nil {
+		return "", err
+	}
+	s.invalidateSessions(ctx, app.BotUserID)
+	return raw, nil
+}
+
+// Delete removes an application and takes its bot out of every server.
+func (s *Service) Delete(ctx context.Context, ownerID, appID int64) error {
+	app, err := s.ownedApplication(ctx, ownerID, appID)
+	if err != nil {
+		return err
+	}
+	if err := s.apps.Delete(ctx, app.ID); err != nil {
+		return err
+	}
+	s.invalidateSessions(ctx, app.BotUserID)
+	return nil
+}
+
+// AuthorizeURL builds the link a server manager follows to add the bot to one
+// of their servers with the requested permissions.
+func (s *Service) AuthorizeURL(appID int64, permissions int64) string {
+	q := url.Values{}
+	q.Set("client_id", strconv.FormatInt(appID, 10))
+	q.Set("scope", "bot")
+	q.Set("permissions", strconv.FormatInt(permissions&model.AllPermissions, 10))
+	return s.publicURL + "/oauth2/authorize?" + q.Encode()
+}
+
+// AuthorizeParams is a server manager's consent to add a bot to a server.
+type AuthorizeParams struct {
+	UserID        int64
+	ApplicationID int64
+	ServerID      int64
+	Permissions   int64
+}
+
+// Authorize adds the application's bot to a server and grants the requested
+// permissions through a managed role named after the application. Authorizing
+// a bot already in the server replaces its permissions. The authorizing user
+// needs Manage Server and cannot grant permissions they lack.
+func (s *Service) Authorize(ctx context.Context, params AuthorizeParams) (*model.Role, error) {
+	app, err := s.apps.GetByID(ctx, params.ApplicationID)
+	if err != nil {
+		return nil, err
+	}
+	if app == nil {
+		return nil, ErrApplicationNotFound
+	}
+
+	server, err := s.servers.GetByID(ctx, params.ServerID)
+	if err != nil {
+		return nil, err
+	}
+	if server == nil {
+		return nil, fmt.Errorf("server not found")
+	}
+
+	requested := params.Permissions & model.AllPermissions
+	perms, err := s.perms.Effective(ctx, params.ServerID, params.UserID)
+	if errors.Is(err, permission.ErrNotMember) {
+		return nil, ErrMissingPermission
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !model.HasPermission(perms, model.PermissionManageServer) {
+		return nil, ErrMissingPermission
+	}
+	if perms&model.PermissionAdmin == 0 && requested&^perms != 0 {
+		return nil, ErrExceedsPermissions
+	}
+
+	member, err := s.servers.IsMember(ctx, params.ServerID, app.BotUserID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.servers.AddMember(ctx, params.ServerID, app.BotUserID); err != nil {
+		return nil, err
+	}
+	role, err := s.grant(ctx, app, params.ServerID, requested)
+	if err != nil {
+		return nil, err
+	}
+	if member {
+		return role, nil
+	}
+
+	// Tell the bot's gateway sessions about the server so they follow it.
+	created := events.Event{Type: events.ServerCreate, Data: server}
+	if err := s.bus.Publish(ctx, fmt.Sprintf("user:%d", app.BotUserID), created); err != nil {
+		log.Warn().Err(err).Int64("server_id", params.ServerID).Msg("failed to publish bot server join")
+	}
+
+	bot, err := s.users.GetByID(ctx, app.BotUserID)
+	if err == nil && bot != nil {
+		event := events.Event{
+			Type: events.ServerMemberAdd,
+			Data: events.ServerMemberAddPayload{
+				ServerID:    params.ServerID,
+				UserID:      bot.ID,
+				Username:    bot.Username,
+				DisplayName: bot.DisplayName,
+				AvatarURL:   bot.AvatarURL,
+				Bot:         true,
+				JoinedAt:    time.Now(),
+			},
+		}
+		if err := s.bus.Publish(ctx, fmt.Sprintf("server:%d", params.ServerID), event); err != nil {
+			log.Warn().Err(err).Int64("server_id", params.ServerID).Msg("failed to publish bot member add")
+		}
+	}
+	return role, nil
+}
+
+// grant gives the bot exactly the requested permissions in a server through
+// its managed role, creating the role the first time the bot is authorized
+// there and updating it when the bot is authorized again.
+func (s *Service) grant(ctx context.Context, app *model.Application, serverID, permissions int64) (*model.Role, error) {
+	roles, err := s.roles.GetMemberRoles(ctx, serverID, app.BotUserID)
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range roles {
+		if !role.Managed {
+			continue
+		}
+		role.Name = app.Name
+		role.Permissions = permissions
+		if err := s.roles.Update(ctx, &role); err != nil {
+			return nil, err
+		}
+		s.publishRole(ctx, events.RoleUpdate, &role)
+		return &role, nil
+	}
+
+	all, err := s.roles.ListByServer(ctx, serverID)
+	if err != nil {
+		return nil, err
+	}
+	role := &model.Role{
+		ID:          model.NewID().Int64(),
+		ServerID:    serverID,
+		Name:        app.Name,
+		Permissions: permissions,
+		Position:    len(all),
+		Managed:     true,
+	}
+	if err := s.roles.Create(ctx, role); err != nil {
+		return nil, err
+	}
+	if err := s.roles.AssignRole(ctx, serverID, app.BotUserID, role.ID); err != nil {
+		return nil, err
+	}
+	s.publishRole(ctx, events.RoleCreate, role)
+	return role, nil
+}
+
+func (s *Service) publishRole(ctx context.Context, typ string, role *model.Role) {
+	event := events.Event{Type: typ, Data: role}
+	if err := s.bus.Publish(ctx, fmt.Sprintf("server:%d", role.ServerID), event); err != nil {
+		log.Warn().Err(err).Int64("role_id", role.ID).Msg("failed to publish bot role")
+	}
+}
+
+func (s *Service) ownedApplication(ctx context.Context, ownerID, appID int64) (*model.Application, error) {
+	app, err := s.apps.GetByID(ctx, appID)
+	if err != nil {
+		return nil, err
+	}
+	if app == nil {
+		return nil, ErrApplicationNotFound
+	}
+	if app.OwnerID != ownerID {
+		return nil, ErrNotOwner
+	}
+	return app, nil
+}
+
+// invalidateSessions disconnects any gateway sessions held by the bot.
+func (s *Service) invalidateSessions(ctx context.Context, botUserID int64) {
+	event := events.Event{Type: events.SessionInvalidate, Data: events.SessionInvalidatePayload{}}
+	if err := s.bus.Publish(ctx, fmt.Sprintf("user:%d", botUserID), event); err != nil {
+		log.Warn().Err(err).Int64("user_id", botUserID).Msg("failed to publish bot session invalidation")
+	}
+}
@@ -0,0 +1,257 @@
+package bot
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/permission"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	if err := model.InitSnowflake(0); err != nil {
+		panic(err)
+	}
+}
+
+const (
+	ownerID   = 1
+	managerID = 2
+	outsider  = 3
+	serverID  = 10
+	appID     = 20
+	botID     = 21
+)
+
+type fakeApps struct {
+	store.ApplicationStoreInterface
+}
+
+func (fakeApps) GetByID(_ context.Context, id int64) (*model.Application, error) {
+	if id != appID {
+		return nil, nil
+	}
+	return &model.Application{ID: appID, OwnerID: ownerID, Name: "Helper", BotUserID: botID}, nil
+}
+
+type fakeUsers struct{ store.UserStoreInterface }
+
+func (fakeUsers) GetByID(_ context.Context, id int64) (*model.User, error) {
+	return &model.User{ID: id, Username: "helper_abcd", Bot: true}, nil
+}
+
+// fakeServerRoles keeps one server's members and roles in memory, behind
+// fakeServers and fakeRoles.
+type fakeServerRoles struct {
+	mu          sync.Mutex
+	members     map[int64]bool
+	roles       []model.Role
+	memberRoles map[int64][]int64
+	managerPerm int64
+}
+
+func newFakeServerRoles() *fakeServerRoles {
+	return &fakeServerRoles{
+		members:     map[int64]bool{ownerID: true, managerID: true},
+		roles:       []model.Role{{ID: serverID, ServerID: serverID, Name: "@everyone"}},
+		memberRoles: make(map[int64][]int64),
+		managerPerm: model.PermissionManageServer | model.PermissionSendMessages,
+	}
+}
+
+type fakeServers struct {
+	store.ServerStoreInterface
+	f *fakeServerRoles
+}
+
+func (fakeServers) GetByID(_ context.Context, id int64) (*model.Server, error) {
+	return &model.Server{ID: id, OwnerID: ownerID}, nil
+}
+
+type fakeRoles struct {
+	store.RoleStoreInterface
+	f *fakeServerRoles
+}
+
+func (s fakeServers) IsMember(_ context.Context, _, userID int64) (bool, error) {
+	f := s.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.members[userID], nil
+}
+
+func (s fakeServers) AddMember(_ context.Context, _, userID int64) error {
+	f := s.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.members[userID] = true
+	return nil
+}
+
+func (r fakeRoles) ListByServer(context.Context, int64) ([]model.Role, error) {
+	f := r.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]model.Role(nil), f.roles...), nil
+}
+
+func (r fakeRoles) Create(_ context.Context, role *model.Role) error {
+	f := r.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.roles = append(f.roles, *role)
+	return nil
+}
+
+func (r fakeRoles) Update(_ context.Context, role *model.Role) error {
+	f := r.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.roles {
+		if f.roles[i].ID == role.ID {
+			f.roles[i] = *role
+		}
+	}
+	return nil
+}
+
+func (r fakeRoles) AssignRole(_ context.Context, _, userID, roleID int64) error {
+	f := r.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.memberRoles[userID] = append(f.memberRoles[userID], roleID)
+	return nil
+}
+
+func (r fakeRoles) GetMemberRoles(_ context.Context, _, userID int64) ([]model.Role, error) {
+	f := r.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []model.Role
+	for _, id := range f.memberRoles[userID] {
+		for _, role := range f.roles {
+			if role.ID == id {
+				out = append(out, role)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (r fakeRoles) GetMemberPermissions(context.Context, int64, int64) (int64, error) {
+	f := r.f
+	return f.managerPerm, nil
+}
+
+type recorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recorder) Publish(_ context.Context, topic string, event events.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, topic+" "+event.Type)
+	return nil
+}
+
+func newTestService() (*Service, *fakeServerRoles, *recorder) {
+	sr := newFakeServerRoles()
+	bus := &recorder{}
+	servers, roles := fakeServers{f: sr}, fakeRoles{f: sr}
+	perms := permission.NewChecker(servers, roles)
+	return NewService(fakeApps{}, fakeUsers{}, servers, roles, perms, bus, "https://example.com"), sr, bus
+}
+
+func TestAuthorize(t *testing.T) {
+	s, sr, bus := newTestService()
+
+	role, err := s.Authorize(context.Background(), AuthorizeParams{
+		UserID:        ownerID,
+		ApplicationID: appID,
+		ServerID:      serverID,
+		Permissions:   model.PermissionSendMessages,
+	})
+	require.NoError(t, err)
+	assert.True(t, role.Managed)
+	assert.Equal(t, "Helper", role.Name)
+	assert.Equal(t, model.PermissionSendMessages, role.Permissions)
+	assert.True(t, sr.members[botID])
+	assert.Equal(t, []int64{role.ID}, sr.memberRoles[botID])
+	assert.Equal(t, []string{"server:10 ROLE_CREATE", "user:21 SERVER_CREATE", "server:10 SERVER_MEMBER_ADD"}, bus.events)
+}
+
+func TestAuthorizeAgainUpdatesManagedRole(t *testing.T) {
+	s, sr, bus := newTestService()
+	ctx := context.Background()
+	params := AuthorizeParams{
+		UserID:        ownerID,
+		ApplicationID: appID,
+		ServerID:      serverID,
+		Permissions:   model.PermissionSendMessages,
+	}
+	first, err := s.Authorize(ctx, params)
+	require.NoError(t, err)
+	bus.events = nil
+
+	params.Permissions = model.PermissionSendMessages | model.PermissionReadMessages
+	second, err := s.Authorize(ctx, params)
+	require.NoError(t, err)
+
+	assert.Equal(t, first.ID, second.ID)
+	assert.Equal(t, params.Permissions, second.Permissions)
+	assert.Len(t, sr.roles, 2, "no second managed role")
+	assert.Equal(t, []int64{first.ID}, sr.memberRoles[botID])
+	assert.Equal(t, params.Permissions, sr.roles[1].Permissions)
+	assert.Equal(t, []string{"server:10 ROLE_UPDATE"}, bus.events, "the bot has not joined again")
+}
+
+func TestAuthorizeLimitsManagers(t *testing.T) {
+	s, sr, _ := newTestService()
+	ctx := context.Background()
+
+	_, err := s.Authorize(ctx, AuthorizeParams{
+		UserID:        managerID,
+		ApplicationID: appID,
+		ServerID:      serverID,
+		Permissions:   model.PermissionBanMembers,
+	})
+	assert.ErrorIs(t, err, ErrExceedsPermissions)
+
+	sr.managerPerm = model.PermissionSendMessages
+	_, err = s.Authorize(ctx, AuthorizeParams{
+		UserID:        managerID,
+		ApplicationID: appID,
+		ServerID:      serverID,
+		Permissions:   model.PermissionSendMessages,
+	})
+	assert.ErrorIs(t, err, ErrMissingPermission)
+
+	_, err = s.Authorize(ctx, AuthorizeParams{UserID: ownerID, ApplicationID: 99, ServerID: serverID})
+	assert.ErrorIs(t, err, ErrApplicationNotFound)
+}
+
+func TestAuthorizeRequiresMembership(t *testing.T) {
+	s, sr, _ := newTestService()
+
+	// The role store would grant anyone Manage Server through @everyone.
+	_, err := s.Authorize(context.Background(), AuthorizeParams{
+		UserID:        outsider,
+		ApplicationID: appID,
+		ServerID:      serverID,
+		Permissions:   model.PermissionSendMessages,
+	})
+	assert.ErrorIs(t, err, ErrMissingPermission)
+	assert.False(t, sr.members[botID])
+}
+
+func TestAuthorizeURL(t *testing.T) {
+	s, _, _ := newTestService()
+	u := s.AuthorizeURL(appID, model.PermissionSendMessages|1<<62)
+	assert.Equal(t, "https://example.com/oauth2/authorize?client_id=20&permissions=64&scope=bot", u)
+}
@@ -2,6 +2,9 @@ package config
 
 import (
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -9,6 +12,78 @@ type Config struct {
 	RedisURL    string
 	JWTSecret   string
 	ListenAddr  string
+
+	// PublicURL is the externally reachable frontend URL, used to build links in emails.
+	PublicURL string
+
+	// Mail delivery. MailDriver is "smtp" or "log".
+	MailDriver    string
+	MailFrom      string
+	MailOutputDir string
+	SMTPHost      string
+	SMTPPort      int
+	SMTPUsername  string
+	SMTPPassword  string
+
+	// Argon2id password hashing cost parameters.
+	Argon2MemoryKiB   int
+	Argon2Iterations  int
+	Argon2Parallelism int
+
+	// Login throttling. Zero values fall back to auth.DefaultLockoutPolicy.
+	LoginMaxAttempts      int
+	LoginMaxAttemptsPerIP int
+	LoginLockoutDuration  time.Duration
+
+	// NotifyNewDeviceLogin emails users when their account is accessed from a
+	// device it has not seen before.
+	NotifyNewDeviceLogin bool
+
+	// RequireVerifiedEmail blocks users with an unverified email from sending
+	// messages anywhere on the instance.
+	RequireVerifiedEmail bool
+
+	// Event bus transport: "pubsub" (fire-and-forget), "streams" or "nats"
+	// (durable), or "memory" (in-process, for single-binary deployments).
+	// EventStreamMaxLen bounds stream retention for "streams" and "nats".
+	// EventConsumerGroup names this process's stream consumer group and
+	// defaults to one derived from the hostname.
+	EventTransport     string
+	EventStreamMaxLen  int
+	EventConsumerGroup string
+	NATSURL            string
+
+	// Gateway shutdown. On SIGTERM clients are told to reconnect elsewhere
+	// at random points over GatewayDrainSpread, and the node waits up to
+	// GatewayDrainTimeout in total for their sessions to be resumed.
+	GatewayDrainSpread  time.Duration
+	GatewayDrainTimeout time.Duration
+
+	// Gateway send queues. Zero values fall back to
+	// gateway.DefaultQueuePolicy. GatewayDroppableEvents is a comma-separated
+	// list of event types dropped for clients that fall behind.
+	GatewaySendQueueSize   int
+	GatewaySendQueueDropAt int
+	GatewayDroppableEvents []string
+
+	// Presence. Zero values fall back to presence.DefaultPolicy.
+	PresenceAwayAfter            time.Duration
+	PresenceDebounce             time.Duration
+	PresenceLargeServerThreshold int
+
+	// Voice media. VoiceICEServers is a comma-separated list of STUN and
+	// TURN URLs for clients and the SFU. VoicePublicIPs are the addresses
+	// clients reach this node at, when they differ from its own, such as
+	// behind NAT. VoiceUDPPortMin and VoiceUDPPortMax bound the ports media
+	// is received on; zero allows any.
+	VoiceICEServers []string
+	VoicePublicIPs  []string
+	VoiceUDPPortMin int
+	VoiceUDPPortMax int
+
+	// EventDeliveryAllowPrivateNetworks lets event subscriptions target plain
+	// HTTP and private or loopback addresses. Only enable it for development.
+	EventDeliveryAllowPrivateNetworks bool
 }
 
 func Load() *Config {
@@ -17,6 +92,50 @@ func Load() *Config {
 		RedisURL:    getEnv("REDIS_URL", "redis://localhost:6379"),
 		JWTSecret:   getEnv("JWT_SECRET", "dev-secret-change-me"),
 		ListenAddr:  getEnv("LISTEN_ADDR", ":8080"),
+
+		PublicURL: getEnv("PUBLIC_URL", "http://localhost:5173"),
+
+		MailDriver:    getEnv("MAIL_DRIVER", "log"),
+		MailFrom:      getEnv("MAIL_FROM", "Possessive Potato <no-reply@localhost>"),
+		MailOutputDir: getEnv("MAIL_OUTPUT_DIR", ""),
+		SMTPHost:      getEnv("SMTP_HOST", "localhost"),
+		SMTPPort:      getEnvInt("SMTP_PORT", 587),
+		SMTPUsername:  getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:  getEnv("SMTP_PASSWORD", ""),
+
+		Argon2MemoryKiB:   getEnvInt("ARGON2_MEMORY_KIB", 64*1024),
+		Argon2Iterations:  getEnvInt("ARGON2_ITERATIONS", 3),
+		Argon2Parallelism: getEnvInt("ARGON2_PARALLELISM", 2),
+
+		LoginMaxAttempts:      getEnvInt("LOGIN_MAX_ATTEMPTS", 0),
+		LoginMaxAttemptsPerIP: getEnvInt("LOGIN_MAX_ATTEMPTS_PER_IP", 0),
+		LoginLockoutDuration:  getEnvDuration("LOGIN_LOCKOUT_DURATION", 0),
+		NotifyNewDeviceLogin:  getEnvBool("NOTIFY_NEW_DEVICE_LOGIN", false),
+
+		RequireVerifiedEmail: getEnvBool("REQUIRE_VERIFIED_EMAIL", false),
+
+		EventTransport:     getEnv("EVENT_TRANSPORT", "pubsub"),
+		EventStreamMaxLen:  getEnvInt("EVENT_STREAM_MAXLEN", 100_000),
+		EventConsumerGroup: getEnv("EVENT_CONSUMER_GROUP", ""),
+		NATSURL:            getEnv("NATS_URL", "nats://localhost:4222"),
+
+		GatewayDrainSpread:  getEnvDuration("GATEWAY_DRAIN_SPREAD", 10*time.Second),
+		GatewayDrainTimeout: getEnvDuration("GATEWAY_DRAIN_TIMEOUT", 30*time.Second),
+
+		GatewaySendQueueSize:   getEnvInt("GATEWAY_SEND_QUEUE_SIZE", 0),
+		GatewaySendQueueDropAt: getEnvInt("GATEWAY_SEND_QUEUE_DROP_AT", 0),
+		GatewayDroppableEvents: getEnvList("GATEWAY_DROPPABLE_EVENTS"),
+
+		PresenceAwayAfter:            getEnvDuration("PRESENCE_AWAY_AFTER", 0),
+		PresenceDebounce:             getEnvDuration("PRESENCE_DEBOUNCE", 0),
+		PresenceLargeServerThreshold: getEnvInt("PRESENCE_LARGE_SERVER_THRESHOLD", 0),
+
+		VoiceICEServers: getEnvList("VOICE_ICE_SERVERS"),
+		VoicePublicIPs:  getEnvList("VOICE_PUBLIC_IPS"),
+		VoiceUDPPortMin: getEnvInt("VOICE_UDP_PORT_MIN", 0),
+		VoiceUDPPortMax: getEnvInt("VOICE_UDP_PORT_MAX", 0),
+
+		EventDeliveryAllowPrivateNetworks: getEnvBool("EVENT_DELIVERY_ALLOW_PRIVATE_NETWORKS", false),
 	}
 }
 
@@ -26,3 +145,45 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getEnvInt(key string, fallback int) int {
+	if val := os.Getenv(key); val != "" {
+		if n, err := strconv.Atoi(val); err == nil {
+			return n
+		}
+	}
+	return fallback
+}
+
+// getEnvList splits a comma-separated variable, returning nil if it is unset.
+func getEnvList(key string) []string {
+	val := os.Getenv(key)
+	if val == "" {
+		return nil
+	}
+	var out []string
+	for _, part := range strings.Split(val, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	if val := os.Getenv(key); val != "" {
+		if b, err := strconv.ParseBool(val); err == nil {
+			return b
+		}
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if val := os.Getenv(key); val != "" {
+		if d, err := time.ParseDuration(val); err == nil {
+			return d
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMPTZ;
+
+-- Per-server override: require a verified email before members can send messages
+ALTER TABLE servers ADD COLUMN require_verified_email BOOLEAN NOT NULL DEFAULT FALSE;
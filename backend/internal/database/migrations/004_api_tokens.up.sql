@@ -0,0 +1,14 @@
+CREATE TABLE api_tokens (
+    id           BIGINT PRIMARY KEY,
+    user_id      BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name         VARCHAR(64) NOT NULL,
+    token_hash   CHAR(64) UNIQUE NOT NULL,
+    token_prefix VARCHAR(16) NOT NULL,
+    scopes       TEXT[] NOT NULL DEFAULT '{}',
+    server_id    BIGINT REFERENCES servers(id) ON DELETE CASCADE,
+    expires_at   TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_api_tokens_user_id ON api_tokens (user_id);
@@ -0,0 +1,6 @@
+ALTER TABLE roles DROP COLUMN IF EXISTS managed;
+DROP TABLE IF EXISTS applications;
+DELETE FROM users WHERE bot;
+ALTER TABLE users ALTER COLUMN password_hash SET NOT NULL;
+ALTER TABLE users ALTER COLUMN email SET NOT NULL;
+ALTER TABLE users DROP COLUMN IF EXISTS bot;
@@ -0,0 +1,20 @@
+-- Bot users authenticate with a token only, so they have no email or password
+ALTER TABLE users ADD COLUMN bot BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ALTER COLUMN email DROP NOT NULL;
+ALTER TABLE users ALTER COLUMN password_hash DROP NOT NULL;
+
+CREATE TABLE applications (
+    id             BIGINT PRIMARY KEY,
+    owner_id       BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name           VARCHAR(64) NOT NULL,
+    description    TEXT,
+    bot_user_id    BIGINT UNIQUE NOT NULL REFERENCES users(id),
+    bot_token_hash CHAR(64) UNIQUE NOT NULL,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_applications_owner_id ON applications (owner_id);
+
+-- Managed roles are created for a bot when it is authorized into a server and
+-- belong to that bot rather than to server admins
+ALTER TABLE roles ADD COLUMN managed BOOLEAN NOT NULL DEFAULT FALSE;
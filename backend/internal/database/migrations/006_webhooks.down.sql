@@ -0,0 +1,7 @@
+DELETE FROM messages WHERE author_id IS NULL;
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS chk_messages_author;
+ALTER TABLE messages DROP COLUMN IF EXISTS webhook_avatar_url;
+ALTER TABLE messages DROP COLUMN IF EXISTS webhook_name;
+ALTER TABLE messages DROP COLUMN IF EXISTS webhook_id;
+ALTER TABLE messages ALTER COLUMN author_id SET NOT NULL;
+DROP TABLE IF EXISTS webhooks;
@@ -0,0 +1,21 @@
+CREATE TABLE webhooks (
+    id         BIGINT PRIMARY KEY,
+    server_id  BIGINT NOT NULL REFERENCES servers(id) ON DELETE CASCADE,
+    channel_id BIGINT NOT NULL REFERENCES channels(id) ON DELETE CASCADE,
+    name       VARCHAR(80) NOT NULL,
+    avatar_url TEXT,
+    token_hash CHAR(64) NOT NULL,
+    created_by BIGINT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_webhooks_channel_id ON webhooks (channel_id);
+
+-- Webhook messages have no users row; the display name and avatar used for
+-- each post are stored on the message itself
+ALTER TABLE messages ALTER COLUMN author_id DROP NOT NULL;
+ALTER TABLE messages ADD COLUMN webhook_id BIGINT REFERENCES webhooks(id) ON DELETE SET NULL;
+ALTER TABLE messages ADD COLUMN webhook_name VARCHAR(80);
+ALTER TABLE messages ADD COLUMN webhook_avatar_url TEXT;
+ALTER TABLE messages ADD CONSTRAINT chk_messages_author
+    CHECK (author_id IS NOT NULL OR webhook_name IS NOT NULL);
@@ -0,0 +1,34 @@
+CREATE TABLE event_subscriptions (
+    id                   BIGINT PRIMARY KEY,
+    server_id            BIGINT NOT NULL REFERENCES servers(id) ON DELETE CASCADE,
+    created_by           BIGINT REFERENCES users(id) ON DELETE SET NULL,
+    url                  TEXT NOT NULL,
+    secret               VARCHAR(128) NOT NULL,
+    event_types          TEXT[] NOT NULL,
+    channel_ids          BIGINT[] NOT NULL DEFAULT '{}',
+    enabled              BOOLEAN NOT NULL DEFAULT TRUE,
+    consecutive_failures INT NOT NULL DEFAULT 0,
+    disabled_reason      TEXT,
+    created_at           TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_event_subscriptions_server_id ON event_subscriptions (server_id) WHERE enabled;
+
+-- Durable delivery queue and delivery log. Pending rows are claimed by
+-- workers once next_attempt_at has passed.
+CREATE TABLE event_deliveries (
+    id               BIGINT PRIMARY KEY,
+    subscription_id  BIGINT NOT NULL REFERENCES event_subscriptions(id) ON DELETE CASCADE,
+    event_type       VARCHAR(64) NOT NULL,
+    payload          JSONB NOT NULL,
+    status           VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts         INT NOT NULL DEFAULT 0,
+    next_attempt_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_status_code INT,
+    last_error       TEXT,
+    delivered_at     TIMESTAMPTZ,
+    created_at       TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_event_deliveries_due ON event_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX idx_event_deliveries_subscription_id ON event_deliveries (subscription_id, id);
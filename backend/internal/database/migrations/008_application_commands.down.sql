@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS application_commands;
+ALTER TABLE applications DROP COLUMN IF EXISTS interactions_secret;
+ALTER TABLE applications DROP COLUMN IF EXISTS interactions_endpoint_url;
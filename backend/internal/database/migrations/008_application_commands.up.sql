@@ -0,0 +1,21 @@
+-- Applications may receive interactions over HTTP instead of the gateway.
+-- Requests are signed with interactions_secret.
+ALTER TABLE applications ADD COLUMN interactions_endpoint_url TEXT;
+ALTER TABLE applications ADD COLUMN interactions_secret VARCHAR(128);
+
+-- Slash commands. A NULL server_id registers the command in every server the
+-- application's bot is a member of.
+CREATE TABLE application_commands (
+    id                         BIGINT PRIMARY KEY,
+    application_id             BIGINT NOT NULL REFERENCES applications(id) ON DELETE CASCADE,
+    server_id                  BIGINT REFERENCES servers(id) ON DELETE CASCADE,
+    name                       VARCHAR(32) NOT NULL,
+    description                VARCHAR(100) NOT NULL,
+    options                    JSONB NOT NULL DEFAULT '[]',
+    default_member_permissions BIGINT,
+    created_at                 TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX idx_application_commands_name
+    ON application_commands (application_id, COALESCE(server_id, 0), name);
+CREATE INDEX idx_application_commands_server_id ON application_commands (server_id);
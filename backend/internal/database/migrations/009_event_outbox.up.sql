@@ -0,0 +1,16 @@
+-- Events written in the same transaction as the change they describe, and
+-- published to the event bus by the outbox relay after commit.
+CREATE TABLE event_outbox (
+    id              BIGINT PRIMARY KEY,
+    idempotency_key VARCHAR(128) NOT NULL,
+    channel         VARCHAR(128) NOT NULL,
+    payload         JSONB NOT NULL,
+    attempts        INT NOT NULL DEFAULT 0,
+    last_error      TEXT,
+    published_at    TIMESTAMPTZ,
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX idx_event_outbox_key ON event_outbox (channel, idempotency_key);
+CREATE INDEX idx_event_outbox_unpublished ON event_outbox (id) WHERE published_at IS NULL;
+CREATE INDEX idx_event_outbox_published_at ON event_outbox (published_at) WHERE published_at IS NOT NULL;
@@ -0,0 +1,2 @@
+UPDATE users SET status = 'offline' WHERE status = 'invisible';
+ALTER TABLE users ALTER COLUMN status SET DEFAULT 'offline';
@@ -0,0 +1,4 @@
+-- users.status is now the status a user chose, and their presence is derived
+-- from it and their gateway connections. Nobody chose "offline".
+ALTER TABLE users ALTER COLUMN status SET DEFAULT 'online';
+UPDATE users SET status = 'online' WHERE status = 'offline';
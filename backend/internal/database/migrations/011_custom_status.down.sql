@@ -0,0 +1,4 @@
+ALTER TABLE users
+    DROP COLUMN IF EXISTS custom_status_text,
+    DROP COLUMN IF EXISTS custom_status_emoji,
+    DROP COLUMN IF EXISTS custom_status_expires_at;
@@ -0,0 +1,4 @@
+ALTER TABLE users
+    ADD COLUMN custom_status_text       VARCHAR(128),
+    ADD COLUMN custom_status_emoji      VARCHAR(64),
+    ADD COLUMN custom_status_expires_at TIMESTAMPTZ;
@@ -0,0 +1,6 @@
+ALTER TABLE server_members
+    DROP COLUMN IF EXISTS mute,
+    DROP COLUMN IF EXISTS deaf;
+
+ALTER TABLE channels
+    DROP COLUMN IF EXISTS user_limit;
@@ -0,0 +1,6 @@
+ALTER TABLE channels
+    ADD COLUMN user_limit INT NOT NULL DEFAULT 0;
+
+ALTER TABLE server_members
+    ADD COLUMN mute BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN deaf BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,294 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/robwittman/possessive-potato/backend/internal/auth"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/permission"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+)
+
+// SecretPrefix marks event subscription signing secrets.
+const SecretPrefix = "whsec_"
+
+// MaxSubscriptionsPerServer bounds how many endpoints one server can fan out to.
+const MaxSubscriptionsPerServer = 10
+
+// DeliverableEvents are the event types a subscription may ask for. Typing,
+// presence, voice and session events are too chatty or too private to leave
+// the instance.
+var DeliverableEvents = []string{
+	events.MessageCreate,
+	events.MessageUpdate,
+	events.MessageDelete,
+	events.ChannelCreate,
+	events.ChannelUpdate,
+	events.ChannelDelete,
+	events.ServerUpdate,
+	events.ServerDelete,
+	events.ServerMemberAdd,
+	events.ServerMemberRemove,
+	events.ThreadCreate,
+	events.ThreadUpdate,
+}
+
+var (
+	ErrNotFound             = errors.New("unknown event subscription")
+	ErrDeliveryNotFound     = errors.New("unknown delivery")
+	ErrInvalidURL           = errors.New("endpoint must be an https URL on a public host")
+	ErrInvalidEventType     = errors.New("unsupported event type")
+	ErrNoEventTypes         = errors.New("at least one event type is required")
+	ErrInvalidChannel       = errors.New("channel filter must only contain channels in this server")
+	ErrTooManySubscriptions = fmt.Errorf("servers can have at most %d event subscriptions", MaxSubscriptionsPerServer)
+)
+
+// Service manages a server's event subscriptions and their delivery logs.
+type Service struct {
+	subs         store.EventSubscriptionStoreInterface
+	deliveries   store.EventDeliveryStoreInterface
+	channels     store.ChannelStoreInterface
+	perms        *permission.Checker
+	allowPrivate bool
+}
+
+func NewService(
+	subs store.EventSubscriptionStoreInterface,
+	deliveries store.EventDeliveryStoreInterface,
+	channels store.ChannelStoreInterface,
+	perms *permission.Checker,
+	allowPrivate bool,
+) *Service {
+	return &Service{
+		subs:         subs,
+		deliveries:   deliveries,
+		channels:     channels,
+		perms:        perms,
+		allowPrivate: allowPrivate,
+	}
+}
+
+// SubscriptionParams describes where a subscription delivers and what it
+// receives. An empty ChannelIDs receives events from every channel.
+type SubscriptionParams struct {
+	URL        string
+	EventTypes []string
+	ChannelIDs []int64
+}
+
+// Create adds an event subscription to a server. The signing secret is
+// returned once; receivers use it with VerifySignature.
+func (s *Service) Create(ctx context.Context, actorID, serverID int64, params SubscriptionParams) (*model.EventSubscription, string, error) {
+	if err := s.perms.Require(ctx, serverID, actorID, model.PermissionManageWebhooks); err != nil {
+		return nil, "", err
+	}
+	if err := s.validate(ctx, serverID, params); err != nil {
+		return nil, "", err
+	}
+	existing, err := s.subs.ListByServer(ctx, serverID)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(existing) >= MaxSubscriptionsPerServer {
+		return nil, "", ErrTooManySubscriptions
+	}
+
+	secret, _, err := auth.GenerateSecret(SecretPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+	sub := &model.EventSubscription{
+		ID:         model.NewID().Int64(),
+		ServerID:   serverID,
+		CreatedBy:  &actorID,
+		URL:        params.URL,
+		Secret:     secret,
+		EventTypes: params.EventTypes,
+		ChannelIDs: channelIDs(params.ChannelIDs),
+		Enabled:    true,
+		CreatedAt:  time.Now(),
+	}
+	if err := s.subs.Create(ctx, sub); err != nil {
+		return nil, "", err
+	}
+	return sub, secret, nil
+}
+
+func (s *Service) List(ctx context.Context, actorID, serverID int64) ([]model.EventSubscription, error) {
+	if err := s.perms.Require(ctx, serverID, actorID, model.PermissionManageWebhooks); err != nil {
+		return nil, err
+	}
+	return s.subs.ListByServer(ctx, serverID)
+}
+
+func (s *Service) Update(ctx context.Context, actorID, subscriptionID int64, params SubscriptionParams) (*model.EventSubscription, error) {
+	sub, err := s.managed(ctx, actorID, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.validate(ctx, sub.ServerID, params); err != nil {
+		return nil, err
+	}
+	sub.URL = params.URL
+	sub.EventTypes = params.EventTypes
+	sub.ChannelIDs = channelIDs(params.ChannelIDs)
+	if err := s.subs.Update(ctx, sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// RotateSecret replaces the signing secret and returns the new one.
+func (s *Service) RotateSecret(ctx context.Context, actorID, subscriptionID int64) (string, error) {
+	sub, err := s.managed(ctx, actorID, subscriptionID)
+	if err != nil {
+		return "", err
+	}
+	secret, _, err := auth.GenerateSecret(SecretPrefix)
+	if err != nil {
+		return "", err
+	}
+	if err := s.subs.UpdateSecret(ctx, sub.ID, secret); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// SetEnabled turns delivery on or off. Re-enabling an endpoint that was
+// disabled for failing resets its failure count.
+func (s *Service) SetEnabled(ctx context.Context, actorID, subscriptionID int64, enabled bool) error {
+	sub, err := s.managed(ctx, actorID, subscriptionID)
+	if err != nil {
+		return err
+	}
+	var reason *string
+	if !enabled {
+		r := "disabled by a server manager"
+		reason = &r
+	}
+	return s.subs.SetEnabled(ctx, sub.ID, enabled, reason)
+}
+
+func (s *Service) Delete(ctx context.Context, actorID, subscriptionID int64) error {
+	sub, err := s.managed(ctx, actorID, subscriptionID)
+	if err != nil {
+		return err
+	}
+	return s.subs.Delete(ctx, sub.ID)
+}
+
+// ListDeliveries returns a page of the subscription's delivery log.
+func (s *Service) ListDeliveries(ctx context.Context, actorID, subscriptionID int64, before int64, limit int) ([]model.EventDelivery, error) {
+	sub, err := s.managed(ctx, actorID, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+	return s.deliveries.ListBySubscription(ctx, sub.ID, before, limit)
+}
+
+// Redeliver queues a new delivery of a logged event. The payload, including
+// its event_id, is sent unchanged so receivers can deduplicate.
+func (s *Service) Redeliver(ctx context.Context, actorID, deliveryID int64) (*model.EventDelivery, error) {
+	original, err := s.deliveries.GetByID(ctx, deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	if original == nil {
+		return nil, ErrDeliveryNotFound
+	}
+	if _, err := s.managed(ctx, actorID, original.SubscriptionID); err != nil {
+		return nil, err
+	}
+
+	d := &model.EventDelivery{
+		ID:             model.NewID().Int64(),
+		SubscriptionID: original.SubscriptionID,
+		EventType:      original.EventType,
+		Payload:        original.Payload,
+		Status:         model.DeliveryStatusPending,
+		NextAttemptAt:  time.Now(),
+		CreatedAt:      time.Now(),
+	}
+	if err := s.deliveries.Create(ctx, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (s *Service) managed(ctx context.Context, actorID, subscriptionID int64) (*model.EventSubscription, error) {
+	sub, err := s.subs.GetByID(ctx, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	if sub == nil {
+		return nil, ErrNotFound
+	}
+	if err := s.perms.Require(ctx, sub.ServerID, actorID, model.PermissionManageWebhooks); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (s *Service) validate(ctx context.Context, serverID int64, params SubscriptionParams) error {
+	if err := ValidateURL(params.URL, s.allowPrivate); err != nil {
+		return err
+	}
+	if len(params.EventTypes) == 0 {
+		return ErrNoEventTypes
+	}
+	for _, t := range params.EventTypes {
+		if !slices.Contains(DeliverableEvents, t) {
+			return fmt.Errorf("%w: %s", ErrInvalidEventType, t)
+		}
+	}
+	for _, id := range params.ChannelIDs {
+		ch, err := s.channels.GetByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if ch == nil || ch.ServerID != serverID {
+			return ErrInvalidChannel
+		}
+	}
+	return nil
+}
+
+// ValidateURL rejects endpoints NewHTTPClient would refuse to dial anyway, so
+// users find out when they configure the endpoint rather than from a failed
+// delivery. The dialer repeats the address check after DNS resolution.
+func ValidateURL(raw string, allowPrivate bool) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.User != nil {
+		return ErrInvalidURL
+	}
+	if allowPrivate {
+		if u.Scheme != "https" && u.Scheme != "http" {
+			return ErrInvalidURL
+		}
+		return nil
+	}
+	if u.Scheme != "https" || u.Hostname() == "localhost" {
+		return ErrInvalidURL
+	}
+	if ip, err := netip.ParseAddr(u.Hostname()); err == nil && !isPublicIP(ip) {
+		return ErrInvalidURL
+	}
+	return nil
+}
+
+func channelIDs(ids []int64) []int64 {
+	if ids == nil {
+		return []int64{}
+	}
+	return ids
+}
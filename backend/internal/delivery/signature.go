@@ -0,0 +1,67 @@
+package delivery
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers sent with every delivery.
+const (
+	HeaderSignature = "X-Potato-Signature"
+	HeaderEvent     = "X-Potato-Event"
+	HeaderDelivery  = "X-Potato-Delivery"
+)
+
+// SignatureTolerance is how old a signed timestamp VerifySignature accepts.
+const SignatureTolerance = 5 * time.Minute
+
+var ErrInvalidSignature = errors.New("invalid X-Potato-Signature")
+
+// Sign computes the X-Potato-Signature header for a body sent at ts:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">". Including the
+// timestamp in the MAC lets receivers reject replayed deliveries.
+func Sign(secret string, ts time.Time, body []byte) string {
+	t := strconv.FormatInt(ts.Unix(), 10)
+	return "t=" + t + ",v1=" + hex.EncodeToString(computeMAC(secret, t, body))
+}
+
+// VerifySignature checks a X-Potato-Signature header the way receivers
+// should: the MAC must match and the timestamp must be recent.
+func VerifySignature(secret string, body []byte, header string, now time.Time) error {
+	var t, v1 string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "t":
+			t = v
+		case "v1":
+			v1 = v
+		}
+	}
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if d := now.Sub(time.Unix(unix, 0)); d > SignatureTolerance || d < -SignatureTolerance {
+		return fmt.Errorf("%w: timestamp outside tolerance", ErrInvalidSignature)
+	}
+	got, err := hex.DecodeString(v1)
+	if err != nil || !hmac.Equal(got, computeMAC(secret, t, body)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func computeMAC(secret, t string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
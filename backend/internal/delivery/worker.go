@@ -0,0 +1,480 @@
+package delivery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// MaxAttempts is how many times a delivery is tried before it is marked failed.
+	MaxAttempts = 8
+	// BaseBackoff doubles after each failed attempt, up to MaxBackoff.
+	BaseBackoff = 30 * time.Second
+	MaxBackoff  = time.Hour
+	// DisableAfterFailures consecutive failed attempts, across all of a
+	// subscription's deliveries, disable the subscription.
+	DisableAfterFailures = 25
+
+	requestTimeout = 10 * time.Second
+	pollInterval   = time.Second
+	claimBatch     = 50
+	concurrency    = 10
+	// claimLease must outlast requestTimeout so a delivery in flight is never
+	// claimed twice.
+	claimLease = 2 * time.Minute
+	// subscriptionCacheTTL bounds how long subscription changes take to
+	// reach the enqueue path.
+	subscriptionCacheTTL = 10 * time.Second
+	// dedupWindow suppresses the same bus event, by its key, being enqueued
+	// by every worker replica.
+	dedupWindow = 30 * time.Second
+	userAgent   = "PossessivePotato-Webhooks/1.0"
+)
+
+// payload is the JSON body POSTed to subscribers.
+type payload struct {
+	EventID   int64           `json:"event_id,string"`
+	Type      string          `json:"type"`
+	ServerID  int64           `json:"server_id,string"`
+	ChannelID *int64          `json:"channel_id,string,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+	Data      json.RawMessage `json:"data"`
+}
+
+type cachedSubscriptions struct {
+	subs    []model.EventSubscription
+	expires time.Time
+}
+
+// Worker fans bus events out to matching event subscriptions and delivers
+// them. Every replica enqueues and delivers; deliveries are persisted before
+// any HTTP request is made so they survive restarts, and are claimed with
+// row locks so each is in flight on one worker at a time.
+type Worker struct {
+	subs       store.EventSubscriptionStoreInterface
+	deliveries store.EventDeliveryStoreInterface
+	channels   store.ChannelStoreInterface
+	bus        events.Subscriber
+	redis      *redis.Client
+	client     *http.Client
+
+	mu             sync.Mutex
+	subsByServer   map[int64]cachedSubscriptions
+	channelServers map[int64]int64
+
+	wake chan struct{}
+}
+
+func NewWorker(
+	subs store.EventSubscriptionStoreInterface,
+	deliveries store.EventDeliveryStoreInterface,
+	channels store.ChannelStoreInterface,
+	bus events.Subscriber,
+	redisClient *redis.Client,
+	allowPrivate bool,
+) *Worker {
+	return &Worker{
+		subs:           subs,
+		deliveries:     deliveries,
+		channels:       channels,
+		bus:            bus,
+		redis:          redisClient,
+		client:         NewHTTPClient(allowPrivate),
+		subsByServer:   make(map[int64]cachedSubscriptions),
+		channelServers: make(map[int64]int64),
+		wake:           make(chan struct{}, 1),
+	}
+}
+
+// Run subscribes to server and channel events and delivers queued events
+// until ctx is cancelled.
+func (w *Worker) Run(ctx context.Context) {
+	w.bus.PSubscribe(ctx, w.handleEvent, "server:*", "channel:*")
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.wake:
+		}
+		w.deliverDue(ctx)
+	}
+}
+
+// handleEvent queues a delivery for every subscription that wants the event.
+func (w *Worker) handleEvent(topic string, event events.Event) {
+	if !slices.Contains(DeliverableEvents, event.Type) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	kind, rawID, _ := strings.Cut(topic, ":")
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		return
+	}
+	var serverID int64
+	var channelID *int64
+	switch kind {
+	case "server":
+		serverID = id
+	case "channel":
+		channelID = &id
+		if serverID, err = w.serverForChannel(ctx, id); err != nil || serverID == 0 {
+			return
+		}
+	}
+
+	subs, err := w.subscriptionsFor(ctx, serverID)
+	if err != nil {
+		log.Error().Err(err).Int64("server_id", serverID).Msg("failed to load event subscriptions")
+		return
+	}
+	var matched []model.EventSubscription
+	for _, sub := range subs {
+		if matches(sub, event.Type, channelID) {
+			matched = append(matched, sub)
+		}
+	}
+	if len(matched) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return
+	}
+	if first, err := w.firstSighting(ctx, topic, event.Key); err != nil || !first {
+		return
+	}
+
+	body, err := json.Marshal(payload{
+		EventID:   model.NewID().Int64(),
+		Type:      event.Type,
+		ServerID:  serverID,
+		ChannelID: channelID,
+		Timestamp: time.Now().UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		return
+	}
+	for _, sub := range matched {
+		d := &model.EventDelivery{
+			ID:             model.NewID().Int64(),
+			SubscriptionID: sub.ID,
+			EventType:      event.Type,
+			Payload:        body,
+			Status:         model.DeliveryStatusPending,
+			NextAttemptAt:  time.Now(),
+		}
+		if err := w.deliveries.Create(ctx, d); err != nil {
+			log.Error().Err(err).Int64("subscription_id", sub.ID).Msg("failed to queue event delivery")
+		}
+	}
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func matches(sub model.EventSubscription, eventType string, channelID *int64) bool {
+	if !slices.Contains(sub.EventTypes, eventType) {
+		return false
+	}
+	if channelID != nil && len(sub.ChannelIDs) > 0 {
+		return slices.Contains(sub.ChannelIDs, *channelID)
+	}
+	return true
+}
+
+// firstSighting reports whether this replica is the first to see the event
+// with the given key. Every replica receives every bus message, so without
+// this each would queue its own copy. Events published without a key cannot
+// be told apart from an identical event published again, so they are never
+// suppressed.
+func (w *Worker) firstSighting(ctx context.Context, topic, key string) (bool, error) {
+	if key == "" {
+		return true, nil
+	}
+	ok, err := w.redis.SetNX(ctx, "event_delivery_seen:"+topic+":"+key, 1, dedupWindow).Result()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to deduplicate event")
+		return false, err
+	}
+	return ok, nil
+}
+
+func (w *Worker) subscriptionsFor(ctx context.Context, serverID int64) ([]model.EventSubscription, error) {
+	w.mu.Lock()
+	cached, ok := w.subsByServer[serverID]
+	w.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.subs, nil
+	}
+
+	subs, err := w.subs.ListEnabledByServer(ctx, serverID)
+	if err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	w.subsByServer[serverID] = cachedSubscriptions{subs: subs, expires: time.Now().Add(subscriptionCacheTTL)}
+	w.mu.Unlock()
+	return subs, nil
+}
+
+// serverForChannel resolves a channel's server. Channels never move between
+// servers, so the mapping is cached for the life of the worker.
+func (w *Worker) serverForChannel(ctx context.Context, channelID int64) (int64, error) {
+	w.mu.Lock()
+	serverID, ok := w.channelServers[channelID]
+	w.mu.Unlock()
+	if ok {
+		return serverID, nil
+	}
+
+	ch, err := w.channels.GetByID(ctx, channelID)
+	if err != nil || ch == nil {
+		return 0, err
+	}
+	w.mu.Lock()
+	w.channelServers[channelID] = ch.ServerID
+	w.mu.Unlock()
+	return ch.ServerID, nil
+}
+
+// deliverDue claims due deliveries and attempts them concurrently.
+func (w *Worker) deliverDue(ctx context.Context) {
+	for {
+		batch, err := w.deliveries.ClaimDue(ctx, claimBatch, claimLease)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error().Err(err).Msg("failed to claim event deliveries")
+			}
+			return
+		}
+
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, concurrency)
+		for _, d := range batch {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(d model.EventDelivery) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				w.attempt(ctx, d)
+			}(d)
+		}
+		wg.Wait()
+
+		if len(batch) < claimBatch {
+			return
+		}
+	}
+}
+
+func (w *Worker) attempt(ctx context.Context, d model.EventDelivery) {
+	sub, err := w.subs.GetByID(ctx, d.SubscriptionID)
+	if err != nil {
+		log.Error().Err(err).Int64("delivery_id", d.ID).Msg("failed to load event subscription")
+		return
+	}
+	if sub == nil {
+		return // deleted; the delivery was removed with it
+	}
+	if !sub.Enabled {
+		reason := "subscription disabled"
+		w.record(ctx, d.ID, model.DeliveryStatusFailed, nil, &reason, time.Now())
+		return
+	}
+
+	statusCode, err := w.send(ctx, sub, d)
+	if ctx.Err() != nil {
+		return // shutting down; the lease will expire and the delivery will be retried
+	}
+	if err == nil {
+		w.record(ctx, d.ID, model.DeliveryStatusSucceeded, &statusCode, nil, time.Now())
+		if sub.ConsecutiveFailures > 0 {
+			if err := w.subs.RecordSuccess(ctx, sub.ID); err != nil {
+				log.Error().Err(err).Int64("subscription_id", sub.ID).Msg("failed to reset subscription failures")
+			}
+		}
+		return
+	}
+
+	var code *int
+	if statusCode != 0 {
+		code = &statusCode
+	}
+	msg := err.Error()
+	attempts := d.Attempts + 1
+	if attempts >= MaxAttempts {
+		w.record(ctx, d.ID, model.DeliveryStatusFailed, code, &msg, time.Now())
+	} else {
+		w.record(ctx, d.ID, model.DeliveryStatusPending, code, &msg, time.Now().Add(backoff(attempts)))
+	}
+	w.recordFailure(ctx, sub, statusCode)
+}
+
+// recordFailure counts a failed attempt against the subscription and disables
+// it once it has failed too many times in a row. 410 Gone disables it at once.
+func (w *Worker) recordFailure(ctx context.Context, sub *model.EventSubscription, statusCode int) {
+	failures, err := w.subs.RecordFailure(ctx, sub.ID)
+	if err != nil {
+		log.Error().Err(err).Int64("subscription_id", sub.ID).Msg("failed to record subscription failure")
+		return
+	}
+
+	var reason string
+	switch {
+	case statusCode == http.StatusGone:
+		reason = "endpoint responded 410 Gone"
+	case failures >= DisableAfterFailures:
+		reason = fmt.Sprintf("disabled after %d consecutive failed deliveries", failures)
+	default:
+		return
+	}
+	if err := w.subs.SetEnabled(ctx, sub.ID, false, &reason); err != nil {
+		log.Error().Err(err).Int64("subscription_id", sub.ID).Msg("failed to disable subscription")
+		return
+	}
+	w.mu.Lock()
+	delete(w.subsByServer, sub.ServerID)
+	w.mu.Unlock()
+	log.Warn().Int64("subscription_id", sub.ID).Str("reason", reason).Msg("event subscription disabled")
+}
+
+func (w *Worker) record(ctx context.Context, id int64, status model.DeliveryStatus, code *int, msg *string, next time.Time) {
+	if err := w.deliveries.RecordAttempt(ctx, id, status, code, msg, next); err != nil {
+		log.Error().Err(err).Int64("delivery_id", id).Msg("failed to record delivery attempt")
+	}
+}
+
+// send POSTs the signed payload. Any 2xx response is success.
+func (w *Worker) send(ctx context.Context, sub *model.EventSubscription, d model.EventDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set(HeaderEvent, d.EventType)
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(d.ID, 10))
+	req.Header.Set(HeaderSignature, Sign(sub.Secret, time.Now(), d.Payload))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff returns the delay before the next attempt, with ±20% jitter so
+// retries from a burst of failures spread out.
+func backoff(attempts int) time.Duration {
+	d := MaxBackoff
+	if shift := attempts - 1; shift < 16 {
+		d = min(BaseBackoff<<shift, MaxBackoff)
+	}
+	jitter := time.Duration(rand.Int64N(int64(d)/5*2+1)) - d/5
+	return d + jitter
+}
+
+var errPrivateAddress = errors.New("refusing to connect to a private address")
+
+// NewHTTPClient returns a client for calling user-supplied endpoints. It does
+// not follow redirects and, unless allowPrivate is set, refuses to connect to
+// non-public addresses so an endpoint cannot be used to probe the internal
+// network.
+func NewHTTPClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip, err := netip.ParseAddr(host); err != nil || !isPublicIP(ip) {
+				return errPrivateAddress
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// nonPublicPrefixes are ranges the standard library's address predicates do
+// not cover but which are not reachable on the public internet, or which
+// translate to addresses that may not be.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT, and some cloud metadata services
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, and broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, which reaches any IPv4 address
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64
+	netip.MustParsePrefix("100::/64"),        // discard
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4, which embeds an IPv4 address
+}
+
+func isPublicIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
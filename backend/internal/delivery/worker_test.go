@@ -0,0 +1,253 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	if err := model.InitSnowflake(0); err != nil {
+		panic(err)
+	}
+}
+
+const (
+	serverID  = 10
+	channelID = 20
+)
+
+// fakeSubscriptions holds one subscription to channel and server updates.
+type fakeSubscriptions struct {
+	store.EventSubscriptionStoreInterface
+	mu       sync.Mutex
+	sub      model.EventSubscription
+	failures int
+}
+
+func newFakeSubscriptions() *fakeSubscriptions {
+	return &fakeSubscriptions{sub: model.EventSubscription{
+		ID:         1,
+		ServerID:   serverID,
+		URL:        "https://hooks.example.com/potato",
+		Secret:     "whsec_test",
+		EventTypes: []string{events.ChannelUpdate, events.ServerUpdate},
+		Enabled:    true,
+	}}
+}
+
+func (f *fakeSubscriptions) ListEnabledByServer(_ context.Context, id int64) ([]model.EventSubscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if id != serverID || !f.sub.Enabled {
+		return nil, nil
+	}
+	return []model.EventSubscription{f.sub}, nil
+}
+
+func (f *fakeSubscriptions) RecordFailure(context.Context, int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures++
+	return f.failures, nil
+}
+
+func (f *fakeSubscriptions) SetEnabled(_ context.Context, _ int64, enabled bool, reason *string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sub.Enabled = enabled
+	f.sub.DisabledReason = reason
+	return nil
+}
+
+func (f *fakeSubscriptions) enabled() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sub.Enabled
+}
+
+type fakeDeliveries struct {
+	store.EventDeliveryStoreInterface
+	mu      sync.Mutex
+	created []model.EventDelivery
+}
+
+func (f *fakeDeliveries) Create(_ context.Context, d *model.EventDelivery) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.created = append(f.created, *d)
+	return nil
+}
+
+func (f *fakeDeliveries) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.created)
+}
+
+type fakeChannels struct{ store.ChannelStoreInterface }
+
+func (fakeChannels) GetByID(_ context.Context, id int64) (*model.Channel, error) {
+	return &model.Channel{ID: id, ServerID: serverID, Type: model.ChannelTypeText}, nil
+}
+
+// newTestWorkers returns n worker replicas sharing a bus and Redis, queueing
+// into the same store, each following the bus.
+func newTestWorkers(t *testing.T, n int) (*events.Bus, *fakeSubscriptions, *fakeDeliveries, []*Worker) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	bus := events.NewBusWithTransport(events.NewMemoryTransport())
+	subs, deliveries := newFakeSubscriptions(), &fakeDeliveries{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	workers := make([]*Worker, n)
+	for i := range workers {
+		workers[i] = NewWorker(subs, deliveries, fakeChannels{}, bus, rdb, false)
+		bus.PSubscribe(ctx, workers[i].handleEvent, "server:*", "channel:*")
+	}
+	return bus, subs, deliveries, workers
+}
+
+// settle waits for n deliveries to be queued, then a little longer for any
+// that should not have been.
+func settle(t *testing.T, deliveries *fakeDeliveries, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool { return deliveries.count() >= n }, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, n, deliveries.count())
+}
+
+func TestWorkerQueuesEachPublish(t *testing.T) {
+	bus, _, deliveries, _ := newTestWorkers(t, 1)
+	ctx := context.Background()
+
+	// A topic set from A to B and back sends A twice; both are delivered.
+	for _, topic := range []string{"A", "B", "A"} {
+		ch := &model.Channel{ID: channelID, ServerID: serverID, Name: "general", Topic: &topic}
+		require.NoError(t, bus.Publish(ctx, "channel:20", events.Event{Type: events.ChannelUpdate, Data: ch}))
+	}
+	server := &model.Server{ID: serverID, Name: "Potatoes"}
+	for range 2 {
+		require.NoError(t, bus.Publish(ctx, "server:10", events.Event{Type: events.ServerUpdate, Data: server}))
+	}
+	settle(t, deliveries, 5)
+}
+
+func TestWorkerReplicasQueueOnce(t *testing.T) {
+	bus, _, deliveries, _ := newTestWorkers(t, 3)
+	ctx := context.Background()
+	server := &model.Server{ID: serverID, Name: "Potatoes"}
+
+	require.NoError(t, bus.Publish(ctx, "server:10", events.Event{Type: events.ServerUpdate, Data: server}))
+	settle(t, deliveries, 1)
+
+	// A redelivery of the same publish is dropped too.
+	event := events.Event{Type: events.ServerUpdate, Data: server, Key: "outbox-1"}
+	require.NoError(t, bus.Publish(ctx, "server:10", event))
+	require.NoError(t, bus.Publish(ctx, "server:10", event))
+	settle(t, deliveries, 2)
+}
+
+func TestBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  BaseBackoff,
+		2:  2 * BaseBackoff,
+		4:  8 * BaseBackoff,
+		8:  MaxBackoff,
+		60: MaxBackoff,
+	} {
+		for range 20 {
+			d := backoff(attempts)
+			assert.GreaterOrEqual(t, d, want-want/5, "attempt %d", attempts)
+			assert.LessOrEqual(t, d, want+want/5, "attempt %d", attempts)
+		}
+	}
+}
+
+func TestRecordFailureDisablesSubscription(t *testing.T) {
+	_, subs, _, workers := newTestWorkers(t, 1)
+	w, ctx := workers[0], context.Background()
+	sub := subs.sub
+
+	for range DisableAfterFailures - 1 {
+		w.recordFailure(ctx, &sub, http.StatusInternalServerError)
+	}
+	assert.True(t, subs.enabled())
+	w.recordFailure(ctx, &sub, http.StatusInternalServerError)
+	assert.False(t, subs.enabled())
+	assert.Contains(t, *subs.sub.DisabledReason, "consecutive failed deliveries")
+
+	// An endpoint that is gone is disabled at once.
+	subs.sub.Enabled, subs.failures = true, 0
+	w.recordFailure(ctx, &sub, http.StatusGone)
+	assert.False(t, subs.enabled())
+	assert.Contains(t, *subs.sub.DisabledReason, "410 Gone")
+}
+
+func TestIsPublicIP(t *testing.T) {
+	for addr, public := range map[string]bool{
+		"93.184.215.14":          true,
+		"1.1.1.1":                true,
+		"2606:4700:4700::1111":   true,
+		"127.0.0.1":              false,
+		"10.1.2.3":               false,
+		"172.16.0.1":             false,
+		"192.168.1.1":            false,
+		"169.254.169.254":        false,
+		"0.0.0.0":                false,
+		"0.1.2.3":                false,
+		"100.64.0.1":             false,
+		"100.100.100.200":        false,
+		"192.0.0.8":              false,
+		"198.18.0.1":             false,
+		"198.19.255.255":         false,
+		"203.0.113.7":            false,
+		"240.0.0.1":              false,
+		"255.255.255.255":        false,
+		"224.0.0.1":              false,
+		"::1":                    false,
+		"::":                     false,
+		"fe80::1":                false,
+		"fc00::1":                false,
+		"ff02::1":                false,
+		"::ffff:10.0.0.1":        false,
+		"::ffff:100.100.100.200": false,
+		"64:ff9b::a9fe:a9fe":     false,
+		"64:ff9b:1::1":           false,
+		"2001:db8::1":            false,
+		"2002:a00:1::1":          false,
+	} {
+		assert.Equal(t, public, isPublicIP(netip.MustParseAddr(addr)), addr)
+	}
+}
+
+func TestHTTPClientRefusesPrivateAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+
+	_, err := NewHTTPClient(false).Get(srv.URL)
+	assert.True(t, errors.Is(err, errPrivateAddress), "got %v", err)
+
+	resp, err := NewHTTPClient(true).Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
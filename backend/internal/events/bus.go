@@ -2,53 +2,130 @@ package events
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/robwittman/possessive-potato/backend/internal/config"
 	"github.com/rs/zerolog/log"
 )
 
-// Bus wraps Redis pub/sub for inter-service event delivery.
+// Publisher sends events to a channel. Bus publishes immediately; the outbox
+// writer defers publishing until the caller's transaction commits.
+type Publisher interface {
+	Publish(ctx context.Context, channel string, event Event) error
+}
+
+// Subscriber delivers events published to channels. Handlers are called from
+// a single goroutine per subscription, in publish order, with the channel
+// each event was published to.
+type Subscriber interface {
+	Subscribe(ctx context.Context, handler func(channel string, event Event), channels ...string) Subscription
+	PSubscribe(ctx context.Context, handler func(channel string, event Event), patterns ...string) Subscription
+}
+
+// PubSub publishes and subscribes.
+type PubSub interface {
+	Publisher
+	Subscriber
+}
+
+// Bus publishes and delivers events between services. It encodes events and
+// hands them to a Transport: Redis pub/sub by default, Redis Streams or NATS
+// JetStream when events must survive a subscriber briefly going away, or an
+// in-process transport for tests and single-binary deployments.
 type Bus struct {
-	redis *redis.Client
+	transport Transport
 }
 
+// NewBus returns a bus on Redis pub/sub.
 func NewBus(redisClient *redis.Client) *Bus {
-	return &Bus{redis: redisClient}
+	return &Bus{transport: NewPubSubTransport(redisClient)}
+}
+
+// NewBusFromConfig returns a bus on the transport selected by
+// cfg.EventTransport.
+func NewBusFromConfig(cfg *config.Config, redisClient *redis.Client) (*Bus, error) {
+	switch cfg.EventTransport {
+	case "", "pubsub":
+		return NewBus(redisClient), nil
+	case "streams":
+		return NewBusWithTransport(NewStreamTransport(redisClient, StreamOptions{
+			MaxLen: int64(cfg.EventStreamMaxLen),
+			Group:  cfg.EventConsumerGroup,
+		})), nil
+	case "nats":
+		t, err := NewNATSTransport(cfg.NATSURL, NATSOptions{
+			MaxMsgs: int64(cfg.EventStreamMaxLen),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return NewBusWithTransport(t), nil
+	case "memory":
+		return NewBusWithTransport(NewMemoryTransport()), nil
+	default:
+		return nil, fmt.Errorf("unknown event transport %q", cfg.EventTransport)
+	}
+}
+
+// NewBusWithTransport returns a bus on the given transport.
+func NewBusWithTransport(t Transport) *Bus {
+	return &Bus{transport: t}
+}
+
+// Transport returns the bus's transport, for transport-specific features
+// such as StreamTransport.Consume.
+func (b *Bus) Transport() Transport {
+	return b.transport
 }
 
 // Publish sends an event to a channel (e.g., "channel:123" or "server:456").
+// An event without a Key is given a new one, so consumers that see it more
+// than once can tell it apart from an identical event published again.
 func (b *Bus) Publish(ctx context.Context, channel string, event Event) error {
+	if event.Key == "" {
+		key := make([]byte, 16)
+		if _, err := rand.Read(key); err != nil {
+			return fmt.Errorf("generate event key: %w", err)
+		}
+		event.Key = hex.EncodeToString(key)
+	}
 	data, err := json.Marshal(event)
 	if err != nil {
 		return fmt.Errorf("marshal event: %w", err)
 	}
-	return b.redis.Publish(ctx, channel, data).Err()
-}
-
-// Subscribe listens for events on the given channels and delivers them to the handler.
-func (b *Bus) Subscribe(ctx context.Context, handler func(Event), channels ...string) {
-	sub := b.redis.Subscribe(ctx, channels...)
-	ch := sub.Channel()
-
-	go func() {
-		defer sub.Close()
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case msg, ok := <-ch:
-				if !ok {
-					return
-				}
-				var event Event
-				if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
-					log.Error().Err(err).Str("channel", msg.Channel).Msg("failed to unmarshal event")
-					continue
-				}
-				handler(event)
-			}
+	return b.transport.Publish(ctx, channel, data)
+}
+
+// Subscribe listens for events on the given channels and delivers them to
+// the handler with the channel they arrived on. Channels can be changed
+// later through the returned Subscription.
+func (b *Bus) Subscribe(ctx context.Context, handler func(channel string, event Event), channels ...string) Subscription {
+	return b.transport.Subscribe(ctx, decoding(handler), channels...)
+}
+
+// PSubscribe listens for events on every channel matching the given glob
+// patterns (e.g., "server:*") and delivers them with the channel they arrived on.
+func (b *Bus) PSubscribe(ctx context.Context, handler func(channel string, event Event), patterns ...string) Subscription {
+	return b.transport.PSubscribe(ctx, decoding(handler), patterns...)
+}
+
+func decoding(handler func(channel string, event Event)) func(string, []byte) {
+	return func(channel string, payload []byte) {
+		if event, ok := decode(channel, payload); ok {
+			handler(channel, event)
 		}
-	}()
+	}
+}
+
+func decode(channel string, payload []byte) (Event, bool) {
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		log.Error().Err(err).Str("channel", channel).Msg("failed to unmarshal event")
+		return event, false
+	}
+	return event, true
 }
@@ -0,0 +1,79 @@
+package events
+
+import (
+	"slices"
+	"strconv"
+)
+
+// CloseCode is the status code of the WebSocket close frame the gateway
+// sends when it ends a connection. Codes 4000-4999 are the gateway's own;
+// each says whether the client should RESUME its session or IDENTIFY anew.
+type CloseCode int
+
+const (
+	// CloseNormal ends a connection the client or server was done with.
+	CloseNormal CloseCode = 1000
+
+	// CloseUnknownError is sent when the gateway failed in a way it cannot
+	// describe. The client may resume.
+	CloseUnknownError CloseCode = 4000
+	// CloseSessionReplaced is sent to a connection whose session was resumed
+	// on another connection. The client should not reconnect.
+	CloseSessionReplaced CloseCode = 4001
+	// CloseSessionInvalidated is sent when the session's credentials were
+	// revoked. The session cannot be resumed.
+	CloseSessionInvalidated CloseCode = 4002
+	// CloseSlowConsumer is sent when the client fell too far behind reading
+	// events. The client may resume.
+	CloseSlowConsumer CloseCode = 4003
+	// CloseSessionTimedOut is sent when the client missed its heartbeat
+	// deadline. The client may resume.
+	CloseSessionTimedOut CloseCode = 4004
+	// CloseReconnect is sent when the gateway node is shutting down. The
+	// client should resume straight away, and will reach another node.
+	CloseReconnect CloseCode = 4005
+	// CloseDecodeError is sent when the client sent a handshake the gateway
+	// could not decode. The session was not started, so there is nothing to
+	// resume.
+	CloseDecodeError CloseCode = 4006
+)
+
+var closeCodeNames = map[CloseCode]string{
+	CloseNormal:             "normal closure",
+	CloseUnknownError:       "unknown error",
+	CloseSessionReplaced:    "session replaced",
+	CloseSessionInvalidated: "session invalidated",
+	CloseSlowConsumer:       "slow consumer",
+	CloseSessionTimedOut:    "session timed out",
+	CloseReconnect:          "reconnect",
+	CloseDecodeError:        "decode error",
+}
+
+// String returns the close reason sent with the code.
+func (c CloseCode) String() string {
+	if name, ok := closeCodeNames[c]; ok {
+		return name
+	}
+	return "close code " + strconv.Itoa(int(c))
+}
+
+// Resumable reports whether a client closed with c may resume its session.
+func (c CloseCode) Resumable() bool {
+	switch c {
+	case CloseSessionReplaced, CloseSessionInvalidated, CloseDecodeError:
+		return false
+	}
+	return true
+}
+
+// CloseCodes returns the gateway's own close codes in order.
+func CloseCodes() []CloseCode {
+	codes := make([]CloseCode, 0, len(closeCodeNames))
+	for c := range closeCodeNames {
+		if c >= 4000 {
+			codes = append(codes, c)
+		}
+	}
+	slices.Sort(codes)
+	return codes
+}
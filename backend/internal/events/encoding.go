@@ -0,0 +1,156 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Encoder is a wire format for gateway frames. Every format carries the same
+// document as JSON, so an Encoder only converts to and from JSON, and
+// Event's JSON methods remain the one definition of the payload schema.
+// Clients choose a format when they connect.
+type Encoder interface {
+	// Name is how clients ask for the format.
+	Name() string
+	// Binary reports whether frames are sent as binary WebSocket messages.
+	Binary() bool
+	// FromJSON converts a JSON document to the format.
+	FromJSON(data []byte) ([]byte, error)
+	// ToJSON converts a document in the format to JSON.
+	ToJSON(data []byte) ([]byte, error)
+}
+
+var (
+	JSON        Encoder = jsonEncoder{}
+	MessagePack Encoder = msgpackEncoder{}
+	CBOR        Encoder = cborEncoder{}
+)
+
+var encoders = map[string]Encoder{
+	JSON.Name():        JSON,
+	MessagePack.Name(): MessagePack,
+	CBOR.Name():        CBOR,
+}
+
+// LookupEncoder returns the encoder with the given name.
+func LookupEncoder(name string) (Encoder, bool) {
+	enc, ok := encoders[name]
+	return enc, ok
+}
+
+// Marshal encodes v, such as an Event, with enc.
+func Marshal(enc Encoder, v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return enc.FromJSON(data)
+}
+
+// Unmarshal decodes data written with enc into v.
+func Unmarshal(enc Encoder, data []byte, v any) error {
+	data, err := enc.ToJSON(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) Name() string                         { return "json" }
+func (jsonEncoder) Binary() bool                         { return false }
+func (jsonEncoder) FromJSON(data []byte) ([]byte, error) { return data, nil }
+func (jsonEncoder) ToJSON(data []byte) ([]byte, error)   { return data, nil }
+
+type msgpackEncoder struct{}
+
+func (msgpackEncoder) Name() string { return "msgpack" }
+func (msgpackEncoder) Binary() bool { return true }
+
+func (msgpackEncoder) FromJSON(data []byte) ([]byte, error) {
+	v, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	out, err := msgpack.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("encode msgpack: %w", err)
+	}
+	return out, nil
+}
+
+func (msgpackEncoder) ToJSON(data []byte) ([]byte, error) {
+	var v any
+	if err := msgpack.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("decode msgpack: %w", err)
+	}
+	return json.Marshal(v)
+}
+
+type cborEncoder struct{}
+
+// cborDecMode decodes maps with string keys, as JSON objects have.
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeFor[map[string]any](),
+}.DecMode()
+
+func (cborEncoder) Name() string { return "cbor" }
+func (cborEncoder) Binary() bool { return true }
+
+func (cborEncoder) FromJSON(data []byte) ([]byte, error) {
+	v, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	out, err := cbor.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("encode cbor: %w", err)
+	}
+	return out, nil
+}
+
+func (cborEncoder) ToJSON(data []byte) ([]byte, error) {
+	var v any
+	if err := cborDecMode.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("decode cbor: %w", err)
+	}
+	return json.Marshal(v)
+}
+
+// decodeJSON decodes a JSON document into plain values, keeping integers
+// as integers so binary formats encode them compactly and exactly.
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("decode json: %w", err)
+	}
+	return numbers(v), nil
+}
+
+func numbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for k, e := range v {
+			v[k] = numbers(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = numbers(e)
+		}
+	}
+	return v
+}
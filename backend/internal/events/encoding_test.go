@@ -0,0 +1,114 @@
+package events
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sample returns a *T for t with every field set, so that a round trip that
+// loses or changes any of them shows. IDs are snowflakes beyond float64's
+// exact range.
+func sample(t reflect.Type) any {
+	v := reflect.New(t)
+	fill(v.Elem(), 1)
+	return v.Interface()
+}
+
+func fill(v reflect.Value, depth int) {
+	switch {
+	case v.Type() == reflect.TypeFor[time.Time]():
+		v.Set(reflect.ValueOf(time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)))
+		return
+	case v.Type() == reflect.TypeFor[json.RawMessage]():
+		v.SetBytes([]byte(`{"id":9007199254740993,"name":"raw","score":1.5}`))
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		v.SetInt(int64(41 + depth))
+	case reflect.Int64:
+		v.SetInt(1<<60 + int64(depth))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(uint64(7 + depth))
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(0.5 + float64(depth))
+	case reflect.String:
+		v.SetString("héllo <wörld> 🎙")
+	case reflect.Pointer:
+		if depth > 3 {
+			return // leave recursive types' deeper levels nil
+		}
+		p := reflect.New(v.Type().Elem())
+		fill(p.Elem(), depth+1)
+		v.Set(p)
+	case reflect.Slice:
+		if depth > 3 {
+			return
+		}
+		s := reflect.MakeSlice(v.Type(), 2, 2)
+		for i := range 2 {
+			fill(s.Index(i), depth+1)
+		}
+		v.Set(s)
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		key := reflect.New(v.Type().Key()).Elem()
+		fill(key, depth+1)
+		elem := reflect.New(v.Type().Elem()).Elem()
+		fill(elem, depth+1)
+		m.SetMapIndex(key, elem)
+		v.Set(m)
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if v.Type().Field(i).IsExported() {
+				fill(v.Field(i), depth)
+			}
+		}
+	}
+}
+
+func TestEncodersRoundTripEveryPayload(t *testing.T) {
+	for _, eventType := range EventTypes() {
+		t.Run(eventType, func(t *testing.T) {
+			p, _ := Lookup(eventType)
+			event := Event{Type: eventType, Data: sample(p.Type), Seq: 1 << 62, Key: "key"}
+
+			data, err := Marshal(JSON, event)
+			require.NoError(t, err)
+			var want Event
+			require.NoError(t, Unmarshal(JSON, data, &want))
+			require.IsType(t, reflect.PointerTo(p.Type), reflect.TypeOf(want.Data))
+
+			for _, enc := range []Encoder{MessagePack, CBOR} {
+				encoded, err := Marshal(enc, event)
+				require.NoError(t, err, enc.Name())
+				var got Event
+				require.NoError(t, Unmarshal(enc, encoded, &got), enc.Name())
+				assert.Equal(t, want, got, enc.Name())
+
+				back, err := enc.ToJSON(encoded)
+				require.NoError(t, err, enc.Name())
+				assert.JSONEq(t, string(data), string(back), enc.Name())
+			}
+		})
+	}
+}
+
+func TestEncodersKeepIntegersExact(t *testing.T) {
+	doc := `{"big":9007199254740993,"neg":-9007199254740993,"float":1.5,"list":[1,2.25,"3"]}`
+	for _, enc := range []Encoder{JSON, MessagePack, CBOR} {
+		encoded, err := enc.FromJSON([]byte(doc))
+		require.NoError(t, err, enc.Name())
+		back, err := enc.ToJSON(encoded)
+		require.NoError(t, err, enc.Name())
+		assert.JSONEq(t, doc, string(back), enc.Name())
+	}
+}
@@ -0,0 +1,139 @@
+package events
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// memoryQueueSize is how many messages a memory subscription buffers before
+// Publish blocks.
+const memoryQueueSize = 1024
+
+// MemoryTransport delivers events within a single process. It suits tests and
+// single-binary deployments with no Redis or NATS. Like Redis pub/sub it is
+// fire-and-forget: nothing is retained for subscribers that come later.
+//
+// Each subscription has a buffered queue drained by its own goroutine.
+// Publish blocks while a matching subscriber's queue is full, so a handler
+// that publishes to its own subscription must not do so in a tight loop.
+type MemoryTransport struct {
+	mu   sync.RWMutex
+	subs map[*memorySub]struct{}
+}
+
+type memorySub struct {
+	t         *MemoryTransport
+	channels  map[string]bool
+	patterns  []string
+	isPattern bool
+	queue     chan memoryMessage
+	done      <-chan struct{}
+}
+
+type memoryMessage struct {
+	channel string
+	payload []byte
+}
+
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{subs: make(map[*memorySub]struct{})}
+}
+
+func (t *MemoryTransport) Publish(ctx context.Context, channel string, payload []byte) error {
+	t.mu.RLock()
+	var matched []*memorySub
+	for sub := range t.subs {
+		if sub.matches(channel) {
+			matched = append(matched, sub)
+		}
+	}
+	t.mu.RUnlock()
+
+	msg := memoryMessage{channel: channel, payload: slices.Clone(payload)}
+	for _, sub := range matched {
+		select {
+		case sub.queue <- msg:
+		case <-sub.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (t *MemoryTransport) Subscribe(ctx context.Context, handler func(channel string, payload []byte), channels ...string) Subscription {
+	sub := &memorySub{channels: make(map[string]bool, len(channels))}
+	for _, c := range channels {
+		sub.channels[c] = true
+	}
+	return t.add(ctx, sub, handler)
+}
+
+func (t *MemoryTransport) PSubscribe(ctx context.Context, handler func(channel string, payload []byte), patterns ...string) Subscription {
+	sub := &memorySub{patterns: slices.Clone(patterns), isPattern: true}
+	return t.add(ctx, sub, handler)
+}
+
+func (t *MemoryTransport) add(ctx context.Context, sub *memorySub, handler func(string, []byte)) *memorySub {
+	sub.t = t
+	sub.queue = make(chan memoryMessage, memoryQueueSize)
+	sub.done = ctx.Done()
+
+	t.mu.Lock()
+	t.subs[sub] = struct{}{}
+	t.mu.Unlock()
+
+	go func() {
+		defer func() {
+			t.mu.Lock()
+			delete(t.subs, sub)
+			t.mu.Unlock()
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-sub.queue:
+				handler(msg.channel, msg.payload)
+			}
+		}
+	}()
+	return sub
+}
+
+// matches must be called with the transport's lock held.
+func (s *memorySub) matches(channel string) bool {
+	if s.channels[channel] {
+		return true
+	}
+	return matchAny(s.patterns, channel)
+}
+
+func (s *memorySub) Add(ctx context.Context, topics ...string) error {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	for _, topic := range topics {
+		if s.isPattern {
+			if !slices.Contains(s.patterns, topic) {
+				s.patterns = append(s.patterns, topic)
+			}
+		} else {
+			s.channels[topic] = true
+		}
+	}
+	return nil
+}
+
+func (s *memorySub) Remove(ctx context.Context, topics ...string) error {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	for _, topic := range topics {
+		if s.isPattern {
+			s.patterns = slices.DeleteFunc(s.patterns, func(p string) bool { return p == topic })
+		} else {
+			delete(s.channels, topic)
+		}
+	}
+	return nil
+}
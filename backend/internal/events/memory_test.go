@@ -0,0 +1,93 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemorySubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tr := NewMemoryTransport()
+
+	handler, got := listen()
+	sub := tr.Subscribe(ctx, handler, "channel:1")
+	require.NoError(t, tr.Publish(ctx, "channel:1", []byte("one")))
+	require.NoError(t, tr.Publish(ctx, "channel:2", []byte("other")))
+	assert.Equal(t, delivery{"channel:1", "one"}, receive(t, got))
+
+	require.NoError(t, sub.Add(ctx, "channel:2", "channel:3"))
+	require.NoError(t, sub.Remove(ctx, "channel:1", "channel:3"))
+	require.NoError(t, tr.Publish(ctx, "channel:1", []byte("dropped")))
+	require.NoError(t, tr.Publish(ctx, "channel:3", []byte("dropped")))
+	require.NoError(t, tr.Publish(ctx, "channel:2", []byte("two")))
+	assert.Equal(t, delivery{"channel:2", "two"}, receive(t, got))
+	nothing(t, got)
+}
+
+func TestMemoryPSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tr := NewMemoryTransport()
+
+	handler, got := listen()
+	sub := tr.PSubscribe(ctx, handler, "server:*")
+	require.NoError(t, tr.Publish(ctx, "server:1", []byte("one")))
+	require.NoError(t, tr.Publish(ctx, "user:1", []byte("other")))
+	assert.Equal(t, delivery{"server:1", "one"}, receive(t, got))
+
+	require.NoError(t, sub.Add(ctx, "user:*", "user:*"))
+	require.NoError(t, sub.Remove(ctx, "server:*"))
+	require.NoError(t, tr.Publish(ctx, "server:1", []byte("dropped")))
+	require.NoError(t, tr.Publish(ctx, "user:2", []byte("two")))
+	assert.Equal(t, delivery{"user:2", "two"}, receive(t, got))
+	nothing(t, got)
+
+	// Both copies of the pattern are removed.
+	require.NoError(t, sub.Remove(ctx, "user:*"))
+	require.NoError(t, tr.Publish(ctx, "user:2", []byte("dropped")))
+	nothing(t, got)
+}
+
+func TestMemorySubscriptionEndsWithContext(t *testing.T) {
+	ctx := context.Background()
+	tr := NewMemoryTransport()
+
+	subCtx, cancel := context.WithCancel(ctx)
+	handler, got := listen()
+	tr.Subscribe(subCtx, handler, "channel:1")
+	cancel()
+	assert.Eventually(t, func() bool {
+		tr.mu.RLock()
+		defer tr.mu.RUnlock()
+		return len(tr.subs) == 0
+	}, time.Second, time.Millisecond)
+
+	require.NoError(t, tr.Publish(ctx, "channel:1", []byte("dropped")))
+	nothing(t, got)
+}
+
+func TestMemoryPublishDoesNotBlockOnClosedSubscription(t *testing.T) {
+	ctx := context.Background()
+	tr := NewMemoryTransport()
+
+	// A handler that never returns fills the queue.
+	block := make(chan struct{})
+	defer close(block)
+	subCtx, cancel := context.WithCancel(ctx)
+	tr.Subscribe(subCtx, func(string, []byte) { <-block }, "channel:1")
+	for range memoryQueueSize + 1 {
+		require.NoError(t, tr.Publish(ctx, "channel:1", nil))
+	}
+
+	publishCtx, stop := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer stop()
+	assert.ErrorIs(t, tr.Publish(publishCtx, "channel:1", nil), context.DeadlineExceeded)
+
+	cancel()
+	assert.NoError(t, tr.Publish(ctx, "channel:1", nil))
+}
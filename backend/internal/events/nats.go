@@ -0,0 +1,420 @@
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// natsChannelHeader carries the bus channel an event was published to.
+	// Subjects are derived from channels but cannot always be mapped back.
+	natsChannelHeader = "Potato-Channel"
+	natsSetupTimeout  = 10 * time.Second
+	natsRetryWait     = time.Second
+)
+
+// NATSOptions configures a NATSTransport. Zero values get defaults.
+type NATSOptions struct {
+	// Stream is the JetStream stream events are stored in.
+	Stream string
+	// SubjectPrefix is prepended to every subject; the stream captures
+	// SubjectPrefix + ".>".
+	SubjectPrefix string
+	// MaxMsgs and MaxAge bound retention. A subscriber that loses its consumer
+	// resumes from the last event it saw only while that event is retained.
+	MaxMsgs int64
+	MaxAge  time.Duration
+	// InactiveThreshold is how long the server keeps a subscription's
+	// consumer after its process stops pulling from it.
+	InactiveThreshold time.Duration
+}
+
+func (o *NATSOptions) setDefaults() {
+	if o.Stream == "" {
+		o.Stream = "EVENTS"
+	}
+	if o.SubjectPrefix == "" {
+		o.SubjectPrefix = "events"
+	}
+	if o.MaxMsgs <= 0 {
+		o.MaxMsgs = 100_000
+	}
+	if o.MaxAge <= 0 {
+		o.MaxAge = 24 * time.Hour
+	}
+	if o.InactiveThreshold <= 0 {
+		o.InactiveThreshold = time.Minute
+	}
+}
+
+// NATSTransport carries events on a NATS JetStream stream. A channel such as
+// "channel:123" is published on the subject "events.channel.123", so the
+// server filters events for each subscription.
+//
+// Every subscription has its own consumer, created from the point it
+// subscribes. If the consumer is lost, for example because the server
+// removed it while the process was disconnected, it is recreated from the
+// last event the subscription saw, so nothing still retained is missed.
+type NATSTransport struct {
+	nc   *nats.Conn
+	js   jetstream.JetStream
+	opts NATSOptions
+}
+
+// NewNATSTransport connects to url and creates or updates the stream.
+func NewNATSTransport(url string, opts NATSOptions) (*NATSTransport, error) {
+	opts.setDefaults()
+
+	nc, err := nats.Connect(url, nats.Name("possessive-potato"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("connect to nats: %w", err)
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("open jetstream: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), natsSetupTimeout)
+	defer cancel()
+	_, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     opts.Stream,
+		Subjects: []string{opts.SubjectPrefix + ".>"},
+		MaxMsgs:  opts.MaxMsgs,
+		MaxAge:   opts.MaxAge,
+		Discard:  jetstream.DiscardOld,
+		Storage:  jetstream.FileStorage,
+	})
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("create event stream: %w", err)
+	}
+
+	return &NATSTransport{nc: nc, js: js, opts: opts}, nil
+}
+
+// Publish stores the event in the stream, waiting for the server to
+// acknowledge it.
+func (t *NATSTransport) Publish(ctx context.Context, channel string, payload []byte) error {
+	msg := nats.NewMsg(t.subject(channel))
+	msg.Header.Set(natsChannelHeader, channel)
+	msg.Data = payload
+	if _, err := t.js.PublishMsg(ctx, msg); err != nil {
+		return fmt.Errorf("publish to nats: %w", err)
+	}
+	return nil
+}
+
+func (t *NATSTransport) Subscribe(ctx context.Context, handler func(channel string, payload []byte), channels ...string) Subscription {
+	sub := &natsSub{t: t, name: natsConsumerName(), handler: handler, channels: make(map[string]bool, len(channels))}
+	for _, c := range channels {
+		sub.channels[c] = true
+	}
+	go sub.run(ctx)
+	return sub
+}
+
+func (t *NATSTransport) PSubscribe(ctx context.Context, handler func(channel string, payload []byte), patterns ...string) Subscription {
+	sub := &natsSub{t: t, name: natsConsumerName(), handler: handler, patterns: slices.Clone(patterns), isPattern: true}
+	go sub.run(ctx)
+	return sub
+}
+
+// Close drains the connection, letting in-flight handlers finish.
+func (t *NATSTransport) Close() error {
+	return t.nc.Drain()
+}
+
+// subject maps a channel to a subject, one token per ":"-separated part.
+func (t *NATSTransport) subject(channel string) string {
+	parts := strings.Split(channel, ":")
+	for i, p := range parts {
+		parts[i] = subjectToken(p)
+	}
+	return t.opts.SubjectPrefix + "." + strings.Join(parts, ".")
+}
+
+// filter maps a glob pattern to a subject filter. A "*" part becomes a "*"
+// token; a pattern with any other glob syntax filters on every subject and
+// relies on matching locally.
+func (t *NATSTransport) filter(pattern string) string {
+	parts := strings.Split(pattern, ":")
+	for i, p := range parts {
+		switch {
+		case p == "*":
+		case strings.ContainsAny(p, `*?[\`):
+			return t.opts.SubjectPrefix + ".>"
+		default:
+			parts[i] = subjectToken(p)
+		}
+	}
+	return t.opts.SubjectPrefix + "." + strings.Join(parts, ".")
+}
+
+// subjectToken replaces characters that are not allowed in a subject token.
+// Collisions only widen the server-side filter; channels are still matched
+// exactly on delivery.
+func subjectToken(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func natsConsumerName() string {
+	return "sub_" + rand.Text()
+}
+
+// natsSub is a subscription backed by its own JetStream consumer.
+type natsSub struct {
+	t         *NATSTransport
+	handler   func(channel string, payload []byte)
+	isPattern bool
+	name      string
+
+	mu       sync.Mutex
+	channels map[string]bool
+	patterns []string
+	// added holds the last stream sequence before each topic was added to
+	// the running consumer. Changing the consumer's filters does not move
+	// it past events published before, so they are dropped here.
+	added    map[string]uint64
+	consumer jetstream.Consumer // nil until created
+	lastSeq  uint64
+	startSeq uint64 // where the current consumer started, or 0 for new events
+	lost     chan struct{}
+}
+
+func (s *natsSub) run(ctx context.Context) {
+	for {
+		cc, err := s.start(ctx)
+		if err == nil {
+			select {
+			case <-ctx.Done():
+				cc.Stop()
+				s.delete()
+				return
+			case <-s.lost:
+				cc.Stop()
+				log.Warn().Str("consumer", s.name).Msg("nats consumer lost, recreating")
+			}
+		} else if ctx.Err() == nil {
+			log.Warn().Err(err).Str("consumer", s.name).Msg("failed to start nats consumer, retrying")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(natsRetryWait):
+		}
+	}
+}
+
+// start creates the consumer, from just after the last event seen if it
+// is being recreated, and starts consuming.
+func (s *natsSub) start(ctx context.Context) (jetstream.ConsumeContext, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.startSeq = 0
+	if s.lastSeq > 0 {
+		s.startSeq = s.lastSeq + 1
+	}
+	cfg := s.config()
+	setupCtx, cancel := context.WithTimeout(ctx, natsSetupTimeout)
+	defer cancel()
+	consumer, err := s.t.js.CreateOrUpdateConsumer(setupCtx, s.t.opts.Stream, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("create nats consumer: %w", err)
+	}
+
+	lost := make(chan struct{})
+	var once sync.Once
+	cc, err := consumer.Consume(s.receive, jetstream.ConsumeErrHandler(func(_ jetstream.ConsumeContext, err error) {
+		if errors.Is(err, jetstream.ErrConsumerDeleted) || errors.Is(err, jetstream.ErrConsumerNotFound) {
+			once.Do(func() { close(lost) })
+		}
+	}))
+	if err != nil {
+		return nil, fmt.Errorf("consume from nats: %w", err)
+	}
+	s.consumer = consumer
+	s.lost = lost
+	return cc, nil
+}
+
+func (s *natsSub) receive(msg jetstream.Msg) {
+	channel := msg.Headers().Get(natsChannelHeader)
+
+	s.mu.Lock()
+	var seq uint64
+	if meta, err := msg.Metadata(); err == nil {
+		seq = meta.Sequence.Stream
+		s.lastSeq = seq
+	}
+	matched := s.matches(channel, seq)
+	s.mu.Unlock()
+
+	if matched {
+		s.handler(channel, msg.Data())
+	}
+	if err := msg.Ack(); err != nil {
+		log.Debug().Err(err).Str("channel", channel).Msg("failed to ack nats message")
+	}
+}
+
+// matches reports whether the event at stream sequence seq is for the
+// subscription. It must be called with s.mu held.
+func (s *natsSub) matches(channel string, seq uint64) bool {
+	if s.channels[channel] && seq > s.added[channel] {
+		return true
+	}
+	for _, p := range s.patterns {
+		if ok, _ := path.Match(p, channel); ok && seq > s.added[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// config must be called with s.mu held.
+func (s *natsSub) config() jetstream.ConsumerConfig {
+	cfg := jetstream.ConsumerConfig{
+		Name:              s.name,
+		DeliverPolicy:     jetstream.DeliverNewPolicy,
+		AckPolicy:         jetstream.AckExplicitPolicy,
+		FilterSubjects:    s.filters(),
+		InactiveThreshold: s.t.opts.InactiveThreshold,
+	}
+	if s.startSeq > 0 {
+		cfg.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+		cfg.OptStartSeq = s.startSeq
+	}
+	return cfg
+}
+
+// filters returns the consumer's subject filters. JetStream rejects
+// overlapping filters, so overlapping patterns fall back to every subject.
+func (s *natsSub) filters() []string {
+	var filters []string
+	if s.isPattern {
+		for _, p := range s.patterns {
+			filters = append(filters, s.t.filter(p))
+		}
+	} else {
+		for c := range s.channels {
+			filters = append(filters, s.t.subject(c))
+		}
+	}
+	slices.Sort(filters)
+	filters = slices.Compact(filters)
+
+	if len(filters) == 0 {
+		// An empty filter means every subject; filter on one nothing is
+		// published to instead.
+		return []string{s.t.opts.SubjectPrefix + "._none"}
+	}
+	for i := range filters {
+		for j := i + 1; j < len(filters); j++ {
+			if subjectsOverlap(filters[i], filters[j]) {
+				return []string{s.t.opts.SubjectPrefix + ".>"}
+			}
+		}
+	}
+	return filters
+}
+
+func (s *natsSub) Add(ctx context.Context, topics ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var last uint64
+	if s.consumer != nil {
+		stream, err := s.t.js.Stream(ctx, s.t.opts.Stream)
+		if err != nil {
+			return fmt.Errorf("get nats stream: %w", err)
+		}
+		last = stream.CachedInfo().State.LastSeq
+	}
+	for _, topic := range topics {
+		if last > 0 && !s.channels[topic] && !slices.Contains(s.patterns, topic) {
+			if s.added == nil {
+				s.added = make(map[string]uint64)
+			}
+			s.added[topic] = last
+		}
+		if s.isPattern {
+			if !slices.Contains(s.patterns, topic) {
+				s.patterns = append(s.patterns, topic)
+			}
+		} else {
+			s.channels[topic] = true
+		}
+	}
+	return s.update(ctx)
+}
+
+func (s *natsSub) Remove(ctx context.Context, topics ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, topic := range topics {
+		delete(s.added, topic)
+		if s.isPattern {
+			s.patterns = slices.DeleteFunc(s.patterns, func(p string) bool { return p == topic })
+		} else {
+			delete(s.channels, topic)
+		}
+	}
+	return s.update(ctx)
+}
+
+// update applies the current filters to the consumer. Before the consumer
+// exists there is nothing to update; it is created with them. It must be
+// called with s.mu held.
+func (s *natsSub) update(ctx context.Context) error {
+	if s.consumer == nil {
+		return nil
+	}
+	if _, err := s.t.js.UpdateConsumer(ctx, s.t.opts.Stream, s.config()); err != nil {
+		return fmt.Errorf("update nats consumer: %w", err)
+	}
+	return nil
+}
+
+func (s *natsSub) delete() {
+	ctx, cancel := context.WithTimeout(context.Background(), natsSetupTimeout)
+	defer cancel()
+	if err := s.t.js.DeleteConsumer(ctx, s.t.opts.Stream, s.name); err != nil && !errors.Is(err, jetstream.ErrConsumerNotFound) {
+		log.Debug().Err(err).Str("consumer", s.name).Msg("failed to delete nats consumer")
+	}
+}
+
+// subjectsOverlap reports whether some subject matches both filters.
+func subjectsOverlap(a, b string) bool {
+	at, bt := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(at) && i < len(bt); i++ {
+		if at[i] == ">" || bt[i] == ">" {
+			return true
+		}
+		if at[i] != bt[i] && at[i] != "*" && bt[i] != "*" {
+			return false
+		}
+	}
+	return len(at) == len(bt)
+}
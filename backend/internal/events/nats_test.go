@@ -0,0 +1,159 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runNATS starts an in-process nats-server with JetStream, storing to a
+// temporary directory.
+func runNATS(t *testing.T) string {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	require.NoError(t, err)
+	go ns.Start()
+	t.Cleanup(ns.Shutdown)
+	require.True(t, ns.ReadyForConnections(5*time.Second), "nats-server did not start")
+	return ns.ClientURL()
+}
+
+func newTestNATS(t *testing.T, url string) *NATSTransport {
+	t.Helper()
+	tr, err := NewNATSTransport(url, NATSOptions{})
+	require.NoError(t, err)
+	t.Cleanup(func() { tr.Close() })
+	return tr
+}
+
+// consumerReady waits for a subscription's consumer to exist, since events
+// published before then are not delivered to it.
+func consumerReady(t *testing.T, sub Subscription) {
+	t.Helper()
+	s := sub.(*natsSub)
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.consumer != nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNATSSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tr := newTestNATS(t, runNATS(t))
+
+	handler, got := listen()
+	sub := tr.Subscribe(ctx, handler, "channel:1")
+	consumerReady(t, sub)
+
+	require.NoError(t, tr.Publish(ctx, "channel:1", []byte("one")))
+	require.NoError(t, tr.Publish(ctx, "channel:2", []byte("other")))
+	assert.Equal(t, delivery{"channel:1", "one"}, receive(t, got))
+	nothing(t, got)
+
+	require.NoError(t, sub.Add(ctx, "channel:2"))
+	require.NoError(t, sub.Remove(ctx, "channel:1"))
+	require.NoError(t, tr.Publish(ctx, "channel:1", []byte("dropped")))
+	require.NoError(t, tr.Publish(ctx, "channel:2", []byte("two")))
+	assert.Equal(t, delivery{"channel:2", "two"}, receive(t, got))
+	nothing(t, got)
+}
+
+func TestNATSPSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tr := newTestNATS(t, runNATS(t))
+
+	handler, got := listen()
+	sub := tr.PSubscribe(ctx, handler, "server:*")
+	consumerReady(t, sub)
+
+	require.NoError(t, tr.Publish(ctx, "server:1", []byte("one")))
+	require.NoError(t, tr.Publish(ctx, "user:1", []byte("other")))
+	assert.Equal(t, delivery{"server:1", "one"}, receive(t, got))
+	nothing(t, got)
+
+	// Overlapping and non-token patterns widen the filter and are matched
+	// locally.
+	require.NoError(t, sub.Add(ctx, "server:1", "us?r:*"))
+	require.NoError(t, tr.Publish(ctx, "user:2", []byte("two")))
+	require.NoError(t, tr.Publish(ctx, "channel:2", []byte("dropped")))
+	assert.Equal(t, delivery{"user:2", "two"}, receive(t, got))
+	nothing(t, got)
+}
+
+func TestNATSSubscriptionsAreDurable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	url := runNATS(t)
+	tr := newTestNATS(t, url)
+	publisher := newTestNATS(t, url)
+
+	handler, got := listen()
+	sub := tr.Subscribe(ctx, handler, "channel:1")
+	consumerReady(t, sub)
+	require.NoError(t, publisher.Publish(ctx, "channel:1", []byte("one")))
+	assert.Equal(t, delivery{"channel:1", "one"}, receive(t, got))
+
+	// The server drops the consumer, as it does after InactiveThreshold
+	// while the process is disconnected. Events published meanwhile are
+	// delivered once the consumer is recreated, and "one" is not repeated.
+	name := sub.(*natsSub).name
+	require.NoError(t, tr.js.DeleteConsumer(ctx, tr.opts.Stream, name))
+	require.NoError(t, publisher.Publish(ctx, "channel:1", []byte("two")))
+	require.NoError(t, publisher.Publish(ctx, "channel:1", []byte("three")))
+
+	assert.Equal(t, delivery{"channel:1", "two"}, receive(t, got))
+	assert.Equal(t, delivery{"channel:1", "three"}, receive(t, got))
+	nothing(t, got)
+}
+
+func TestNATSSubscriptionDeletesConsumer(t *testing.T) {
+	ctx := context.Background()
+	tr := newTestNATS(t, runNATS(t))
+
+	subCtx, cancel := context.WithCancel(ctx)
+	handler, _ := listen()
+	sub := tr.Subscribe(subCtx, handler, "channel:1")
+	consumerReady(t, sub)
+	cancel()
+
+	assert.Eventually(t, func() bool {
+		_, err := tr.js.Consumer(ctx, tr.opts.Stream, sub.(*natsSub).name)
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNATSSubjects(t *testing.T) {
+	tr := &NATSTransport{opts: NATSOptions{SubjectPrefix: "events"}}
+	assert.Equal(t, "events.channel.123", tr.subject("channel:123"))
+	assert.Equal(t, "events.a_b._.c_d", tr.subject("a.b::c*d"))
+
+	assert.Equal(t, "events.server.*", tr.filter("server:*"))
+	assert.Equal(t, "events.user.1", tr.filter("user:1"))
+	assert.Equal(t, "events.>", tr.filter("us?r:*"))
+
+	assert.True(t, subjectsOverlap("events.server.*", "events.server.1"))
+	assert.True(t, subjectsOverlap("events.>", "events.user.1"))
+	assert.False(t, subjectsOverlap("events.server.*", "events.user.1"))
+	assert.False(t, subjectsOverlap("events.server.*", "events.server.1.x"))
+
+	s := &natsSub{t: tr, channels: map[string]bool{}}
+	assert.Equal(t, []string{"events._none"}, s.filters())
+	s.channels["user:2"], s.channels["user:1"] = true, true
+	assert.Equal(t, []string{"events.user.1", "events.user.2"}, s.filters())
+	s = &natsSub{t: tr, isPattern: true, patterns: []string{"server:*", "server:1"}}
+	assert.Equal(t, []string{"events.>"}, s.filters())
+}
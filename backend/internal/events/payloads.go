@@ -0,0 +1,164 @@
+package events
+
+import (
+	"time"
+
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+)
+
+// Payloads for events that do not carry a model directly. Event types and
+// their payloads are paired in registry.go.
+
+type MessageDeletePayload struct {
+	ID        int64 `json:"id,string"`
+	ChannelID int64 `json:"channel_id,string"`
+}
+
+type TypingStartPayload struct {
+	ChannelID int64 `json:"channel_id,string"`
+	UserID    int64 `json:"user_id,string"`
+	// Nickname is the user's nickname in the channel's server, if they have
+	// one.
+	Nickname  *string   `json:"nickname"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type ServerDeletePayload struct {
+	ID int64 `json:"id,string"`
+}
+
+type ServerMemberAddPayload struct {
+	ServerID    int64     `json:"server_id,string"`
+	UserID      int64     `json:"user_id,string"`
+	Username    string    `json:"username"`
+	DisplayName string    `json:"display_name"`
+	AvatarURL   *string   `json:"avatar_url"`
+	Nickname    *string   `json:"nickname"`
+	Bot         bool      `json:"bot"`
+	JoinedAt    time.Time `json:"joined_at"`
+}
+
+// ServerMemberUpdatePayload is a member's changed nickname or roles.
+type ServerMemberUpdatePayload struct {
+	ServerID int64    `json:"server_id,string"`
+	UserID   int64    `json:"user_id,string"`
+	Nickname *string  `json:"nickname"`
+	RoleIDs  []string `json:"role_ids"` // snowflake strings
+}
+
+type ServerMemberRemovePayload struct {
+	ServerID int64 `json:"server_id,string"`
+	UserID   int64 `json:"user_id,string"`
+}
+
+type RoleDeletePayload struct {
+	ID       int64 `json:"id,string"`
+	ServerID int64 `json:"server_id,string"`
+}
+
+// VoiceStatePayload is a user's voice connection. ChannelID is nil once the
+// user has left voice.
+type VoiceStatePayload struct {
+	model.VoiceState
+}
+
+// VoiceServerInfoPayload is WebRTC signaling from the voice server to one of
+// the user's sessions. Type is "ready" once the session has joined, with the
+// ICE servers to create its peer connection with, then "answer" to its offer,
+// "offer" when tracks are added or removed, or "candidate". Endpoint is the
+// node hosting the channel's media.
+type VoiceServerInfoPayload struct {
+	ChannelID  int64         `json:"channel_id,string"`
+	SessionID  string        `json:"session_id"`
+	Endpoint   string        `json:"endpoint"`
+	Type       string        `json:"type"`
+	SDP        string        `json:"sdp,omitempty"`
+	Candidate  *ICECandidate `json:"candidate,omitempty"`
+	ICEServers []string      `json:"ice_servers,omitempty"`
+}
+
+// VoiceSignalPayload is WebRTC signaling from a client: "offer", "answer",
+// "candidate", or "layer" to choose which layer of another user's video it
+// receives. Offers map the mid of each track the client sends to its source,
+// "microphone", "camera" or "screen". Clients send it as the VOICE_SIGNAL op
+// without UserID and SessionID, which the gateway fills in.
+type VoiceSignalPayload struct {
+	ChannelID int64             `json:"channel_id,string"`
+	UserID    int64             `json:"user_id,string"`
+	SessionID string            `json:"session_id"`
+	Type      string            `json:"type"`
+	SDP       string            `json:"sdp,omitempty"`
+	Candidate *ICECandidate     `json:"candidate,omitempty"`
+	Tracks    map[string]string `json:"tracks,omitempty"`
+	Layer     *VideoLayer       `json:"layer,omitempty"`
+}
+
+// VideoLayer chooses the simulcast layer of a user's camera or screen share
+// that a client receives: the layer with RID if it is sent, otherwise the
+// best layer within MaxBitrate bits per second, or the best of all if it is
+// zero.
+type VideoLayer struct {
+	UserID     int64  `json:"user_id,string"`
+	Source     string `json:"source"`
+	RID        string `json:"rid,omitempty"`
+	MaxBitrate int    `json:"max_bitrate,omitempty"`
+}
+
+// ICECandidate is an RTCIceCandidateInit.
+type ICECandidate struct {
+	Candidate        string  `json:"candidate"`
+	SDPMid           *string `json:"sdp_mid"`
+	SDPMLineIndex    *uint16 `json:"sdp_mline_index"`
+	UsernameFragment *string `json:"username_fragment"`
+}
+
+// PresenceUpdatePayload is a user's status as shown to the recipient:
+// others see invisible users as offline.
+type PresenceUpdatePayload struct {
+	UserID int64 `json:"user_id,string"`
+	model.Presence
+}
+
+// InteractionDeferredPayload tells clients an application is working on its
+// response to an interaction.
+type InteractionDeferredPayload struct {
+	InteractionID int64 `json:"interaction_id,string"`
+	ApplicationID int64 `json:"application_id,string"`
+	ChannelID     int64 `json:"channel_id,string"`
+	UserID        int64 `json:"user_id,string"`
+}
+
+// HelloPayload is the first frame on every gateway connection.
+// HeartbeatInterval is how often, in milliseconds, the client must send
+// HEARTBEAT; a client that misses one is disconnected.
+type HelloPayload struct {
+	HeartbeatInterval int64 `json:"heartbeat_interval"`
+}
+
+type HeartbeatAckPayload struct{}
+
+// ReconnectPayload tells the client the node is shutting down. The
+// connection is closed with CloseReconnect, and the client should resume on
+// another node.
+type ReconnectPayload struct{}
+
+type ReadyPayload struct {
+	SessionID string `json:"session_id"`
+	UserID    int64  `json:"user_id,string"`
+}
+
+type ResumedPayload struct{}
+
+// InvalidSessionPayload tells the client its session cannot be resumed. The
+// client has been given a new session and must re-fetch any state it shows.
+type InvalidSessionPayload struct {
+	Resumable bool `json:"resumable"`
+}
+
+// SessionInvalidatePayload closes a user's gateway sessions, for example
+// after their credentials were revoked. TokenID is the revoked API token,
+// if that was the cause. If SessionID is set, only that session is closed.
+type SessionInvalidatePayload struct {
+	TokenID   *int64 `json:"token_id,string,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+}
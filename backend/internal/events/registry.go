@@ -0,0 +1,150 @@
+package events
+
+//go:generate go run ../../cmd/eventgen -out ../../../frontend/src/types/events.gen.ts
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+)
+
+// Changing a payload here or in payloads.go changes the client contract:
+// run go generate to update the TypeScript definitions.
+
+// Payload describes the payload of one event type. Version starts at 1 and is
+// bumped whenever the payload changes incompatibly; an upgrade registered
+// from the previous version rewrites payloads still encoded the old way, so
+// consumers only ever see the current shape.
+type Payload struct {
+	Version int
+	Type    reflect.Type
+
+	upgrades map[int]Upgrade
+}
+
+// Upgrade rewrites an encoded payload from one version to the next.
+type Upgrade func(data json.RawMessage) (json.RawMessage, error)
+
+var registry = make(map[string]*Payload)
+
+func init() {
+	register[model.Message](MessageCreate, 1)
+	register[model.Message](MessageUpdate, 1)
+	register[MessageDeletePayload](MessageDelete, 1)
+
+	register[TypingStartPayload](TypingStart, 1)
+
+	register[model.Channel](ChannelCreate, 1)
+	register[model.Channel](ChannelUpdate, 1)
+	register[model.Channel](ChannelDelete, 1)
+
+	register[model.Server](ServerCreate, 1)
+	register[model.Server](ServerUpdate, 1)
+	register[ServerDeletePayload](ServerDelete, 1)
+	register[ServerMemberAddPayload](ServerMemberAdd, 1)
+	register[ServerMemberUpdatePayload](ServerMemberUpdate, 1)
+	register[ServerMemberRemovePayload](ServerMemberRemove, 1)
+
+	register[model.Role](RoleCreate, 1)
+	register[model.Role](RoleUpdate, 1)
+	register[RoleDeletePayload](RoleDelete, 1)
+
+	register[model.Thread](ThreadCreate, 1)
+	register[model.Thread](ThreadUpdate, 1)
+
+	register[VoiceStatePayload](VoiceStateUpdate, 1)
+	register[VoiceServerInfoPayload](VoiceServerInfo, 1)
+	register[VoiceSignalPayload](VoiceSignal, 1)
+
+	register[PresenceUpdatePayload](PresenceUpdate, 1)
+
+	register[model.Interaction](InteractionCreate, 1)
+	register[InteractionDeferredPayload](InteractionDeferred, 1)
+
+	register[HelloPayload](Hello, 1)
+	register[HeartbeatAckPayload](HeartbeatAck, 1)
+	register[ReconnectPayload](Reconnect, 1)
+	register[ReadyPayload](Ready, 1)
+	register[ResumedPayload](Resumed, 1)
+	register[InvalidSessionPayload](InvalidSession, 1)
+	register[SessionInvalidatePayload](SessionInvalidate, 1)
+}
+
+// register pairs an event type with its payload T at version. upgrades[i]
+// rewrites a payload from version i+1 to i+2, so there is one fewer upgrade
+// than the version number.
+func register[T any](eventType string, version int, upgrades ...Upgrade) {
+	if _, ok := registry[eventType]; ok {
+		panic("events: payload registered twice for " + eventType)
+	}
+	if len(upgrades) != version-1 {
+		panic(fmt.Sprintf("events: %s version %d needs %d upgrades", eventType, version, version-1))
+	}
+	p := &Payload{
+		Version:  version,
+		Type:     reflect.TypeFor[T](),
+		upgrades: make(map[int]Upgrade, len(upgrades)),
+	}
+	for i, fn := range upgrades {
+		p.upgrades[i+1] = fn
+	}
+	registry[eventType] = p
+}
+
+// Lookup returns the payload registered for an event type.
+func Lookup(eventType string) (*Payload, bool) {
+	p, ok := registry[eventType]
+	return p, ok
+}
+
+// EventTypes returns every registered event type, sorted.
+func EventTypes() []string {
+	types := make([]string, 0, len(registry))
+	for t := range registry {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// check reports an error if data is not the payload registered for the event
+// type, or a pointer to it. Unregistered event types accept any payload.
+func (p *Payload) check(eventType string, data interface{}) error {
+	t := reflect.TypeOf(data)
+	if t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t != p.Type {
+		return fmt.Errorf("event %s: payload is %T, want %s", eventType, data, p.Type)
+	}
+	return nil
+}
+
+// decode upgrades data from version to the current version and decodes it
+// into a new *T for the registered T.
+func (p *Payload) decode(eventType string, version int, data json.RawMessage) (interface{}, error) {
+	// Events from before payloads were versioned are version 1.
+	version = max(version, 1)
+	for ; version < p.Version; version++ {
+		upgrade, ok := p.upgrades[version]
+		if !ok {
+			return nil, fmt.Errorf("event %s: no upgrade from payload version %d", eventType, version)
+		}
+		var err error
+		if data, err = upgrade(data); err != nil {
+			return nil, fmt.Errorf("event %s: upgrade payload from version %d: %w", eventType, version, err)
+		}
+	}
+
+	v := reflect.New(p.Type)
+	if len(data) > 0 && !slices.Equal(data, []byte("null")) {
+		if err := json.Unmarshal(data, v.Interface()); err != nil {
+			return nil, fmt.Errorf("event %s: decode payload: %w", eventType, err)
+		}
+	}
+	return v.Interface(), nil
+}
@@ -0,0 +1,401 @@
+package events
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	streamReadCount = 100
+	streamReadBlock = 5 * time.Second
+	streamRetryWait = time.Second
+)
+
+// StreamOptions configures a StreamTransport. Zero values get defaults.
+type StreamOptions struct {
+	// Stream is the Redis key all events are appended to.
+	Stream string
+	// MaxLen bounds retention: the stream is trimmed to roughly this many
+	// entries. A subscriber away for longer than it takes to publish MaxLen
+	// events misses the oldest ones.
+	MaxLen int64
+	// Group is this process's consumer group. Every process needs its own
+	// group to see every event; keeping the name stable across restarts lets
+	// a restarted process continue where it left off.
+	Group string
+	// ClaimIdle is how long a Consume entry may go unacknowledged before
+	// another consumer retries it.
+	ClaimIdle time.Duration
+}
+
+func (o *StreamOptions) setDefaults() {
+	if o.Stream == "" {
+		o.Stream = "events"
+	}
+	if o.MaxLen <= 0 {
+		o.MaxLen = 100_000
+	}
+	if o.Group == "" {
+		host, _ := os.Hostname()
+		o.Group = "node:" + host
+	}
+	if o.ClaimIdle <= 0 {
+		o.ClaimIdle = 30 * time.Second
+	}
+}
+
+// StreamTransport carries events on a single Redis stream. Each entry records
+// the channel it was published to, and subscribers filter locally, so
+// publishing to many channels costs no more than publishing to one.
+//
+// Subscribe and PSubscribe share one reader per process, reading through the
+// process's consumer group. An entry is acknowledged once every matching
+// handler has returned, so events published while the process is restarting
+// or disconnected from Redis are delivered when it comes back, as long as
+// they are still retained. Handlers run on the reader goroutine and should
+// not block for long.
+type StreamTransport struct {
+	redis *redis.Client
+	opts  StreamOptions
+
+	mu      sync.Mutex
+	subs    map[*streamSub]struct{}
+	started bool
+	cancel  context.CancelFunc
+}
+
+// streamSub is a Subscribe or PSubscribe registration. Its channels and
+// patterns are guarded by the transport's lock.
+type streamSub struct {
+	t         *StreamTransport
+	channels  map[string]bool
+	patterns  []string
+	isPattern bool
+	handler   func(channel string, payload []byte)
+}
+
+func (s *streamSub) Add(ctx context.Context, topics ...string) error {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	for _, topic := range topics {
+		if s.isPattern {
+			if !slices.Contains(s.patterns, topic) {
+				s.patterns = append(s.patterns, topic)
+			}
+		} else {
+			s.channels[topic] = true
+		}
+	}
+	return nil
+}
+
+func (s *streamSub) Remove(ctx context.Context, topics ...string) error {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	for _, topic := range topics {
+		if s.isPattern {
+			s.patterns = slices.DeleteFunc(s.patterns, func(p string) bool { return p == topic })
+		} else {
+			delete(s.channels, topic)
+		}
+	}
+	return nil
+}
+
+func (s *streamSub) matches(channel string) bool {
+	if s.channels[channel] {
+		return true
+	}
+	return matchAny(s.patterns, channel)
+}
+
+func NewStreamTransport(redisClient *redis.Client, opts StreamOptions) *StreamTransport {
+	opts.setDefaults()
+	return &StreamTransport{
+		redis: redisClient,
+		opts:  opts,
+		subs:  make(map[*streamSub]struct{}),
+	}
+}
+
+// Publish appends the event to the stream, trimming old entries.
+func (t *StreamTransport) Publish(ctx context.Context, channel string, payload []byte) error {
+	err := t.redis.XAdd(ctx, &redis.XAddArgs{
+		Stream: t.opts.Stream,
+		MaxLen: t.opts.MaxLen,
+		Approx: true,
+		Values: []interface{}{"c", channel, "p", payload},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("publish to stream: %w", err)
+	}
+	return nil
+}
+
+func (t *StreamTransport) Subscribe(ctx context.Context, handler func(channel string, payload []byte), channels ...string) Subscription {
+	sub := &streamSub{t: t, channels: make(map[string]bool, len(channels)), handler: handler}
+	for _, c := range channels {
+		sub.channels[c] = true
+	}
+	t.add(ctx, sub)
+	return sub
+}
+
+func (t *StreamTransport) PSubscribe(ctx context.Context, handler func(channel string, payload []byte), patterns ...string) Subscription {
+	sub := &streamSub{t: t, patterns: slices.Clone(patterns), handler: handler, isPattern: true}
+	t.add(ctx, sub)
+	return sub
+}
+
+// add registers sub until ctx is done, starting the reader on first use.
+func (t *StreamTransport) add(ctx context.Context, sub *streamSub) {
+	t.mu.Lock()
+	t.subs[sub] = struct{}{}
+	if !t.started {
+		t.started = true
+		readerCtx, cancel := context.WithCancel(context.Background())
+		t.cancel = cancel
+		go t.read(readerCtx)
+	}
+	t.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		t.mu.Lock()
+		delete(t.subs, sub)
+		t.mu.Unlock()
+	}()
+}
+
+// Close stops the shared reader. Unacknowledged entries are redelivered
+// when a reader in the same group starts again.
+func (t *StreamTransport) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cancel != nil {
+		t.cancel()
+	}
+}
+
+func (t *StreamTransport) read(ctx context.Context) {
+	if err := t.PruneGroups(ctx); err != nil {
+		log.Warn().Err(err).Msg("failed to prune stale stream consumer groups")
+	}
+	t.consume(ctx, t.opts.Group, "reader", func(channel string, payload []byte) bool {
+		t.mu.Lock()
+		var matched []*streamSub
+		for sub := range t.subs {
+			if sub.matches(channel) {
+				matched = append(matched, sub)
+			}
+		}
+		t.mu.Unlock()
+
+		for _, sub := range matched {
+			sub.handler(channel, payload)
+		}
+		return true
+	})
+}
+
+// Consume delivers matching events to handler with at-least-once semantics,
+// sharing the work between every consumer in group: each entry goes to one
+// of them. An entry is acknowledged when handler returns nil; otherwise it is
+// retried, possibly by another consumer, once it has been idle for ClaimIdle.
+// Entries that match no pattern are acknowledged without calling handler.
+func (t *StreamTransport) Consume(ctx context.Context, group, consumer string, handler func(channel string, payload []byte) error, patterns ...string) {
+	go t.consume(ctx, group, consumer, func(channel string, payload []byte) bool {
+		if !matchAny(patterns, channel) {
+			return true
+		}
+		if err := handler(channel, payload); err != nil {
+			log.Warn().Err(err).Str("group", group).Str("channel", channel).Msg("stream consumer failed, will retry")
+			return false
+		}
+		return true
+	})
+}
+
+// consume reads the stream as consumer in group until ctx is done, calling
+// process for each entry and acknowledging it if process returns true. It
+// first re-processes entries this consumer read but never acknowledged, and
+// periodically claims entries other consumers have left idle.
+func (t *StreamTransport) consume(ctx context.Context, group, consumer string, process func(channel string, payload []byte) bool) {
+	t.ensureGroup(ctx, group)
+
+	handle := func(msgs []redis.XMessage) {
+		for _, m := range msgs {
+			channel, _ := m.Values["c"].(string)
+			payload, _ := m.Values["p"].(string)
+			if !process(channel, []byte(payload)) {
+				continue
+			}
+			if err := t.redis.XAck(ctx, t.opts.Stream, group, m.ID).Err(); err != nil && ctx.Err() == nil {
+				log.Warn().Err(err).Str("group", group).Msg("failed to acknowledge stream entry")
+			}
+		}
+	}
+
+	pending := "0"
+	lastClaim := time.Now()
+	for ctx.Err() == nil {
+		if time.Since(lastClaim) >= t.opts.ClaimIdle {
+			lastClaim = time.Now()
+			msgs, _, err := t.redis.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+				Stream:   t.opts.Stream,
+				Group:    group,
+				Consumer: consumer,
+				MinIdle:  t.opts.ClaimIdle,
+				Start:    "0-0",
+				Count:    streamReadCount,
+			}).Result()
+			if err == nil {
+				handle(msgs)
+			}
+		}
+
+		// Reading from "0" returns this consumer's unacknowledged entries;
+		// ">" returns new ones.
+		id := ">"
+		block := streamReadBlock
+		if pending != "" {
+			id, block = pending, -1
+		}
+		res, err := t.redis.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: consumer,
+			Streams:  []string{t.opts.Stream, id},
+			Count:    streamReadCount,
+			Block:    block,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				t.ensureGroup(ctx, group)
+			} else {
+				log.Warn().Err(err).Str("group", group).Msg("stream read failed")
+			}
+			time.Sleep(streamRetryWait)
+			continue
+		}
+
+		var msgs []redis.XMessage
+		if len(res) > 0 {
+			msgs = res[0].Messages
+		}
+		if pending != "" {
+			if len(msgs) == 0 {
+				pending = ""
+				continue
+			}
+			pending = msgs[len(msgs)-1].ID
+		}
+		handle(msgs)
+	}
+}
+
+// ensureGroup creates group at the end of the stream if it does not exist.
+func (t *StreamTransport) ensureGroup(ctx context.Context, group string) {
+	err := t.redis.XGroupCreateMkStream(ctx, t.opts.Stream, group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") && ctx.Err() == nil {
+		log.Warn().Err(err).Str("group", group).Msg("failed to create stream consumer group")
+	}
+}
+
+// Replay calls handler for every retained entry after afterID, oldest first.
+// Pass "0" to replay everything retained. Entry IDs can be saved and passed
+// back in to continue later.
+func (t *StreamTransport) Replay(ctx context.Context, afterID string, handler func(id, channel string, payload []byte) error) error {
+	start := "(" + afterID
+	if afterID == "0" || afterID == "" {
+		start = "-"
+	}
+	for {
+		msgs, err := t.redis.XRangeN(ctx, t.opts.Stream, start, "+", 500).Result()
+		if err != nil {
+			return fmt.Errorf("replay stream: %w", err)
+		}
+		for _, m := range msgs {
+			channel, _ := m.Values["c"].(string)
+			payload, _ := m.Values["p"].(string)
+			if err := handler(m.ID, channel, []byte(payload)); err != nil {
+				return err
+			}
+		}
+		if len(msgs) < 500 {
+			return nil
+		}
+		start = "(" + msgs[len(msgs)-1].ID
+	}
+}
+
+// PruneGroups deletes consumer groups of processes that have been gone so
+// long that the entries they had not yet read were trimmed. Without this,
+// every renamed or retired process would leave a group behind.
+func (t *StreamTransport) PruneGroups(ctx context.Context) error {
+	info, err := t.redis.XInfoStream(ctx, t.opts.Stream).Result()
+	if err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return nil
+		}
+		return fmt.Errorf("inspect stream: %w", err)
+	}
+	groups, err := t.redis.XInfoGroups(ctx, t.opts.Stream).Result()
+	if err != nil {
+		return fmt.Errorf("list stream groups: %w", err)
+	}
+	for _, g := range groups {
+		if g.Name == t.opts.Group || g.Pending > 0 || info.FirstEntry.ID == "" {
+			continue
+		}
+		if compareIDs(g.LastDeliveredID, info.FirstEntry.ID) < 0 {
+			if err := t.redis.XGroupDestroy(ctx, t.opts.Stream, g.Name).Err(); err != nil {
+				return fmt.Errorf("delete stream group: %w", err)
+			}
+			log.Info().Str("group", g.Name).Msg("deleted stale stream consumer group")
+		}
+	}
+	return nil
+}
+
+// compareIDs orders two stream entry IDs ("<ms>-<seq>").
+func compareIDs(a, b string) int {
+	parse := func(id string) (int64, int64) {
+		ms, seq, _ := strings.Cut(id, "-")
+		m, _ := strconv.ParseInt(ms, 10, 64)
+		s, _ := strconv.ParseInt(seq, 10, 64)
+		return m, s
+	}
+	am, as := parse(a)
+	bm, bs := parse(b)
+	if am != bm {
+		return cmp.Compare(am, bm)
+	}
+	return cmp.Compare(as, bs)
+}
+
+func matchAny(patterns []string, channel string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, channel); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRedis(t *testing.T) *redis.Client {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// collect returns a handler that sends what it is called with to the
+// returned channel, failing with err if it is set.
+func collect(err error) (func(channel string, payload []byte) error, chan delivery) {
+	ch := make(chan delivery, 16)
+	return func(channel string, payload []byte) error {
+		ch <- delivery{channel, string(payload)}
+		return err
+	}, ch
+}
+
+func pending(t *testing.T, client *redis.Client, group string) int64 {
+	t.Helper()
+	p, err := client.XPending(context.Background(), "events", group).Result()
+	require.NoError(t, err)
+	return p.Count
+}
+
+func TestStreamConsumeAcknowledges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := newTestRedis(t)
+	tr := NewStreamTransport(client, StreamOptions{})
+
+	handler, got := collect(nil)
+	tr.Consume(ctx, "webhooks", "a", handler, "channel:*")
+	require.Eventually(t, func() bool {
+		return client.Exists(ctx, "events").Val() == 1
+	}, deliveryWait, 10*time.Millisecond, "group created")
+
+	require.NoError(t, tr.Publish(ctx, "server:1", []byte("skipped")))
+	require.NoError(t, tr.Publish(ctx, "channel:1", []byte("hello")))
+	assert.Equal(t, delivery{"channel:1", "hello"}, receive(t, got))
+	assert.Eventually(t, func() bool { return pending(t, client, "webhooks") == 0 },
+		deliveryWait, 10*time.Millisecond, "both entries acknowledged")
+}
+
+func TestStreamConsumeRedeliversAfterCrash(t *testing.T) {
+	ctx := context.Background()
+	client := newTestRedis(t)
+	tr := NewStreamTransport(client, StreamOptions{})
+
+	// The first process reads the entry but fails before finishing it.
+	crashCtx, crash := context.WithCancel(ctx)
+	failing, got := collect(errors.New("crashed"))
+	tr.Consume(crashCtx, "webhooks", "a", failing, "channel:*")
+	require.Eventually(t, func() bool {
+		return client.Exists(ctx, "events").Val() == 1
+	}, deliveryWait, 10*time.Millisecond, "group created")
+	require.NoError(t, tr.Publish(ctx, "channel:1", []byte("hello")))
+	receive(t, got)
+	crash()
+	assert.Equal(t, int64(1), pending(t, client, "webhooks"))
+
+	// Restarted under the same name, it re-reads its unacknowledged entry
+	// before anything new.
+	restartCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	handler, got := collect(nil)
+	NewStreamTransport(client, StreamOptions{}).Consume(restartCtx, "webhooks", "a", handler, "channel:*")
+	assert.Equal(t, delivery{"channel:1", "hello"}, receive(t, got))
+	assert.Eventually(t, func() bool { return pending(t, client, "webhooks") == 0 },
+		deliveryWait, 10*time.Millisecond)
+}
+
+func TestStreamConsumeClaimsIdleEntries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := newTestRedis(t)
+	opts := StreamOptions{ClaimIdle: 100 * time.Millisecond}
+
+	// Consumer a reads the entry, fails, and its process dies.
+	crashed := redis.NewClient(&redis.Options{Addr: client.Options().Addr})
+	crashCtx, crash := context.WithCancel(ctx)
+	failing, failed := collect(errors.New("crashed"))
+	NewStreamTransport(crashed, opts).Consume(crashCtx, "webhooks", "a", failing, "channel:1")
+	require.Eventually(t, func() bool {
+		return client.Exists(ctx, "events").Val() == 1
+	}, deliveryWait, 10*time.Millisecond, "group created")
+	tr := NewStreamTransport(client, opts)
+	require.NoError(t, tr.Publish(ctx, "channel:1", []byte("hello")))
+	receive(t, failed)
+	crash()
+	crashed.Close()
+
+	// Another consumer in the group takes the entry over once it has been
+	// idle for ClaimIdle.
+	handler, got := collect(nil)
+	tr.Consume(ctx, "webhooks", "b", handler, "channel:*")
+	time.Sleep(2 * opts.ClaimIdle)
+	require.NoError(t, tr.Publish(ctx, "channel:2", []byte("wake")))
+
+	seen := map[delivery]bool{}
+	for len(seen) < 2 {
+		seen[receive(t, got)] = true
+	}
+	assert.True(t, seen[delivery{"channel:1", "hello"}], "claimed from a")
+	assert.True(t, seen[delivery{"channel:2", "wake"}])
+}
+
+func TestStreamSubscribeResumesAfterRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := newTestRedis(t)
+	opts := StreamOptions{Group: "node:test"}
+
+	first := NewStreamTransport(client, opts)
+	got := make(chan delivery, 16)
+	handler := func(channel string, payload []byte) { got <- delivery{channel, string(payload)} }
+	sub := first.Subscribe(ctx, handler, "channel:1")
+	require.Eventually(t, func() bool {
+		return client.Exists(ctx, "events").Val() == 1
+	}, deliveryWait, 10*time.Millisecond, "group created")
+
+	require.NoError(t, first.Publish(ctx, "channel:1", []byte("one")))
+	assert.Equal(t, delivery{"channel:1", "one"}, receive(t, got))
+	require.NoError(t, sub.Add(ctx, "channel:2"))
+	require.NoError(t, sub.Remove(ctx, "channel:1"))
+	require.NoError(t, first.Publish(ctx, "channel:1", []byte("dropped")))
+	require.NoError(t, first.Publish(ctx, "channel:2", []byte("two")))
+	assert.Equal(t, delivery{"channel:2", "two"}, receive(t, got))
+	first.Close()
+
+	// Published while the process is down.
+	require.NoError(t, first.Publish(ctx, "channel:2", []byte("three")))
+
+	second := NewStreamTransport(client, opts)
+	second.Subscribe(ctx, handler, "channel:2")
+	assert.Equal(t, delivery{"channel:2", "three"}, receive(t, got))
+}
+
+func TestStreamReplay(t *testing.T) {
+	ctx := context.Background()
+	client := newTestRedis(t)
+	tr := NewStreamTransport(client, StreamOptions{})
+	for i := range 1200 {
+		require.NoError(t, tr.Publish(ctx, fmt.Sprintf("channel:%d", i%3), []byte(fmt.Sprint(i))))
+	}
+
+	var ids []string
+	var payloads []string
+	require.NoError(t, tr.Replay(ctx, "0", func(id, channel string, payload []byte) error {
+		ids = append(ids, id)
+		payloads = append(payloads, string(payload))
+		return nil
+	}))
+	require.Len(t, payloads, 1200, "across several pages")
+	assert.Equal(t, "0", payloads[0])
+	assert.Equal(t, "1199", payloads[1199])
+
+	// Continue from a saved ID.
+	var rest []string
+	require.NoError(t, tr.Replay(ctx, ids[1000], func(id, channel string, payload []byte) error {
+		rest = append(rest, string(payload))
+		return nil
+	}))
+	assert.Equal(t, payloads[1001:], rest)
+
+	stop := errors.New("stop")
+	n := 0
+	err := tr.Replay(ctx, "", func(string, string, []byte) error {
+		if n++; n == 3 {
+			return stop
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, stop)
+	assert.Equal(t, 3, n)
+}
+
+func TestCompareIDs(t *testing.T) {
+	assert.Equal(t, -1, compareIDs("1-5", "2-0"))
+	assert.Equal(t, 1, compareIDs("10-0", "9-9"))
+	assert.Equal(t, -1, compareIDs("5-2", "5-10"))
+	assert.Equal(t, 0, compareIDs("5-2", "5-2"))
+}
@@ -0,0 +1,112 @@
+package events
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Transport moves encoded events between processes. Handlers are called from
+// a single goroutine per subscription, in publish order.
+type Transport interface {
+	Publish(ctx context.Context, channel string, payload []byte) error
+	// Subscribe delivers messages published to any of channels until ctx is
+	// done. Channels can be added and removed through the returned
+	// Subscription.
+	Subscribe(ctx context.Context, handler func(channel string, payload []byte), channels ...string) Subscription
+	// PSubscribe is Subscribe for glob patterns such as "server:*".
+	PSubscribe(ctx context.Context, handler func(channel string, payload []byte), patterns ...string) Subscription
+}
+
+// Subscription changes the channels (or, for PSubscribe, the patterns) an
+// open subscription listens on without reopening it. Events already in flight
+// for a removed channel may still be delivered.
+type Subscription interface {
+	Add(ctx context.Context, topics ...string) error
+	Remove(ctx context.Context, topics ...string) error
+}
+
+// PubSubTransport is fire-and-forget Redis pub/sub: a subscriber that is not
+// connected when an event is published never sees it.
+type PubSubTransport struct {
+	redis *redis.Client
+}
+
+func NewPubSubTransport(redisClient *redis.Client) *PubSubTransport {
+	return &PubSubTransport{redis: redisClient}
+}
+
+func (t *PubSubTransport) Publish(ctx context.Context, channel string, payload []byte) error {
+	return t.redis.Publish(ctx, channel, payload).Err()
+}
+
+func (t *PubSubTransport) Subscribe(ctx context.Context, handler func(channel string, payload []byte), channels ...string) Subscription {
+	sub := t.redis.Subscribe(ctx, channels...)
+	t.run(ctx, sub, handler)
+	return &pubSubSubscription{sub: sub}
+}
+
+func (t *PubSubTransport) PSubscribe(ctx context.Context, handler func(channel string, payload []byte), patterns ...string) Subscription {
+	sub := t.redis.PSubscribe(ctx, patterns...)
+	t.run(ctx, sub, handler)
+	return &pubSubSubscription{sub: sub, patterns: true}
+}
+
+func (t *PubSubTransport) run(ctx context.Context, sub *redis.PubSub, handler func(string, []byte)) {
+	ch := sub.Channel()
+
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				handler(msg.Channel, []byte(msg.Payload))
+			}
+		}
+	}()
+}
+
+type pubSubSubscription struct {
+	sub      *redis.PubSub
+	patterns bool
+}
+
+func (s *pubSubSubscription) Add(ctx context.Context, topics ...string) error {
+	if len(topics) == 0 {
+		return nil
+	}
+	var err error
+	if s.patterns {
+		err = s.sub.PSubscribe(ctx, topics...)
+	} else {
+		err = s.sub.Subscribe(ctx, topics...)
+	}
+	if err != nil {
+		return fmt.Errorf("add subscription topics: %w", err)
+	}
+	return nil
+}
+
+// Remove unsubscribes from topics. Unlike redis.PubSub.Unsubscribe, removing
+// no topics is a no-op rather than removing all of them.
+func (s *pubSubSubscription) Remove(ctx context.Context, topics ...string) error {
+	if len(topics) == 0 {
+		return nil
+	}
+	var err error
+	if s.patterns {
+		err = s.sub.PUnsubscribe(ctx, topics...)
+	} else {
+		err = s.sub.Unsubscribe(ctx, topics...)
+	}
+	if err != nil {
+		return fmt.Errorf("remove subscription topics: %w", err)
+	}
+	return nil
+}
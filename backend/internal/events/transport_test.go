@@ -0,0 +1,43 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+// deliveryWait bounds how long a test waits for an event to be delivered.
+const deliveryWait = 2 * time.Second
+
+type delivery struct {
+	channel string
+	payload string
+}
+
+// listen returns a subscription handler that sends what it receives to
+// the returned channel.
+func listen() (func(channel string, payload []byte), chan delivery) {
+	ch := make(chan delivery, 16)
+	return func(channel string, payload []byte) {
+		ch <- delivery{channel, string(payload)}
+	}, ch
+}
+
+func receive(t *testing.T, ch <-chan delivery) delivery {
+	t.Helper()
+	select {
+	case d := <-ch:
+		return d
+	case <-time.After(deliveryWait):
+		t.Fatal("nothing delivered")
+		return delivery{}
+	}
+}
+
+func nothing(t *testing.T, ch <-chan delivery) {
+	t.Helper()
+	select {
+	case d := <-ch:
+		t.Fatalf("unexpected delivery %+v", d)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -1,5 +1,7 @@
 package events
 
+import "encoding/json"
+
 // Event type constants for real-time event delivery
 const (
 	// Message events
@@ -20,8 +22,14 @@ const (
 	ServerUpdate       = "SERVER_UPDATE"
 	ServerDelete       = "SERVER_DELETE"
 	ServerMemberAdd    = "SERVER_MEMBER_ADD"
+	ServerMemberUpdate = "SERVER_MEMBER_UPDATE"
 	ServerMemberRemove = "SERVER_MEMBER_REMOVE"
 
+	// Role events
+	RoleCreate = "ROLE_CREATE"
+	RoleUpdate = "ROLE_UPDATE"
+	RoleDelete = "ROLE_DELETE"
+
 	// Thread events
 	ThreadCreate = "THREAD_CREATE"
 	ThreadUpdate = "THREAD_UPDATE"
@@ -29,14 +37,87 @@ const (
 	// Voice events
 	VoiceStateUpdate = "VOICE_STATE_UPDATE"
 	VoiceServerInfo  = "VOICE_SERVER_INFO"
+	// VoiceSignal carries a client's WebRTC signaling from its gateway node
+	// to the node hosting its voice channel's media.
+	VoiceSignal = "VOICE_SIGNAL"
 
 	// Presence events
 	PresenceUpdate = "PRESENCE_UPDATE"
+
+	// Interaction events
+	InteractionCreate   = "INTERACTION_CREATE"
+	InteractionDeferred = "INTERACTION_DEFERRED"
+
+	// Session events
+	Hello             = "HELLO"
+	HeartbeatAck      = "HEARTBEAT_ACK"
+	Reconnect         = "RECONNECT"
+	Ready             = "READY"
+	Resumed           = "RESUMED"
+	InvalidSession    = "INVALID_SESSION"
+	SessionInvalidate = "SESSION_INVALIDATE"
 )
 
-// Event is the envelope for all real-time events.
+// Event is the envelope for all real-time events. Data holds the payload
+// registered for Type in registry.go; decoded events carry a pointer to it,
+// or a json.RawMessage for unregistered types.
 type Event struct {
 	Type           string      `json:"t"`
 	Data           interface{} `json:"d"`
 	SourceInstance string      `json:"s,omitempty"` // Federation-ready: origin instance
+	// Version is the payload version. It is filled in from the registry when
+	// the event is encoded.
+	Version int `json:"v,omitempty"`
+	// Seq is assigned per gateway session as events are sent to the client,
+	// so a reconnecting client can resume after the last event it saw.
+	// Publishers leave it zero.
+	Seq int64 `json:"q,omitempty"`
+	// Key identifies one publish of the event across redeliveries. Bus.Publish
+	// stamps a new key on events without one; events relayed from the outbox
+	// keep theirs, as they may be published more than once. Consumers drop
+	// repeats by Key.
+	Key string `json:"k,omitempty"`
+}
+
+// envelope is Event without its JSON methods.
+type envelope Event
+
+// MarshalJSON encodes the event, stamping the current payload version and
+// rejecting a payload of the wrong type.
+func (e Event) MarshalJSON() ([]byte, error) {
+	if p, ok := Lookup(e.Type); ok {
+		if err := p.check(e.Type, e.Data); err != nil {
+			return nil, err
+		}
+		if e.Version == 0 {
+			e.Version = p.Version
+		}
+	}
+	return json.Marshal(envelope(e))
+}
+
+// UnmarshalJSON decodes the event, upgrading and decoding the payload into
+// its registered type.
+func (e *Event) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		envelope
+		Data json.RawMessage `json:"d"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	*e = Event(raw.envelope)
+
+	p, ok := Lookup(e.Type)
+	if !ok {
+		e.Data = raw.Data
+		return nil
+	}
+	data, err := p.decode(e.Type, e.Version, raw.Data)
+	if err != nil {
+		return err
+	}
+	e.Data = data
+	e.Version = p.Version
+	return nil
 }
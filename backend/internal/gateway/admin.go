@@ -0,0 +1,38 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+)
+
+// Admin lists and ends users' gateway sessions on every node. It needs only
+// the registry and the event bus, so it can run outside the gateway.
+type Admin struct {
+	registry *Registry
+	bus      events.Publisher
+}
+
+func NewAdmin(registry *Registry, bus events.Publisher) *Admin {
+	return &Admin{registry: registry, bus: bus}
+}
+
+// ListSessions returns the user's connected sessions.
+func (a *Admin) ListSessions(ctx context.Context, userID int64) ([]SessionInfo, error) {
+	return a.registry.List(ctx, userID)
+}
+
+// KillSessions closes the user's sessions, or only sessionID if it is not
+// empty, on whichever nodes hold them. Killed sessions cannot be resumed, and
+// the client is told so with events.CloseSessionInvalidated.
+func (a *Admin) KillSessions(ctx context.Context, userID int64, sessionID string) error {
+	event := events.Event{
+		Type: events.SessionInvalidate,
+		Data: events.SessionInvalidatePayload{SessionID: sessionID},
+	}
+	if err := a.bus.Publish(ctx, userTopic(userID), event); err != nil {
+		return fmt.Errorf("publish session invalidation: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/rs/zerolog/log"
+)
+
+// appendBatchSize bounds how many events are written to the replay buffer in
+// one round trip.
+const appendBatchSize = 512
+
+// appender writes the events sessions send to the replay buffer in the
+// background, so that dispatching an event to many sessions waits on no Redis
+// round trips. Whatever has queued up while one batch is written goes out in
+// the next, pipelined.
+type appender struct {
+	buffer *ReplayBuffer
+	node   string
+
+	mu      sync.Mutex
+	written *sync.Cond
+	pending []pendingAppend
+	// queued and done count appends ever queued and ever written or given
+	// up on.
+	queued  uint64
+	done    uint64
+	running bool
+}
+
+type pendingAppend struct {
+	sess *Session
+	replayAppend
+}
+
+func newAppender(buffer *ReplayBuffer, node string) *appender {
+	a := &appender{buffer: buffer, node: node}
+	a.written = sync.NewCond(&a.mu)
+	return a
+}
+
+// add queues an event sent to a session with seq.
+func (a *appender) add(sess *Session, seq int64, data []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending = append(a.pending, pendingAppend{sess, replayAppend{SessionID: sess.ID, Seq: seq, Data: data}})
+	a.queued++
+	if !a.running {
+		a.running = true
+		go a.run()
+	}
+}
+
+// sync waits until everything queued so far has been written.
+func (a *appender) sync() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	target := a.queued
+	for a.done < target {
+		a.written.Wait()
+	}
+}
+
+// run writes batches until none are left.
+func (a *appender) run() {
+	for {
+		a.mu.Lock()
+		if len(a.pending) == 0 {
+			a.pending = nil
+			a.running = false
+			a.mu.Unlock()
+			return
+		}
+		n := min(len(a.pending), appendBatchSize)
+		batch := a.pending[:n:n]
+		a.pending = a.pending[n:]
+		a.mu.Unlock()
+
+		a.write(batch)
+
+		a.mu.Lock()
+		a.done += uint64(n)
+		a.written.Broadcast()
+		a.mu.Unlock()
+	}
+}
+
+func (a *appender) write(batch []pendingAppend) {
+	appends := make([]replayAppend, len(batch))
+	for i, p := range batch {
+		appends[i] = p.replayAppend
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	errs := a.buffer.AppendAll(ctx, a.node, appends)
+	cancel()
+
+	for i, err := range errs {
+		sess := batch[i].sess
+		if errors.Is(err, ErrNotOwner) {
+			// The client resumed on another node; it gets the events there.
+			sess.close(events.CloseSessionReplaced, false)
+			continue
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("session_id", sess.ID).Msg("failed to buffer gateway event")
+		}
+	}
+}
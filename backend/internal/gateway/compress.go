@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression names clients may pass as ?compress= when they connect. Both
+// compress the whole connection as one stream, flushed after every frame,
+// so each frame benefits from what came before it. Clients feed every
+// binary frame they receive into a single decompressor. Client frames are
+// not compressed.
+const (
+	CompressZlibStream = "zlib-stream"
+	CompressZstdStream = "zstd-stream"
+)
+
+// compressor compresses a connection's outgoing frames as one stream.
+type compressor interface {
+	compress(frame []byte) ([]byte, error)
+	close()
+}
+
+func newCompressor(name string) (compressor, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case CompressZlibStream:
+		z := &zlibStream{}
+		z.w = zlib.NewWriter(&z.buf)
+		return z, nil
+	case CompressZstdStream:
+		z := &zstdStream{}
+		w, err := zstd.NewWriter(&z.buf,
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithWindowSize(zstdWindowSize),
+			zstd.WithLowerEncoderMem(true),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("create zstd encoder: %w", err)
+		}
+		z.w = w
+		return z, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", name)
+	}
+}
+
+// zstdWindowSize keeps each connection's encoder small; gateway frames
+// rarely refer back further than this.
+const zstdWindowSize = 1 << 18
+
+// zlibStream ends each frame with a sync flush, so it ends in the bytes
+// 00 00 ff ff and the client can decompress it straight away.
+type zlibStream struct {
+	buf bytes.Buffer
+	w   *zlib.Writer
+}
+
+func (z *zlibStream) compress(frame []byte) ([]byte, error) {
+	z.buf.Reset()
+	if _, err := z.w.Write(frame); err != nil {
+		return nil, fmt.Errorf("compress frame: %w", err)
+	}
+	if err := z.w.Flush(); err != nil {
+		return nil, fmt.Errorf("compress frame: %w", err)
+	}
+	return bytes.Clone(z.buf.Bytes()), nil
+}
+
+func (z *zlibStream) close() { z.w.Close() }
+
+type zstdStream struct {
+	buf bytes.Buffer
+	w   *zstd.Encoder
+}
+
+func (z *zstdStream) compress(frame []byte) ([]byte, error) {
+	z.buf.Reset()
+	if _, err := z.w.Write(frame); err != nil {
+		return nil, fmt.Errorf("compress frame: %w", err)
+	}
+	if err := z.w.Flush(); err != nil {
+		return nil, fmt.Errorf("compress frame: %w", err)
+	}
+	return bytes.Clone(z.buf.Bytes()), nil
+}
+
+func (z *zstdStream) close() { z.w.Close() }
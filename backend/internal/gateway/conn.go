@@ -0,0 +1,209 @@
+package gateway
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	writeTimeout = 10 * time.Second
+	maxFrameSize = 4096
+	// maxSignalFrameSize bounds VOICE_SIGNAL frames instead, whose session
+	// descriptions run to tens of kilobytes once video and simulcast are
+	// offered.
+	maxSignalFrameSize = 64 << 10
+)
+
+// conn is one WebSocket connection. Frames are written by a single goroutine
+// from a queue bounded by the server's QueuePolicy, so a slow client never
+// blocks event dispatch. Frames are queued as JSON and converted to the
+// connection's encoding and compression as they are written.
+type conn struct {
+	ws     *websocket.Conn
+	policy QueuePolicy
+	enc    events.Encoder
+	comp   compressor // nil if uncompressed; used only by writeLoop
+	in     chan *clientMessage
+	out    chan []byte
+	done   chan struct{}
+	// heartbeat closes the connection when the client misses a heartbeat.
+	heartbeat *time.Timer
+
+	// mu orders closing against enqueue, so nothing is queued after close
+	// and the queue depth metric stays exact.
+	mu     sync.Mutex
+	closed bool
+	code   events.CloseCode
+}
+
+// newConn starts serving ws, greeting the client with HELLO.
+func newConn(ws *websocket.Conn, policy QueuePolicy, enc events.Encoder, comp compressor) *conn {
+	ws.SetReadLimit(maxSignalFrameSize)
+	c := &conn{
+		ws:     ws,
+		policy: policy,
+		enc:    enc,
+		comp:   comp,
+		in:     make(chan *clientMessage),
+		out:    make(chan []byte, policy.Size),
+		done:   make(chan struct{}),
+	}
+	connections.Add(1)
+	c.heartbeat = time.AfterFunc(heartbeatTimeout, func() { c.close(events.CloseSessionTimedOut) })
+	c.send(events.Event{Type: events.Hello, Data: events.HelloPayload{
+		HeartbeatInterval: HeartbeatInterval.Milliseconds(),
+	}})
+	go c.readLoop()
+	go c.writeLoop()
+	return c
+}
+
+// send marshals and queues a frame that is not part of the session's
+// numbered event stream.
+func (c *conn) send(event events.Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Error().Err(err).Str("type", event.Type).Msg("failed to marshal gateway frame")
+		return
+	}
+	c.enqueue(data)
+}
+
+// enqueue queues a frame, closing the connection if its queue is full.
+func (c *conn) enqueue(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.out <- data:
+		queueDepth.Add(1)
+	default:
+		slowConsumers.Add(1)
+		c.closeLocked(events.CloseSlowConsumer)
+	}
+}
+
+// drops reports whether an event of eventType should be discarded rather
+// than queued, because the client is falling behind.
+func (c *conn) drops(eventType string) bool {
+	return c.policy.drops(eventType, len(c.out))
+}
+
+// readLoop feeds client messages to c.in, closing it when the connection
+// fails. Malformed frames, and frames other than VOICE_SIGNAL over
+// maxFrameSize, are skipped. Heartbeats are answered here so they
+// are acknowledged even while a message is being handled.
+func (c *conn) readLoop() {
+	defer close(c.in)
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			c.close(events.CloseNormal)
+			return
+		}
+		var msg clientMessage
+		if events.Unmarshal(c.enc, data, &msg) != nil {
+			continue
+		}
+		if len(data) > maxFrameSize && msg.Op != OpVoiceSignal {
+			continue
+		}
+		if msg.Op == OpHeartbeat {
+			c.heartbeat.Reset(heartbeatTimeout)
+			c.send(events.Event{Type: events.HeartbeatAck, Data: events.HeartbeatAckPayload{}})
+			continue
+		}
+		select {
+		case c.in <- &msg:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// close ends the connection, sending the client code.
+func (c *conn) close(code events.CloseCode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked(code)
+}
+
+func (c *conn) closeLocked(code events.CloseCode) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.code = code
+	c.heartbeat.Stop()
+	close(c.done)
+}
+
+// writeLoop writes queued frames until the connection is closed. It is the
+// only reader of c.out.
+func (c *conn) writeLoop() {
+	defer func() {
+		c.ws.Close()
+		if c.comp != nil {
+			c.comp.close()
+		}
+		for len(c.out) > 0 {
+			<-c.out
+			queueDepth.Add(-1)
+		}
+		connections.Add(-1)
+	}()
+	for {
+		select {
+		case data := <-c.out:
+			queueDepth.Add(-1)
+			c.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := c.write(data); err != nil {
+				c.close(events.CloseNormal)
+				return
+			}
+		case <-c.done:
+			// Flush what is already queued, such as RECONNECT, before the
+			// close frame, but give up quickly on a client that is not reading.
+			deadline := time.Now().Add(time.Second)
+			c.ws.SetWriteDeadline(deadline)
+			for len(c.out) > 0 {
+				data := <-c.out
+				queueDepth.Add(-1)
+				if c.write(data) != nil {
+					return
+				}
+			}
+			msg := websocket.FormatCloseMessage(int(c.code), c.code.String())
+			c.ws.WriteControl(websocket.CloseMessage, msg, deadline)
+			return
+		}
+	}
+}
+
+// write converts a queued JSON frame for the connection and sends it. A
+// frame that cannot be converted is logged and skipped.
+func (c *conn) write(data []byte) error {
+	data, err := c.enc.FromJSON(data)
+	if err != nil {
+		log.Error().Err(err).Str("encoding", c.enc.Name()).Msg("failed to encode gateway frame")
+		return nil
+	}
+	messageType := websocket.TextMessage
+	if c.enc.Binary() {
+		messageType = websocket.BinaryMessage
+	}
+	if c.comp != nil {
+		if data, err = c.comp.compress(data); err != nil {
+			return err
+		}
+		messageType = websocket.BinaryMessage
+	}
+	return c.ws.WriteMessage(messageType, data)
+}
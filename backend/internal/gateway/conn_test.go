@@ -0,0 +1,76 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dialConn connects a client to a conn served by a test server.
+func dialConn(t *testing.T) (*conn, *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- newConn(ws, DefaultQueuePolicy, events.JSON, nil)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	c := <-conns
+	t.Cleanup(func() { c.close(events.CloseNormal) })
+	return c, client
+}
+
+// frame is a client message of op padded to size bytes.
+func frame(op string, size int) []byte {
+	padded := func(pad int) []byte {
+		data, _ := json.Marshal(map[string]any{"op": op, "d": map[string]string{"pad": strings.Repeat("x", pad)}})
+		return data
+	}
+	return padded(size - len(padded(0)))
+}
+
+func next(t *testing.T, c *conn) *clientMessage {
+	t.Helper()
+	select {
+	case msg := <-c.in:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func TestConnFrameLimits(t *testing.T) {
+	c, client := dialConn(t)
+
+	// Session descriptions exceed the limit for other messages.
+	require.NoError(t, client.WriteMessage(websocket.TextMessage, frame(OpSubscribe, maxFrameSize+1)))
+	require.NoError(t, client.WriteMessage(websocket.TextMessage, frame(OpVoiceSignal, 48<<10)))
+	require.NoError(t, client.WriteMessage(websocket.TextMessage, frame(OpSubscribe, maxFrameSize)))
+	assert.Equal(t, OpVoiceSignal, next(t, c).Op)
+	assert.Equal(t, OpSubscribe, next(t, c).Op)
+
+	// Anything larger still ends the connection.
+	require.NoError(t, client.WriteMessage(websocket.TextMessage, frame(OpVoiceSignal, maxSignalFrameSize+1)))
+	select {
+	case _, ok := <-c.in:
+		assert.False(t, ok, "oversized frame was delivered")
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection not closed")
+	}
+}
@@ -0,0 +1,110 @@
+package gateway
+
+import (
+	"context"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/rs/zerolog/log"
+)
+
+// drainPollInterval is how often a draining node checks which of its
+// sessions have been resumed elsewhere.
+const drainPollInterval = time.Second
+
+// Drain hands this node's clients over to other nodes before it shuts down,
+// and should be called on SIGTERM. New connections are refused. Every
+// session is sent RECONNECT and closed with events.CloseReconnect, at
+// random points spread evenly over spread so the clients do not all
+// reconnect at once.
+//
+// Sessions stay subscribed and keep buffering events after their client
+// leaves, so nothing published during the handover is lost. Drain returns
+// once every session has been resumed on another node, or when ctx is done;
+// sessions left then can still be resumed elsewhere until they expire.
+func (s *Server) Drain(ctx context.Context, spread time.Duration) {
+	s.mu.Lock()
+	s.draining = true
+	sessions := slices.Collect(maps.Values(s.sessions))
+	s.mu.Unlock()
+
+	log.Info().Int("sessions", len(sessions)).Dur("spread", spread).Msg("draining gateway")
+	rand.Shuffle(len(sessions), func(i, j int) {
+		sessions[i], sessions[j] = sessions[j], sessions[i]
+	})
+	start := time.Now()
+	for i, sess := range sessions {
+		at := start.Add(spread * time.Duration(i) / time.Duration(len(sessions)))
+		select {
+		case <-time.After(time.Until(at)):
+		case <-ctx.Done():
+		}
+		// The client resumes elsewhere from the replay buffer.
+		s.appends.sync()
+		sess.reconnect()
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.releaseClaimed(ctx) == 0 {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.mu.Lock()
+			left := slices.Collect(maps.Values(s.sessions))
+			s.mu.Unlock()
+			for _, sess := range left {
+				sess.close(events.CloseReconnect, false)
+			}
+			log.Info().Int("sessions", len(left)).Msg("gateway drain timed out")
+			return
+		}
+	}
+}
+
+// releaseClaimed closes the sessions that another node has taken over or
+// that have expired, and returns how many are left.
+func (s *Server) releaseClaimed(ctx context.Context) int {
+	s.mu.Lock()
+	sessions := slices.Collect(maps.Values(s.sessions))
+	s.mu.Unlock()
+
+	left := 0
+	for _, sess := range sessions {
+		rctx, cancel := context.WithTimeout(ctx, redisTimeout)
+		owner, err := s.replay.Owner(rctx, sess.ID)
+		cancel()
+		if err != nil || owner == s.nodeID {
+			left++
+			continue
+		}
+		sess.close(events.CloseReconnect, false)
+	}
+	return left
+}
+
+// Draining reports whether Drain has been called. Health checks should
+// report the node unavailable so load balancers stop routing clients to it.
+func (s *Server) Draining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// reconnect tells the client to resume on another node and closes its
+// connection. The session itself stays open.
+func (s *Session) reconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return
+	}
+	s.conn.send(events.Event{Type: events.Reconnect, Data: events.ReconnectPayload{}})
+	s.conn.close(events.CloseReconnect)
+}
@@ -0,0 +1,121 @@
+package gateway
+
+import (
+	"context"
+	"sync"
+
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/rs/zerolog/log"
+)
+
+// Hub holds a single bus subscription for the node and adds and removes
+// topics on it as sessions come to need them, sharing each topic between all
+// of the node's sessions interested in it.
+type Hub struct {
+	bus events.Subscriber
+
+	mu     sync.Mutex
+	sub    events.Subscription // nil until the first topic
+	topics map[string]*hubTopic
+}
+
+// recentKeys is how many event keys each topic remembers to drop repeats.
+const recentKeys = 256
+
+type hubTopic struct {
+	sessions map[*Session]struct{}
+
+	// recent holds the keys of the topic's most recent events, so an event
+	// the outbox relay published twice reaches sessions once.
+	recent *keyWindow
+}
+
+// keyWindow remembers a fixed number of recent event keys.
+type keyWindow struct {
+	size  int
+	seen  map[string]struct{}
+	order []string
+}
+
+func newKeyWindow(size int) *keyWindow {
+	return &keyWindow{size: size, seen: make(map[string]struct{}, size)}
+}
+
+func NewHub(bus events.Subscriber) *Hub {
+	return &Hub{bus: bus, topics: make(map[string]*hubTopic)}
+}
+
+func (h *Hub) Subscribe(topic string, s *Session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t, ok := h.topics[topic]
+	if !ok {
+		t = &hubTopic{
+			sessions: make(map[*Session]struct{}),
+			recent:   newKeyWindow(recentKeys),
+		}
+		h.topics[topic] = t
+		if h.sub == nil {
+			h.sub = h.bus.Subscribe(context.Background(), h.dispatch, topic)
+		} else if err := h.sub.Add(context.Background(), topic); err != nil {
+			log.Warn().Err(err).Str("topic", topic).Msg("failed to subscribe gateway to topic")
+		}
+	}
+	t.sessions[s] = struct{}{}
+}
+
+func (h *Hub) Unsubscribe(topic string, s *Session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t, ok := h.topics[topic]
+	if !ok {
+		return
+	}
+	delete(t.sessions, s)
+	if len(t.sessions) == 0 {
+		delete(h.topics, topic)
+		if err := h.sub.Remove(context.Background(), topic); err != nil {
+			log.Warn().Err(err).Str("topic", topic).Msg("failed to unsubscribe gateway from topic")
+		}
+	}
+}
+
+func (h *Hub) dispatch(topic string, event events.Event) {
+	h.mu.Lock()
+	t, ok := h.topics[topic]
+	var sessions []*Session
+	if ok && t.recent.duplicate(event.Key) {
+		ok = false
+	}
+	if ok {
+		sessions = make([]*Session, 0, len(t.sessions))
+		for s := range t.sessions {
+			sessions = append(sessions, s)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, s := range sessions {
+		s.dispatch(topic, event)
+	}
+}
+
+// duplicate reports whether key was already seen, and remembers it
+// otherwise. Events without a key are never duplicates.
+func (w *keyWindow) duplicate(key string) bool {
+	if key == "" {
+		return false
+	}
+	if _, ok := w.seen[key]; ok {
+		return true
+	}
+	if len(w.order) == w.size {
+		delete(w.seen, w.order[0])
+		w.order = w.order[1:]
+	}
+	w.seen[key] = struct{}{}
+	w.order = append(w.order, key)
+	return false
+}
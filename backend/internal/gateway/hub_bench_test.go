@@ -0,0 +1,140 @@
+package gateway
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/robwittman/possessive-potato/backend/internal/auth"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+)
+
+const benchChannel = 100
+
+// benchConn is a connection without a socket. With drain set, frames are
+// taken off its queue as fast as a writer could send them; otherwise the
+// client never reads, and its queue fills.
+func benchConn(policy QueuePolicy, drain bool) *conn {
+	c := &conn{
+		policy:    policy,
+		enc:       events.JSON,
+		out:       make(chan []byte, policy.Size),
+		done:      make(chan struct{}),
+		heartbeat: time.NewTimer(time.Hour),
+	}
+	if drain {
+		go func() {
+			for {
+				select {
+				case <-c.out:
+					queueDepth.Add(-1)
+				case <-c.done:
+					return
+				}
+			}
+		}()
+	}
+	return c
+}
+
+// benchSessions connects n sessions following benchChannel, of which stalled
+// never read from their connections.
+func benchSessions(b *testing.B, s *Server, n, stalled int) []*Session {
+	b.Helper()
+	sessions := make([]*Session, n)
+	for i := range sessions {
+		sess := newSession(s, strconv.Itoa(i), &auth.Principal{UserID: int64(i + 1)}, 0)
+		s.add(sess)
+		sess.subscribe(benchChannel)
+		sess.mu.Lock()
+		sess.conn = benchConn(s.queue, i >= stalled)
+		sess.mu.Unlock()
+		sessions[i] = sess
+	}
+	holdAppends(s)
+	b.Cleanup(func() {
+		for _, sess := range sessions {
+			sess.conn.close(events.CloseNormal)
+		}
+	})
+	return sessions
+}
+
+// holdAppends stops the server writing to the replay buffer, which happens
+// off the dispatch path, so that what is measured is dispatch alone.
+func holdAppends(s *Server) {
+	s.appends.mu.Lock()
+	s.appends.running = true
+	s.appends.mu.Unlock()
+}
+
+// dispatchAll sends event to every session following benchChannel, then
+// discards the replay buffer writes it queued.
+func dispatchAll(b *testing.B, s *Server, event events.Event) {
+	s.hub.dispatch(channelTopic(benchChannel), event)
+	b.StopTimer()
+	s.appends.mu.Lock()
+	s.appends.pending = s.appends.pending[:0]
+	s.appends.mu.Unlock()
+	b.StartTimer()
+}
+
+func BenchmarkHubFanOut(b *testing.B) {
+	for _, n := range []int{100, 1000, 5000} {
+		b.Run(fmt.Sprintf("sessions=%d", n), func(b *testing.B) {
+			s, _ := newTestServer(b)
+			s.queue = DefaultQueuePolicy
+			benchSessions(b, s, n, 0)
+			msg := &model.Message{ID: 1, ChannelID: benchChannel, AuthorID: 1, Content: "hello", CreatedAt: time.Now()}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				dispatchAll(b, s, events.Event{Type: events.MessageCreate, Data: msg})
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*n), "ns/session")
+		})
+	}
+}
+
+// BenchmarkHubBackpressure fans typing indicators and messages out to
+// sessions of which a share never read. Their queues pass DropAt, so typing
+// indicators are discarded, and then fill, so they are closed as slow
+// consumers; neither may slow delivery to the rest.
+func BenchmarkHubBackpressure(b *testing.B) {
+	const n = 1000
+	// A short queue fills within a few hundred events.
+	policy := QueuePolicy{Size: 32, DropAt: 8, Droppable: []string{events.TypingStart}}
+	for _, stalled := range []int{0, n / 10, n / 2} {
+		b.Run(fmt.Sprintf("stalled=%d", stalled), func(b *testing.B) {
+			s, _ := newTestServer(b)
+			s.queue = policy
+			sessions := benchSessions(b, s, n, stalled)
+			typing := &events.TypingStartPayload{ChannelID: benchChannel, UserID: 1, Timestamp: time.Now()}
+			msg := &model.Message{ID: 1, ChannelID: benchChannel, AuthorID: 1, Content: "hello", CreatedAt: time.Now()}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				event := events.Event{Type: events.TypingStart, Data: typing}
+				if i%4 == 0 {
+					event = events.Event{Type: events.MessageCreate, Data: msg}
+				}
+				dispatchAll(b, s, event)
+			}
+			b.StopTimer()
+
+			closed := 0
+			for _, sess := range sessions[:stalled] {
+				sess.mu.Lock()
+				if sess.conn.closed {
+					closed++
+				}
+				sess.mu.Unlock()
+			}
+			b.ReportMetric(float64(closed), "slow-closed")
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package gateway
+
+import "github.com/robwittman/possessive-potato/backend/internal/events"
+
+// Intents selects the optional event groups a session receives. Server,
+// channel, role and session events are always sent.
+type Intents int64
+
+const (
+	// IntentMessages: MESSAGE_*, THREAD_* and INTERACTION_DEFERRED.
+	IntentMessages Intents = 1 << iota
+	// IntentMembers: SERVER_MEMBER_*.
+	IntentMembers
+	// IntentPresence: PRESENCE_UPDATE.
+	IntentPresence
+	// IntentTyping: TYPING_START.
+	IntentTyping
+	// IntentVoice: VOICE_STATE_UPDATE and VOICE_SERVER_INFO.
+	IntentVoice
+
+	AllIntents = IntentMessages | IntentMembers | IntentPresence | IntentTyping | IntentVoice
+)
+
+var eventIntents = map[string]Intents{
+	events.MessageCreate:       IntentMessages,
+	events.MessageUpdate:       IntentMessages,
+	events.MessageDelete:       IntentMessages,
+	events.ThreadCreate:        IntentMessages,
+	events.ThreadUpdate:        IntentMessages,
+	events.InteractionDeferred: IntentMessages,
+	events.ServerMemberAdd:     IntentMembers,
+	events.ServerMemberUpdate:  IntentMembers,
+	events.ServerMemberRemove:  IntentMembers,
+	events.PresenceUpdate:      IntentPresence,
+	events.TypingStart:         IntentTyping,
+	events.VoiceStateUpdate:    IntentVoice,
+	events.VoiceServerInfo:     IntentVoice,
+}
+
+// allows reports whether a session with these intents receives eventType.
+func (i Intents) allows(eventType string) bool {
+	need, ok := eventIntents[eventType]
+	return !ok || i&need != 0
+}
+
+// channelEvents reports whether the intents need channel subscriptions,
+// which carry messages and typing.
+func (i Intents) channelEvents() bool {
+	return i&(IntentMessages|IntentTyping) != 0
+}
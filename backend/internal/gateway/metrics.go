@@ -0,0 +1,24 @@
+package gateway
+
+import "expvar"
+
+// Gateway metrics, published with expvar under "gateway".
+var (
+	// connections is the number of open WebSocket connections.
+	connections = new(expvar.Int)
+	// queueDepth is the number of frames waiting in send queues, summed over
+	// all connections.
+	queueDepth = new(expvar.Int)
+	// droppedEvents counts events discarded for congested clients, by type.
+	droppedEvents = new(expvar.Map).Init()
+	// slowConsumers counts connections closed because their queue filled.
+	slowConsumers = new(expvar.Int)
+)
+
+func init() {
+	m := expvar.NewMap("gateway")
+	m.Set("connections", connections)
+	m.Set("send_queue_depth", queueDepth)
+	m.Set("dropped_events", droppedEvents)
+	m.Set("slow_consumer_disconnects", slowConsumers)
+}
@@ -0,0 +1,90 @@
+package gateway
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+)
+
+// Clients connect to /ws with their token and, optionally, an encoding
+// (?encoding=json, msgpack or cbor; frames in both directions use it) and a
+// compression (?compress=zlib-stream or zstd-stream) for server frames.
+//
+// Client ops. The server opens every connection with HELLO, after which the
+// client sends IDENTIFY for a new session or RESUME to continue a previous
+// one, and HEARTBEAT every heartbeat interval until it disconnects. A
+// session identified with intents receives the events of every server its
+// user belongs to; SUBSCRIBE and UNSUBSCRIBE are only for sessions
+// identified without them.
+const (
+	OpIdentify    = "IDENTIFY"
+	OpResume      = "RESUME"
+	OpSubscribe   = "SUBSCRIBE"
+	OpUnsubscribe = "UNSUBSCRIBE"
+	OpHeartbeat   = "HEARTBEAT"
+	// OpPresenceUpdate sets the user's chosen status, and reports whether
+	// the client is idle. Clients send it with idle false, at most every
+	// minute or so, while their user is active; a session with no activity
+	// for the presence policy's AwayAfter counts as idle.
+	OpPresenceUpdate = "PRESENCE_UPDATE"
+	// OpTypingStart says the user is typing in a channel. Clients send it
+	// every typing.Interval while the user types.
+	OpTypingStart = "TYPING_START"
+	// OpVoiceStateUpdate joins, moves between or, with a null channel,
+	// leaves voice channels, and sets the user's self mute and deafen.
+	OpVoiceStateUpdate = "VOICE_STATE_UPDATE"
+	// OpVoiceSignal carries WebRTC signaling for the session's voice
+	// connection, as an events.VoiceSignalPayload. The server signals back
+	// with VOICE_SERVER_INFO.
+	OpVoiceSignal = "VOICE_SIGNAL"
+)
+
+const (
+	// HeartbeatInterval is how often clients are asked to send HEARTBEAT.
+	HeartbeatInterval = 30 * time.Second
+	// heartbeatTimeout is how long the server waits for a heartbeat before
+	// closing the connection as a zombie. It leaves room for network delay
+	// and for clients that jitter their first heartbeat.
+	heartbeatTimeout = HeartbeatInterval * 3 / 2
+)
+
+// clientMessage is a frame sent by the client.
+type clientMessage struct {
+	Op string          `json:"op"`
+	D  json.RawMessage `json:"d"`
+}
+
+type identifyPayload struct {
+	// Intents is nil for clients that subscribe to channels themselves.
+	Intents *Intents `json:"intents"`
+}
+
+type resumePayload struct {
+	SessionID string `json:"session_id"`
+	// Seq is the last sequence number the client received.
+	Seq int64 `json:"seq"`
+}
+
+type presenceUpdatePayload struct {
+	Status model.UserStatus `json:"status"`
+	Idle   *bool            `json:"idle"`
+	// CustomStatus is left unchanged if absent and cleared if null.
+	CustomStatus json.RawMessage `json:"custom_status"`
+	// Activities replaces this session's activities if present.
+	Activities *[]model.Activity `json:"activities"`
+}
+
+type typingStartPayload struct {
+	ChannelID int64 `json:"channel_id,string"`
+}
+
+type voiceStateUpdatePayload struct {
+	ChannelID *int64 `json:"channel_id,string"`
+	SelfMute  bool   `json:"self_mute"`
+	SelfDeaf  bool   `json:"self_deaf"`
+}
+
+type subscribePayload struct {
+	ChannelID int64 `json:"channel_id,string"`
+}
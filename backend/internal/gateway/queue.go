@@ -0,0 +1,52 @@
+package gateway
+
+import (
+	"slices"
+
+	"github.com/robwittman/possessive-potato/backend/internal/config"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+)
+
+// QueuePolicy bounds each connection's send queue, so a client that cannot
+// keep up costs a fixed amount of memory and never holds up other sessions.
+// Once DropAt frames are waiting, events of the Droppable types are
+// discarded rather than queued. A connection whose queue reaches Size is
+// closed with events.CloseSlowConsumer, and the client can resume.
+type QueuePolicy struct {
+	Size   int
+	DropAt int
+	// Droppable lists event types a client can do without, such as typing
+	// indicators. Dropped events are never numbered, so they leave no gap in
+	// the session's sequence and are not replayed on resume.
+	Droppable []string
+}
+
+var DefaultQueuePolicy = QueuePolicy{
+	Size:      256,
+	DropAt:    64,
+	Droppable: []string{events.TypingStart},
+}
+
+// QueuePolicyFromConfig overrides the default policy with any values set in cfg.
+func QueuePolicyFromConfig(cfg *config.Config) QueuePolicy {
+	p := DefaultQueuePolicy
+	if cfg.GatewaySendQueueSize > 0 {
+		p.Size = cfg.GatewaySendQueueSize
+	}
+	if cfg.GatewaySendQueueDropAt > 0 {
+		p.DropAt = cfg.GatewaySendQueueDropAt
+	}
+	if cfg.GatewayDroppableEvents != nil {
+		p.Droppable = cfg.GatewayDroppableEvents
+	}
+	if p.DropAt > p.Size {
+		p.DropAt = p.Size
+	}
+	return p
+}
+
+// drops reports whether an event of eventType is discarded for a connection
+// with depth frames queued.
+func (p QueuePolicy) drops(eventType string, depth int) bool {
+	return depth >= p.DropAt && slices.Contains(p.Droppable, eventType)
+}
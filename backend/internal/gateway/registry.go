@@ -0,0 +1,123 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// registryTTL is how long a connected session stays registered without
+	// being refreshed, so sessions on a node that died drop out on their own.
+	registryTTL = 90 * time.Second
+	// registryRefreshInterval is how often nodes refresh their sessions.
+	registryRefreshInterval = 30 * time.Second
+)
+
+// SessionInfo describes a session with a client connected to it.
+type SessionInfo struct {
+	SessionID   string    `json:"session_id"`
+	UserID      int64     `json:"user_id,string"`
+	Node        string    `json:"node"`
+	Encoding    string    `json:"encoding"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// Registry records in Redis which sessions each user has connected, and on
+// which gateway node, across every node. Sessions are registered while a
+// client is attached; a session waiting to be resumed is not listed.
+type Registry struct {
+	redis *redis.Client
+}
+
+func NewRegistry(redisClient *redis.Client) *Registry {
+	return &Registry{redis: redisClient}
+}
+
+// userSessionsKey holds a user's session IDs, scored by when they expire.
+func userSessionsKey(userID int64) string    { return "gw_user_sessions:" + strconv.FormatInt(userID, 10) }
+func sessionInfoKey(sessionID string) string { return "gw_session_info:" + sessionID }
+
+// Register records a connected session, or refreshes it.
+func (r *Registry) Register(ctx context.Context, info SessionInfo) error {
+	return r.Refresh(ctx, []SessionInfo{info})
+}
+
+// Refresh re-registers sessions, extending their TTL.
+func (r *Registry) Refresh(ctx context.Context, infos []SessionInfo) error {
+	if len(infos) == 0 {
+		return nil
+	}
+	expires := time.Now().Add(registryTTL).UnixMilli()
+	_, err := r.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, info := range infos {
+			data, err := json.Marshal(info)
+			if err != nil {
+				return err
+			}
+			key := userSessionsKey(info.UserID)
+			pipe.Set(ctx, sessionInfoKey(info.SessionID), data, registryTTL)
+			pipe.ZAdd(ctx, key, redis.Z{Score: float64(expires), Member: info.SessionID})
+			pipe.PExpire(ctx, key, registryTTL)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("register gateway sessions: %w", err)
+	}
+	return nil
+}
+
+// Unregister removes a session whose client has disconnected.
+func (r *Registry) Unregister(ctx context.Context, userID int64, sessionID string) error {
+	_, err := r.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, userSessionsKey(userID), sessionID)
+		pipe.Del(ctx, sessionInfoKey(sessionID))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unregister gateway session: %w", err)
+	}
+	return nil
+}
+
+// List returns the user's connected sessions on every node.
+func (r *Registry) List(ctx context.Context, userID int64) ([]SessionInfo, error) {
+	key := userSessionsKey(userID)
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	if err := r.redis.ZRemRangeByScore(ctx, key, "-inf", "("+now).Err(); err != nil {
+		return nil, fmt.Errorf("expire gateway sessions: %w", err)
+	}
+	ids, err := r.redis.ZRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("list gateway sessions: %w", err)
+	}
+	if len(ids) == 0 {
+		return []SessionInfo{}, nil
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = sessionInfoKey(id)
+	}
+	values, err := r.redis.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get gateway sessions: %w", err)
+	}
+	sessions := make([]SessionInfo, 0, len(values))
+	for _, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue // expired since the range was read
+		}
+		var info SessionInfo
+		if json.Unmarshal([]byte(data), &info) == nil {
+			sessions = append(sessions, info)
+		}
+	}
+	return sessions, nil
+}
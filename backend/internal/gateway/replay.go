@@ -0,0 +1,247 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// ReplayBufferSize is how many recent events are kept per session.
+	ReplayBufferSize = 1000
+	// ResumeWindow is how long after its last event or disconnect a session
+	// can be resumed.
+	ResumeWindow = 2 * time.Minute
+)
+
+// ReplayBuffer keeps each session's recently sent events in Redis so a client
+// can resume on any gateway node. A session's metadata records the node that
+// owns it; only the owner may append, which lets another node take over a
+// session without two nodes assigning the same sequence numbers.
+type ReplayBuffer struct {
+	redis *redis.Client
+}
+
+func NewReplayBuffer(redisClient *redis.Client) *ReplayBuffer {
+	return &ReplayBuffer{redis: redisClient}
+}
+
+// sessionMeta is the resumable state of a session.
+type sessionMeta struct {
+	UserID   int64
+	Seq      int64
+	Channels []int64
+	// Auto and Intents are how the session was identified. Auto sessions'
+	// channels are reloaded rather than restored when they are claimed.
+	Auto    bool
+	Intents Intents
+}
+
+func metaKey(sessionID string) string   { return "gw_session:" + sessionID }
+func bufferKey(sessionID string) string { return "gw_replay:" + sessionID }
+
+// appendScript adds an event to the buffer if node still owns the session.
+// Appends are written after the session's metadata may have been saved with a
+// later seq, which is kept.
+var appendScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'node') ~= ARGV[1] then
+	return 0
+end
+if tonumber(redis.call('HGET', KEYS[1], 'seq') or 0) < tonumber(ARGV[2]) then
+	redis.call('HSET', KEYS[1], 'seq', ARGV[2])
+end
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[3])
+redis.call('ZREMRANGEBYRANK', KEYS[2], 0, -tonumber(ARGV[4]) - 1)
+redis.call('PEXPIRE', KEYS[1], ARGV[5])
+redis.call('PEXPIRE', KEYS[2], ARGV[5])
+return 1
+`)
+
+// saveScript writes session metadata unless another node has taken it over.
+var saveScript = redis.NewScript(`
+local node = redis.call('HGET', KEYS[1], 'node')
+if node and node ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'node', ARGV[1], 'user_id', ARGV[2], 'seq', ARGV[3], 'channels', ARGV[4], 'intents', ARGV[5])
+redis.call('PEXPIRE', KEYS[1], ARGV[6])
+redis.call('PEXPIRE', KEYS[2], ARGV[6])
+return 1
+`)
+
+// claimScript makes node the owner of a user's session and returns its state.
+var claimScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'user_id') ~= ARGV[1] then
+	return false
+end
+redis.call('HSET', KEYS[1], 'node', ARGV[2])
+return redis.call('HMGET', KEYS[1], 'seq', 'channels', 'intents')
+`)
+
+// ErrNotOwner is returned when another node has taken over the session.
+var ErrNotOwner = errors.New("session is owned by another node")
+
+// replayAppend is an event sent to a session with Seq.
+type replayAppend struct {
+	SessionID string
+	Seq       int64
+	Data      []byte
+}
+
+// AppendAll records events sent by sessions node owns, in one round trip. It
+// returns the error for each, ErrNotOwner for sessions another node has taken
+// over.
+func (b *ReplayBuffer) AppendAll(ctx context.Context, node string, appends []replayAppend) []error {
+	errs := make([]error, len(appends))
+	cmds, err := b.pipelineAppends(ctx, node, appends)
+	if redis.HasErrorPrefix(err, "NOSCRIPT") {
+		if err := appendScript.Load(ctx, b.redis).Err(); err != nil {
+			for i := range errs {
+				errs[i] = fmt.Errorf("load replay append script: %w", err)
+			}
+			return errs
+		}
+		cmds, _ = b.pipelineAppends(ctx, node, appends)
+	}
+
+	for i, cmd := range cmds {
+		ok, err := cmd.(*redis.Cmd).Int()
+		switch {
+		case err != nil:
+			errs[i] = fmt.Errorf("append replay event: %w", err)
+		case ok == 0:
+			errs[i] = ErrNotOwner
+		}
+	}
+	return errs
+}
+
+func (b *ReplayBuffer) pipelineAppends(ctx context.Context, node string, appends []replayAppend) ([]redis.Cmder, error) {
+	return b.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, a := range appends {
+			appendScript.EvalSha(ctx, pipe,
+				[]string{metaKey(a.SessionID), bufferKey(a.SessionID)},
+				node, a.Seq, a.Data, ReplayBufferSize, ResumeWindow.Milliseconds(),
+			)
+		}
+		return nil
+	})
+}
+
+// Save writes the session's metadata and restarts its resume window.
+func (b *ReplayBuffer) Save(ctx context.Context, sessionID, node string, meta sessionMeta) error {
+	ok, err := saveScript.Run(ctx, b.redis,
+		[]string{metaKey(sessionID), bufferKey(sessionID)},
+		node, meta.UserID, meta.Seq, joinIDs(meta.Channels), encodeIntents(meta), ResumeWindow.Milliseconds(),
+	).Int()
+	if err != nil {
+		return fmt.Errorf("save gateway session: %w", err)
+	}
+	if ok == 0 {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+// Claim takes ownership of a user's session for node. It returns nil if the
+// session has expired or belongs to someone else. Once claimed, the previous
+// owner can no longer append, so the returned sequence number is final.
+func (b *ReplayBuffer) Claim(ctx context.Context, sessionID string, userID int64, node string) (*sessionMeta, error) {
+	res, err := claimScript.Run(ctx, b.redis, []string{metaKey(sessionID)}, userID, node).Slice()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("claim gateway session: %w", err)
+	}
+	seqStr, _ := res[0].(string)
+	channelsStr, _ := res[1].(string)
+	intentsStr, _ := res[2].(string)
+	seq, _ := strconv.ParseInt(seqStr, 10, 64)
+	meta := &sessionMeta{UserID: userID, Seq: seq, Channels: splitIDs(channelsStr), Intents: AllIntents}
+	if intents, err := strconv.ParseInt(intentsStr, 10, 64); err == nil {
+		meta.Auto = true
+		meta.Intents = Intents(intents)
+	}
+	return meta, nil
+}
+
+// Owner returns the node that owns a session, or "" if it has expired.
+func (b *ReplayBuffer) Owner(ctx context.Context, sessionID string) (string, error) {
+	node, err := b.redis.HGet(ctx, metaKey(sessionID), "node").Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("get gateway session owner: %w", err)
+	}
+	return node, nil
+}
+
+// encodeIntents stores an auto session's intents, or nothing for a session
+// that subscribes to channels itself.
+func encodeIntents(meta sessionMeta) string {
+	if !meta.Auto {
+		return ""
+	}
+	return strconv.FormatInt(int64(meta.Intents), 10)
+}
+
+// Since returns the events sent after seq, up to and including last. ok is
+// false if any of them have been trimmed or expired, in which case the client
+// must re-sync instead.
+func (b *ReplayBuffer) Since(ctx context.Context, sessionID string, seq, last int64) ([][]byte, bool, error) {
+	if seq > last || seq < 0 {
+		return nil, false, nil
+	}
+	if seq == last {
+		return nil, true, nil
+	}
+	entries, err := b.redis.ZRangeByScoreWithScores(ctx, bufferKey(sessionID), &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(seq, 10),
+		Max: strconv.FormatInt(last, 10),
+	}).Result()
+	if err != nil {
+		return nil, false, fmt.Errorf("read replay buffer: %w", err)
+	}
+	if int64(len(entries)) != last-seq || int64(entries[0].Score) != seq+1 {
+		return nil, false, nil
+	}
+
+	out := make([][]byte, len(entries))
+	for i, e := range entries {
+		out[i] = []byte(e.Member.(string))
+	}
+	return out, true, nil
+}
+
+// Delete discards a session so it cannot be resumed.
+func (b *ReplayBuffer) Delete(ctx context.Context, sessionID string) error {
+	if err := b.redis.Del(ctx, metaKey(sessionID), bufferKey(sessionID)).Err(); err != nil {
+		return fmt.Errorf("delete gateway session: %w", err)
+	}
+	return nil
+}
+
+func joinIDs(ids []int64) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.FormatInt(id, 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+func splitIDs(s string) []int64 {
+	var ids []int64
+	for _, part := range strings.Split(s, ",") {
+		if id, err := strconv.ParseInt(part, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
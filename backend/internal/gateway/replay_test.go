@@ -0,0 +1,103 @@
+package gateway
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/robwittman/possessive-potato/backend/internal/auth"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestReplayBuffer(t testing.TB) *ReplayBuffer {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewReplayBuffer(client)
+}
+
+func TestReplayBufferAppendAll(t *testing.T) {
+	ctx := context.Background()
+	b := newTestReplayBuffer(t)
+	require.NoError(t, b.Save(ctx, "a", "node1", sessionMeta{UserID: 1}))
+	require.NoError(t, b.Save(ctx, "b", "node2", sessionMeta{UserID: 2}))
+
+	// The first batch loads the script into Redis.
+	errs := b.AppendAll(ctx, "node1", []replayAppend{
+		{SessionID: "a", Seq: 1, Data: []byte("one")},
+		{SessionID: "b", Seq: 1, Data: []byte("theirs")},
+		{SessionID: "a", Seq: 2, Data: []byte("two")},
+	})
+	assert.NoError(t, errs[0])
+	assert.ErrorIs(t, errs[1], ErrNotOwner)
+	assert.NoError(t, errs[2])
+
+	errs = b.AppendAll(ctx, "node1", []replayAppend{{SessionID: "a", Seq: 3, Data: []byte("three")}})
+	assert.NoError(t, errs[0])
+
+	missed, ok, err := b.Since(ctx, "a", 1, 3)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, [][]byte{[]byte("two"), []byte("three")}, missed)
+}
+
+func TestReplayBufferAppendKeepsSavedSeq(t *testing.T) {
+	ctx := context.Background()
+	b := newTestReplayBuffer(t)
+	require.NoError(t, b.Save(ctx, "a", "node1", sessionMeta{UserID: 1, Seq: 2}))
+
+	// Appends land after metadata saved with a later seq.
+	errs := b.AppendAll(ctx, "node1", []replayAppend{
+		{SessionID: "a", Seq: 1, Data: []byte("one")},
+		{SessionID: "a", Seq: 2, Data: []byte("two")},
+	})
+	require.NoError(t, errs[0])
+
+	meta, err := b.Claim(ctx, "a", 1, "node2")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), meta.Seq)
+
+	errs = b.AppendAll(ctx, "node1", []replayAppend{{SessionID: "a", Seq: 3, Data: []byte("three")}})
+	assert.ErrorIs(t, errs[0], ErrNotOwner, "claimed by node2")
+}
+
+func TestAppender(t *testing.T) {
+	ctx := context.Background()
+	b := newTestReplayBuffer(t)
+	s := &Server{
+		hub:      NewHub(events.NewBusWithTransport(events.NewMemoryTransport())),
+		replay:   b,
+		appends:  newAppender(b, "node1"),
+		nodeID:   "node1",
+		sessions: make(map[string]*Session),
+	}
+	mine := newSession(s, "a", &auth.Principal{UserID: 1}, 0)
+	taken := newSession(s, "b", &auth.Principal{UserID: 2}, 0)
+	s.add(mine)
+	s.add(taken)
+	require.NoError(t, b.Save(ctx, "a", "node1", sessionMeta{UserID: 1}))
+	require.NoError(t, b.Save(ctx, "b", "node2", sessionMeta{UserID: 2}))
+
+	for seq := int64(1); seq <= 1000; seq++ {
+		s.appends.add(mine, seq, []byte(strconv.FormatInt(seq, 10)))
+	}
+	s.appends.add(taken, 1, []byte("theirs"))
+	s.appends.sync()
+
+	missed, ok, err := b.Since(ctx, "a", 0, 1000)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Len(t, missed, 1000)
+
+	taken.mu.Lock()
+	assert.True(t, taken.closed, "the session was resumed on another node")
+	taken.mu.Unlock()
+	mine.mu.Lock()
+	assert.False(t, mine.closed)
+	mine.mu.Unlock()
+}
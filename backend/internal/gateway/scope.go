@@ -0,0 +1,287 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/permission"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// syncTimeout bounds loading a server's channels, or a user's
+	// permissions there.
+	syncTimeout = 5 * time.Second
+	// resyncDelay is how long sessions affected by changes in a server are
+	// collected before it is reloaded for all of them.
+	resyncDelay = 100 * time.Millisecond
+)
+
+// channelVisible reports whether a member with the given server permissions
+// can see a channel and receive its events.
+func channelVisible(perms int64, ch *model.Channel) bool {
+	return model.HasPermission(permission.InChannel(perms, ch), model.PermissionReadMessages)
+}
+
+// syncServers subscribes an auto session to every server its user belongs
+// to and drops any it no longer belongs to.
+func (s *Server) syncServers(ctx context.Context, sess *Session) error {
+	servers, err := s.servers.ListByUser(ctx, sess.UserID)
+	if err != nil {
+		return fmt.Errorf("list servers: %w", err)
+	}
+	member := make(map[int64]bool, len(servers))
+	for _, srv := range servers {
+		member[srv.ID] = true
+		if err := s.syncServer(ctx, sess, srv.ID); err != nil {
+			return err
+		}
+	}
+
+	sess.mu.Lock()
+	for id := range sess.servers {
+		if !member[id] {
+			sess.leaveServerLocked(id)
+		}
+	}
+	sess.mu.Unlock()
+	return nil
+}
+
+// syncServer reloads the user's permissions in a server and subscribes the
+// session to the channels they can see there, or leaves the server if they
+// are no longer a member or the session's token does not cover it.
+func (s *Server) syncServer(ctx context.Context, sess *Session, serverID int64) error {
+	return s.syncSessions(ctx, serverID, []*Session{sess})
+}
+
+// syncSessions is syncServer for several sessions, loading the server's
+// channels once and each user's permissions once. Sessions that fail to sync
+// do not hold up the rest; the first error is returned.
+func (s *Server) syncSessions(ctx context.Context, serverID int64, sessions []*Session) error {
+	listCtx, cancel := context.WithTimeout(ctx, syncTimeout)
+	channels, err := s.channels.ListByServer(listCtx, serverID)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("list channels: %w", err)
+	}
+
+	perms := make(map[int64]int64) // by user, absent if not a member
+	loaded := make(map[int64]bool)
+	var first error
+	for _, sess := range sessions {
+		if err := s.syncSession(ctx, sess, serverID, channels, perms, loaded); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (s *Server) syncSession(ctx context.Context, sess *Session, serverID int64, channels []model.Channel, perms map[int64]int64, loaded map[int64]bool) error {
+	sess.syncMu.Lock()
+	defer sess.syncMu.Unlock()
+
+	if !sess.can(model.ScopeReadMessages, serverID) {
+		sess.leaveServer(serverID) // outside the token's server
+		return nil
+	}
+	if !loaded[sess.UserID] {
+		permsCtx, cancel := context.WithTimeout(ctx, syncTimeout)
+		p, err := s.perms.Effective(permsCtx, serverID, sess.UserID)
+		cancel()
+		if err != nil && !errors.Is(err, permission.ErrNotMember) {
+			return fmt.Errorf("load permissions: %w", err)
+		}
+		if err == nil {
+			perms[sess.UserID] = p
+		}
+		loaded[sess.UserID] = true
+	}
+	p, member := perms[sess.UserID]
+	if !member {
+		sess.leaveServer(serverID)
+		return nil
+	}
+
+	var visible []int64
+	for i := range channels {
+		if channelVisible(p, &channels[i]) {
+			visible = append(visible, channels[i].ID)
+		}
+	}
+	sess.joinServer(serverID, p, visible)
+	return nil
+}
+
+// resync reloads a server for the session in the background, after a change
+// to membership or roles. It must be called with s.mu held.
+func (s *Session) resync(serverID int64) {
+	s.server.scheduleResync(serverID, s)
+}
+
+// scheduleResync reloads a server for a session after resyncDelay, together
+// with every other session a change there has affected meanwhile. A role
+// change reaches every session following the server, and reloading them in
+// one pass spares the database a burst of identical queries.
+func (s *Server) scheduleResync(serverID int64, sess *Session) {
+	s.resyncMu.Lock()
+	defer s.resyncMu.Unlock()
+	if s.resyncs == nil {
+		s.resyncs = make(map[int64]map[*Session]struct{})
+	}
+	pending, ok := s.resyncs[serverID]
+	if !ok {
+		pending = make(map[*Session]struct{})
+		s.resyncs[serverID] = pending
+		time.AfterFunc(resyncDelay, func() { s.resync(serverID) })
+	}
+	pending[sess] = struct{}{}
+}
+
+func (s *Server) resync(serverID int64) {
+	s.resyncMu.Lock()
+	sessions := slices.Collect(maps.Keys(s.resyncs[serverID]))
+	delete(s.resyncs, serverID)
+	s.resyncMu.Unlock()
+
+	if err := s.syncSessions(context.Background(), serverID, sessions); err != nil {
+		log.Warn().Err(err).Int("sessions", len(sessions)).Int64("server_id", serverID).Msg("failed to sync gateway server")
+	}
+}
+
+// joinServer follows a server with the given permissions and visible
+// channels, replacing whatever the session followed there before.
+func (s *Session) joinServer(serverID, perms int64, channelIDs []int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+
+	if _, ok := s.servers[serverID]; !ok {
+		s.server.hub.Subscribe(serverTopic(serverID), s)
+	}
+	s.servers[serverID] = perms
+
+	want := make(map[int64]bool, len(channelIDs))
+	if s.intents.channelEvents() {
+		for _, id := range channelIDs {
+			want[id] = true
+		}
+	}
+	for id, sid := range s.channels {
+		if sid == serverID && !want[id] {
+			s.removeChannelLocked(id)
+		}
+	}
+	for id := range want {
+		s.addChannelLocked(id, serverID)
+	}
+	s.save()
+}
+
+func (s *Session) leaveServer(serverID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leaveServerLocked(serverID)
+}
+
+// leaveServerLocked stops following a server and its channels. It must be
+// called with s.mu held.
+func (s *Session) leaveServerLocked(serverID int64) {
+	if _, ok := s.servers[serverID]; !ok {
+		return
+	}
+	delete(s.servers, serverID)
+	s.server.hub.Unsubscribe(serverTopic(serverID), s)
+	for id, sid := range s.channels {
+		if sid == serverID {
+			s.removeChannelLocked(id)
+		}
+	}
+	if !s.closed {
+		s.save()
+	}
+}
+
+// observe keeps an auto session's subscriptions in step with membership,
+// role and channel events, and reports whether the event is visible to the
+// session. It must be called with s.mu held.
+func (s *Session) observe(topic string, event events.Event) bool {
+	switch event.Type {
+	case events.ServerCreate:
+		// Sent to the user's topic when they create or join a server.
+		if srv, ok := payload[model.Server](event); ok && topic == userTopic(s.UserID) {
+			s.resync(srv.ID)
+		}
+	case events.ServerDelete:
+		if p, ok := payload[events.ServerDeletePayload](event); ok {
+			s.leaveServerLocked(p.ID)
+		}
+	case events.ServerMemberAdd:
+		if p, ok := payload[events.ServerMemberAddPayload](event); ok && p.UserID == s.UserID {
+			s.resync(p.ServerID)
+		}
+	case events.ServerMemberUpdate:
+		if p, ok := payload[events.ServerMemberUpdatePayload](event); ok && p.UserID == s.UserID {
+			s.resync(p.ServerID)
+		}
+	case events.ServerMemberRemove:
+		if p, ok := payload[events.ServerMemberRemovePayload](event); ok && p.UserID == s.UserID {
+			s.leaveServerLocked(p.ServerID)
+		}
+	case events.RoleCreate, events.RoleUpdate:
+		if role, ok := payload[model.Role](event); ok {
+			s.resync(role.ServerID)
+		}
+	case events.RoleDelete:
+		if p, ok := payload[events.RoleDeletePayload](event); ok {
+			s.resync(p.ServerID)
+		}
+	case events.ChannelCreate, events.ChannelUpdate, events.ChannelDelete:
+		ch, ok := payload[model.Channel](event)
+		if !ok {
+			return false
+		}
+		perms, ok := s.servers[ch.ServerID]
+		if !ok {
+			return false
+		}
+		_, subscribed := s.channels[ch.ID]
+		visible := channelVisible(perms, ch)
+		switch {
+		case event.Type == events.ChannelDelete:
+			s.removeChannelLocked(ch.ID)
+		case visible && s.intents.channelEvents():
+			s.addChannelLocked(ch.ID, ch.ServerID)
+		case !visible:
+			s.removeChannelLocked(ch.ID)
+		}
+		if _, now := s.channels[ch.ID]; now != subscribed {
+			s.save()
+		}
+		// A channel that was just hidden from the user is deleted from
+		// their point of view, but they are not told so here; clients drop
+		// channels they can no longer read after re-fetching.
+		return visible || (event.Type == events.ChannelDelete && subscribed)
+	}
+	return true
+}
+
+// payload returns an event's payload as a *T, whether it was published as a
+// T or decoded from the bus.
+func payload[T any](event events.Event) (*T, bool) {
+	switch v := event.Data.(type) {
+	case *T:
+		return v, v != nil
+	case T:
+		return &v, true
+	}
+	return nil, false
+}
@@ -0,0 +1,188 @@
+package gateway
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/robwittman/possessive-potato/backend/internal/auth"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/permission"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testServerID = 10
+
+// fakeGuild is one server with two channels, where every user other than
+// its owner is a member with perms.
+type fakeGuild struct {
+	perms        atomic.Int64
+	memberChecks atomic.Int32
+	channelLists atomic.Int32
+}
+
+type guildServers struct {
+	store.ServerStoreInterface
+	g *fakeGuild
+}
+
+func (guildServers) GetByID(_ context.Context, id int64) (*model.Server, error) {
+	return &model.Server{ID: id, OwnerID: 1}, nil
+}
+
+func (s guildServers) IsMember(context.Context, int64, int64) (bool, error) {
+	s.g.memberChecks.Add(1)
+	return true, nil
+}
+
+func (guildServers) ListByUser(context.Context, int64) ([]model.Server, error) {
+	return []model.Server{{ID: testServerID}}, nil
+}
+
+type guildChannels struct {
+	store.ChannelStoreInterface
+	g *fakeGuild
+}
+
+func (c guildChannels) ListByServer(_ context.Context, serverID int64) ([]model.Channel, error) {
+	c.g.channelLists.Add(1)
+	return []model.Channel{{ID: 100, ServerID: serverID}, {ID: 101, ServerID: serverID}}, nil
+}
+
+type guildRoles struct {
+	store.RoleStoreInterface
+	g *fakeGuild
+}
+
+func (r guildRoles) GetMemberPermissions(context.Context, int64, int64) (int64, error) {
+	return r.g.perms.Load(), nil
+}
+
+func newTestServer(t testing.TB) (*Server, *fakeGuild) {
+	t.Helper()
+	g := &fakeGuild{}
+	g.perms.Store(model.PermissionReadMessages)
+	replay := newTestReplayBuffer(t)
+	s := &Server{
+		perms:    permission.NewChecker(guildServers{g: g}, guildRoles{g: g}),
+		servers:  guildServers{g: g},
+		channels: guildChannels{g: g},
+		hub:      NewHub(events.NewBusWithTransport(events.NewMemoryTransport())),
+		replay:   replay,
+		appends:  newAppender(replay, "node1"),
+		nodeID:   "node1",
+		sessions: make(map[string]*Session),
+	}
+	return s, g
+}
+
+func autoSession(s *Server, id string, userID int64) *Session {
+	sess := newSession(s, id, &auth.Principal{UserID: userID}, 0)
+	sess.auto = true
+	s.add(sess)
+	return sess
+}
+
+func channelsOf(sess *Session) []int64 {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	var ids []int64
+	for id := range sess.channels {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestSyncServers(t *testing.T) {
+	s, g := newTestServer(t)
+	sess := autoSession(s, "a", 2)
+	require.NoError(t, s.syncServers(context.Background(), sess))
+	assert.ElementsMatch(t, []int64{100, 101}, channelsOf(sess))
+
+	g.perms.Store(0)
+	require.NoError(t, s.syncServer(context.Background(), sess, testServerID))
+	assert.Empty(t, channelsOf(sess))
+	sess.mu.Lock()
+	assert.Contains(t, sess.servers, int64(testServerID), "still following the server")
+	sess.mu.Unlock()
+}
+
+func TestSyncServerOutsideTokenServer(t *testing.T) {
+	s, _ := newTestServer(t)
+	other := int64(99)
+	sess := newSession(s, "a", &auth.Principal{
+		UserID:   2,
+		TokenID:  5,
+		Scopes:   []string{model.ScopeReadMessages},
+		ServerID: &other,
+	}, 0)
+	sess.auto = true
+	require.NoError(t, s.syncServers(context.Background(), sess))
+	assert.Empty(t, channelsOf(sess))
+	assert.Empty(t, sess.servers)
+}
+
+func TestRoleChangesResyncServerOnce(t *testing.T) {
+	s, g := newTestServer(t)
+	ctx := context.Background()
+
+	// 50 sessions of 10 users follow the server.
+	var sessions []*Session
+	for i := range 50 {
+		sess := autoSession(s, strconv.Itoa(i), int64(2+i%10))
+		require.NoError(t, s.syncServers(ctx, sess))
+		sessions = append(sessions, sess)
+	}
+	g.memberChecks.Store(0)
+	g.channelLists.Store(0)
+
+	// Read access is taken away by a burst of role changes.
+	g.perms.Store(0)
+	role := &model.Role{ID: 7, ServerID: testServerID}
+	for range 5 {
+		s.hub.dispatch(serverTopic(testServerID), events.Event{Type: events.RoleUpdate, Data: role})
+	}
+
+	require.Eventually(t, func() bool {
+		for _, sess := range sessions {
+			if len(channelsOf(sess)) > 0 {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(2 * resyncDelay)
+	assert.Equal(t, int32(1), g.channelLists.Load(), "channels loaded once")
+	assert.Equal(t, int32(10), g.memberChecks.Load(), "permissions loaded once per user")
+}
+
+func TestScheduleResyncCollectsSessions(t *testing.T) {
+	s, _ := newTestServer(t)
+	a, b := autoSession(s, "a", 2), autoSession(s, "b", 3)
+
+	var wg sync.WaitGroup
+	for _, sess := range []*Session{a, b, a} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.scheduleResync(testServerID, sess)
+		}()
+	}
+	wg.Wait()
+
+	s.resyncMu.Lock()
+	assert.Len(t, s.resyncs[testServerID], 2)
+	s.resyncMu.Unlock()
+	require.Eventually(t, func() bool {
+		return len(channelsOf(a)) == 2 && len(channelsOf(b)) == 2
+	}, time.Second, 10*time.Millisecond)
+	s.resyncMu.Lock()
+	assert.Empty(t, s.resyncs)
+	s.resyncMu.Unlock()
+}
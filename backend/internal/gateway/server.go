@@ -0,0 +1,488 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/robwittman/possessive-potato/backend/internal/auth"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/permission"
+	"github.com/robwittman/possessive-potato/backend/internal/presence"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+	"github.com/robwittman/possessive-potato/backend/internal/typing"
+	"github.com/robwittman/possessive-potato/backend/internal/voice"
+	"github.com/rs/zerolog/log"
+)
+
+// handshakeTimeout is how long the server waits for IDENTIFY or RESUME.
+// Clients that send neither get a new session, as older clients expect.
+const handshakeTimeout = time.Second
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// Server accepts gateway WebSocket connections on /ws and manages this
+// node's sessions.
+type Server struct {
+	tokens   *auth.APITokenService
+	perms    *permission.Checker
+	servers  store.ServerStoreInterface
+	channels store.ChannelStoreInterface
+	hub      *Hub
+	replay   *ReplayBuffer
+	appends  *appender
+	registry *Registry
+	presence *presence.Service
+	typing   *typing.Service
+	voice    *voice.Service
+	sfu      *voice.SFU
+	queue    QueuePolicy
+	nodeID   string
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+	draining bool
+
+	// resyncs holds the sessions waiting to reload each server.
+	resyncMu sync.Mutex
+	resyncs  map[int64]map[*Session]struct{}
+}
+
+// NewServer creates a gateway server that bounds send queues with
+// DefaultQueuePolicy. Use WithQueuePolicy to override.
+func NewServer(
+	tokens *auth.APITokenService,
+	perms *permission.Checker,
+	servers store.ServerStoreInterface,
+	channels store.ChannelStoreInterface,
+	hub *Hub,
+	replay *ReplayBuffer,
+	registry *Registry,
+	presence *presence.Service,
+	typing *typing.Service,
+	voice *voice.Service,
+	sfu *voice.SFU,
+) *Server {
+	nodeID := model.NewID().String()
+	return &Server{
+		tokens:   tokens,
+		perms:    perms,
+		servers:  servers,
+		channels: channels,
+		hub:      hub,
+		replay:   replay,
+		appends:  newAppender(replay, nodeID),
+		registry: registry,
+		presence: presence,
+		typing:   typing,
+		voice:    voice,
+		sfu:      sfu,
+		queue:    DefaultQueuePolicy,
+		nodeID:   nodeID,
+		sessions: make(map[string]*Session),
+	}
+}
+
+// WithQueuePolicy replaces DefaultQueuePolicy and returns the server.
+func (s *Server) WithQueuePolicy(p QueuePolicy) *Server {
+	s.queue = p
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Draining() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "gateway is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	query := r.URL.Query()
+	principal, err := s.tokens.Authenticate(r.Context(), query.Get("token"))
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !principal.HasScope(model.ScopeReadMessages) {
+		http.Error(w, "token lacks the messages:read scope", http.StatusForbidden)
+		return
+	}
+	enc := events.JSON
+	if name := query.Get("encoding"); name != "" {
+		var ok bool
+		if enc, ok = events.LookupEncoder(name); !ok {
+			http.Error(w, "unknown encoding", http.StatusBadRequest)
+			return
+		}
+	}
+	comp, err := newCompressor(query.Get("compress"))
+	if err != nil {
+		http.Error(w, "unknown compression", http.StatusBadRequest)
+		return
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		if comp != nil {
+			comp.close()
+		}
+		return
+	}
+	c := newConn(ws, s.queue, enc, comp)
+
+	sess, first := s.start(r.Context(), principal, c)
+	if sess == nil {
+		return
+	}
+	if first != nil {
+		s.handle(r.Context(), sess, first)
+	}
+
+	for msg := range c.in {
+		s.handle(r.Context(), sess, msg)
+	}
+	sess.detach(c)
+}
+
+// start identifies or resumes the session c asks for in its first message.
+// A client that sends neither in time gets a new session without intents,
+// and the message it sent instead is returned to be handled. It returns no
+// session if the connection closed first or the handshake was malformed.
+func (s *Server) start(ctx context.Context, principal *auth.Principal, c *conn) (*Session, *clientMessage) {
+	first, ok := handshake(c)
+	if !ok {
+		return nil, nil
+	}
+
+	var sess *Session
+	var intents *Intents
+	if first != nil && first.Op == OpResume {
+		var p resumePayload
+		if json.Unmarshal(first.D, &p) == nil {
+			sess, intents = s.resume(ctx, principal, p, c)
+		}
+		if sess != nil {
+			return sess, nil
+		}
+		// Clients identify again after INVALID_SESSION. One that does not
+		// keeps the intents of the session it tried to resume.
+		c.send(events.Event{Type: events.InvalidSession, Data: events.InvalidSessionPayload{Resumable: false}})
+		if first, ok = handshake(c); !ok {
+			return nil, nil
+		}
+	}
+
+	p := identifyPayload{Intents: intents}
+	if first != nil && first.Op == OpIdentify {
+		if err := json.Unmarshal(first.D, &p); err != nil {
+			c.close(events.CloseDecodeError)
+			return nil, nil
+		}
+	}
+	sess = s.identify(ctx, principal, p.Intents, c)
+	if first != nil && (first.Op == OpIdentify || first.Op == OpResume) {
+		first = nil
+	}
+	return sess, first
+}
+
+// handshake waits up to handshakeTimeout for the client's next message. It
+// returns nil if none arrives in time, and false if the connection closed.
+func handshake(c *conn) (*clientMessage, bool) {
+	select {
+	case msg, ok := <-c.in:
+		return msg, ok
+	case <-time.After(handshakeTimeout):
+		return nil, true
+	}
+}
+
+// identify starts a new session on c. With intents, the session follows
+// every server the user belongs to before READY is sent.
+func (s *Server) identify(ctx context.Context, principal *auth.Principal, intents *Intents, c *conn) *Session {
+	sess := newSession(s, model.NewID().String(), principal, 0)
+	if intents != nil {
+		sess.auto = true
+		sess.intents = *intents & AllIntents
+	}
+	s.add(sess)
+	sess.mu.Lock()
+	sess.save()
+	sess.mu.Unlock()
+	s.hub.Subscribe(userTopic(sess.UserID), sess)
+	if sess.auto {
+		if err := s.syncServers(ctx, sess); err != nil {
+			log.Warn().Err(err).Str("session_id", sess.ID).Msg("failed to load gateway servers")
+		}
+	}
+	sess.attach(c, principal, nil, false)
+	return sess
+}
+
+// resume reattaches c to an earlier session, replaying the events the client
+// missed. It returns nil if the session cannot be resumed, along with the
+// session's intents if it was the user's and was identified with them.
+func (s *Server) resume(ctx context.Context, principal *auth.Principal, p resumePayload, c *conn) (*Session, *Intents) {
+	userID := principal.UserID
+	s.mu.Lock()
+	sess := s.sessions[p.SessionID]
+	s.mu.Unlock()
+
+	if sess != nil {
+		if sess.UserID != userID {
+			return nil, nil
+		}
+		sess.mu.Lock()
+		last := sess.seq
+		intents := sess.identifiedWith()
+		sess.resuming = true
+		sess.mu.Unlock()
+		s.appends.sync()
+		missed, ok, err := s.replay.Since(ctx, sess.ID, p.Seq, last)
+		if err != nil || !ok {
+			sess.mu.Lock()
+			sess.resuming = false
+			pending := sess.pending
+			sess.pending = nil
+			for _, event := range pending {
+				sess.deliver(event)
+			}
+			sess.mu.Unlock()
+			return nil, intents
+		}
+		sess.attach(c, principal, missed, true)
+		return sess, nil
+	}
+
+	// The session lives on another node, or did until that node went away.
+	// Subscribe before claiming so nothing published during the handover is
+	// missed; events received by both nodes in that moment may be delivered
+	// twice.
+	sess = newSession(s, p.SessionID, principal, 0)
+	sess.resuming = true
+	s.hub.Subscribe(userTopic(userID), sess)
+
+	meta, err := s.replay.Claim(ctx, p.SessionID, userID, s.nodeID)
+	if err != nil || meta == nil {
+		sess.close(events.CloseNormal, false)
+		return nil, nil
+	}
+	missed, ok, err := s.replay.Since(ctx, p.SessionID, p.Seq, meta.Seq)
+	if err != nil || !ok {
+		sess.close(events.CloseNormal, true)
+		if !meta.Auto {
+			return nil, nil
+		}
+		return nil, &meta.Intents
+	}
+
+	sess.mu.Lock()
+	sess.auto = meta.Auto
+	sess.intents = meta.Intents
+	sess.seq = meta.Seq
+	if !sess.auto {
+		for _, id := range meta.Channels {
+			sess.addChannelLocked(id, 0)
+		}
+	}
+	sess.mu.Unlock()
+	if sess.auto {
+		if err := s.syncServers(ctx, sess); err != nil {
+			log.Warn().Err(err).Str("session_id", sess.ID).Msg("failed to load gateway servers")
+		}
+	}
+	s.add(sess)
+	sess.attach(c, principal, missed, true)
+	return sess, nil
+}
+
+func (s *Server) handle(ctx context.Context, sess *Session, msg *clientMessage) {
+	switch msg.Op {
+	case OpSubscribe:
+		if sess.auto {
+			return // auto sessions' subscriptions follow the user's servers
+		}
+		var p subscribePayload
+		if json.Unmarshal(msg.D, &p) != nil {
+			return
+		}
+		if s.canRead(ctx, sess, p.ChannelID) {
+			sess.subscribe(p.ChannelID)
+		}
+	case OpUnsubscribe:
+		if sess.auto {
+			return
+		}
+		var p subscribePayload
+		if json.Unmarshal(msg.D, &p) != nil {
+			return
+		}
+		sess.unsubscribe(p.ChannelID)
+	case OpTypingStart:
+		var p typingStartPayload
+		if json.Unmarshal(msg.D, &p) != nil {
+			return
+		}
+		if ch := s.channel(ctx, p.ChannelID); ch == nil || !sess.can(model.ScopeSendMessages, ch.ServerID) {
+			return
+		}
+		err := s.typing.Start(ctx, p.ChannelID, sess.UserID)
+		if err != nil && !errors.Is(err, typing.ErrInvalidChannel) &&
+			!errors.Is(err, permission.ErrMissingPermission) && !errors.Is(err, permission.ErrNotMember) {
+			log.Warn().Err(err).Str("session_id", sess.ID).Msg("failed to start typing")
+		}
+	case OpVoiceStateUpdate:
+		if sess.apiToken() {
+			return // no token scope covers voice
+		}
+		var p voiceStateUpdatePayload
+		if json.Unmarshal(msg.D, &p) != nil {
+			return
+		}
+		var err error
+		if p.ChannelID == nil {
+			err = s.voice.Leave(ctx, sess.UserID, "")
+		} else {
+			var state *model.VoiceState
+			if state, err = s.voice.Join(ctx, sess.UserID, sess.ID, *p.ChannelID, p.SelfMute, p.SelfDeaf); err == nil {
+				err = s.sfu.Ready(ctx, state)
+			}
+		}
+		if err != nil && !errors.Is(err, voice.ErrInvalidChannel) && !errors.Is(err, voice.ErrChannelFull) &&
+			!errors.Is(err, permission.ErrMissingPermission) && !errors.Is(err, permission.ErrNotMember) {
+			log.Warn().Err(err).Str("session_id", sess.ID).Msg("failed to update voice state")
+		}
+	case OpVoiceSignal:
+		if sess.apiToken() {
+			return
+		}
+		var p events.VoiceSignalPayload
+		if json.Unmarshal(msg.D, &p) != nil {
+			return
+		}
+		p.UserID = sess.UserID
+		p.SessionID = sess.ID
+		if err := s.sfu.Signal(ctx, p); err != nil {
+			log.Warn().Err(err).Str("session_id", sess.ID).Msg("failed to forward voice signal")
+		}
+	case OpPresenceUpdate:
+		if sess.apiToken() {
+			return // nor presence
+		}
+		var p presenceUpdatePayload
+		if json.Unmarshal(msg.D, &p) != nil {
+			return
+		}
+		if p.Status != "" {
+			if err := s.presence.SetStatus(ctx, sess.UserID, p.Status); err != nil && !errors.Is(err, presence.ErrInvalidStatus) {
+				log.Warn().Err(err).Str("session_id", sess.ID).Msg("failed to set status")
+			}
+		}
+		if p.Idle != nil {
+			sess.setIdle(*p.Idle)
+		}
+		if p.CustomStatus != nil {
+			var cs *model.CustomStatus
+			if json.Unmarshal(p.CustomStatus, &cs) != nil {
+				return
+			}
+			if err := s.presence.SetCustomStatus(ctx, sess.UserID, cs); err != nil && !errors.Is(err, presence.ErrInvalidCustomStatus) {
+				log.Warn().Err(err).Str("session_id", sess.ID).Msg("failed to set custom status")
+			}
+		}
+		if p.Activities != nil {
+			if err := s.presence.SetActivities(ctx, sess.UserID, sess.ID, *p.Activities); err != nil && !errors.Is(err, presence.ErrInvalidActivity) {
+				log.Warn().Err(err).Str("session_id", sess.ID).Msg("failed to set activities")
+			}
+		}
+	}
+}
+
+// canRead reports whether the session's user may read a channel, and its
+// token allows them to.
+func (s *Server) canRead(ctx context.Context, sess *Session, channelID int64) bool {
+	ch := s.channel(ctx, channelID)
+	if ch == nil || !sess.can(model.ScopeReadMessages, ch.ServerID) {
+		return false
+	}
+	perms, err := s.perms.EffectiveInChannel(ctx, ch, sess.UserID)
+	if err != nil {
+		return false
+	}
+	return model.HasPermission(perms, model.PermissionReadMessages)
+}
+
+// channel returns a channel, or nil if it does not exist or cannot be loaded.
+func (s *Server) channel(ctx context.Context, channelID int64) *model.Channel {
+	ch, err := s.channels.GetByID(ctx, channelID)
+	if err != nil {
+		return nil
+	}
+	return ch
+}
+
+// Run keeps this node's connected sessions registered, and their users'
+// presence and voice states current, until ctx is done.
+func (s *Server) Run(ctx context.Context) {
+	ticker := time.NewTicker(registryRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		sessions := make([]*Session, 0, len(s.sessions))
+		for _, sess := range s.sessions {
+			sessions = append(sessions, sess)
+		}
+		s.mu.Unlock()
+
+		// Each takes one round trip, made without holding any session's lock.
+		infos := make([]SessionInfo, 0, len(sessions))
+		touches := make([]presence.SessionTouch, 0, len(sessions))
+		for _, sess := range sessions {
+			if info, touch, ok := sess.connected(); ok {
+				infos = append(infos, info)
+				touches = append(touches, touch)
+			}
+		}
+		if err := s.registry.Refresh(ctx, infos); err != nil {
+			log.Warn().Err(err).Msg("failed to refresh gateway sessions")
+		}
+		if err := s.presence.TouchAll(ctx, touches); err != nil {
+			log.Warn().Err(err).Msg("failed to refresh presence")
+		}
+
+		// Voice outlasts the connection while the session can be resumed.
+		voiceSessions := make(map[string]int64, len(sessions))
+		for _, sess := range sessions {
+			voiceSessions[sess.ID] = sess.UserID
+		}
+		if err := s.voice.Refresh(ctx, voiceSessions); err != nil {
+			log.Warn().Err(err).Msg("failed to refresh voice states")
+		}
+	}
+}
+
+func (s *Server) add(sess *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[sess.ID] = sess
+}
+
+func (s *Server) remove(sess *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[sess.ID] == sess {
+		delete(s.sessions, sess.ID)
+	}
+}
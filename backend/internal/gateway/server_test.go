@@ -0,0 +1,54 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/robwittman/possessive-potato/backend/internal/auth"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailedResumeKeepsIntents(t *testing.T) {
+	s, _ := newTestServer(t)
+	sess := autoSession(s, "a", 2)
+	sess.intents = IntentMessages
+	sess.seq = 5 // the buffer holds none of the events, so they cannot be replayed
+
+	resumed, intents := s.resume(context.Background(), &auth.Principal{UserID: 2}, resumePayload{SessionID: "a", Seq: 1}, nil)
+	assert.Nil(t, resumed)
+	if assert.NotNil(t, intents) {
+		assert.Equal(t, IntentMessages, *intents)
+	}
+
+	resumed, intents = s.resume(context.Background(), &auth.Principal{UserID: 3}, resumePayload{SessionID: "a", Seq: 1}, nil)
+	assert.Nil(t, resumed)
+	assert.Nil(t, intents, "another user's session")
+
+	resumed, intents = s.resume(context.Background(), &auth.Principal{UserID: 2}, resumePayload{SessionID: "b", Seq: 1}, nil)
+	assert.Nil(t, resumed)
+	assert.Nil(t, intents, "expired session")
+}
+
+func TestMalformedIdentifyClosesConnection(t *testing.T) {
+	s, _ := newTestServer(t)
+	c, client := dialConn(t)
+	started := make(chan *Session, 1)
+	go func() {
+		sess, _ := s.start(context.Background(), &auth.Principal{UserID: 2}, c)
+		started <- sess
+	}()
+
+	require.NoError(t, client.WriteMessage(websocket.TextMessage, []byte(`{"op":"IDENTIFY","d":{"intents":"messages"}}`)))
+	assert.Nil(t, <-started)
+	var err error
+	for err == nil {
+		_, _, err = client.ReadMessage() // HELLO, then the close
+	}
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, int(events.CloseDecodeError), closeErr.Code)
+	assert.Empty(t, s.sessions)
+}
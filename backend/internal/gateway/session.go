@@ -0,0 +1,481 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/robwittman/possessive-potato/backend/internal/auth"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/presence"
+	"github.com/rs/zerolog/log"
+)
+
+const redisTimeout = 2 * time.Second
+
+// sessionRecentKeys is how many event keys each session remembers to drop
+// events it receives on several topics, such as a user's presence on every
+// server they share with the session's user.
+const sessionRecentKeys = 64
+
+// Session is a client's logical gateway session. It outlives individual
+// WebSocket connections: when a connection drops, the session stays
+// subscribed and keeps buffering events for ResumeWindow so the client can
+// RESUME without losing anything.
+type Session struct {
+	ID     string
+	UserID int64
+
+	server *Server
+
+	// principal is how the current or last connection authenticated. It is
+	// guarded by mu.
+	principal *auth.Principal
+
+	// auto sessions follow every server their user belongs to; others
+	// subscribe to channels one at a time. Both are set before the session
+	// handles its first client message.
+	auto    bool
+	intents Intents
+
+	// syncMu serializes reloading the session's servers from the database.
+	syncMu sync.Mutex
+
+	// regMu serializes writing registrations, of which only the newest
+	// decided is written.
+	regMu      sync.Mutex
+	regWritten uint64
+
+	mu  sync.Mutex
+	seq int64
+	// channels maps each subscribed channel to its server, or to zero if the
+	// client subscribed to it directly.
+	channels map[int64]int64
+	// servers maps each server an auto session follows to the user's
+	// permissions there.
+	servers map[int64]int64
+	conn    *conn // nil while detached
+	// connectedAt is when conn was attached, and lastActive when its client
+	// last reported activity.
+	connectedAt time.Time
+	lastActive  time.Time
+	// recent drops events that reach the session on more than one topic.
+	recent *keyWindow
+	// resuming holds live events back while missed events are replayed.
+	resuming bool
+	pending  []events.Event
+	closed   bool
+	expiry   *time.Timer
+	// regSeq numbers the registrations decided for the session.
+	regSeq uint64
+}
+
+func newSession(server *Server, id string, principal *auth.Principal, seq int64) *Session {
+	return &Session{
+		ID:        id,
+		UserID:    principal.UserID,
+		server:    server,
+		principal: principal,
+		intents:   AllIntents,
+		seq:       seq,
+		channels:  make(map[int64]int64),
+		servers:   make(map[int64]int64),
+		recent:    newKeyWindow(sessionRecentKeys),
+	}
+}
+
+// dispatch sends a bus event received on topic to the client, numbering and
+// buffering it first. Events the session's intents or permissions exclude
+// are dropped.
+func (s *Session) dispatch(topic string, event events.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	if s.auto && !s.observe(topic, event) {
+		return
+	}
+	if !s.targeted(topic, event) || s.recent.duplicate(event.Key) {
+		return
+	}
+	if !s.intents.allows(event.Type) {
+		return
+	}
+	if s.resuming {
+		s.pending = append(s.pending, event)
+		return
+	}
+	s.deliver(event)
+}
+
+// deliver numbers an event and sends it, writing it to the replay buffer in
+// the background. It must be called with s.mu held.
+func (s *Session) deliver(event events.Event) {
+	if s.conn != nil && s.conn.drops(event.Type) {
+		droppedEvents.Add(event.Type, 1)
+		return
+	}
+	event.Seq = s.seq + 1
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Error().Err(err).Str("type", event.Type).Msg("failed to marshal gateway event")
+		return
+	}
+
+	s.server.appends.add(s, event.Seq, data)
+	s.seq = event.Seq
+	if s.conn != nil {
+		s.conn.enqueue(data)
+	}
+
+	if event.Type == events.SessionInvalidate {
+		s.closeLocked(events.CloseSessionInvalidated, true)
+	}
+}
+
+// attach binds a connection, authenticated as principal, to the session and
+// replays missed events to it. Live events that arrived while replaying are
+// sent after the replay.
+func (s *Session) attach(c *conn, principal *auth.Principal, missed [][]byte, resumed bool) {
+	s.mu.Lock()
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	if s.conn != nil && s.conn != c {
+		s.conn.close(events.CloseSessionReplaced)
+	}
+	s.conn = c
+	s.principal = principal
+	s.connectedAt = time.Now()
+	s.lastActive = s.connectedAt
+	reg := s.register()
+
+	for _, data := range missed {
+		c.enqueue(data)
+	}
+	if resumed {
+		c.send(events.Event{Type: events.Resumed, Data: events.ResumedPayload{}})
+	} else {
+		c.send(events.Event{Type: events.Ready, Data: events.ReadyPayload{SessionID: s.ID, UserID: s.UserID}})
+	}
+
+	s.resuming = false
+	for _, event := range s.pending {
+		s.deliver(event)
+	}
+	s.pending = nil
+	s.mu.Unlock()
+	s.write(reg)
+}
+
+// detach unbinds a closed connection. The session stays resumable for
+// ResumeWindow.
+func (s *Session) detach(c *conn) {
+	s.mu.Lock()
+	if s.conn != c || s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.conn = nil
+	reg := s.unregister()
+	s.save()
+	s.expiry = time.AfterFunc(ResumeWindow, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.conn == nil {
+			s.closeLocked(events.CloseNormal, false)
+			s.leaveVoice()
+		}
+	})
+	s.mu.Unlock()
+	s.write(reg)
+}
+
+// targeted reports whether an event received on topic is meant for this
+// session. The user's own presence is taken only from their user topic,
+// where invisible is not shown as offline, and a revoked API token closes
+// only the sessions it authenticated. Tokens limited to one server are not
+// told about others. It must be called with s.mu held.
+func (s *Session) targeted(topic string, event events.Event) bool {
+	switch event.Type {
+	case events.ServerCreate:
+		srv, ok := payload[model.Server](event)
+		return !ok || s.principal.Can(model.ScopeReadMessages, srv.ID)
+	case events.SessionInvalidate:
+		p, ok := payload[events.SessionInvalidatePayload](event)
+		if !ok {
+			return true
+		}
+		if p.TokenID != nil && *p.TokenID != s.principal.TokenID {
+			return false
+		}
+		return p.SessionID == "" || p.SessionID == s.ID
+	case events.PresenceUpdate:
+		p, ok := payload[events.PresenceUpdatePayload](event)
+		return !ok || p.UserID != s.UserID || topic == userTopic(s.UserID)
+	case events.VoiceServerInfo:
+		p, ok := payload[events.VoiceServerInfoPayload](event)
+		return !ok || p.SessionID == s.ID
+	}
+	return true
+}
+
+// can reports whether the session's token allows an action requiring scope
+// on serverID.
+func (s *Session) can(scope string, serverID int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.principal.Can(scope, serverID)
+}
+
+// apiToken reports whether the session authenticated with an API token.
+func (s *Session) apiToken() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.principal.IsAPIToken()
+}
+
+// identifiedWith returns the intents the session was identified with, or nil
+// if it subscribes to channels itself. It must be called with s.mu held.
+func (s *Session) identifiedWith() *Intents {
+	if !s.auto {
+		return nil
+	}
+	intents := s.intents
+	return &intents
+}
+
+// connected describes the attached connection for the registry and the
+// user's presence. ok is false while detached.
+func (s *Session) connected() (info SessionInfo, touch presence.SessionTouch, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return SessionInfo{}, presence.SessionTouch{}, false
+	}
+	return s.infoLocked(), s.touchLocked(), true
+}
+
+// touchLocked describes the session for the user's presence. It must be
+// called with s.mu held.
+func (s *Session) touchLocked() presence.SessionTouch {
+	return presence.SessionTouch{UserID: s.UserID, SessionID: s.ID, LastActive: s.lastActive}
+}
+
+func (s *Session) infoLocked() SessionInfo {
+	return SessionInfo{
+		SessionID:   s.ID,
+		UserID:      s.UserID,
+		Node:        s.server.nodeID,
+		Encoding:    s.conn.enc.Name(),
+		ConnectedAt: s.connectedAt,
+	}
+}
+
+// registration is a change to the session's entry in the registry and to
+// the user's presence. It is decided with s.mu held and written once it is
+// released, so that Redis never holds up dispatch.
+type registration struct {
+	seq uint64
+	// info is the connection to register, or nil to unregister.
+	info       *SessionInfo
+	lastActive time.Time
+}
+
+// register decides to record the attached connection in the registry and
+// the user's presence. It must be called with s.mu held.
+func (s *Session) register() registration {
+	s.regSeq++
+	info := s.infoLocked()
+	return registration{seq: s.regSeq, info: &info, lastActive: s.lastActive}
+}
+
+// unregister decides to remove the session from the registry and the user's
+// presence. It must be called with s.mu held.
+func (s *Session) unregister() registration {
+	s.regSeq++
+	return registration{seq: s.regSeq}
+}
+
+// write applies a registration unless a newer one has been written, which
+// may happen when registrations are written from different goroutines.
+func (s *Session) write(r registration) {
+	s.regMu.Lock()
+	defer s.regMu.Unlock()
+	if r.seq <= s.regWritten {
+		return
+	}
+	s.regWritten = r.seq
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if r.info != nil {
+		if err := s.server.registry.Register(ctx, *r.info); err != nil {
+			log.Warn().Err(err).Str("session_id", s.ID).Msg("failed to register gateway session")
+		}
+		if err := s.server.presence.Touch(ctx, s.UserID, s.ID, r.lastActive); err != nil {
+			log.Warn().Err(err).Str("session_id", s.ID).Msg("failed to update presence")
+		}
+		return
+	}
+	if err := s.server.registry.Unregister(ctx, s.UserID, s.ID); err != nil {
+		log.Warn().Err(err).Str("session_id", s.ID).Msg("failed to unregister gateway session")
+	}
+	if err := s.server.presence.Disconnect(ctx, s.UserID, s.ID); err != nil {
+		log.Warn().Err(err).Str("session_id", s.ID).Msg("failed to update presence")
+	}
+}
+
+// setIdle records the client's activity: idle clients count as inactive
+// since they connected, and others as active now.
+func (s *Session) setIdle(idle bool) {
+	s.mu.Lock()
+	if s.conn == nil {
+		s.mu.Unlock()
+		return
+	}
+	if idle {
+		s.lastActive = time.Time{}
+	} else {
+		s.lastActive = time.Now()
+	}
+	touch := s.touchLocked()
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := s.server.presence.TouchAll(ctx, []presence.SessionTouch{touch}); err != nil {
+		log.Warn().Err(err).Str("session_id", s.ID).Msg("failed to update presence")
+	}
+}
+
+// subscribe adds a channel to the session's subscriptions.
+func (s *Session) subscribe(channelID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	if s.addChannelLocked(channelID, 0) {
+		s.save()
+	}
+}
+
+func (s *Session) unsubscribe(channelID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.removeChannelLocked(channelID) {
+		s.save()
+	}
+}
+
+// addChannelLocked subscribes to a channel and reports whether it was new.
+// It must be called with s.mu held.
+func (s *Session) addChannelLocked(channelID, serverID int64) bool {
+	if _, ok := s.channels[channelID]; ok {
+		return false
+	}
+	s.channels[channelID] = serverID
+	s.server.hub.Subscribe(channelTopic(channelID), s)
+	return true
+}
+
+// removeChannelLocked unsubscribes from a channel and reports whether it was
+// subscribed. It must be called with s.mu held.
+func (s *Session) removeChannelLocked(channelID int64) bool {
+	if _, ok := s.channels[channelID]; !ok {
+		return false
+	}
+	delete(s.channels, channelID)
+	s.server.hub.Unsubscribe(channelTopic(channelID), s)
+	return true
+}
+
+// save persists the resumable state. It must be called with s.mu held.
+func (s *Session) save() {
+	channels := make([]int64, 0, len(s.channels))
+	for id := range s.channels {
+		channels = append(channels, id)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	err := s.server.replay.Save(ctx, s.ID, s.server.nodeID, sessionMeta{
+		UserID:   s.UserID,
+		Seq:      s.seq,
+		Channels: channels,
+		Auto:     s.auto,
+		Intents:  s.intents,
+	})
+	if errors.Is(err, ErrNotOwner) {
+		s.closeLocked(events.CloseSessionReplaced, false)
+		return
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("session_id", s.ID).Msg("failed to save gateway session")
+	}
+}
+
+// close ends the session for good.
+func (s *Session) close(code events.CloseCode, discard bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeLocked(code, discard)
+}
+
+// closeLocked unsubscribes the session and closes its connection. With
+// discard set, the session also can no longer be resumed.
+func (s *Session) closeLocked(code events.CloseCode, discard bool) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	if s.conn != nil {
+		s.conn.close(code)
+		s.conn = nil
+		go s.write(s.unregister())
+	}
+
+	// Hub callbacks hold no session locks, so unsubscribing here is safe.
+	s.server.hub.Unsubscribe(userTopic(s.UserID), s)
+	for id := range s.channels {
+		s.server.hub.Unsubscribe(channelTopic(id), s)
+	}
+	for id := range s.servers {
+		s.server.hub.Unsubscribe(serverTopic(id), s)
+	}
+	s.server.remove(s)
+
+	if discard {
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		defer cancel()
+		if err := s.server.replay.Delete(ctx, s.ID); err != nil {
+			log.Warn().Err(err).Str("session_id", s.ID).Msg("failed to discard gateway session")
+		}
+		s.leaveVoice()
+	}
+}
+
+// leaveVoice disconnects the user from voice if this session, which has
+// ended for good, held their connection. Sessions closed only on this node
+// may resume elsewhere and keep it.
+func (s *Session) leaveVoice() {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := s.server.voice.Leave(ctx, s.UserID, s.ID); err != nil {
+		log.Warn().Err(err).Str("session_id", s.ID).Msg("failed to leave voice")
+	}
+}
+
+func userTopic(userID int64) string       { return fmt.Sprintf("user:%d", userID) }
+func serverTopic(serverID int64) string   { return fmt.Sprintf("server:%d", serverID) }
+func channelTopic(channelID int64) string { return fmt.Sprintf("channel:%d", channelID) }
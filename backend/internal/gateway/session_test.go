@@ -0,0 +1,64 @@
+package gateway
+
+import (
+	"testing"
+
+	"github.com/robwittman/possessive-potato/backend/internal/auth"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionInvalidateTargeting(t *testing.T) {
+	tokenID, otherTokenID := int64(5), int64(6)
+	jwt := &Session{ID: "a", UserID: 1, principal: &auth.Principal{UserID: 1}}
+	pat := &Session{ID: "b", UserID: 1, principal: &auth.Principal{UserID: 1, TokenID: tokenID}}
+
+	tests := []struct {
+		name    string
+		payload events.SessionInvalidatePayload
+		jwt     bool
+		pat     bool
+	}{
+		{"all sessions", events.SessionInvalidatePayload{}, true, true},
+		{"one session", events.SessionInvalidatePayload{SessionID: "b"}, false, true},
+		{"revoked token", events.SessionInvalidatePayload{TokenID: &tokenID}, false, true},
+		{"other token", events.SessionInvalidatePayload{TokenID: &otherTokenID}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := events.Event{Type: events.SessionInvalidate, Data: &tt.payload}
+			assert.Equal(t, tt.jwt, jwt.targeted(userTopic(1), event), "JWT session")
+			assert.Equal(t, tt.pat, pat.targeted(userTopic(1), event), "API token session")
+		})
+	}
+}
+
+func TestServerCreateTargeting(t *testing.T) {
+	serverID := int64(7)
+	jwt := &Session{ID: "a", UserID: 1, principal: &auth.Principal{UserID: 1}}
+	pinned := &Session{ID: "b", UserID: 1, principal: &auth.Principal{
+		UserID:   1,
+		TokenID:  5,
+		Scopes:   []string{model.ScopeReadMessages},
+		ServerID: &serverID,
+	}}
+
+	same := events.Event{Type: events.ServerCreate, Data: &model.Server{ID: 7}}
+	other := events.Event{Type: events.ServerCreate, Data: &model.Server{ID: 8}}
+	assert.True(t, jwt.targeted(userTopic(1), same))
+	assert.True(t, jwt.targeted(userTopic(1), other))
+	assert.True(t, pinned.targeted(userTopic(1), same))
+	assert.False(t, pinned.targeted(userTopic(1), other))
+}
+
+func TestSessionCan(t *testing.T) {
+	sess := &Session{principal: &auth.Principal{UserID: 1, TokenID: 5, Scopes: []string{model.ScopeReadMessages}}}
+	assert.True(t, sess.apiToken())
+	assert.True(t, sess.can(model.ScopeReadMessages, 7))
+	assert.False(t, sess.can(model.ScopeSendMessages, 7))
+
+	sess = &Session{principal: &auth.Principal{UserID: 1}}
+	assert.False(t, sess.apiToken())
+	assert.True(t, sess.can(model.ScopeSendMessages, 7))
+}
@@ -0,0 +1,272 @@
+package interaction
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"unicode/utf8"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/robwittman/possessive-potato/backend/internal/bot"
+	"github.com/robwittman/possessive-potato/backend/internal/delivery"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/permission"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+)
+
+const (
+	MaxCommandsPerScope   = 100
+	MaxOptionsPerCommand  = 25
+	MaxDescriptionLength  = 100
+	MaxContentLength      = 2000
+	MaxStringOptionLength = 2000
+)
+
+var commandName = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+var (
+	ErrInvalidCommand  = errors.New("invalid command")
+	ErrTooManyCommands = fmt.Errorf("applications can register at most %d commands per scope", MaxCommandsPerScope)
+	ErrUnknownCommand  = errors.New("unknown command")
+	ErrBotNotInServer  = errors.New("the application's bot is not a member of this server")
+)
+
+// Service registers application commands and routes their interactions
+// between invoking users and applications.
+type Service struct {
+	commands store.ApplicationCommandStoreInterface
+	apps     store.ApplicationStoreInterface
+	users    store.UserStoreInterface
+	servers  store.ServerStoreInterface
+	channels store.ChannelStoreInterface
+	roles    store.RoleStoreInterface
+	messages store.MessageStoreInterface
+	perms    *permission.Checker
+	tx       store.TxManagerInterface
+	outbox   events.Publisher
+	bus      events.Publisher
+	redis    *redis.Client
+
+	client       *http.Client
+	allowPrivate bool
+}
+
+func NewService(
+	commands store.ApplicationCommandStoreInterface,
+	apps store.ApplicationStoreInterface,
+	users store.UserStoreInterface,
+	servers store.ServerStoreInterface,
+	channels store.ChannelStoreInterface,
+	roles store.RoleStoreInterface,
+	messages store.MessageStoreInterface,
+	perms *permission.Checker,
+	tx store.TxManagerInterface,
+	outbox events.Publisher,
+	bus events.Publisher,
+	redisClient *redis.Client,
+	allowPrivate bool,
+) *Service {
+	return &Service{
+		commands:     commands,
+		apps:         apps,
+		users:        users,
+		servers:      servers,
+		channels:     channels,
+		roles:        roles,
+		messages:     messages,
+		perms:        perms,
+		tx:           tx,
+		outbox:       outbox,
+		bus:          bus,
+		redis:        redisClient,
+		client:       delivery.NewHTTPClient(allowPrivate),
+		allowPrivate: allowPrivate,
+	}
+}
+
+// CommandParams describes a command to register.
+type CommandParams struct {
+	Name                     string
+	Description              string
+	Options                  []model.CommandOption
+	DefaultMemberPermissions *int64
+}
+
+// RegisterCommand creates a command, or replaces the application's command of
+// the same name, globally (serverID nil) or in one server. The actor must be
+// the application's owner or its bot.
+func (s *Service) RegisterCommand(ctx context.Context, actorID, appID int64, serverID *int64, params CommandParams) (*model.ApplicationCommand, error) {
+	app, err := s.application(ctx, actorID, appID)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateCommand(params); err != nil {
+		return nil, err
+	}
+	if serverID != nil {
+		member, err := s.servers.IsMember(ctx, *serverID, app.BotUserID)
+		if err != nil {
+			return nil, err
+		}
+		if !member {
+			return nil, ErrBotNotInServer
+		}
+	}
+
+	existing, err := s.commands.ListByApplication(ctx, app.ID, serverID)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) >= MaxCommandsPerScope && !hasCommandNamed(existing, params.Name) {
+		return nil, ErrTooManyCommands
+	}
+
+	var perms *int64
+	if params.DefaultMemberPermissions != nil {
+		p := *params.DefaultMemberPermissions & model.AllPermissions
+		perms = &p
+	}
+	options := params.Options
+	if options == nil {
+		options = []model.CommandOption{}
+	}
+	cmd := &model.ApplicationCommand{
+		ID:                       model.NewID().Int64(),
+		ApplicationID:            app.ID,
+		ServerID:                 serverID,
+		Name:                     params.Name,
+		Description:              params.Description,
+		Options:                  options,
+		DefaultMemberPermissions: perms,
+	}
+	if err := s.commands.Upsert(ctx, cmd); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// ListCommands returns the application's global commands, or its commands in
+// one server.
+func (s *Service) ListCommands(ctx context.Context, actorID, appID int64, serverID *int64) ([]model.ApplicationCommand, error) {
+	app, err := s.application(ctx, actorID, appID)
+	if err != nil {
+		return nil, err
+	}
+	return s.commands.ListByApplication(ctx, app.ID, serverID)
+}
+
+func (s *Service) DeleteCommand(ctx context.Context, actorID, appID, commandID int64) error {
+	app, err := s.application(ctx, actorID, appID)
+	if err != nil {
+		return err
+	}
+	cmd, err := s.commands.GetByID(ctx, commandID)
+	if err != nil {
+		return err
+	}
+	if cmd == nil || cmd.ApplicationID != app.ID {
+		return ErrUnknownCommand
+	}
+	return s.commands.Delete(ctx, cmd.ID)
+}
+
+// ListAvailable returns the commands a member can invoke in a server, for
+// client autocomplete. A server command hides a global command of the same
+// application and name.
+func (s *Service) ListAvailable(ctx context.Context, userID, serverID int64) ([]model.ApplicationCommand, error) {
+	perms, err := s.perms.Effective(ctx, serverID, userID)
+	if err != nil {
+		return nil, err
+	}
+	cmds, err := s.commands.ListForServer(ctx, serverID)
+	if err != nil {
+		return nil, err
+	}
+
+	type key struct {
+		app  int64
+		name string
+	}
+	seen := make(map[key]bool)
+	available := []model.ApplicationCommand{}
+	for _, cmd := range cmds {
+		k := key{cmd.ApplicationID, cmd.Name}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if cmd.UsableWith(perms) {
+			available = append(available, cmd)
+		}
+	}
+	return available, nil
+}
+
+// application loads an application the actor may manage commands for.
+func (s *Service) application(ctx context.Context, actorID, appID int64) (*model.Application, error) {
+	app, err := s.apps.GetByID(ctx, appID)
+	if err != nil {
+		return nil, err
+	}
+	if app == nil {
+		return nil, bot.ErrApplicationNotFound
+	}
+	if actorID != app.OwnerID && actorID != app.BotUserID {
+		return nil, bot.ErrNotOwner
+	}
+	return app, nil
+}
+
+func validateCommand(params CommandParams) error {
+	if !commandName.MatchString(params.Name) {
+		return fmt.Errorf("%w: name must be 1-32 lowercase letters, digits, - or _", ErrInvalidCommand)
+	}
+	if err := validateDescription(params.Description); err != nil {
+		return err
+	}
+	if len(params.Options) > MaxOptionsPerCommand {
+		return fmt.Errorf("%w: at most %d options", ErrInvalidCommand, MaxOptionsPerCommand)
+	}
+
+	names := make(map[string]bool)
+	optional := false
+	for _, opt := range params.Options {
+		if !commandName.MatchString(opt.Name) {
+			return fmt.Errorf("%w: invalid option name %q", ErrInvalidCommand, opt.Name)
+		}
+		if names[opt.Name] {
+			return fmt.Errorf("%w: duplicate option %q", ErrInvalidCommand, opt.Name)
+		}
+		names[opt.Name] = true
+		if !opt.Type.Valid() {
+			return fmt.Errorf("%w: option %q has an unsupported type", ErrInvalidCommand, opt.Name)
+		}
+		if err := validateDescription(opt.Description); err != nil {
+			return err
+		}
+		if opt.Required && optional {
+			return fmt.Errorf("%w: required options must come before optional ones", ErrInvalidCommand)
+		}
+		optional = optional || !opt.Required
+	}
+	return nil
+}
+
+func validateDescription(desc string) error {
+	if n := utf8.RuneCountInString(desc); n == 0 || n > MaxDescriptionLength {
+		return fmt.Errorf("%w: descriptions must be 1-%d characters", ErrInvalidCommand, MaxDescriptionLength)
+	}
+	return nil
+}
+
+func hasCommandNamed(cmds []model.ApplicationCommand, name string) bool {
+	for _, c := range cmds {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package interaction
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/robwittman/possessive-potato/backend/internal/auth"
+	"github.com/robwittman/possessive-potato/backend/internal/bot"
+	"github.com/robwittman/possessive-potato/backend/internal/delivery"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+)
+
+// SecretPrefix marks interaction endpoint signing secrets.
+const SecretPrefix = "ixsec_"
+
+var ErrEndpointVerification = errors.New("interactions endpoint did not answer the PING with a PONG")
+
+// SetInteractionsEndpoint routes the application's interactions to an HTTP
+// endpoint, or back to the gateway if url is empty. The endpoint must answer
+// a signed PING with a PONG before it is saved. The signing secret is
+// returned; it is kept across endpoint changes.
+func (s *Service) SetInteractionsEndpoint(ctx context.Context, ownerID, appID int64, url string) (string, error) {
+	app, err := s.apps.GetByID(ctx, appID)
+	if err != nil {
+		return "", err
+	}
+	if app == nil {
+		return "", bot.ErrApplicationNotFound
+	}
+	if app.OwnerID != ownerID {
+		return "", bot.ErrNotOwner
+	}
+
+	if url == "" {
+		return "", s.apps.UpdateInteractionsEndpoint(ctx, app.ID, nil, app.InteractionsSecret)
+	}
+	if err := delivery.ValidateURL(url, s.allowPrivate); err != nil {
+		return "", err
+	}
+
+	secret := app.InteractionsSecret
+	if secret == "" {
+		if secret, _, err = auth.GenerateSecret(SecretPrefix); err != nil {
+			return "", err
+		}
+	}
+	ping := model.Interaction{
+		ID:            model.NewID().Int64(),
+		ApplicationID: app.ID,
+		Type:          model.InteractionTypePing,
+		CreatedAt:     time.Now(),
+	}
+	resp, err := s.call(ctx, url, secret, ping)
+	if err != nil || resp.Type != model.InteractionResponsePong {
+		return "", ErrEndpointVerification
+	}
+
+	if err := s.apps.UpdateInteractionsEndpoint(ctx, app.ID, &url, secret); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// deliverHTTP sends an interaction to the application's endpoint and applies
+// the response it returns.
+func (s *Service) deliverHTTP(ctx context.Context, app *model.Application, st *state, it model.Interaction) error {
+	resp, err := s.call(ctx, *app.InteractionsEndpointURL, app.InteractionsSecret, it)
+	if err != nil {
+		return err
+	}
+	return s.respond(ctx, st, *resp)
+}
+
+// call POSTs a signed interaction and decodes the endpoint's response. The
+// endpoint has InitialResponseWindow to answer.
+func (s *Service) call(ctx context.Context, url, secret string, it model.Interaction) (*model.InteractionResponse, error) {
+	body, err := json.Marshal(it)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, InitialResponseWindow)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(delivery.HeaderSignature, delivery.Sign(secret, time.Now(), body))
+	req.Header.Set(delivery.HeaderDelivery, strconv.FormatInt(it.ID, 10))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("endpoint responded %s", res.Status)
+	}
+
+	var resp model.InteractionResponse
+	if err := json.NewDecoder(io.LimitReader(res.Body, 64<<10)).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("decode interaction response: %w", err)
+	}
+	return &resp, nil
+}
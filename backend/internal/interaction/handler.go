@@ -0,0 +1,119 @@
+package interaction
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/rs/zerolog/log"
+)
+
+// maxBodySize bounds interaction responses from applications.
+const maxBodySize = 64 << 10
+
+// Handler serves the token-authenticated endpoints applications use to
+// respond to interactions. Mount it under /api/v1/interactions.
+type Handler struct {
+	service *Service
+}
+
+func NewHandler(service *Service) *Handler {
+	return &Handler{service: service}
+}
+
+func (h *Handler) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Post("/{interactionID}/{token}/callback", h.callback)
+	r.Patch("/{interactionID}/{token}/messages/@original", h.editOriginal)
+	r.Post("/{interactionID}/{token}/followup", h.followUp)
+	return r
+}
+
+func (h *Handler) callback(w http.ResponseWriter, r *http.Request) {
+	id, ok := interactionID(w, r)
+	if !ok {
+		return
+	}
+	var resp model.InteractionResponse
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&resp); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if err := h.service.Respond(r.Context(), id, chi.URLParam(r, "token"), resp); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) editOriginal(w http.ResponseWriter, r *http.Request) {
+	id, ok := interactionID(w, r)
+	if !ok {
+		return
+	}
+	var data model.InteractionMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&data); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	msg, err := h.service.EditOriginal(r.Context(), id, chi.URLParam(r, "token"), data)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, msg)
+}
+
+func (h *Handler) followUp(w http.ResponseWriter, r *http.Request) {
+	id, ok := interactionID(w, r)
+	if !ok {
+		return
+	}
+	var data model.InteractionMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&data); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	msg, err := h.service.FollowUp(r.Context(), id, chi.URLParam(r, "token"), data)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, msg)
+}
+
+func interactionID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "interactionID"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, ErrUnknownInteraction.Error())
+		return 0, false
+	}
+	return id, true
+}
+
+func writeServiceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrUnknownInteraction):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrAlreadyResponded), errors.Is(err, ErrResponseTimeout), errors.Is(err, ErrNotResponded):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, ErrInvalidResponse), errors.Is(err, ErrEmptyContent), errors.Is(err, ErrContentTooLong):
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		log.Error().Err(err).Msg("interaction response failed")
+		writeError(w, http.StatusInternalServerError, "internal error")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
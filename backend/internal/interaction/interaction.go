@@ -0,0 +1,459 @@
+package interaction
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/robwittman/possessive-potato/backend/internal/auth"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/outbox"
+	"github.com/robwittman/possessive-potato/backend/internal/permission"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// InitialResponseWindow is how long an application has to reply to or
+	// defer an interaction.
+	InitialResponseWindow = 3 * time.Second
+	// TokenLifetime is how long an interaction token can edit the original
+	// response and send follow-ups.
+	TokenLifetime = 15 * time.Minute
+)
+
+var (
+	ErrUnknownInteraction = errors.New("unknown interaction")
+	ErrInvalidOption      = errors.New("invalid option")
+	ErrResponseTimeout    = errors.New("the interaction must be acknowledged within 3 seconds")
+	ErrAlreadyResponded   = errors.New("interaction has already been acknowledged")
+	ErrNotResponded       = errors.New("interaction has not been acknowledged")
+	ErrInvalidResponse    = errors.New("invalid interaction response")
+	ErrEmptyContent       = errors.New("cannot send an empty message")
+	ErrContentTooLong     = fmt.Errorf("message content must be at most %d characters", MaxContentLength)
+	ErrInteractionFailed  = errors.New("the application did not respond")
+)
+
+// state is what the server remembers about an interaction while its token is
+// valid. It lives in Redis and expires with the token.
+type state struct {
+	Interaction model.Interaction `json:"interaction"`
+	TokenHash   string            `json:"token_hash"`
+	BotUserID   int64             `json:"bot_user_id,string"`
+	Deferred    bool              `json:"deferred,omitempty"`
+	Ephemeral   bool              `json:"ephemeral,omitempty"`
+	Original    *model.Message    `json:"original,omitempty"`
+}
+
+// InvokeOption is an argument as typed by the invoking user.
+type InvokeOption struct {
+	Name  string          `json:"name"`
+	Value json.RawMessage `json:"value"`
+}
+
+type InvokeParams struct {
+	UserID    int64
+	ChannelID int64
+	CommandID int64
+	Options   []InvokeOption
+}
+
+// Invoke runs a command on behalf of a user. The interaction is delivered to
+// the application's HTTP endpoint if it has one, otherwise to its bot over
+// the gateway. The returned interaction has no token; only the application
+// receives that.
+func (s *Service) Invoke(ctx context.Context, params InvokeParams) (*model.Interaction, error) {
+	ch, err := s.channels.GetByID(ctx, params.ChannelID)
+	if err != nil {
+		return nil, err
+	}
+	if ch == nil || ch.Type != model.ChannelTypeText {
+		return nil, ErrUnknownCommand
+	}
+	perms, err := s.perms.Effective(ctx, ch.ServerID, params.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd, err := s.commands.GetByID(ctx, params.CommandID)
+	if err != nil {
+		return nil, err
+	}
+	if cmd == nil || (cmd.ServerID != nil && *cmd.ServerID != ch.ServerID) {
+		return nil, ErrUnknownCommand
+	}
+	app, err := s.apps.GetByID(ctx, cmd.ApplicationID)
+	if err != nil {
+		return nil, err
+	}
+	if app == nil {
+		return nil, ErrUnknownCommand
+	}
+	if member, err := s.servers.IsMember(ctx, ch.ServerID, app.BotUserID); err != nil {
+		return nil, err
+	} else if !member {
+		return nil, ErrUnknownCommand
+	}
+	if !model.HasPermission(perms, model.PermissionSendMessages) || !cmd.UsableWith(perms) {
+		return nil, permission.ErrMissingPermission
+	}
+
+	options, err := s.resolveOptions(ctx, ch.ServerID, cmd.Options, params.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	token, hash, err := auth.GenerateSecret("")
+	if err != nil {
+		return nil, err
+	}
+	it := model.Interaction{
+		ID:            model.NewID().Int64(),
+		ApplicationID: app.ID,
+		Type:          model.InteractionTypeCommand,
+		ServerID:      ch.ServerID,
+		ChannelID:     ch.ID,
+		UserID:        params.UserID,
+		Command:       &model.InteractionCommand{ID: cmd.ID, Name: cmd.Name, Options: options},
+		CreatedAt:     time.Now(),
+	}
+	st := &state{Interaction: it, TokenHash: hash, BotUserID: app.BotUserID}
+	if err := s.save(ctx, st, true); err != nil {
+		return nil, err
+	}
+
+	it.Token = token
+	if app.InteractionsEndpointURL != nil {
+		if err := s.deliverHTTP(ctx, app, st, it); err != nil {
+			log.Warn().Err(err).Int64("application_id", app.ID).Msg("interaction endpoint failed")
+			return nil, ErrInteractionFailed
+		}
+	} else {
+		event := events.Event{Type: events.InteractionCreate, Data: it}
+		if err := s.bus.Publish(ctx, fmt.Sprintf("user:%d", app.BotUserID), event); err != nil {
+			return nil, fmt.Errorf("publish interaction: %w", err)
+		}
+	}
+
+	it.Token = ""
+	return &it, nil
+}
+
+// Respond is the application's initial response to an interaction: a reply
+// or a deferral. It must arrive within InitialResponseWindow.
+func (s *Service) Respond(ctx context.Context, interactionID int64, token string, resp model.InteractionResponse) error {
+	st, err := s.load(ctx, interactionID, token)
+	if err != nil {
+		return err
+	}
+	if time.Since(st.Interaction.CreatedAt) > InitialResponseWindow {
+		return ErrResponseTimeout
+	}
+	return s.respond(ctx, st, resp)
+}
+
+func (s *Service) respond(ctx context.Context, st *state, resp model.InteractionResponse) error {
+	switch resp.Type {
+	case model.InteractionResponseMessage:
+		if resp.Data == nil {
+			return ErrInvalidResponse
+		}
+		if err := validateContent(resp.Data.Content); err != nil {
+			return err
+		}
+	case model.InteractionResponseDeferred:
+	default:
+		return ErrInvalidResponse
+	}
+
+	ackKey := fmt.Sprintf("interaction_ack:%d", st.Interaction.ID)
+	ok, err := s.redis.SetNX(ctx, ackKey, 1, TokenLifetime).Result()
+	if err != nil {
+		return fmt.Errorf("acknowledge interaction: %w", err)
+	}
+	if !ok {
+		return ErrAlreadyResponded
+	}
+
+	if resp.Type == model.InteractionResponseMessage {
+		msg, err := s.post(ctx, st, *resp.Data)
+		if err != nil {
+			s.redis.Del(ctx, ackKey)
+			return err
+		}
+		st.Original = msg
+		return s.save(ctx, st, false)
+	}
+
+	st.Deferred = true
+	st.Ephemeral = resp.Data != nil && resp.Data.Flags&model.MessageFlagEphemeral != 0
+	if err := s.save(ctx, st, false); err != nil {
+		s.redis.Del(ctx, ackKey)
+		return err
+	}
+	// Let clients show that the application is working on it.
+	event := events.Event{Type: events.InteractionDeferred, Data: events.InteractionDeferredPayload{
+		InteractionID: st.Interaction.ID,
+		ApplicationID: st.Interaction.ApplicationID,
+		ChannelID:     st.Interaction.ChannelID,
+		UserID:        st.Interaction.UserID,
+	}}
+	topic := fmt.Sprintf("channel:%d", st.Interaction.ChannelID)
+	if st.Ephemeral {
+		topic = fmt.Sprintf("user:%d", st.Interaction.UserID)
+	}
+	if err := s.bus.Publish(ctx, topic, event); err != nil {
+		log.Warn().Err(err).Int64("interaction_id", st.Interaction.ID).Msg("failed to publish interaction deferral")
+	}
+	return nil
+}
+
+// EditOriginal sets the content of the original response. After a deferral
+// this is how the reply is first sent.
+func (s *Service) EditOriginal(ctx context.Context, interactionID int64, token string, data model.InteractionMessage) (*model.Message, error) {
+	st, err := s.load(ctx, interactionID, token)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateContent(data.Content); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case st.Original == nil && !st.Deferred:
+		return nil, ErrNotResponded
+	case st.Original == nil:
+		// A deferred response keeps the visibility chosen when deferring.
+		data.Flags &^= model.MessageFlagEphemeral
+		if st.Ephemeral {
+			data.Flags |= model.MessageFlagEphemeral
+		}
+		msg, err := s.post(ctx, st, data)
+		if err != nil {
+			return nil, err
+		}
+		st.Original = msg
+	default:
+		msg := st.Original
+		now := time.Now()
+		msg.Content = data.Content
+		msg.EditedAt = &now
+		topic := fmt.Sprintf("user:%d", st.Interaction.UserID)
+		if msg.Flags&model.MessageFlagEphemeral == 0 {
+			if err := s.messages.Update(ctx, msg.ID, msg.Content); err != nil {
+				return nil, err
+			}
+			topic = fmt.Sprintf("channel:%d", msg.ChannelID)
+		}
+		event := events.Event{Type: events.MessageUpdate, Data: msg}
+		if err := s.bus.Publish(ctx, topic, event); err != nil {
+			log.Warn().Err(err).Int64("message_id", msg.ID).Msg("failed to publish interaction reply edit")
+		}
+	}
+
+	if err := s.save(ctx, st, false); err != nil {
+		return nil, err
+	}
+	return st.Original, nil
+}
+
+// FollowUp sends another message in response to an acknowledged interaction.
+func (s *Service) FollowUp(ctx context.Context, interactionID int64, token string, data model.InteractionMessage) (*model.Message, error) {
+	st, err := s.load(ctx, interactionID, token)
+	if err != nil {
+		return nil, err
+	}
+	if st.Original == nil && !st.Deferred {
+		return nil, ErrNotResponded
+	}
+	if err := validateContent(data.Content); err != nil {
+		return nil, err
+	}
+	return s.post(ctx, st, data)
+}
+
+// post sends a message from the application's bot. Ephemeral messages go only
+// to the invoking user and are not stored.
+func (s *Service) post(ctx context.Context, st *state, data model.InteractionMessage) (*model.Message, error) {
+	author := &model.MessageAuthor{ID: st.BotUserID, Bot: true}
+	if u, err := s.users.GetByID(ctx, st.BotUserID); err == nil && u != nil {
+		author.Username = u.Username
+		author.DisplayName = u.DisplayName
+		author.AvatarURL = u.AvatarURL
+	}
+	msg := &model.Message{
+		ID:        model.NewID().Int64(),
+		ChannelID: st.Interaction.ChannelID,
+		AuthorID:  st.BotUserID,
+		Content:   strings.TrimSpace(data.Content),
+		CreatedAt: time.Now(),
+		Author:    author,
+	}
+
+	event := events.Event{Type: events.MessageCreate, Data: msg}
+	if data.Flags&model.MessageFlagEphemeral != 0 {
+		// Ephemeral replies are never stored, so there is nothing for the
+		// event to diverge from.
+		msg.Flags = model.MessageFlagEphemeral
+		if err := s.bus.Publish(ctx, fmt.Sprintf("user:%d", st.Interaction.UserID), event); err != nil {
+			log.Warn().Err(err).Int64("message_id", msg.ID).Msg("failed to publish interaction reply")
+		}
+		return msg, nil
+	}
+
+	event.Key = outbox.Key(events.MessageCreate, msg.ID)
+	err := s.tx.InTx(ctx, func(ctx context.Context) error {
+		if err := s.messages.Create(ctx, msg); err != nil {
+			return err
+		}
+		return s.outbox.Publish(ctx, fmt.Sprintf("channel:%d", msg.ChannelID), event)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s *Service) load(ctx context.Context, interactionID int64, token string) (*state, error) {
+	raw, err := s.redis.Get(ctx, fmt.Sprintf("interaction:%d", interactionID)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrUnknownInteraction
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load interaction: %w", err)
+	}
+	var st state
+	if err := json.Unmarshal(raw, &st); err != nil {
+		return nil, fmt.Errorf("decode interaction: %w", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(st.TokenHash), []byte(auth.HashToken(token))) != 1 {
+		return nil, ErrUnknownInteraction
+	}
+	return &st, nil
+}
+
+// save stores the interaction state. The first save starts the token's
+// lifetime; later saves keep its expiry.
+func (s *Service) save(ctx context.Context, st *state, create bool) error {
+	raw, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("encode interaction: %w", err)
+	}
+	key := fmt.Sprintf("interaction:%d", st.Interaction.ID)
+	if create {
+		err = s.redis.Set(ctx, key, raw, TokenLifetime).Err()
+	} else {
+		err = s.redis.SetArgs(ctx, key, raw, redis.SetArgs{KeepTTL: true, Mode: "XX"}).Err()
+		if err == redis.Nil {
+			return ErrUnknownInteraction
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("save interaction: %w", err)
+	}
+	return nil
+}
+
+// resolveOptions checks the user's arguments against the command's options
+// and normalizes their values.
+func (s *Service) resolveOptions(ctx context.Context, serverID int64, declared []model.CommandOption, given []InvokeOption) ([]model.InteractionOption, error) {
+	values := make(map[string]json.RawMessage, len(given))
+	for _, o := range given {
+		values[o.Name] = o.Value
+	}
+
+	resolved := []model.InteractionOption{}
+	for _, opt := range declared {
+		raw, ok := values[opt.Name]
+		if !ok || len(raw) == 0 || string(raw) == "null" {
+			if opt.Required {
+				return nil, fmt.Errorf("%w: %q is required", ErrInvalidOption, opt.Name)
+			}
+			continue
+		}
+		delete(values, opt.Name)
+
+		value, err := s.resolveValue(ctx, serverID, opt, raw)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, model.InteractionOption{Name: opt.Name, Type: opt.Type, Value: value})
+	}
+	for name := range values {
+		return nil, fmt.Errorf("%w: unknown option %q", ErrInvalidOption, name)
+	}
+	return resolved, nil
+}
+
+func (s *Service) resolveValue(ctx context.Context, serverID int64, opt model.CommandOption, raw json.RawMessage) (json.RawMessage, error) {
+	invalid := func(reason string) error {
+		return fmt.Errorf("%w: %q %s", ErrInvalidOption, opt.Name, reason)
+	}
+
+	switch opt.Type {
+	case model.CommandOptionString:
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, invalid("must be a string")
+		}
+		if n := utf8.RuneCountInString(v); n == 0 || n > MaxStringOptionLength {
+			return nil, invalid(fmt.Sprintf("must be 1-%d characters", MaxStringOptionLength))
+		}
+		return json.Marshal(v)
+	case model.CommandOptionInteger:
+		var v int64
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, invalid("must be an integer")
+		}
+		return json.Marshal(v)
+	}
+
+	// User, channel and role values are snowflakes, sent as strings.
+	var rawID string
+	if err := json.Unmarshal(raw, &rawID); err != nil {
+		return nil, invalid("must be an ID string")
+	}
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		return nil, invalid("must be an ID string")
+	}
+
+	var found bool
+	switch opt.Type {
+	case model.CommandOptionUser:
+		found, err = s.servers.IsMember(ctx, serverID, id)
+	case model.CommandOptionChannel:
+		var ch *model.Channel
+		ch, err = s.channels.GetByID(ctx, id)
+		found = ch != nil && ch.ServerID == serverID
+	case model.CommandOptionRole:
+		var role *model.Role
+		role, err = s.roles.GetByID(ctx, id)
+		found = role != nil && role.ServerID == serverID
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, invalid("is not in this server")
+	}
+	return json.Marshal(rawID)
+}
+
+func validateContent(content string) error {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return ErrEmptyContent
+	}
+	if utf8.RuneCountInString(content) > MaxContentLength {
+		return ErrContentTooLong
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/robwittman/possessive-potato/backend/internal/config"
+)
+
+// Message is a rendered email ready for delivery.
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer delivers outgoing email.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// New returns the mailer selected by cfg.MailDriver ("smtp" or "log").
+func New(cfg *config.Config) (Mailer, error) {
+	switch cfg.MailDriver {
+	case "smtp":
+		m, err := NewSMTPMailer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	case "log", "":
+		return NewLogMailer(cfg.MailOutputDir), nil
+	default:
+		return nil, fmt.Errorf("unknown mail driver: %q", cfg.MailDriver)
+	}
+}
@@ -0,0 +1,78 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// smtpServer accepts one message and returns the commands it was sent and
+// the message's headers.
+func smtpServer(t *testing.T) (string, int, <-chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	got := make(chan []string, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		tp := textproto.NewConn(c)
+		var lines []string
+		tp.PrintfLine("220 test ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				got <- lines
+				return
+			}
+			lines = append(lines, line)
+			switch cmd := strings.ToUpper(strings.Fields(line + " ")[0]); cmd {
+			case "EHLO", "HELO":
+				tp.PrintfLine("250 test")
+			case "DATA":
+				tp.PrintfLine("354 go ahead")
+				header, _ := textproto.NewReader(bufio.NewReader(tp.DotReader())).ReadMIMEHeader()
+				lines = append(lines, "From: "+header.Get("From"))
+				tp.PrintfLine("250 queued")
+			case "QUIT":
+				tp.PrintfLine("221 bye")
+				got <- lines
+				return
+			default:
+				tp.PrintfLine("250 ok")
+			}
+		}
+	}()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return host, p, got
+}
+
+func TestSMTPMailerSendsBareEnvelopeSender(t *testing.T) {
+	host, port, got := smtpServer(t)
+	m, err := NewSMTPMailer(host, port, "", "", "Possessive Potato <no-reply@localhost>")
+	require.NoError(t, err)
+
+	require.NoError(t, m.Send(context.Background(), Message{To: "user@example.com", Subject: "Hi", Text: "hello"}))
+	lines := <-got
+	assert.Contains(t, lines, "MAIL FROM:<no-reply@localhost>")
+	assert.Contains(t, lines, "RCPT TO:<user@example.com>")
+	assert.Contains(t, lines, `From: "Possessive Potato" <no-reply@localhost>`)
+}
+
+func TestNewSMTPMailerRejectsBadSender(t *testing.T) {
+	_, err := NewSMTPMailer("localhost", 25, "", "", "not an address")
+	assert.Error(t, err)
+}
@@ -0,0 +1,63 @@
+package mail
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+)
+
+//go:embed templates/*
+var templatesFS embed.FS
+
+// Template names. Each has a .txt and .html variant under templates/.
+const (
+	TemplateVerifyEmail   = "verify_email"
+	TemplateResetPassword = "reset_password"
+	TemplateNewLogin      = "new_login"
+)
+
+var subjects = map[string]string{
+	TemplateVerifyEmail:   "Verify your email address",
+	TemplateResetPassword: "Reset your password",
+	TemplateNewLogin:      "New sign-in to your account",
+}
+
+var (
+	textTemplates = texttemplate.Must(texttemplate.ParseFS(templatesFS, "templates/*.txt"))
+	htmlTemplates = htmltemplate.Must(htmltemplate.ParseFS(templatesFS, "templates/*.html"))
+)
+
+// TemplateData is the data available to every email template.
+type TemplateData struct {
+	DisplayName string
+	Email       string
+	Link        string
+	ExpiresIn   string
+	IPAddress   string
+	UserAgent   string
+}
+
+// Render builds a Message addressed to data.Email from the named template.
+func Render(name string, data TemplateData) (Message, error) {
+	subject, ok := subjects[name]
+	if !ok {
+		return Message{}, fmt.Errorf("unknown mail template: %q", name)
+	}
+
+	var text, html bytes.Buffer
+	if err := textTemplates.ExecuteTemplate(&text, name+".txt", data); err != nil {
+		return Message{}, fmt.Errorf("render %s text: %w", name, err)
+	}
+	if err := htmlTemplates.ExecuteTemplate(&html, name+".html", data); err != nil {
+		return Message{}, fmt.Errorf("render %s html: %w", name, err)
+	}
+
+	return Message{
+		To:      data.Email,
+		Subject: subject,
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
@@ -0,0 +1,39 @@
+package model
+
+import (
+	"time"
+)
+
+// API token scopes
+const (
+	ScopeReadMessages = "messages:read"
+	ScopeSendMessages = "messages:send"
+	ScopeManageServer = "server:manage"
+)
+
+// ValidScopes lists every scope an API token may be granted.
+var ValidScopes = []string{
+	ScopeReadMessages,
+	ScopeSendMessages,
+	ScopeManageServer,
+}
+
+// APIToken is a user-created personal access token. Only a hash of the secret
+// is stored; TokenPrefix is kept so users can tell their tokens apart.
+type APIToken struct {
+	ID          int64      `json:"id,string" db:"id"`
+	UserID      int64      `json:"user_id,string" db:"user_id"`
+	Name        string     `json:"name" db:"name"`
+	TokenHash   string     `json:"-" db:"token_hash"`
+	TokenPrefix string     `json:"token_prefix" db:"token_prefix"`
+	Scopes      []string   `json:"scopes" db:"scopes"`
+	ServerID    *int64     `json:"server_id,string,omitempty" db:"server_id"`
+	ExpiresAt   *time.Time `json:"expires_at" db:"expires_at"`
+	LastUsedAt  *time.Time `json:"last_used_at" db:"last_used_at"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+}
+
+// Expired reports whether the token is past its expiry time.
+func (t *APIToken) Expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
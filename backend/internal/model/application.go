@@ -0,0 +1,22 @@
+package model
+
+import (
+	"time"
+)
+
+// Application is a developer-registered integration. Every application owns
+// exactly one bot user, which is how it appears in servers.
+type Application struct {
+	ID           int64     `json:"id,string" db:"id"`
+	OwnerID      int64     `json:"owner_id,string" db:"owner_id"`
+	Name         string    `json:"name" db:"name"`
+	Description  *string   `json:"description" db:"description"`
+	BotUserID    int64     `json:"bot_user_id,string" db:"bot_user_id"`
+	BotTokenHash string    `json:"-" db:"bot_token_hash"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+
+	// InteractionsEndpointURL, when set, receives interactions over HTTP
+	// instead of the bot's gateway connection.
+	InteractionsEndpointURL *string `json:"interactions_endpoint_url" db:"interactions_endpoint_url"`
+	InteractionsSecret      string  `json:"-" db:"interactions_secret"`
+}
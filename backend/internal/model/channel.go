@@ -12,11 +12,14 @@ const (
 )
 
 type Channel struct {
-	ID        int64       `json:"id,string" db:"id"`
-	ServerID  int64       `json:"server_id,string" db:"server_id"`
-	Name      string      `json:"name" db:"name"`
-	Type      ChannelType `json:"type" db:"type"`
-	Position  int         `json:"position" db:"position"`
-	Topic     *string     `json:"topic" db:"topic"`
-	CreatedAt time.Time   `json:"created_at" db:"created_at"`
+	ID       int64       `json:"id,string" db:"id"`
+	ServerID int64       `json:"server_id,string" db:"server_id"`
+	Name     string      `json:"name" db:"name"`
+	Type     ChannelType `json:"type" db:"type"`
+	Position int         `json:"position" db:"position"`
+	Topic    *string     `json:"topic" db:"topic"`
+	// UserLimit caps how many users can be in a voice channel at once.
+	// Zero means no limit.
+	UserLimit int       `json:"user_limit" db:"user_limit"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
 }
@@ -0,0 +1,58 @@
+package model
+
+import (
+	"time"
+)
+
+type CommandOptionType int
+
+const (
+	CommandOptionString  CommandOptionType = 3
+	CommandOptionInteger CommandOptionType = 4
+	CommandOptionUser    CommandOptionType = 6
+	CommandOptionChannel CommandOptionType = 7
+	CommandOptionRole    CommandOptionType = 8
+)
+
+// Valid reports whether t is a supported option type.
+func (t CommandOptionType) Valid() bool {
+	switch t {
+	case CommandOptionString, CommandOptionInteger, CommandOptionUser, CommandOptionChannel, CommandOptionRole:
+		return true
+	}
+	return false
+}
+
+// CommandOption is a typed argument to an application command.
+type CommandOption struct {
+	Type        CommandOptionType `json:"type"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Required    bool              `json:"required,omitempty"`
+}
+
+// ApplicationCommand is a slash command registered by an application, either
+// globally (ServerID nil) or for a single server.
+type ApplicationCommand struct {
+	ID            int64           `json:"id,string" db:"id"`
+	ApplicationID int64           `json:"application_id,string" db:"application_id"`
+	ServerID      *int64          `json:"server_id,string,omitempty" db:"server_id"`
+	Name          string          `json:"name" db:"name"`
+	Description   string          `json:"description" db:"description"`
+	Options       []CommandOption `json:"options" db:"options"`
+	// DefaultMemberPermissions restricts the command to members with these
+	// permissions. Nil allows everyone; zero allows only administrators.
+	DefaultMemberPermissions *int64    `json:"default_member_permissions,string" db:"default_member_permissions"`
+	CreatedAt                time.Time `json:"created_at" db:"created_at"`
+}
+
+// UsableWith reports whether a member with perms may invoke the command.
+func (c *ApplicationCommand) UsableWith(perms int64) bool {
+	if c.DefaultMemberPermissions == nil {
+		return true
+	}
+	if *c.DefaultMemberPermissions == 0 {
+		return perms&PermissionAdmin != 0
+	}
+	return HasPermission(perms, *c.DefaultMemberPermissions)
+}
@@ -0,0 +1,45 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// EventSubscription delivers a server's real-time events to an external
+// HTTPS endpoint. Payloads are signed with Secret.
+type EventSubscription struct {
+	ID                  int64     `json:"id,string" db:"id"`
+	ServerID            int64     `json:"server_id,string" db:"server_id"`
+	CreatedBy           *int64    `json:"created_by,string,omitempty" db:"created_by"`
+	URL                 string    `json:"url" db:"url"`
+	Secret              string    `json:"-" db:"secret"`
+	EventTypes          []string  `json:"event_types" db:"event_types"`
+	ChannelIDs          []int64   `json:"channel_ids" db:"channel_ids"`
+	Enabled             bool      `json:"enabled" db:"enabled"`
+	ConsecutiveFailures int       `json:"consecutive_failures" db:"consecutive_failures"`
+	DisabledReason      *string   `json:"disabled_reason" db:"disabled_reason"`
+	CreatedAt           time.Time `json:"created_at" db:"created_at"`
+}
+
+type DeliveryStatus string
+
+const (
+	DeliveryStatusPending   DeliveryStatus = "pending"
+	DeliveryStatusSucceeded DeliveryStatus = "succeeded"
+	DeliveryStatusFailed    DeliveryStatus = "failed"
+)
+
+// EventDelivery is one event queued for, or delivered to, a subscription.
+type EventDelivery struct {
+	ID             int64           `json:"id,string" db:"id"`
+	SubscriptionID int64           `json:"subscription_id,string" db:"subscription_id"`
+	EventType      string          `json:"event_type" db:"event_type"`
+	Payload        json.RawMessage `json:"payload" db:"payload"`
+	Status         DeliveryStatus  `json:"status" db:"status"`
+	Attempts       int             `json:"attempts" db:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at" db:"next_attempt_at"`
+	LastStatusCode *int            `json:"last_status_code" db:"last_status_code"`
+	LastError      *string         `json:"last_error" db:"last_error"`
+	DeliveredAt    *time.Time      `json:"delivered_at" db:"delivered_at"`
+	CreatedAt      time.Time       `json:"created_at" db:"created_at"`
+}
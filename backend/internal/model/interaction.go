@@ -0,0 +1,63 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type InteractionType int
+
+const (
+	InteractionTypePing    InteractionType = 1
+	InteractionTypeCommand InteractionType = 2
+)
+
+// InteractionOption is a resolved command argument. User, channel and role
+// values are snowflake strings; integers are JSON numbers.
+type InteractionOption struct {
+	Name  string            `json:"name"`
+	Type  CommandOptionType `json:"type"`
+	Value json.RawMessage   `json:"value"`
+}
+
+type InteractionCommand struct {
+	ID      int64               `json:"id,string"`
+	Name    string              `json:"name"`
+	Options []InteractionOption `json:"options"`
+}
+
+// Interaction is a user invoking one of an application's commands. Token
+// authorizes the application to respond and is valid for a limited time.
+type Interaction struct {
+	ID            int64               `json:"id,string"`
+	ApplicationID int64               `json:"application_id,string"`
+	Type          InteractionType     `json:"type"`
+	Token         string              `json:"token,omitempty"`
+	ServerID      int64               `json:"server_id,string,omitempty"`
+	ChannelID     int64               `json:"channel_id,string,omitempty"`
+	UserID        int64               `json:"user_id,string,omitempty"`
+	Command       *InteractionCommand `json:"command,omitempty"`
+	CreatedAt     time.Time           `json:"created_at"`
+}
+
+type InteractionResponseType int
+
+const (
+	InteractionResponsePong InteractionResponseType = 1
+	// InteractionResponseMessage replies with a message immediately.
+	InteractionResponseMessage InteractionResponseType = 4
+	// InteractionResponseDeferred acknowledges the interaction; the reply is
+	// sent later by editing the original response.
+	InteractionResponseDeferred InteractionResponseType = 5
+)
+
+// InteractionMessage is the content of an interaction reply or follow-up.
+type InteractionMessage struct {
+	Content string `json:"content"`
+	Flags   int    `json:"flags,omitempty"`
+}
+
+type InteractionResponse struct {
+	Type InteractionResponseType `json:"type"`
+	Data *InteractionMessage     `json:"data,omitempty"`
+}
@@ -4,12 +4,55 @@ import (
 	"time"
 )
 
+// Message is a chat message. It is posted either by a user (AuthorID) or by an
+// incoming webhook (WebhookID), in which case AuthorID is zero and the
+// per-post display name and avatar are kept in WebhookName/WebhookAvatarURL.
 type Message struct {
-	ID        int64      `json:"id,string" db:"id"`
-	ChannelID int64      `json:"channel_id,string" db:"channel_id"`
-	AuthorID  int64      `json:"author_id,string" db:"author_id"`
-	Content   string     `json:"content" db:"content"`
-	ThreadID  *int64     `json:"thread_id,string,omitempty" db:"thread_id"`
-	EditedAt  *time.Time `json:"edited_at,omitempty" db:"edited_at"`
-	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	ID               int64      `json:"id,string" db:"id"`
+	ChannelID        int64      `json:"channel_id,string" db:"channel_id"`
+	AuthorID         int64      `json:"author_id,string,omitempty" db:"author_id"`
+	WebhookID        *int64     `json:"webhook_id,string,omitempty" db:"webhook_id"`
+	WebhookName      *string    `json:"-" db:"webhook_name"`
+	WebhookAvatarURL *string    `json:"-" db:"webhook_avatar_url"`
+	Content          string     `json:"content" db:"content"`
+	ThreadID         *int64     `json:"thread_id,string,omitempty" db:"thread_id"`
+	EditedAt         *time.Time `json:"edited_at,omitempty" db:"edited_at"`
+	CreatedAt        time.Time  `json:"created_at" db:"created_at"`
+
+	// Author is populated when listing messages so clients need no extra lookups.
+	Author *MessageAuthor `json:"author,omitempty" db:"-"`
+
+	// Flags is only set on messages that are never stored, such as ephemeral
+	// interaction replies.
+	Flags int `json:"flags,omitempty" db:"-"`
+}
+
+// MessageFlagEphemeral marks a message that only its recipient can see. It is
+// delivered over the recipient's gateway connection and never stored.
+const MessageFlagEphemeral = 1 << 6
+
+// MessageAuthor is the public profile of whoever posted a message. For a
+// webhook post, ID is the webhook ID and Webhook is set.
+type MessageAuthor struct {
+	ID          int64   `json:"id,string"`
+	Username    string  `json:"username"`
+	DisplayName string  `json:"display_name"`
+	AvatarURL   *string `json:"avatar_url"`
+	Bot         bool    `json:"bot"`
+	Webhook     bool    `json:"webhook,omitempty"`
+}
+
+// WebhookAuthor builds the author shown for a webhook post.
+func (m *Message) WebhookAuthor() *MessageAuthor {
+	if m.WebhookID == nil || m.WebhookName == nil {
+		return nil
+	}
+	return &MessageAuthor{
+		ID:          *m.WebhookID,
+		Username:    *m.WebhookName,
+		DisplayName: *m.WebhookName,
+		AvatarURL:   m.WebhookAvatarURL,
+		Bot:         true,
+		Webhook:     true,
+	}
 }
@@ -0,0 +1,19 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// OutboxEntry is an event waiting to be published, or recently published,
+// by the outbox relay.
+type OutboxEntry struct {
+	ID             int64           `json:"id,string" db:"id"`
+	IdempotencyKey string          `json:"idempotency_key" db:"idempotency_key"`
+	Channel        string          `json:"channel" db:"channel"`
+	Payload        json.RawMessage `json:"payload" db:"payload"`
+	Attempts       int             `json:"attempts" db:"attempts"`
+	LastError      *string         `json:"last_error" db:"last_error"`
+	PublishedAt    *time.Time      `json:"published_at" db:"published_at"`
+	CreatedAt      time.Time       `json:"created_at" db:"created_at"`
+}
@@ -0,0 +1,61 @@
+package model
+
+import "time"
+
+// Presence is how a user appears: their status, the custom status they set,
+// and what their connections are doing.
+type Presence struct {
+	Status       UserStatus    `json:"status"`
+	CustomStatus *CustomStatus `json:"custom_status"`
+	Activities   []Activity    `json:"activities"`
+}
+
+// Public returns the presence as other users see it. Invisible users appear
+// offline, and offline users show nothing else.
+func (p Presence) Public() Presence {
+	if p.Status == "" || p.Status == UserStatusInvisible || p.Status == UserStatusOffline {
+		return Presence{Status: UserStatusOffline, Activities: []Activity{}}
+	}
+	return p
+}
+
+// CustomStatus is a short message a user sets, such as "In a meeting",
+// optionally with an emoji. It is cleared automatically at ExpiresAt.
+type CustomStatus struct {
+	Text      string     `json:"text"`
+	Emoji     *string    `json:"emoji"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// Expired reports whether the custom status has expired at now.
+func (c *CustomStatus) Expired(now time.Time) bool {
+	return c.ExpiresAt != nil && !now.Before(*c.ExpiresAt)
+}
+
+type ActivityType string
+
+const (
+	ActivityPlaying   ActivityType = "playing"
+	ActivityListening ActivityType = "listening"
+	ActivityWatching  ActivityType = "watching"
+	ActivityCompeting ActivityType = "competing"
+	// ActivityCustom shows Name on its own, as in "Deploying prod".
+	ActivityCustom ActivityType = "custom"
+)
+
+// Valid reports whether t is a known activity type.
+func (t ActivityType) Valid() bool {
+	switch t {
+	case ActivityPlaying, ActivityListening, ActivityWatching, ActivityCompeting, ActivityCustom:
+		return true
+	}
+	return false
+}
+
+// Activity is something a user or bot is doing. Activities are not stored;
+// each lasts as long as the gateway connection that set it.
+type Activity struct {
+	Type      ActivityType `json:"type"`
+	Name      string       `json:"name"`
+	StartedAt time.Time    `json:"started_at"`
+}
@@ -7,6 +7,7 @@ type Role struct {
 	Permissions int64   `json:"permissions" db:"permissions"`
 	Color       *string `json:"color" db:"color"`
 	Position    int     `json:"position" db:"position"`
+	Managed     bool    `json:"managed" db:"managed"`
 }
 
 type MemberRole struct {
@@ -29,4 +30,20 @@ const (
 	PermissionConnect        int64 = 1 << 9
 	PermissionSpeak          int64 = 1 << 10
 	PermissionShareScreen    int64 = 1 << 11
+	PermissionManageWebhooks int64 = 1 << 12
+	PermissionMuteMembers    int64 = 1 << 13
+	PermissionDeafenMembers  int64 = 1 << 14
+	PermissionMoveMembers    int64 = 1 << 15
 )
+
+// AllPermissions is every defined permission bit.
+const AllPermissions = PermissionAdmin | PermissionManageServer | PermissionManageChannels |
+	PermissionManageRoles | PermissionKickMembers | PermissionBanMembers | PermissionSendMessages |
+	PermissionReadMessages | PermissionManageMessages | PermissionConnect | PermissionSpeak |
+	PermissionShareScreen | PermissionManageWebhooks | PermissionMuteMembers | PermissionDeafenMembers |
+	PermissionMoveMembers
+
+// HasPermission reports whether perms grants perm. Administrators have every permission.
+func HasPermission(perms, perm int64) bool {
+	return perms&PermissionAdmin != 0 || perms&perm == perm
+}
@@ -0,0 +1,25 @@
+package model
+
+import (
+	"time"
+)
+
+type SecurityEventType string
+
+const (
+	SecurityEventLoginSuccess  SecurityEventType = "login_success"
+	SecurityEventLoginFailed   SecurityEventType = "login_failed"
+	SecurityEventAccountLocked SecurityEventType = "account_locked"
+	SecurityEventNewDevice     SecurityEventType = "new_device"
+	SecurityEventPasswordReset SecurityEventType = "password_reset"
+)
+
+// SecurityEvent is an entry in a user's account activity log.
+type SecurityEvent struct {
+	ID        int64             `json:"id,string" db:"id"`
+	UserID    int64             `json:"user_id,string" db:"user_id"`
+	Type      SecurityEventType `json:"type" db:"type"`
+	IPAddress *string           `json:"ip_address" db:"ip_address"`
+	UserAgent *string           `json:"user_agent" db:"user_agent"`
+	CreatedAt time.Time         `json:"created_at" db:"created_at"`
+}
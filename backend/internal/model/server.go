@@ -5,11 +5,12 @@ import (
 )
 
 type Server struct {
-	ID        int64     `json:"id,string" db:"id"`
-	Name      string    `json:"name" db:"name"`
-	OwnerID   int64     `json:"owner_id,string" db:"owner_id"`
-	IconURL   *string   `json:"icon_url" db:"icon_url"`
-	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	ID                   int64     `json:"id,string" db:"id"`
+	Name                 string    `json:"name" db:"name"`
+	OwnerID              int64     `json:"owner_id,string" db:"owner_id"`
+	IconURL              *string   `json:"icon_url" db:"icon_url"`
+	RequireVerifiedEmail bool      `json:"require_verified_email" db:"require_verified_email"`
+	CreatedAt            time.Time `json:"created_at" db:"created_at"`
 }
 
 type ServerMember struct {
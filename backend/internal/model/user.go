@@ -4,23 +4,47 @@ import (
 	"time"
 )
 
+// UserStatus is a user's presence. Users choose online, away, dnd or
+// invisible; they are shown offline while disconnected or invisible, and
+// away while every connection is idle.
 type UserStatus string
 
 const (
-	UserStatusOnline  UserStatus = "online"
-	UserStatusOffline UserStatus = "offline"
-	UserStatusAway    UserStatus = "away"
-	UserStatusDND     UserStatus = "dnd"
+	UserStatusOnline    UserStatus = "online"
+	UserStatusOffline   UserStatus = "offline"
+	UserStatusAway      UserStatus = "away"
+	UserStatusDND       UserStatus = "dnd"
+	UserStatusInvisible UserStatus = "invisible"
 )
 
+// Selectable reports whether users may choose s as their status.
+func (s UserStatus) Selectable() bool {
+	switch s {
+	case UserStatusOnline, UserStatusAway, UserStatusDND, UserStatusInvisible:
+		return true
+	}
+	return false
+}
+
+// User is a human account or, when Bot is set, the user identity of an
+// application. Bots have no email or password.
 type User struct {
-	ID           int64      `json:"id,string" db:"id"`
-	Username     string     `json:"username" db:"username"`
-	DisplayName  string     `json:"display_name" db:"display_name"`
-	Email        string     `json:"email" db:"email"`
-	PasswordHash string     `json:"-" db:"password_hash"`
-	AvatarURL    *string    `json:"avatar_url" db:"avatar_url"`
-	Status       UserStatus `json:"status" db:"status"`
-	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
-	UpdatedAt    time.Time  `json:"updated_at" db:"updated_at"`
+	ID              int64      `json:"id,string" db:"id"`
+	Username        string     `json:"username" db:"username"`
+	DisplayName     string     `json:"display_name" db:"display_name"`
+	Email           string     `json:"email" db:"email"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at" db:"email_verified_at"`
+	PasswordHash    string     `json:"-" db:"password_hash"`
+	AvatarURL       *string    `json:"avatar_url" db:"avatar_url"`
+	Bot             bool       `json:"bot" db:"bot"`
+	// Status is the status the user chose, not their presence; see
+	// presence.Service.
+	Status    UserStatus `json:"status" db:"status"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// EmailVerified reports whether the user has proven ownership of their email.
+func (u *User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
 }
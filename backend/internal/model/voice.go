@@ -0,0 +1,34 @@
+package model
+
+// VoiceState is a user's connection to a voice channel. A user is connected
+// to at most one voice channel at a time, through one gateway session.
+// ChannelID is nil once the user has left.
+type VoiceState struct {
+	ServerID  int64  `json:"server_id,string"`
+	ChannelID *int64 `json:"channel_id,string"`
+	UserID    int64  `json:"user_id,string"`
+	SessionID string `json:"session_id"`
+	// Mute and Deaf are set by moderators, SelfMute and SelfDeaf by the user.
+	Mute     bool `json:"mute"`
+	Deaf     bool `json:"deaf"`
+	SelfMute bool `json:"self_mute"`
+	SelfDeaf bool `json:"self_deaf"`
+	// Suppress is set when the user lacks the Speak permission, so they
+	// can listen but not be heard.
+	Suppress bool `json:"suppress"`
+	// SelfVideo and SelfStream are set while the user sends camera video
+	// and shares their screen.
+	SelfVideo  bool `json:"self_video"`
+	SelfStream bool `json:"self_stream"`
+}
+
+// Muted reports whether the user cannot currently be heard. Deafened users
+// are muted too.
+func (v *VoiceState) Muted() bool {
+	return v.Mute || v.Deaf || v.SelfMute || v.SelfDeaf || v.Suppress
+}
+
+// Deafened reports whether the user cannot currently hear others.
+func (v *VoiceState) Deafened() bool {
+	return v.Deaf || v.SelfDeaf
+}
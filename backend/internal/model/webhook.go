@@ -0,0 +1,18 @@
+package model
+
+import (
+	"time"
+)
+
+// Webhook is an incoming webhook that posts messages into a channel. Only a
+// hash of its secret token is stored.
+type Webhook struct {
+	ID        int64     `json:"id,string" db:"id"`
+	ServerID  int64     `json:"server_id,string" db:"server_id"`
+	ChannelID int64     `json:"channel_id,string" db:"channel_id"`
+	Name      string    `json:"name" db:"name"`
+	AvatarURL *string   `json:"avatar_url" db:"avatar_url"`
+	TokenHash string    `json:"-" db:"token_hash"`
+	CreatedBy *int64    `json:"created_by,string,omitempty" db:"created_by"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
@@ -0,0 +1,167 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// lockID is the Postgres advisory lock held by the relay leader.
+	lockID int64 = 0x6f7574626f78 // "outbox"
+
+	batchSize = 100
+	// pollInterval bounds publish latency if a NOTIFY is missed.
+	pollInterval = time.Second
+	// leaderRetry is how often a standby relay tries to become leader.
+	leaderRetry = 5 * time.Second
+	// MaxBackoff caps the wait after repeated publish failures.
+	MaxBackoff = 30 * time.Second
+
+	// Retention is how long published entries are kept before cleanup.
+	Retention       = 24 * time.Hour
+	cleanupInterval = time.Hour
+)
+
+// Relay publishes outbox entries to the event bus in the order they were
+// written and marks them published. Every replica may run a relay; an
+// advisory lock makes one of them leader. Delivery is at-least-once: an entry
+// published just before a crash is published again by the next leader, with
+// the same idempotency key.
+type Relay struct {
+	db     *pgxpool.Pool
+	outbox store.OutboxStoreInterface
+	// transport receives entries as stored: already-encoded events.
+	transport events.Transport
+}
+
+func NewRelay(db *pgxpool.Pool, outbox store.OutboxStoreInterface, transport events.Transport) *Relay {
+	return &Relay{db: db, outbox: outbox, transport: transport}
+}
+
+// Run relays entries until ctx is cancelled, standing by while another
+// replica holds leadership.
+func (r *Relay) Run(ctx context.Context) {
+	for {
+		if err := r.lead(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			log.Warn().Err(err).Msg("outbox relay stopped leading")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(leaderRetry):
+		}
+	}
+}
+
+// lead takes the advisory lock on a dedicated connection and relays until
+// ctx is cancelled or the connection fails. It returns nil without relaying
+// if another replica is leader.
+func (r *Relay) lead(ctx context.Context) error {
+	conn, err := r.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// The lock and LISTEN belong to this session, so the connection is
+	// closed rather than returned to the pool.
+	defer func() {
+		conn.Conn().Close(context.Background())
+		conn.Release()
+	}()
+
+	var leader bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, lockID).Scan(&leader); err != nil {
+		return err
+	}
+	if !leader {
+		return nil
+	}
+	if _, err := conn.Exec(ctx, "LISTEN "+store.OutboxNotifyChannel); err != nil {
+		return err
+	}
+	log.Info().Msg("outbox relay leading")
+
+	backoff := time.Duration(0)
+	lastCleanup := time.Time{}
+	for {
+		if time.Since(lastCleanup) > cleanupInterval {
+			r.cleanup(ctx)
+			lastCleanup = time.Now()
+		}
+
+		more, err := r.relayBatch(ctx)
+		switch {
+		case err != nil:
+			backoff = min(max(2*backoff, pollInterval), MaxBackoff)
+			log.Warn().Err(err).Dur("retry_in", backoff).Msg("outbox relay failed")
+		case more:
+			backoff = 0
+			continue
+		default:
+			backoff = 0
+		}
+
+		wait := pollInterval
+		if backoff > 0 {
+			wait = backoff
+		}
+		waitCtx, cancel := context.WithTimeout(ctx, wait)
+		_, err = conn.Conn().WaitForNotification(waitCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+	}
+}
+
+// relayBatch publishes the oldest unpublished entries in order. It stops at
+// the first failure so later events never overtake earlier ones, and reports
+// whether a full batch was relayed and more may be waiting.
+func (r *Relay) relayBatch(ctx context.Context) (bool, error) {
+	entries, err := r.outbox.ListUnpublished(ctx, batchSize)
+	if err != nil {
+		return false, err
+	}
+
+	published := make([]int64, 0, len(entries))
+	var publishErr error
+	for _, e := range entries {
+		if err := r.transport.Publish(ctx, e.Channel, e.Payload); err != nil {
+			publishErr = err
+			if err := r.outbox.RecordFailure(ctx, e.ID, err.Error()); err != nil {
+				log.Warn().Err(err).Int64("entry_id", e.ID).Msg("failed to record outbox failure")
+			}
+			break
+		}
+		published = append(published, e.ID)
+	}
+
+	if len(published) > 0 {
+		if err := r.outbox.MarkPublished(ctx, published); err != nil {
+			return false, err
+		}
+	}
+	if publishErr != nil {
+		return false, publishErr
+	}
+	return len(entries) == batchSize, nil
+}
+
+func (r *Relay) cleanup(ctx context.Context) {
+	n, err := r.outbox.DeletePublishedBefore(ctx, time.Now().Add(-Retention))
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to clean up outbox")
+		return
+	}
+	if n > 0 {
+		log.Debug().Int64("deleted", n).Msg("cleaned up outbox")
+	}
+}
@@ -0,0 +1,48 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+)
+
+// Writer is an events.Publisher that records events in the outbox instead of
+// publishing them. Call it inside store.TxManager.InTx alongside the write the
+// event describes; the Relay publishes the event once the transaction commits.
+type Writer struct {
+	outbox store.OutboxStoreInterface
+}
+
+func NewWriter(outbox store.OutboxStoreInterface) *Writer {
+	return &Writer{outbox: outbox}
+}
+
+// Publish records event for channel. Events without a Key are given one, so
+// consumers can drop the repeats at-least-once delivery allows.
+func (w *Writer) Publish(ctx context.Context, channel string, event events.Event) error {
+	id := model.NewID().Int64()
+	if event.Key == "" {
+		event.Key = strconv.FormatInt(id, 10)
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+	return w.outbox.Add(ctx, &model.OutboxEntry{
+		ID:             id,
+		IdempotencyKey: event.Key,
+		Channel:        channel,
+		Payload:        payload,
+	})
+}
+
+// Key builds an idempotency key for an event about a single entity, such as
+// Key(events.MessageCreate, msg.ID).
+func Key(eventType string, id int64) string {
+	return eventType + ":" + strconv.FormatInt(id, 10)
+}
@@ -0,0 +1,119 @@
+package permission
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/robwittman/possessive-potato/backend/internal/auth"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+)
+
+var (
+	ErrNotMember         = errors.New("not a member of this server")
+	ErrMissingPermission = errors.New("missing permission")
+)
+
+// Checker computes a member's effective server permissions. The server owner
+// implicitly has every permission.
+type Checker struct {
+	servers store.ServerStoreInterface
+	roles   store.RoleStoreInterface
+
+	// users is set when sending may require a verified email.
+	users                store.UserStoreInterface
+	requireVerifiedEmail bool
+}
+
+func NewChecker(servers store.ServerStoreInterface, roles store.RoleStoreInterface) *Checker {
+	return &Checker{servers: servers, roles: roles}
+}
+
+// WithVerifiedEmail makes the checker withhold the Send Messages permission
+// from users without a verified email, in every server if instanceRequired is
+// set and otherwise in servers that require one. It returns the checker.
+func (c *Checker) WithVerifiedEmail(users store.UserStoreInterface, instanceRequired bool) *Checker {
+	c.users = users
+	c.requireVerifiedEmail = instanceRequired
+	return c
+}
+
+// Effective returns the user's permission bitfield in the server, or
+// ErrNotMember if they are not a member.
+func (c *Checker) Effective(ctx context.Context, serverID, userID int64) (int64, error) {
+	server, err := c.servers.GetByID(ctx, serverID)
+	if err != nil {
+		return 0, err
+	}
+	if server == nil {
+		return 0, fmt.Errorf("server not found")
+	}
+	var perms int64
+	if server.OwnerID == userID {
+		perms = model.AllPermissions
+	} else {
+		member, err := c.servers.IsMember(ctx, serverID, userID)
+		if err != nil {
+			return 0, err
+		}
+		if !member {
+			return 0, ErrNotMember
+		}
+		perms, err = c.roles.GetMemberPermissions(ctx, serverID, userID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return c.withholdUnverified(ctx, server, userID, perms)
+}
+
+// withholdUnverified removes Send Messages from perms if the server or the
+// instance requires a verified email the user does not have. An unverified
+// administrator keeps every other permission.
+func (c *Checker) withholdUnverified(ctx context.Context, server *model.Server, userID, perms int64) (int64, error) {
+	if c.users == nil || !model.HasPermission(perms, model.PermissionSendMessages) ||
+		!(c.requireVerifiedEmail || server.RequireVerifiedEmail) {
+		return perms, nil
+	}
+	user, err := c.users.GetByID(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	if user == nil || auth.RequireVerifiedEmail(c.requireVerifiedEmail, server, user) == nil {
+		return perms, nil
+	}
+	if perms&model.PermissionAdmin != 0 {
+		perms = model.AllPermissions &^ model.PermissionAdmin
+	}
+	return perms &^ model.PermissionSendMessages, nil
+}
+
+// InChannel returns the permissions a member with the given server-wide
+// permissions has in a channel. Channels do not yet override server
+// permissions, so this is where per-channel permissions will apply.
+func InChannel(perms int64, ch *model.Channel) int64 {
+	return perms
+}
+
+// EffectiveInChannel returns the user's permission bitfield in a channel, or
+// ErrNotMember if they are not a member of its server.
+func (c *Checker) EffectiveInChannel(ctx context.Context, ch *model.Channel, userID int64) (int64, error) {
+	perms, err := c.Effective(ctx, ch.ServerID, userID)
+	if err != nil {
+		return 0, err
+	}
+	return InChannel(perms, ch), nil
+}
+
+// Require returns ErrMissingPermission unless the user has perm in the server.
+func (c *Checker) Require(ctx context.Context, serverID, userID, perm int64) error {
+	perms, err := c.Effective(ctx, serverID, userID)
+	if err != nil {
+		return err
+	}
+	if !model.HasPermission(perms, perm) {
+		return ErrMissingPermission
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package permission
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	serverID = 10
+	// verifiedServerID requires a verified email to send.
+	verifiedServerID = 11
+	ownerID          = 1
+	memberID         = 2
+	outsider         = 3
+)
+
+type fakeServers struct{ store.ServerStoreInterface }
+
+func (fakeServers) GetByID(_ context.Context, id int64) (*model.Server, error) {
+	if id != serverID && id != verifiedServerID {
+		return nil, nil
+	}
+	return &model.Server{ID: id, OwnerID: ownerID, RequireVerifiedEmail: id == verifiedServerID}, nil
+}
+
+func (fakeServers) IsMember(_ context.Context, _, userID int64) (bool, error) {
+	return userID == ownerID || userID == memberID || userID == verifiedID, nil
+}
+
+type fakeRoles struct{ store.RoleStoreInterface }
+
+// fakeUsers has the owner and member unverified, and a verified member.
+type fakeUsers struct{ store.UserStoreInterface }
+
+const verifiedID = 4
+
+func (fakeUsers) GetByID(_ context.Context, id int64) (*model.User, error) {
+	user := &model.User{ID: id}
+	if id == verifiedID {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+	return user, nil
+}
+
+func (fakeRoles) GetMemberPermissions(_ context.Context, _, userID int64) (int64, error) {
+	if userID == memberID {
+		return model.PermissionReadMessages, nil
+	}
+	return model.PermissionReadMessages | model.PermissionSendMessages, nil
+}
+
+func TestEffective(t *testing.T) {
+	ctx := context.Background()
+	c := NewChecker(fakeServers{}, fakeRoles{})
+
+	perms, err := c.Effective(ctx, serverID, ownerID)
+	require.NoError(t, err)
+	assert.Equal(t, model.AllPermissions, perms)
+
+	perms, err = c.Effective(ctx, serverID, memberID)
+	require.NoError(t, err)
+	assert.Equal(t, model.PermissionReadMessages, perms)
+
+	_, err = c.Effective(ctx, serverID, outsider)
+	assert.ErrorIs(t, err, ErrNotMember)
+
+	_, err = c.Effective(ctx, 99, memberID)
+	assert.Error(t, err)
+}
+
+func TestEffectiveInChannel(t *testing.T) {
+	ctx := context.Background()
+	c := NewChecker(fakeServers{}, fakeRoles{})
+	ch := &model.Channel{ID: 20, ServerID: serverID}
+
+	perms, err := c.EffectiveInChannel(ctx, ch, memberID)
+	require.NoError(t, err)
+	assert.Equal(t, InChannel(model.PermissionReadMessages, ch), perms)
+
+	_, err = c.EffectiveInChannel(ctx, ch, outsider)
+	assert.ErrorIs(t, err, ErrNotMember)
+}
+
+func TestRequire(t *testing.T) {
+	ctx := context.Background()
+	c := NewChecker(fakeServers{}, fakeRoles{})
+	assert.NoError(t, c.Require(ctx, serverID, memberID, model.PermissionReadMessages))
+	assert.ErrorIs(t, c.Require(ctx, serverID, memberID, model.PermissionSendMessages), ErrMissingPermission)
+	assert.NoError(t, c.Require(ctx, serverID, ownerID, model.PermissionSendMessages))
+}
+
+func TestEffectiveRequiresVerifiedEmail(t *testing.T) {
+	ctx := context.Background()
+	send := model.PermissionSendMessages
+
+	// Only servers that ask for a verified email withhold sending.
+	c := NewChecker(fakeServers{}, fakeRoles{}).WithVerifiedEmail(fakeUsers{}, false)
+	assert.NoError(t, c.Require(ctx, serverID, ownerID, send))
+	assert.ErrorIs(t, c.Require(ctx, verifiedServerID, ownerID, send), ErrMissingPermission)
+	assert.NoError(t, c.Require(ctx, verifiedServerID, verifiedID, send))
+	perms, err := c.Effective(ctx, verifiedServerID, ownerID)
+	require.NoError(t, err)
+	assert.Equal(t, model.AllPermissions&^(model.PermissionAdmin|send), perms, "owner lost more than sending")
+
+	// The instance can ask for one everywhere.
+	c = NewChecker(fakeServers{}, fakeRoles{}).WithVerifiedEmail(fakeUsers{}, true)
+	assert.ErrorIs(t, c.Require(ctx, serverID, ownerID, send), ErrMissingPermission)
+	assert.NoError(t, c.Require(ctx, serverID, verifiedID, send))
+	assert.NoError(t, c.Require(ctx, serverID, ownerID, model.PermissionReadMessages))
+}
@@ -0,0 +1,602 @@
+// Package presence derives each user's presence from the status and custom
+// status they chose and their gateway connections and activities, and tells
+// the users they share a server with when it changes.
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/robwittman/possessive-potato/backend/internal/config"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// SessionTTL is how long a session counts as connected without being
+	// touched, so users on a gateway node that died go offline on their own.
+	SessionTTL = 90 * time.Second
+
+	// stateTTL bounds how long chosen and last published statuses are cached.
+	stateTTL = 24 * time.Hour
+	// flushInterval is how often due updates are published.
+	flushInterval = 250 * time.Millisecond
+	// flushBatch is the most users published per flush.
+	flushBatch = 100
+	// memberCountTTL is how long server member counts are cached.
+	memberCountTTL = time.Minute
+)
+
+var (
+	// ErrInvalidStatus is returned for a status users cannot choose.
+	ErrInvalidStatus       = errors.New("status cannot be chosen")
+	ErrInvalidCustomStatus = errors.New("invalid custom status")
+	ErrInvalidActivity     = errors.New("invalid activity")
+)
+
+// Limits on custom statuses and activities.
+const (
+	maxCustomStatusText  = 128
+	maxCustomStatusEmoji = 64
+	maxActivities        = 5
+	maxActivityName      = 128
+)
+
+// Policy controls presence. A user with no activity on any connection for
+// AwayAfter is shown away. Changes are published Debounce after the first
+// one, so a flapping connection sends one update. Servers with more than
+// LargeServerThreshold members get no presence updates; their clients ask
+// for the statuses of the members they show instead.
+type Policy struct {
+	AwayAfter            time.Duration
+	Debounce             time.Duration
+	LargeServerThreshold int
+}
+
+var DefaultPolicy = Policy{
+	AwayAfter:            10 * time.Minute,
+	Debounce:             2 * time.Second,
+	LargeServerThreshold: 1000,
+}
+
+// PolicyFromConfig overrides the default policy with any values set in cfg.
+func PolicyFromConfig(cfg *config.Config) Policy {
+	p := DefaultPolicy
+	if cfg.PresenceAwayAfter > 0 {
+		p.AwayAfter = cfg.PresenceAwayAfter
+	}
+	if cfg.PresenceDebounce > 0 {
+		p.Debounce = cfg.PresenceDebounce
+	}
+	if cfg.PresenceLargeServerThreshold > 0 {
+		p.LargeServerThreshold = cfg.PresenceLargeServerThreshold
+	}
+	return p
+}
+
+// Service tracks users' connected sessions in Redis, so every gateway node
+// and API process sees the same presence.
+type Service struct {
+	redis   *redis.Client
+	users   store.UserStoreInterface
+	servers store.ServerStoreInterface
+	bus     events.Publisher
+	policy  Policy
+
+	mu     sync.Mutex
+	counts map[int64]memberCounts // by user
+}
+
+type memberCounts struct {
+	servers map[int64]int
+	at      time.Time
+}
+
+// NewService creates a presence service with DefaultPolicy. Use WithPolicy
+// to override.
+func NewService(redisClient *redis.Client, users store.UserStoreInterface, servers store.ServerStoreInterface, bus events.Publisher) *Service {
+	return &Service{
+		redis:   redisClient,
+		users:   users,
+		servers: servers,
+		bus:     bus,
+		policy:  DefaultPolicy,
+		counts:  make(map[int64]memberCounts),
+	}
+}
+
+// WithPolicy replaces the policy and returns the service.
+func (s *Service) WithPolicy(p Policy) *Service {
+	s.policy = p
+	return s
+}
+
+func sessionsKey(userID int64) string { return "presence_sessions:" + strconv.FormatInt(userID, 10) }
+func idleKey(userID int64) string     { return "presence_idle:" + strconv.FormatInt(userID, 10) }
+func chosenKey(userID int64) string   { return "presence_chosen:" + strconv.FormatInt(userID, 10) }
+func lastKey(userID int64) string     { return "presence_last:" + strconv.FormatInt(userID, 10) }
+
+// activitiesKey holds each session's activities.
+func activitiesKey(userID int64) string {
+	return "presence_activities:" + strconv.FormatInt(userID, 10)
+}
+
+// dueKey holds users whose presence may have changed, scored by when to
+// publish it. expiryKey holds users with sessions, scored by when their last
+// session expires.
+const (
+	dueKey    = "presence_due"
+	expiryKey = "presence_expiry"
+)
+
+// touchScript records a session as connected, and idle or not, dropping
+// expired sessions, and schedules an update if any of that changed anything.
+// ARGV[1] is empty to only drop expired sessions.
+var touchScript = redis.NewScript(`
+local expired = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[3])
+for _, id in ipairs(expired) do
+	redis.call('ZREM', KEYS[1], id)
+	redis.call('SREM', KEYS[2], id)
+	redis.call('HDEL', KEYS[5], id)
+end
+local changed = #expired > 0
+if ARGV[1] ~= '' then
+	if redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1]) == 1 then
+		changed = true
+	end
+	local flipped
+	if ARGV[4] == '1' then
+		flipped = redis.call('SADD', KEYS[2], ARGV[1])
+	else
+		flipped = redis.call('SREM', KEYS[2], ARGV[1])
+	end
+	if flipped == 1 then
+		changed = true
+	end
+	redis.call('PEXPIRE', KEYS[1], ARGV[5])
+	redis.call('PEXPIRE', KEYS[2], ARGV[5])
+	redis.call('PEXPIRE', KEYS[5], ARGV[5])
+	redis.call('ZADD', KEYS[3], 'GT', ARGV[2], ARGV[6])
+	if changed then
+		redis.call('ZADD', KEYS[4], 'LT', ARGV[7], ARGV[6])
+	end
+end
+return 1
+`)
+
+// removeScript drops a session and schedules an update.
+var removeScript = redis.NewScript(`
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('SREM', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[4], ARGV[1])
+redis.call('ZADD', KEYS[3], 'LT', ARGV[2], ARGV[3])
+return 1
+`)
+
+// popScript removes and returns up to ARGV[2] members of KEYS[1] scored at
+// or before ARGV[1].
+var popScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, id in ipairs(ids) do
+	redis.call('ZREM', KEYS[1], id)
+end
+return ids
+`)
+
+// Touch records that a session is connected, refreshing its TTL. The
+// session is idle if its client has shown no activity since lastActive.
+func (s *Service) Touch(ctx context.Context, userID int64, sessionID string, lastActive time.Time) error {
+	return s.TouchAll(ctx, []SessionTouch{{UserID: userID, SessionID: sessionID, LastActive: lastActive}})
+}
+
+// SessionTouch is a connected session whose client was last active at
+// LastActive.
+type SessionTouch struct {
+	UserID     int64
+	SessionID  string
+	LastActive time.Time
+}
+
+// TouchAll records that sessions are connected, as Touch does, in one round
+// trip.
+func (s *Service) TouchAll(ctx context.Context, touches []SessionTouch) error {
+	if len(touches) == 0 {
+		return nil
+	}
+	cmds, err := s.pipelineTouches(ctx, touches)
+	if redis.HasErrorPrefix(err, "NOSCRIPT") {
+		if err := touchScript.Load(ctx, s.redis).Err(); err != nil {
+			return fmt.Errorf("load presence touch script: %w", err)
+		}
+		cmds, err = s.pipelineTouches(ctx, touches)
+	}
+	if err == nil {
+		return nil
+	}
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			return fmt.Errorf("touch presence session: %w", err)
+		}
+	}
+	return fmt.Errorf("touch presence sessions: %w", err)
+}
+
+func (s *Service) pipelineTouches(ctx context.Context, touches []SessionTouch) ([]redis.Cmder, error) {
+	now := time.Now()
+	return s.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, t := range touches {
+			idle := "0"
+			if now.Sub(t.LastActive) >= s.policy.AwayAfter {
+				idle = "1"
+			}
+			touchScript.EvalSha(ctx, pipe, touchKeys(t.UserID),
+				t.SessionID, now.Add(SessionTTL).UnixMilli(), now.UnixMilli(), idle,
+				SessionTTL.Milliseconds(), t.UserID, now.Add(s.policy.Debounce).UnixMilli(),
+			)
+		}
+		return nil
+	})
+}
+
+// Disconnect records that a session's client has gone.
+func (s *Service) Disconnect(ctx context.Context, userID int64, sessionID string) error {
+	err := removeScript.Run(ctx, s.redis,
+		[]string{sessionsKey(userID), idleKey(userID), dueKey, activitiesKey(userID)},
+		sessionID, time.Now().Add(s.policy.Debounce).UnixMilli(), userID,
+	).Err()
+	if err != nil {
+		return fmt.Errorf("remove presence session: %w", err)
+	}
+	return nil
+}
+
+// SetStatus changes the status a user chose.
+func (s *Service) SetStatus(ctx context.Context, userID int64, status model.UserStatus) error {
+	if !status.Selectable() {
+		return ErrInvalidStatus
+	}
+	if err := s.users.UpdateStatus(ctx, userID, status); err != nil {
+		return err
+	}
+	return s.chosenChanged(ctx, userID)
+}
+
+// SetCustomStatus sets the user's custom status, or clears it if cs is nil.
+func (s *Service) SetCustomStatus(ctx context.Context, userID int64, cs *model.CustomStatus) error {
+	if cs != nil {
+		if cs.Text == "" || utf8.RuneCountInString(cs.Text) > maxCustomStatusText ||
+			(cs.Emoji != nil && utf8.RuneCountInString(*cs.Emoji) > maxCustomStatusEmoji) ||
+			cs.Expired(time.Now()) {
+			return ErrInvalidCustomStatus
+		}
+	}
+	if err := s.users.UpdateCustomStatus(ctx, userID, cs); err != nil {
+		return err
+	}
+	return s.chosenChanged(ctx, userID)
+}
+
+// chosenChanged drops the cached choices after the user changed them.
+func (s *Service) chosenChanged(ctx context.Context, userID int64) error {
+	_, err := s.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, chosenKey(userID))
+		s.schedule(ctx, pipe, userID, time.Now().Add(s.policy.Debounce))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("update presence: %w", err)
+	}
+	return nil
+}
+
+// SetActivities replaces the activities shown for one of the user's
+// sessions. They are dropped when the session disconnects. Activities
+// without a start time start now.
+func (s *Service) SetActivities(ctx context.Context, userID int64, sessionID string, activities []model.Activity) error {
+	if len(activities) > maxActivities {
+		return ErrInvalidActivity
+	}
+	now := time.Now()
+	for i := range activities {
+		a := &activities[i]
+		if !a.Type.Valid() || a.Name == "" || utf8.RuneCountInString(a.Name) > maxActivityName {
+			return ErrInvalidActivity
+		}
+		if a.StartedAt.IsZero() || a.StartedAt.After(now) {
+			a.StartedAt = now
+		}
+	}
+
+	data, err := json.Marshal(activities)
+	if err != nil {
+		return err
+	}
+	_, err = s.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		key := activitiesKey(userID)
+		if len(activities) == 0 {
+			pipe.HDel(ctx, key, sessionID)
+		} else {
+			pipe.HSet(ctx, key, sessionID, data)
+			pipe.PExpire(ctx, key, SessionTTL)
+		}
+		s.schedule(ctx, pipe, userID, now.Add(s.policy.Debounce))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("set activities: %w", err)
+	}
+	return nil
+}
+
+// schedule publishes the user's presence at, unless it is due sooner.
+func (s *Service) schedule(ctx context.Context, pipe redis.Pipeliner, userID int64, at time.Time) {
+	pipe.ZAddLT(ctx, dueKey, redis.Z{Score: float64(at.UnixMilli()), Member: userID})
+}
+
+// Presences returns the given users' presence as other users see it.
+func (s *Service) Presences(ctx context.Context, userIDs []int64) (map[int64]model.Presence, error) {
+	out := make(map[int64]model.Presence, len(userIDs))
+	if len(userIDs) == 0 {
+		return out, nil
+	}
+	keys := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		keys[i] = lastKey(id)
+	}
+	values, err := s.redis.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get presence: %w", err)
+	}
+	for i, v := range values {
+		var p model.Presence
+		if data, ok := v.(string); ok {
+			json.Unmarshal([]byte(data), &p)
+		}
+		out[userIDs[i]] = p.Public()
+	}
+	return out, nil
+}
+
+// Run publishes presence changes until ctx is done. Every process running
+// it shares the work.
+func (s *Service) Run(ctx context.Context) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.expire(ctx)
+		s.flush(ctx)
+	}
+}
+
+// expire schedules updates for users whose sessions have all expired.
+func (s *Service) expire(ctx context.Context) {
+	now := time.Now().UnixMilli()
+	ids, err := popScript.Run(ctx, s.redis, []string{expiryKey}, now, flushBatch).StringSlice()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to read expired presence")
+		return
+	}
+	for _, id := range ids {
+		s.redis.ZAddLT(ctx, dueKey, redis.Z{Score: float64(now), Member: id})
+	}
+}
+
+// flush publishes the users whose updates are due.
+func (s *Service) flush(ctx context.Context) {
+	ids, err := popScript.Run(ctx, s.redis, []string{dueKey}, time.Now().UnixMilli(), flushBatch).StringSlice()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to read due presence updates")
+		return
+	}
+	for _, id := range ids {
+		userID, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			continue
+		}
+		if err := s.update(ctx, userID); err != nil {
+			log.Warn().Err(err).Int64("user_id", userID).Msg("failed to publish presence")
+		}
+	}
+}
+
+// update recomputes a user's presence and publishes it if it changed: to
+// the user's own sessions as is, and to everyone else as Public shows it.
+func (s *Service) update(ctx context.Context, userID int64) error {
+	presence, err := s.current(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if cs := presence.CustomStatus; cs != nil && cs.ExpiresAt != nil {
+		// Publish again when it expires.
+		_, err := s.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			s.schedule(ctx, pipe, userID, *cs.ExpiresAt)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("schedule custom status expiry: %w", err)
+		}
+	}
+
+	data, err := json.Marshal(presence)
+	if err != nil {
+		return err
+	}
+	prev, err := s.redis.SetArgs(ctx, lastKey(userID), data, redis.SetArgs{Get: true, TTL: stateTTL}).Result()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("store presence: %w", err)
+	}
+	if prev == string(data) {
+		return nil
+	}
+	previous := model.Presence{Status: model.UserStatusOffline, Activities: []model.Activity{}}
+	if prev != "" {
+		json.Unmarshal([]byte(prev), &previous)
+	}
+
+	key := fmt.Sprintf("presence:%d:%d", userID, time.Now().UnixNano())
+	event := events.Event{
+		Type: events.PresenceUpdate,
+		Data: events.PresenceUpdatePayload{UserID: userID, Presence: presence},
+		Key:  key,
+	}
+	if err := s.bus.Publish(ctx, fmt.Sprintf("user:%d", userID), event); err != nil {
+		return err
+	}
+	public := presence.Public()
+	if samePresence(public, previous.Public()) {
+		return nil
+	}
+
+	event.Data = events.PresenceUpdatePayload{UserID: userID, Presence: public}
+	counts, err := s.memberCounts(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for serverID, count := range counts {
+		if count > s.policy.LargeServerThreshold {
+			continue
+		}
+		if err := s.bus.Publish(ctx, fmt.Sprintf("server:%d", serverID), event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// current derives the user's presence from their choices and sessions.
+func (s *Service) current(ctx context.Context, userID int64) (model.Presence, error) {
+	offline := model.Presence{Status: model.UserStatusOffline, Activities: []model.Activity{}}
+
+	now := time.Now()
+	if err := touchScript.Run(ctx, s.redis, touchKeys(userID),
+		"", 0, now.UnixMilli(), "0", 0, userID, 0,
+	).Err(); err != nil {
+		return offline, fmt.Errorf("expire presence sessions: %w", err)
+	}
+
+	var sessions, idle *redis.IntCmd
+	var activities *redis.StringSliceCmd
+	_, err := s.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		sessions = pipe.ZCard(ctx, sessionsKey(userID))
+		idle = pipe.SCard(ctx, idleKey(userID))
+		activities = pipe.HVals(ctx, activitiesKey(userID))
+		return nil
+	})
+	if err != nil {
+		return offline, fmt.Errorf("read presence sessions: %w", err)
+	}
+	if sessions.Val() == 0 {
+		return offline, nil
+	}
+
+	c, err := s.chosen(ctx, userID)
+	if err != nil {
+		return offline, err
+	}
+	p := model.Presence{Status: c.Status, Activities: []model.Activity{}}
+	if c.Status == model.UserStatusOnline && idle.Val() >= sessions.Val() {
+		p.Status = model.UserStatusAway
+	}
+	if c.CustomStatus != nil && !c.CustomStatus.Expired(now) {
+		p.CustomStatus = c.CustomStatus
+	}
+	for _, data := range activities.Val() {
+		var list []model.Activity
+		if json.Unmarshal([]byte(data), &list) == nil {
+			p.Activities = append(p.Activities, list...)
+		}
+	}
+	slices.SortStableFunc(p.Activities, func(a, b model.Activity) int {
+		return a.StartedAt.Compare(b.StartedAt)
+	})
+	return p, nil
+}
+
+// choices are what the user chose to show.
+type choices struct {
+	Status       model.UserStatus    `json:"status"`
+	CustomStatus *model.CustomStatus `json:"custom_status"`
+}
+
+// chosen returns the user's choices, caching them in Redis.
+func (s *Service) chosen(ctx context.Context, userID int64) (choices, error) {
+	var c choices
+	cached, err := s.redis.Get(ctx, chosenKey(userID)).Result()
+	if err == nil && json.Unmarshal([]byte(cached), &c) == nil {
+		return c, nil
+	}
+	if err != nil && err != redis.Nil {
+		return c, fmt.Errorf("get chosen status: %w", err)
+	}
+
+	user, err := s.users.GetByID(ctx, userID)
+	if err != nil {
+		return c, err
+	}
+	c.Status = model.UserStatusOnline
+	if user != nil && user.Status.Selectable() {
+		c.Status = user.Status
+	}
+	if c.CustomStatus, err = s.users.GetCustomStatus(ctx, userID); err != nil {
+		return c, err
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return c, err
+	}
+	if err := s.redis.Set(ctx, chosenKey(userID), data, stateTTL).Err(); err != nil {
+		return c, fmt.Errorf("cache chosen status: %w", err)
+	}
+	return c, nil
+}
+
+// memberCounts returns the member count of each of the user's servers,
+// cached briefly since a flapping user would otherwise count every time.
+func (s *Service) memberCounts(ctx context.Context, userID int64) (map[int64]int, error) {
+	s.mu.Lock()
+	c, ok := s.counts[userID]
+	s.mu.Unlock()
+	if ok && time.Since(c.at) < memberCountTTL {
+		return c.servers, nil
+	}
+
+	counts, err := s.servers.CountMembersByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, c := range s.counts {
+		if time.Since(c.at) >= memberCountTTL {
+			delete(s.counts, id)
+		}
+	}
+	s.counts[userID] = memberCounts{servers: counts, at: time.Now()}
+	return counts, nil
+}
+
+// samePresence compares presences as they are published.
+func samePresence(a, b model.Presence) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
+
+func touchKeys(userID int64) []string {
+	return []string{sessionsKey(userID), idleKey(userID), expiryKey, dueKey, activitiesKey(userID)}
+}
@@ -0,0 +1,41 @@
+package presence
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTouchAll(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	s := NewService(rdb, nil, nil, nil)
+	ctx := context.Background()
+
+	// The script is loaded on first use, and again if Redis loses it.
+	for range 2 {
+		require.NoError(t, rdb.ScriptFlush(ctx).Err())
+		require.NoError(t, s.TouchAll(ctx, []SessionTouch{
+			{UserID: 1, SessionID: "a", LastActive: time.Now()},
+			{UserID: 1, SessionID: "b", LastActive: time.Time{}},
+			{UserID: 2, SessionID: "c", LastActive: time.Now()},
+		}))
+	}
+
+	sessions, err := rdb.ZRange(ctx, sessionsKey(1), 0, -1).Result()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a", "b"}, sessions)
+	idle, err := rdb.SMembers(ctx, idleKey(1)).Result()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b"}, idle)
+	sessions, err = rdb.ZRange(ctx, sessionsKey(2), 0, -1).Result()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c"}, sessions)
+	assert.NoError(t, s.TouchAll(ctx, nil))
+}
@@ -0,0 +1,83 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+)
+
+type APITokenStore struct {
+	db *pgxpool.Pool
+}
+
+func NewAPITokenStore(db *pgxpool.Pool) *APITokenStore {
+	return &APITokenStore{db: db}
+}
+
+func (s *APITokenStore) Create(ctx context.Context, token *model.APIToken) error {
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`INSERT INTO api_tokens (id, user_id, name, token_hash, token_prefix, scopes, server_id, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		token.ID, token.UserID, token.Name, token.TokenHash, token.TokenPrefix, token.Scopes, token.ServerID, token.ExpiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("create api token: %w", err)
+	}
+	return nil
+}
+
+func (s *APITokenStore) GetByHash(ctx context.Context, hash string) (*model.APIToken, error) {
+	var t model.APIToken
+	err := querier(ctx, s.db).QueryRow(ctx,
+		`SELECT id, user_id, name, token_hash, token_prefix, scopes, server_id, expires_at, last_used_at, created_at
+		 FROM api_tokens WHERE token_hash = $1`, hash,
+	).Scan(&t.ID, &t.UserID, &t.Name, &t.TokenHash, &t.TokenPrefix, &t.Scopes, &t.ServerID, &t.ExpiresAt, &t.LastUsedAt, &t.CreatedAt)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get api token: %w", err)
+	}
+	return &t, nil
+}
+
+func (s *APITokenStore) ListByUser(ctx context.Context, userID int64) ([]model.APIToken, error) {
+	rows, err := querier(ctx, s.db).Query(ctx,
+		`SELECT id, user_id, name, token_hash, token_prefix, scopes, server_id, expires_at, last_used_at, created_at
+		 FROM api_tokens WHERE user_id = $1 ORDER BY created_at DESC`, userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list api tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []model.APIToken
+	for rows.Next() {
+		var t model.APIToken
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &t.TokenHash, &t.TokenPrefix, &t.Scopes, &t.ServerID, &t.ExpiresAt, &t.LastUsedAt, &t.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan api token: %w", err)
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+func (s *APITokenStore) TouchLastUsed(ctx context.Context, id int64) error {
+	_, err := querier(ctx, s.db).Exec(ctx, `UPDATE api_tokens SET last_used_at = NOW() WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("touch api token: %w", err)
+	}
+	return nil
+}
+
+// Delete removes a token owned by userID. It reports whether a token was deleted.
+func (s *APITokenStore) Delete(ctx context.Context, id, userID int64) (bool, error) {
+	tag, err := querier(ctx, s.db).Exec(ctx, `DELETE FROM api_tokens WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return false, fmt.Errorf("delete api token: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
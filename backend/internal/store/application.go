@@ -0,0 +1,180 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+)
+
+const applicationColumns = `id, owner_id, name, description, bot_user_id, bot_token_hash, created_at,
+	interactions_endpoint_url, COALESCE(interactions_secret, '')`
+
+type ApplicationStore struct {
+	db *pgxpool.Pool
+}
+
+func NewApplicationStore(db *pgxpool.Pool) *ApplicationStore {
+	return &ApplicationStore{db: db}
+}
+
+func scanApplication(row pgx.Row, app *model.Application) error {
+	return row.Scan(&app.ID, &app.OwnerID, &app.Name, &app.Description, &app.BotUserID, &app.BotTokenHash, &app.CreatedAt,
+		&app.InteractionsEndpointURL, &app.InteractionsSecret)
+}
+
+// Create inserts the application together with its bot user in one transaction.
+func (s *ApplicationStore) Create(ctx context.Context, app *model.Application, bot *model.User) error {
+	tx, err := querier(ctx, s.db).Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO users (id, username, display_name, bot, status) VALUES ($1, $2, $3, TRUE, $4)`,
+		bot.ID, bot.Username, bot.DisplayName, bot.Status,
+	)
+	if err != nil {
+		return fmt.Errorf("create bot user: %w", err)
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO applications (id, owner_id, name, description, bot_user_id, bot_token_hash)
+		 VALUES ($1, $2, $3, $4, $5, $6)`,
+		app.ID, app.OwnerID, app.Name, app.Description, app.BotUserID, app.BotTokenHash,
+	)
+	if err != nil {
+		return fmt.Errorf("create application: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit tx: %w", err)
+	}
+	return nil
+}
+
+func (s *ApplicationStore) GetByID(ctx context.Context, id int64) (*model.Application, error) {
+	var app model.Application
+	err := scanApplication(querier(ctx, s.db).QueryRow(ctx,
+		`SELECT `+applicationColumns+`
+		 FROM applications WHERE id = $1`, id,
+	), &app)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get application: %w", err)
+	}
+	return &app, nil
+}
+
+func (s *ApplicationStore) GetByBotTokenHash(ctx context.Context, hash string) (*model.Application, error) {
+	var app model.Application
+	err := scanApplication(querier(ctx, s.db).QueryRow(ctx,
+		`SELECT `+applicationColumns+`
+		 FROM applications WHERE bot_token_hash = $1`, hash,
+	), &app)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get application by token: %w", err)
+	}
+	return &app, nil
+}
+
+func (s *ApplicationStore) ListByOwner(ctx context.Context, ownerID int64) ([]model.Application, error) {
+	rows, err := querier(ctx, s.db).Query(ctx,
+		`SELECT `+applicationColumns+`
+		 FROM applications WHERE owner_id = $1 ORDER BY created_at`, ownerID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list applications: %w", err)
+	}
+	defer rows.Close()
+
+	var apps []model.Application
+	for rows.Next() {
+		var app model.Application
+		if err := scanApplication(rows, &app); err != nil {
+			return nil, fmt.Errorf("scan application: %w", err)
+		}
+		apps = append(apps, app)
+	}
+	return apps, nil
+}
+
+// ListByServer returns the applications whose bot is a member of the server.
+func (s *ApplicationStore) ListByServer(ctx context.Context, serverID int64) ([]model.Application, error) {
+	rows, err := querier(ctx, s.db).Query(ctx,
+		`SELECT `+applicationColumns+`
+		 FROM applications a JOIN server_members sm ON sm.user_id = a.bot_user_id
+		 WHERE sm.server_id = $1 ORDER BY a.created_at`, serverID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list server applications: %w", err)
+	}
+	defer rows.Close()
+
+	var apps []model.Application
+	for rows.Next() {
+		var app model.Application
+		if err := scanApplication(rows, &app); err != nil {
+			return nil, fmt.Errorf("scan application: %w", err)
+		}
+		apps = append(apps, app)
+	}
+	return apps, nil
+}
+
+func (s *ApplicationStore) UpdateBotTokenHash(ctx context.Context, id int64, hash string) error {
+	_, err := querier(ctx, s.db).Exec(ctx, `UPDATE applications SET bot_token_hash = $1 WHERE id = $2`, hash, id)
+	if err != nil {
+		return fmt.Errorf("update bot token: %w", err)
+	}
+	return nil
+}
+
+// UpdateInteractionsEndpoint sets or, with a nil url, clears the HTTP endpoint
+// interactions are sent to and the secret they are signed with.
+func (s *ApplicationStore) UpdateInteractionsEndpoint(ctx context.Context, id int64, url *string, secret string) error {
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`UPDATE applications SET interactions_endpoint_url = $2, interactions_secret = NULLIF($3, '') WHERE id = $1`,
+		id, url, secret,
+	)
+	if err != nil {
+		return fmt.Errorf("update interactions endpoint: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the application and its bot from every server. The bot user
+// row is kept so messages it posted still have an author.
+func (s *ApplicationStore) Delete(ctx context.Context, id int64) error {
+	tx, err := querier(ctx, s.db).Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var botUserID int64
+	err = tx.QueryRow(ctx, `DELETE FROM applications WHERE id = $1 RETURNING bot_user_id`, id).Scan(&botUserID)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("delete application: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM server_members WHERE user_id = $1`, botUserID); err != nil {
+		return fmt.Errorf("remove bot memberships: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("commit tx: %w", err)
+	}
+	return nil
+}
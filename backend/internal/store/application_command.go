@@ -0,0 +1,116 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+)
+
+const applicationCommandColumns = `c.id, c.application_id, c.server_id, c.name, c.description, c.options,
+	c.default_member_permissions, c.created_at`
+
+type ApplicationCommandStore struct {
+	db *pgxpool.Pool
+}
+
+func NewApplicationCommandStore(db *pgxpool.Pool) *ApplicationCommandStore {
+	return &ApplicationCommandStore{db: db}
+}
+
+func scanApplicationCommand(row pgx.Row, cmd *model.ApplicationCommand) error {
+	return row.Scan(&cmd.ID, &cmd.ApplicationID, &cmd.ServerID, &cmd.Name, &cmd.Description, &cmd.Options,
+		&cmd.DefaultMemberPermissions, &cmd.CreatedAt)
+}
+
+// Upsert registers a command, replacing any command of the same name the
+// application already has in the same scope. cmd.ID and cmd.CreatedAt are set
+// to those of the stored row.
+func (s *ApplicationCommandStore) Upsert(ctx context.Context, cmd *model.ApplicationCommand) error {
+	err := querier(ctx, s.db).QueryRow(ctx,
+		`INSERT INTO application_commands (id, application_id, server_id, name, description, options, default_member_permissions)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)
+		 ON CONFLICT (application_id, COALESCE(server_id, 0), name) DO UPDATE
+		 SET description = EXCLUDED.description, options = EXCLUDED.options,
+		     default_member_permissions = EXCLUDED.default_member_permissions
+		 RETURNING id, created_at`,
+		cmd.ID, cmd.ApplicationID, cmd.ServerID, cmd.Name, cmd.Description, cmd.Options, cmd.DefaultMemberPermissions,
+	).Scan(&cmd.ID, &cmd.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("upsert application command: %w", err)
+	}
+	return nil
+}
+
+func (s *ApplicationCommandStore) GetByID(ctx context.Context, id int64) (*model.ApplicationCommand, error) {
+	var cmd model.ApplicationCommand
+	err := scanApplicationCommand(querier(ctx, s.db).QueryRow(ctx,
+		`SELECT `+applicationCommandColumns+` FROM application_commands c WHERE c.id = $1`, id,
+	), &cmd)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get application command: %w", err)
+	}
+	return &cmd, nil
+}
+
+// ListByApplication returns an application's global commands, or its commands
+// in one server if serverID is set.
+func (s *ApplicationCommandStore) ListByApplication(ctx context.Context, applicationID int64, serverID *int64) ([]model.ApplicationCommand, error) {
+	if serverID != nil {
+		return s.list(ctx,
+			`SELECT `+applicationCommandColumns+` FROM application_commands c
+			 WHERE c.application_id = $1 AND c.server_id = $2 ORDER BY c.name`,
+			applicationID, *serverID,
+		)
+	}
+	return s.list(ctx,
+		`SELECT `+applicationCommandColumns+` FROM application_commands c
+		 WHERE c.application_id = $1 AND c.server_id IS NULL ORDER BY c.name`,
+		applicationID,
+	)
+}
+
+// ListForServer returns every command usable in a server: commands registered
+// for it, plus global commands of applications whose bot is a member.
+func (s *ApplicationCommandStore) ListForServer(ctx context.Context, serverID int64) ([]model.ApplicationCommand, error) {
+	return s.list(ctx,
+		`SELECT `+applicationCommandColumns+`
+		 FROM application_commands c
+		 JOIN applications a ON a.id = c.application_id
+		 JOIN server_members sm ON sm.user_id = a.bot_user_id AND sm.server_id = $1
+		 WHERE c.server_id = $1 OR c.server_id IS NULL
+		 ORDER BY c.name, c.server_id NULLS LAST`,
+		serverID,
+	)
+}
+
+func (s *ApplicationCommandStore) list(ctx context.Context, query string, args ...interface{}) ([]model.ApplicationCommand, error) {
+	rows, err := querier(ctx, s.db).Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list application commands: %w", err)
+	}
+	defer rows.Close()
+
+	var cmds []model.ApplicationCommand
+	for rows.Next() {
+		var cmd model.ApplicationCommand
+		if err := scanApplicationCommand(rows, &cmd); err != nil {
+			return nil, fmt.Errorf("scan application command: %w", err)
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+func (s *ApplicationCommandStore) Delete(ctx context.Context, id int64) error {
+	_, err := querier(ctx, s.db).Exec(ctx, `DELETE FROM application_commands WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("delete application command: %w", err)
+	}
+	return nil
+}
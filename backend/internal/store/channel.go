@@ -18,9 +18,9 @@ func NewChannelStore(db *pgxpool.Pool) *ChannelStore {
 }
 
 func (s *ChannelStore) Create(ctx context.Context, ch *model.Channel) error {
-	_, err := s.db.Exec(ctx,
-		`INSERT INTO channels (id, server_id, name, type, position, topic) VALUES ($1, $2, $3, $4, $5, $6)`,
-		ch.ID, ch.ServerID, ch.Name, ch.Type, ch.Position, ch.Topic,
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`INSERT INTO channels (id, server_id, name, type, position, topic, user_limit) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		ch.ID, ch.ServerID, ch.Name, ch.Type, ch.Position, ch.Topic, ch.UserLimit,
 	)
 	if err != nil {
 		return fmt.Errorf("create channel: %w", err)
@@ -30,9 +30,9 @@ func (s *ChannelStore) Create(ctx context.Context, ch *model.Channel) error {
 
 func (s *ChannelStore) GetByID(ctx context.Context, id int64) (*model.Channel, error) {
 	var ch model.Channel
-	err := s.db.QueryRow(ctx,
-		`SELECT id, server_id, name, type, position, topic, created_at FROM channels WHERE id = $1`, id,
-	).Scan(&ch.ID, &ch.ServerID, &ch.Name, &ch.Type, &ch.Position, &ch.Topic, &ch.CreatedAt)
+	err := querier(ctx, s.db).QueryRow(ctx,
+		`SELECT id, server_id, name, type, position, topic, user_limit, created_at FROM channels WHERE id = $1`, id,
+	).Scan(&ch.ID, &ch.ServerID, &ch.Name, &ch.Type, &ch.Position, &ch.Topic, &ch.UserLimit, &ch.CreatedAt)
 	if err == pgx.ErrNoRows {
 		return nil, nil
 	}
@@ -43,8 +43,8 @@ func (s *ChannelStore) GetByID(ctx context.Context, id int64) (*model.Channel, e
 }
 
 func (s *ChannelStore) ListByServer(ctx context.Context, serverID int64) ([]model.Channel, error) {
-	rows, err := s.db.Query(ctx,
-		`SELECT id, server_id, name, type, position, topic, created_at
+	rows, err := querier(ctx, s.db).Query(ctx,
+		`SELECT id, server_id, name, type, position, topic, user_limit, created_at
 		 FROM channels WHERE server_id = $1 ORDER BY position`, serverID,
 	)
 	if err != nil {
@@ -55,7 +55,7 @@ func (s *ChannelStore) ListByServer(ctx context.Context, serverID int64) ([]mode
 	var channels []model.Channel
 	for rows.Next() {
 		var ch model.Channel
-		if err := rows.Scan(&ch.ID, &ch.ServerID, &ch.Name, &ch.Type, &ch.Position, &ch.Topic, &ch.CreatedAt); err != nil {
+		if err := rows.Scan(&ch.ID, &ch.ServerID, &ch.Name, &ch.Type, &ch.Position, &ch.Topic, &ch.UserLimit, &ch.CreatedAt); err != nil {
 			return nil, fmt.Errorf("scan channel: %w", err)
 		}
 		channels = append(channels, ch)
@@ -64,9 +64,9 @@ func (s *ChannelStore) ListByServer(ctx context.Context, serverID int64) ([]mode
 }
 
 func (s *ChannelStore) Update(ctx context.Context, ch *model.Channel) error {
-	_, err := s.db.Exec(ctx,
-		`UPDATE channels SET name = $1, topic = $2 WHERE id = $3`,
-		ch.Name, ch.Topic, ch.ID,
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`UPDATE channels SET name = $1, topic = $2, user_limit = $3 WHERE id = $4`,
+		ch.Name, ch.Topic, ch.UserLimit, ch.ID,
 	)
 	if err != nil {
 		return fmt.Errorf("update channel: %w", err)
@@ -75,7 +75,7 @@ func (s *ChannelStore) Update(ctx context.Context, ch *model.Channel) error {
 }
 
 func (s *ChannelStore) UpdatePositions(ctx context.Context, serverID int64, positions []ChannelPosition) error {
-	tx, err := s.db.Begin(ctx)
+	tx, err := querier(ctx, s.db).Begin(ctx)
 	if err != nil {
 		return fmt.Errorf("begin tx: %w", err)
 	}
@@ -98,7 +98,7 @@ func (s *ChannelStore) UpdatePositions(ctx context.Context, serverID int64, posi
 }
 
 func (s *ChannelStore) Delete(ctx context.Context, id int64) error {
-	_, err := s.db.Exec(ctx, `DELETE FROM channels WHERE id = $1`, id)
+	_, err := querier(ctx, s.db).Exec(ctx, `DELETE FROM channels WHERE id = $1`, id)
 	if err != nil {
 		return fmt.Errorf("delete channel: %w", err)
 	}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+)
+
+const eventDeliveryColumns = `id, subscription_id, event_type, payload, status, attempts, next_attempt_at,
+	last_status_code, last_error, delivered_at, created_at`
+
+type EventDeliveryStore struct {
+	db *pgxpool.Pool
+}
+
+func NewEventDeliveryStore(db *pgxpool.Pool) *EventDeliveryStore {
+	return &EventDeliveryStore{db: db}
+}
+
+func scanEventDelivery(row pgx.Row, d *model.EventDelivery) error {
+	return row.Scan(&d.ID, &d.SubscriptionID, &d.EventType, &d.Payload, &d.Status, &d.Attempts, &d.NextAttemptAt,
+		&d.LastStatusCode, &d.LastError, &d.DeliveredAt, &d.CreatedAt)
+}
+
+func (s *EventDeliveryStore) Create(ctx context.Context, d *model.EventDelivery) error {
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`INSERT INTO event_deliveries (id, subscription_id, event_type, payload, status, next_attempt_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)`,
+		d.ID, d.SubscriptionID, d.EventType, d.Payload, d.Status, d.NextAttemptAt,
+	)
+	if err != nil {
+		return fmt.Errorf("create event delivery: %w", err)
+	}
+	return nil
+}
+
+func (s *EventDeliveryStore) GetByID(ctx context.Context, id int64) (*model.EventDelivery, error) {
+	var d model.EventDelivery
+	err := scanEventDelivery(querier(ctx, s.db).QueryRow(ctx,
+		`SELECT `+eventDeliveryColumns+` FROM event_deliveries WHERE id = $1`, id,
+	), &d)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get event delivery: %w", err)
+	}
+	return &d, nil
+}
+
+// ListBySubscription returns a subscription's delivery log, newest first.
+func (s *EventDeliveryStore) ListBySubscription(ctx context.Context, subscriptionID int64, before int64, limit int) ([]model.EventDelivery, error) {
+	var rows pgx.Rows
+	var err error
+	if before > 0 {
+		rows, err = querier(ctx, s.db).Query(ctx,
+			`SELECT `+eventDeliveryColumns+` FROM event_deliveries
+			 WHERE subscription_id = $1 AND id < $2 ORDER BY id DESC LIMIT $3`,
+			subscriptionID, before, limit,
+		)
+	} else {
+		rows, err = querier(ctx, s.db).Query(ctx,
+			`SELECT `+eventDeliveryColumns+` FROM event_deliveries
+			 WHERE subscription_id = $1 ORDER BY id DESC LIMIT $2`,
+			subscriptionID, limit,
+		)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list event deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []model.EventDelivery
+	for rows.Next() {
+		var d model.EventDelivery
+		if err := scanEventDelivery(rows, &d); err != nil {
+			return nil, fmt.Errorf("scan event delivery: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+// ClaimDue leases up to limit pending deliveries whose next attempt is due by
+// pushing their next_attempt_at forward by lease. Concurrent workers skip rows
+// another worker has locked, so each delivery is attempted by one worker at a
+// time; if that worker dies the delivery becomes due again once the lease ends.
+func (s *EventDeliveryStore) ClaimDue(ctx context.Context, limit int, lease time.Duration) ([]model.EventDelivery, error) {
+	rows, err := querier(ctx, s.db).Query(ctx,
+		`UPDATE event_deliveries SET next_attempt_at = NOW() + $2::interval
+		 WHERE id IN (
+		     SELECT id FROM event_deliveries
+		     WHERE status = 'pending' AND next_attempt_at <= NOW()
+		     ORDER BY next_attempt_at
+		     LIMIT $1
+		     FOR UPDATE SKIP LOCKED
+		 )
+		 RETURNING `+eventDeliveryColumns,
+		limit, lease,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("claim event deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []model.EventDelivery
+	for rows.Next() {
+		var d model.EventDelivery
+		if err := scanEventDelivery(rows, &d); err != nil {
+			return nil, fmt.Errorf("scan event delivery: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+// RecordAttempt stores the outcome of a delivery attempt. A pending status
+// schedules another attempt at nextAttemptAt.
+func (s *EventDeliveryStore) RecordAttempt(ctx context.Context, id int64, status model.DeliveryStatus, statusCode *int, lastError *string, nextAttemptAt time.Time) error {
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`UPDATE event_deliveries
+		 SET status = $2, attempts = attempts + 1, last_status_code = $3, last_error = $4, next_attempt_at = $5,
+		     delivered_at = CASE WHEN $2 = 'succeeded' THEN NOW() ELSE delivered_at END
+		 WHERE id = $1`,
+		id, status, statusCode, lastError, nextAttemptAt,
+	)
+	if err != nil {
+		return fmt.Errorf("record event delivery attempt: %w", err)
+	}
+	return nil
+}
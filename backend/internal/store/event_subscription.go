@@ -0,0 +1,154 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+)
+
+const eventSubscriptionColumns = `id, server_id, created_by, url, secret, event_types, channel_ids,
+	enabled, consecutive_failures, disabled_reason, created_at`
+
+type EventSubscriptionStore struct {
+	db *pgxpool.Pool
+}
+
+func NewEventSubscriptionStore(db *pgxpool.Pool) *EventSubscriptionStore {
+	return &EventSubscriptionStore{db: db}
+}
+
+func scanEventSubscription(row pgx.Row, sub *model.EventSubscription) error {
+	return row.Scan(&sub.ID, &sub.ServerID, &sub.CreatedBy, &sub.URL, &sub.Secret, &sub.EventTypes, &sub.ChannelIDs,
+		&sub.Enabled, &sub.ConsecutiveFailures, &sub.DisabledReason, &sub.CreatedAt)
+}
+
+func (s *EventSubscriptionStore) Create(ctx context.Context, sub *model.EventSubscription) error {
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`INSERT INTO event_subscriptions (id, server_id, created_by, url, secret, event_types, channel_ids)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		sub.ID, sub.ServerID, sub.CreatedBy, sub.URL, sub.Secret, sub.EventTypes, sub.ChannelIDs,
+	)
+	if err != nil {
+		return fmt.Errorf("create event subscription: %w", err)
+	}
+	return nil
+}
+
+func (s *EventSubscriptionStore) GetByID(ctx context.Context, id int64) (*model.EventSubscription, error) {
+	var sub model.EventSubscription
+	err := scanEventSubscription(querier(ctx, s.db).QueryRow(ctx,
+		`SELECT `+eventSubscriptionColumns+` FROM event_subscriptions WHERE id = $1`, id,
+	), &sub)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get event subscription: %w", err)
+	}
+	return &sub, nil
+}
+
+func (s *EventSubscriptionStore) ListByServer(ctx context.Context, serverID int64) ([]model.EventSubscription, error) {
+	return s.list(ctx,
+		`SELECT `+eventSubscriptionColumns+` FROM event_subscriptions WHERE server_id = $1 ORDER BY created_at`, serverID,
+	)
+}
+
+// ListEnabledByServer returns the subscriptions that should receive the
+// server's events.
+func (s *EventSubscriptionStore) ListEnabledByServer(ctx context.Context, serverID int64) ([]model.EventSubscription, error) {
+	return s.list(ctx,
+		`SELECT `+eventSubscriptionColumns+` FROM event_subscriptions WHERE server_id = $1 AND enabled`, serverID,
+	)
+}
+
+func (s *EventSubscriptionStore) list(ctx context.Context, query string, arg int64) ([]model.EventSubscription, error) {
+	rows, err := querier(ctx, s.db).Query(ctx, query, arg)
+	if err != nil {
+		return nil, fmt.Errorf("list event subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var subs []model.EventSubscription
+	for rows.Next() {
+		var sub model.EventSubscription
+		if err := scanEventSubscription(rows, &sub); err != nil {
+			return nil, fmt.Errorf("scan event subscription: %w", err)
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+func (s *EventSubscriptionStore) Update(ctx context.Context, sub *model.EventSubscription) error {
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`UPDATE event_subscriptions SET url = $2, event_types = $3, channel_ids = $4 WHERE id = $1`,
+		sub.ID, sub.URL, sub.EventTypes, sub.ChannelIDs,
+	)
+	if err != nil {
+		return fmt.Errorf("update event subscription: %w", err)
+	}
+	return nil
+}
+
+func (s *EventSubscriptionStore) UpdateSecret(ctx context.Context, id int64, secret string) error {
+	_, err := querier(ctx, s.db).Exec(ctx, `UPDATE event_subscriptions SET secret = $2 WHERE id = $1`, id, secret)
+	if err != nil {
+		return fmt.Errorf("update event subscription secret: %w", err)
+	}
+	return nil
+}
+
+// SetEnabled enables or disables a subscription. Enabling clears the failure
+// count; reason is recorded when disabling.
+func (s *EventSubscriptionStore) SetEnabled(ctx context.Context, id int64, enabled bool, reason *string) error {
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`UPDATE event_subscriptions
+		 SET enabled = $2, disabled_reason = $3,
+		     consecutive_failures = CASE WHEN $2 THEN 0 ELSE consecutive_failures END
+		 WHERE id = $1`,
+		id, enabled, reason,
+	)
+	if err != nil {
+		return fmt.Errorf("set event subscription enabled: %w", err)
+	}
+	return nil
+}
+
+// RecordSuccess resets the subscription's consecutive failure count.
+func (s *EventSubscriptionStore) RecordSuccess(ctx context.Context, id int64) error {
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`UPDATE event_subscriptions SET consecutive_failures = 0 WHERE id = $1 AND consecutive_failures <> 0`, id,
+	)
+	if err != nil {
+		return fmt.Errorf("record event subscription success: %w", err)
+	}
+	return nil
+}
+
+// RecordFailure increments the consecutive failure count and returns it.
+func (s *EventSubscriptionStore) RecordFailure(ctx context.Context, id int64) (int, error) {
+	var failures int
+	err := querier(ctx, s.db).QueryRow(ctx,
+		`UPDATE event_subscriptions SET consecutive_failures = consecutive_failures + 1
+		 WHERE id = $1 RETURNING consecutive_failures`, id,
+	).Scan(&failures)
+	if err == pgx.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("record event subscription failure: %w", err)
+	}
+	return failures, nil
+}
+
+func (s *EventSubscriptionStore) Delete(ctx context.Context, id int64) error {
+	_, err := querier(ctx, s.db).Exec(ctx, `DELETE FROM event_subscriptions WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("delete event subscription: %w", err)
+	}
+	return nil
+}
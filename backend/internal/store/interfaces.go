@@ -13,6 +13,11 @@ type UserStoreInterface interface {
 	GetByID(ctx context.Context, id int64) (*model.User, error)
 	GetByEmail(ctx context.Context, email string) (*model.User, error)
 	GetByUsername(ctx context.Context, username string) (*model.User, error)
+	MarkEmailVerified(ctx context.Context, id int64) error
+	UpdatePassword(ctx context.Context, id int64, passwordHash string) error
+	UpdateStatus(ctx context.Context, id int64, status model.UserStatus) error
+	GetCustomStatus(ctx context.Context, id int64) (*model.CustomStatus, error)
+	UpdateCustomStatus(ctx context.Context, id int64, cs *model.CustomStatus) error
 }
 
 // ServerStoreInterface defines all server persistence operations.
@@ -26,6 +31,9 @@ type ServerStoreInterface interface {
 	Update(ctx context.Context, server *model.Server) error
 	Delete(ctx context.Context, id int64) error
 	ListMembers(ctx context.Context, serverID int64) ([]Member, error)
+	GetMember(ctx context.Context, serverID, userID int64) (*Member, error)
+	SetVoiceModeration(ctx context.Context, serverID, userID int64, mute, deaf bool) error
+	CountMembersByUser(ctx context.Context, userID int64) (map[int64]int, error)
 }
 
 // Member represents a server member with user info joined from the users table.
@@ -35,7 +43,11 @@ type Member struct {
 	DisplayName string  `json:"display_name"`
 	AvatarURL   *string `json:"avatar_url"`
 	Nickname    *string `json:"nickname"`
-	JoinedAt    time.Time `json:"joined_at"`
+	Bot         bool    `json:"bot"`
+	// Mute and Deaf are set by moderators and apply in every voice channel.
+	Mute     bool      `json:"mute"`
+	Deaf     bool      `json:"deaf"`
+	JoinedAt time.Time `json:"joined_at"`
 }
 
 // ChannelStoreInterface defines all channel persistence operations.
@@ -84,3 +96,87 @@ type InviteStoreInterface interface {
 	IncrementUses(ctx context.Context, code string) error
 	Delete(ctx context.Context, code string) error
 }
+
+// SecurityEventStoreInterface defines all security event persistence operations.
+type SecurityEventStoreInterface interface {
+	Create(ctx context.Context, event *model.SecurityEvent) error
+	ListByUser(ctx context.Context, userID int64, before int64, limit int) ([]model.SecurityEvent, error)
+}
+
+// APITokenStoreInterface defines all API token persistence operations.
+type APITokenStoreInterface interface {
+	Create(ctx context.Context, token *model.APIToken) error
+	GetByHash(ctx context.Context, hash string) (*model.APIToken, error)
+	ListByUser(ctx context.Context, userID int64) ([]model.APIToken, error)
+	TouchLastUsed(ctx context.Context, id int64) error
+	Delete(ctx context.Context, id, userID int64) (bool, error)
+}
+
+// ApplicationStoreInterface defines all application persistence operations.
+type ApplicationStoreInterface interface {
+	Create(ctx context.Context, app *model.Application, bot *model.User) error
+	GetByID(ctx context.Context, id int64) (*model.Application, error)
+	GetByBotTokenHash(ctx context.Context, hash string) (*model.Application, error)
+	ListByOwner(ctx context.Context, ownerID int64) ([]model.Application, error)
+	ListByServer(ctx context.Context, serverID int64) ([]model.Application, error)
+	UpdateBotTokenHash(ctx context.Context, id int64, hash string) error
+	UpdateInteractionsEndpoint(ctx context.Context, id int64, url *string, secret string) error
+	Delete(ctx context.Context, id int64) error
+}
+
+// WebhookStoreInterface defines all webhook persistence operations.
+type WebhookStoreInterface interface {
+	Create(ctx context.Context, wh *model.Webhook) error
+	GetByID(ctx context.Context, id int64) (*model.Webhook, error)
+	ListByChannel(ctx context.Context, channelID int64) ([]model.Webhook, error)
+	ListByServer(ctx context.Context, serverID int64) ([]model.Webhook, error)
+	Update(ctx context.Context, wh *model.Webhook) error
+	UpdateTokenHash(ctx context.Context, id int64, hash string) error
+	Delete(ctx context.Context, id int64) error
+}
+
+// EventSubscriptionStoreInterface defines all event subscription persistence operations.
+type EventSubscriptionStoreInterface interface {
+	Create(ctx context.Context, sub *model.EventSubscription) error
+	GetByID(ctx context.Context, id int64) (*model.EventSubscription, error)
+	ListByServer(ctx context.Context, serverID int64) ([]model.EventSubscription, error)
+	ListEnabledByServer(ctx context.Context, serverID int64) ([]model.EventSubscription, error)
+	Update(ctx context.Context, sub *model.EventSubscription) error
+	UpdateSecret(ctx context.Context, id int64, secret string) error
+	SetEnabled(ctx context.Context, id int64, enabled bool, reason *string) error
+	RecordSuccess(ctx context.Context, id int64) error
+	RecordFailure(ctx context.Context, id int64) (int, error)
+	Delete(ctx context.Context, id int64) error
+}
+
+// EventDeliveryStoreInterface defines all event delivery persistence operations.
+type EventDeliveryStoreInterface interface {
+	Create(ctx context.Context, d *model.EventDelivery) error
+	GetByID(ctx context.Context, id int64) (*model.EventDelivery, error)
+	ListBySubscription(ctx context.Context, subscriptionID int64, before int64, limit int) ([]model.EventDelivery, error)
+	ClaimDue(ctx context.Context, limit int, lease time.Duration) ([]model.EventDelivery, error)
+	RecordAttempt(ctx context.Context, id int64, status model.DeliveryStatus, statusCode *int, lastError *string, nextAttemptAt time.Time) error
+}
+
+// ApplicationCommandStoreInterface defines all application command persistence operations.
+type ApplicationCommandStoreInterface interface {
+	Upsert(ctx context.Context, cmd *model.ApplicationCommand) error
+	GetByID(ctx context.Context, id int64) (*model.ApplicationCommand, error)
+	ListByApplication(ctx context.Context, applicationID int64, serverID *int64) ([]model.ApplicationCommand, error)
+	ListForServer(ctx context.Context, serverID int64) ([]model.ApplicationCommand, error)
+	Delete(ctx context.Context, id int64) error
+}
+
+// OutboxStoreInterface defines all event outbox persistence operations.
+type OutboxStoreInterface interface {
+	Add(ctx context.Context, entry *model.OutboxEntry) error
+	ListUnpublished(ctx context.Context, limit int) ([]model.OutboxEntry, error)
+	MarkPublished(ctx context.Context, ids []int64) error
+	RecordFailure(ctx context.Context, id int64, lastError string) error
+	DeletePublishedBefore(ctx context.Context, t time.Time) (int64, error)
+}
+
+// TxManagerInterface runs store calls in a single transaction.
+type TxManagerInterface interface {
+	InTx(ctx context.Context, fn func(ctx context.Context) error) error
+}
@@ -34,7 +34,7 @@ func GenerateInviteCode() (string, error) {
 }
 
 func (s *InviteStore) Create(ctx context.Context, invite *model.Invite) error {
-	_, err := s.db.Exec(ctx,
+	_, err := querier(ctx, s.db).Exec(ctx,
 		`INSERT INTO invites (code, server_id, created_by, max_uses, expires_at)
 		 VALUES ($1, $2, $3, $4, $5)`,
 		invite.Code, invite.ServerID, invite.CreatedBy, invite.MaxUses, invite.ExpiresAt,
@@ -47,7 +47,7 @@ func (s *InviteStore) Create(ctx context.Context, invite *model.Invite) error {
 
 func (s *InviteStore) GetByCode(ctx context.Context, code string) (*model.Invite, error) {
 	var inv model.Invite
-	err := s.db.QueryRow(ctx,
+	err := querier(ctx, s.db).QueryRow(ctx,
 		`SELECT code, server_id, created_by, max_uses, uses, expires_at, created_at
 		 FROM invites WHERE code = $1`, code,
 	).Scan(&inv.Code, &inv.ServerID, &inv.CreatedBy, &inv.MaxUses, &inv.Uses, &inv.ExpiresAt, &inv.CreatedAt)
@@ -61,7 +61,7 @@ func (s *InviteStore) GetByCode(ctx context.Context, code string) (*model.Invite
 }
 
 func (s *InviteStore) ListByServer(ctx context.Context, serverID int64) ([]model.Invite, error) {
-	rows, err := s.db.Query(ctx,
+	rows, err := querier(ctx, s.db).Query(ctx,
 		`SELECT code, server_id, created_by, max_uses, uses, expires_at, created_at
 		 FROM invites WHERE server_id = $1 ORDER BY created_at DESC`, serverID,
 	)
@@ -82,7 +82,7 @@ func (s *InviteStore) ListByServer(ctx context.Context, serverID int64) ([]model
 }
 
 func (s *InviteStore) IncrementUses(ctx context.Context, code string) error {
-	_, err := s.db.Exec(ctx,
+	_, err := querier(ctx, s.db).Exec(ctx,
 		`UPDATE invites SET uses = uses + 1 WHERE code = $1`, code,
 	)
 	if err != nil {
@@ -92,7 +92,7 @@ func (s *InviteStore) IncrementUses(ctx context.Context, code string) error {
 }
 
 func (s *InviteStore) Delete(ctx context.Context, code string) error {
-	_, err := s.db.Exec(ctx, `DELETE FROM invites WHERE code = $1`, code)
+	_, err := querier(ctx, s.db).Exec(ctx, `DELETE FROM invites WHERE code = $1`, code)
 	if err != nil {
 		return fmt.Errorf("delete invite: %w", err)
 	}
@@ -17,9 +17,10 @@ func NewMessageStore(db *pgxpool.Pool) *MessageStore {
 }
 
 func (s *MessageStore) Create(ctx context.Context, msg *model.Message) error {
-	_, err := s.db.Exec(ctx,
-		`INSERT INTO messages (id, channel_id, author_id, content, thread_id) VALUES ($1, $2, $3, $4, $5)`,
-		msg.ID, msg.ChannelID, msg.AuthorID, msg.Content, msg.ThreadID,
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`INSERT INTO messages (id, channel_id, author_id, webhook_id, webhook_name, webhook_avatar_url, content, thread_id)
+		 VALUES ($1, $2, NULLIF($3, 0), $4, $5, $6, $7, $8)`,
+		msg.ID, msg.ChannelID, msg.AuthorID, msg.WebhookID, msg.WebhookName, msg.WebhookAvatarURL, msg.Content, msg.ThreadID,
 	)
 	if err != nil {
 		return fmt.Errorf("create message: %w", err)
@@ -34,18 +35,24 @@ func (s *MessageStore) ListByChannel(ctx context.Context, channelID int64, befor
 	var args []interface{}
 
 	if before > 0 {
-		query = `SELECT id, channel_id, author_id, content, thread_id, edited_at, created_at
-				 FROM messages WHERE channel_id = $1 AND id < $2 AND thread_id IS NULL
-				 ORDER BY id DESC LIMIT $3`
+		query = `SELECT m.id, m.channel_id, COALESCE(m.author_id, 0), m.webhook_id, m.webhook_name, m.webhook_avatar_url,
+				        m.content, m.thread_id, m.edited_at, m.created_at,
+				        u.username, u.display_name, u.avatar_url, u.bot
+				 FROM messages m LEFT JOIN users u ON m.author_id = u.id
+				 WHERE m.channel_id = $1 AND m.id < $2 AND m.thread_id IS NULL
+				 ORDER BY m.id DESC LIMIT $3`
 		args = []interface{}{channelID, before, limit}
 	} else {
-		query = `SELECT id, channel_id, author_id, content, thread_id, edited_at, created_at
-				 FROM messages WHERE channel_id = $1 AND thread_id IS NULL
-				 ORDER BY id DESC LIMIT $2`
+		query = `SELECT m.id, m.channel_id, COALESCE(m.author_id, 0), m.webhook_id, m.webhook_name, m.webhook_avatar_url,
+				        m.content, m.thread_id, m.edited_at, m.created_at,
+				        u.username, u.display_name, u.avatar_url, u.bot
+				 FROM messages m LEFT JOIN users u ON m.author_id = u.id
+				 WHERE m.channel_id = $1 AND m.thread_id IS NULL
+				 ORDER BY m.id DESC LIMIT $2`
 		args = []interface{}{channelID, limit}
 	}
 
-	rows, err := s.db.Query(ctx, query, args...)
+	rows, err := querier(ctx, s.db).Query(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("list messages: %w", err)
 	}
@@ -54,16 +61,32 @@ func (s *MessageStore) ListByChannel(ctx context.Context, channelID int64, befor
 	var messages []model.Message
 	for rows.Next() {
 		var m model.Message
-		if err := rows.Scan(&m.ID, &m.ChannelID, &m.AuthorID, &m.Content, &m.ThreadID, &m.EditedAt, &m.CreatedAt); err != nil {
+		var username, displayName *string
+		var avatarURL *string
+		var bot *bool
+		if err := rows.Scan(&m.ID, &m.ChannelID, &m.AuthorID, &m.WebhookID, &m.WebhookName, &m.WebhookAvatarURL,
+			&m.Content, &m.ThreadID, &m.EditedAt, &m.CreatedAt,
+			&username, &displayName, &avatarURL, &bot); err != nil {
 			return nil, fmt.Errorf("scan message: %w", err)
 		}
+		if username != nil {
+			m.Author = &model.MessageAuthor{
+				ID:          m.AuthorID,
+				Username:    *username,
+				DisplayName: *displayName,
+				AvatarURL:   avatarURL,
+				Bot:         *bot,
+			}
+		} else {
+			m.Author = m.WebhookAuthor()
+		}
 		messages = append(messages, m)
 	}
 	return messages, nil
 }
 
 func (s *MessageStore) Update(ctx context.Context, id int64, content string) error {
-	_, err := s.db.Exec(ctx,
+	_, err := querier(ctx, s.db).Exec(ctx,
 		`UPDATE messages SET content = $1, edited_at = NOW() WHERE id = $2`,
 		content, id,
 	)
@@ -74,7 +97,7 @@ func (s *MessageStore) Update(ctx context.Context, id int64, content string) err
 }
 
 func (s *MessageStore) Delete(ctx context.Context, id int64) error {
-	_, err := s.db.Exec(ctx, `DELETE FROM messages WHERE id = $1`, id)
+	_, err := querier(ctx, s.db).Exec(ctx, `DELETE FROM messages WHERE id = $1`, id)
 	if err != nil {
 		return fmt.Errorf("delete message: %w", err)
 	}
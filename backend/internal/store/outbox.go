@@ -0,0 +1,97 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+)
+
+// OutboxNotifyChannel is the Postgres NOTIFY channel signalled when entries
+// are added, so the relay need not wait for its next poll.
+const OutboxNotifyChannel = "event_outbox"
+
+type OutboxStore struct {
+	db *pgxpool.Pool
+}
+
+func NewOutboxStore(db *pgxpool.Pool) *OutboxStore {
+	return &OutboxStore{db: db}
+}
+
+// Add records an event. Call it inside TxManager.InTx with the change the
+// event describes so both commit or neither does. An entry whose idempotency
+// key is already recorded for the same channel is ignored.
+func (s *OutboxStore) Add(ctx context.Context, entry *model.OutboxEntry) error {
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`WITH inserted AS (
+		     INSERT INTO event_outbox (id, idempotency_key, channel, payload)
+		     VALUES ($1, $2, $3, $4)
+		     ON CONFLICT (channel, idempotency_key) DO NOTHING
+		     RETURNING id
+		 )
+		 SELECT pg_notify($5, '') FROM inserted`,
+		entry.ID, entry.IdempotencyKey, entry.Channel, entry.Payload, OutboxNotifyChannel,
+	)
+	if err != nil {
+		return fmt.Errorf("add outbox entry: %w", err)
+	}
+	return nil
+}
+
+// ListUnpublished returns the oldest unpublished entries in the order they
+// were added.
+func (s *OutboxStore) ListUnpublished(ctx context.Context, limit int) ([]model.OutboxEntry, error) {
+	rows, err := querier(ctx, s.db).Query(ctx,
+		`SELECT id, idempotency_key, channel, payload, attempts, last_error, published_at, created_at
+		 FROM event_outbox WHERE published_at IS NULL ORDER BY id LIMIT $1`, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list outbox entries: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []model.OutboxEntry
+	for rows.Next() {
+		var e model.OutboxEntry
+		if err := rows.Scan(&e.ID, &e.IdempotencyKey, &e.Channel, &e.Payload, &e.Attempts, &e.LastError, &e.PublishedAt, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan outbox entry: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (s *OutboxStore) MarkPublished(ctx context.Context, ids []int64) error {
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`UPDATE event_outbox SET published_at = NOW(), attempts = attempts + 1 WHERE id = ANY($1)`, ids,
+	)
+	if err != nil {
+		return fmt.Errorf("mark outbox entries published: %w", err)
+	}
+	return nil
+}
+
+func (s *OutboxStore) RecordFailure(ctx context.Context, id int64, lastError string) error {
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`UPDATE event_outbox SET attempts = attempts + 1, last_error = $2 WHERE id = $1`, id, lastError,
+	)
+	if err != nil {
+		return fmt.Errorf("record outbox failure: %w", err)
+	}
+	return nil
+}
+
+// DeletePublishedBefore removes entries published before t and returns how
+// many were removed.
+func (s *OutboxStore) DeletePublishedBefore(ctx context.Context, t time.Time) (int64, error) {
+	tag, err := querier(ctx, s.db).Exec(ctx,
+		`DELETE FROM event_outbox WHERE published_at < $1`, t,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("delete published outbox entries: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
@@ -18,10 +18,10 @@ func NewRoleStore(db *pgxpool.Pool) *RoleStore {
 }
 
 func (s *RoleStore) Create(ctx context.Context, role *model.Role) error {
-	_, err := s.db.Exec(ctx,
-		`INSERT INTO roles (id, server_id, name, permissions, color, position)
-		 VALUES ($1, $2, $3, $4, $5, $6)`,
-		role.ID, role.ServerID, role.Name, role.Permissions, role.Color, role.Position,
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`INSERT INTO roles (id, server_id, name, permissions, color, position, managed)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		role.ID, role.ServerID, role.Name, role.Permissions, role.Color, role.Position, role.Managed,
 	)
 	if err != nil {
 		return fmt.Errorf("create role: %w", err)
@@ -31,9 +31,9 @@ func (s *RoleStore) Create(ctx context.Context, role *model.Role) error {
 
 func (s *RoleStore) GetByID(ctx context.Context, id int64) (*model.Role, error) {
 	var role model.Role
-	err := s.db.QueryRow(ctx,
-		`SELECT id, server_id, name, permissions, color, position FROM roles WHERE id = $1`, id,
-	).Scan(&role.ID, &role.ServerID, &role.Name, &role.Permissions, &role.Color, &role.Position)
+	err := querier(ctx, s.db).QueryRow(ctx,
+		`SELECT id, server_id, name, permissions, color, position, managed FROM roles WHERE id = $1`, id,
+	).Scan(&role.ID, &role.ServerID, &role.Name, &role.Permissions, &role.Color, &role.Position, &role.Managed)
 	if err == pgx.ErrNoRows {
 		return nil, nil
 	}
@@ -44,8 +44,8 @@ func (s *RoleStore) GetByID(ctx context.Context, id int64) (*model.Role, error)
 }
 
 func (s *RoleStore) ListByServer(ctx context.Context, serverID int64) ([]model.Role, error) {
-	rows, err := s.db.Query(ctx,
-		`SELECT id, server_id, name, permissions, color, position
+	rows, err := querier(ctx, s.db).Query(ctx,
+		`SELECT id, server_id, name, permissions, color, position, managed
 		 FROM roles WHERE server_id = $1 ORDER BY position`, serverID,
 	)
 	if err != nil {
@@ -56,7 +56,7 @@ func (s *RoleStore) ListByServer(ctx context.Context, serverID int64) ([]model.R
 	var roles []model.Role
 	for rows.Next() {
 		var role model.Role
-		if err := rows.Scan(&role.ID, &role.ServerID, &role.Name, &role.Permissions, &role.Color, &role.Position); err != nil {
+		if err := rows.Scan(&role.ID, &role.ServerID, &role.Name, &role.Permissions, &role.Color, &role.Position, &role.Managed); err != nil {
 			return nil, fmt.Errorf("scan role: %w", err)
 		}
 		roles = append(roles, role)
@@ -66,10 +66,10 @@ func (s *RoleStore) ListByServer(ctx context.Context, serverID int64) ([]model.R
 
 func (s *RoleStore) GetDefaultRole(ctx context.Context, serverID int64) (*model.Role, error) {
 	var role model.Role
-	err := s.db.QueryRow(ctx,
-		`SELECT id, server_id, name, permissions, color, position
+	err := querier(ctx, s.db).QueryRow(ctx,
+		`SELECT id, server_id, name, permissions, color, position, managed
 		 FROM roles WHERE server_id = $1 AND position = 0`, serverID,
-	).Scan(&role.ID, &role.ServerID, &role.Name, &role.Permissions, &role.Color, &role.Position)
+	).Scan(&role.ID, &role.ServerID, &role.Name, &role.Permissions, &role.Color, &role.Position, &role.Managed)
 	if err == pgx.ErrNoRows {
 		return nil, nil
 	}
@@ -80,7 +80,7 @@ func (s *RoleStore) GetDefaultRole(ctx context.Context, serverID int64) (*model.
 }
 
 func (s *RoleStore) Update(ctx context.Context, role *model.Role) error {
-	_, err := s.db.Exec(ctx,
+	_, err := querier(ctx, s.db).Exec(ctx,
 		`UPDATE roles SET name = $1, permissions = $2, color = $3, position = $4 WHERE id = $5`,
 		role.Name, role.Permissions, role.Color, role.Position, role.ID,
 	)
@@ -91,7 +91,7 @@ func (s *RoleStore) Update(ctx context.Context, role *model.Role) error {
 }
 
 func (s *RoleStore) Delete(ctx context.Context, id int64) error {
-	_, err := s.db.Exec(ctx, `DELETE FROM roles WHERE id = $1`, id)
+	_, err := querier(ctx, s.db).Exec(ctx, `DELETE FROM roles WHERE id = $1`, id)
 	if err != nil {
 		return fmt.Errorf("delete role: %w", err)
 	}
@@ -99,7 +99,7 @@ func (s *RoleStore) Delete(ctx context.Context, id int64) error {
 }
 
 func (s *RoleStore) AssignRole(ctx context.Context, serverID, userID, roleID int64) error {
-	_, err := s.db.Exec(ctx,
+	_, err := querier(ctx, s.db).Exec(ctx,
 		`INSERT INTO member_roles (server_id, user_id, role_id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
 		serverID, userID, roleID,
 	)
@@ -110,7 +110,7 @@ func (s *RoleStore) AssignRole(ctx context.Context, serverID, userID, roleID int
 }
 
 func (s *RoleStore) RemoveRole(ctx context.Context, serverID, userID, roleID int64) error {
-	_, err := s.db.Exec(ctx,
+	_, err := querier(ctx, s.db).Exec(ctx,
 		`DELETE FROM member_roles WHERE server_id = $1 AND user_id = $2 AND role_id = $3`,
 		serverID, userID, roleID,
 	)
@@ -121,8 +121,8 @@ func (s *RoleStore) RemoveRole(ctx context.Context, serverID, userID, roleID int
 }
 
 func (s *RoleStore) GetMemberRoles(ctx context.Context, serverID, userID int64) ([]model.Role, error) {
-	rows, err := s.db.Query(ctx,
-		`SELECT r.id, r.server_id, r.name, r.permissions, r.color, r.position
+	rows, err := querier(ctx, s.db).Query(ctx,
+		`SELECT r.id, r.server_id, r.name, r.permissions, r.color, r.position, r.managed
 		 FROM roles r
 		 JOIN member_roles mr ON r.id = mr.role_id
 		 WHERE mr.server_id = $1 AND mr.user_id = $2
@@ -136,7 +136,7 @@ func (s *RoleStore) GetMemberRoles(ctx context.Context, serverID, userID int64)
 	var roles []model.Role
 	for rows.Next() {
 		var role model.Role
-		if err := rows.Scan(&role.ID, &role.ServerID, &role.Name, &role.Permissions, &role.Color, &role.Position); err != nil {
+		if err := rows.Scan(&role.ID, &role.ServerID, &role.Name, &role.Permissions, &role.Color, &role.Position, &role.Managed); err != nil {
 			return nil, fmt.Errorf("scan role: %w", err)
 		}
 		roles = append(roles, role)
@@ -148,7 +148,7 @@ func (s *RoleStore) GetMemberRoles(ctx context.Context, serverID, userID int64)
 // all assigned roles plus the @everyone role (position 0).
 func (s *RoleStore) GetMemberPermissions(ctx context.Context, serverID, userID int64) (int64, error) {
 	var perms int64
-	err := s.db.QueryRow(ctx,
+	err := querier(ctx, s.db).QueryRow(ctx,
 		`SELECT COALESCE(bit_or(r.permissions), 0)
 		 FROM roles r
 		 WHERE r.server_id = $1
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+)
+
+type SecurityEventStore struct {
+	db *pgxpool.Pool
+}
+
+func NewSecurityEventStore(db *pgxpool.Pool) *SecurityEventStore {
+	return &SecurityEventStore{db: db}
+}
+
+func (s *SecurityEventStore) Create(ctx context.Context, event *model.SecurityEvent) error {
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`INSERT INTO security_events (id, user_id, type, ip_address, user_agent) VALUES ($1, $2, $3, $4, $5)`,
+		event.ID, event.UserID, event.Type, event.IPAddress, event.UserAgent,
+	)
+	if err != nil {
+		return fmt.Errorf("create security event: %w", err)
+	}
+	return nil
+}
+
+// ListByUser returns a user's security events, newest first, using cursor-based
+// pagination with snowflake IDs. Pass before=0 to get the latest events.
+func (s *SecurityEventStore) ListByUser(ctx context.Context, userID int64, before int64, limit int) ([]model.SecurityEvent, error) {
+	var query string
+	var args []interface{}
+
+	if before > 0 {
+		query = `SELECT id, user_id, type, ip_address, user_agent, created_at
+				 FROM security_events WHERE user_id = $1 AND id < $2
+				 ORDER BY id DESC LIMIT $3`
+		args = []interface{}{userID, before, limit}
+	} else {
+		query = `SELECT id, user_id, type, ip_address, user_agent, created_at
+				 FROM security_events WHERE user_id = $1
+				 ORDER BY id DESC LIMIT $2`
+		args = []interface{}{userID, limit}
+	}
+
+	rows, err := querier(ctx, s.db).Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list security events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []model.SecurityEvent
+	for rows.Next() {
+		var e model.SecurityEvent
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Type, &e.IPAddress, &e.UserAgent, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan security event: %w", err)
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
@@ -18,7 +18,7 @@ func NewServerStore(db *pgxpool.Pool) *ServerStore {
 }
 
 func (s *ServerStore) Create(ctx context.Context, server *model.Server) error {
-	_, err := s.db.Exec(ctx,
+	_, err := querier(ctx, s.db).Exec(ctx,
 		`INSERT INTO servers (id, name, owner_id, icon_url) VALUES ($1, $2, $3, $4)`,
 		server.ID, server.Name, server.OwnerID, server.IconURL,
 	)
@@ -30,9 +30,9 @@ func (s *ServerStore) Create(ctx context.Context, server *model.Server) error {
 
 func (s *ServerStore) GetByID(ctx context.Context, id int64) (*model.Server, error) {
 	var srv model.Server
-	err := s.db.QueryRow(ctx,
-		`SELECT id, name, owner_id, icon_url, created_at FROM servers WHERE id = $1`, id,
-	).Scan(&srv.ID, &srv.Name, &srv.OwnerID, &srv.IconURL, &srv.CreatedAt)
+	err := querier(ctx, s.db).QueryRow(ctx,
+		`SELECT id, name, owner_id, icon_url, require_verified_email, created_at FROM servers WHERE id = $1`, id,
+	).Scan(&srv.ID, &srv.Name, &srv.OwnerID, &srv.IconURL, &srv.RequireVerifiedEmail, &srv.CreatedAt)
 	if err == pgx.ErrNoRows {
 		return nil, nil
 	}
@@ -43,8 +43,8 @@ func (s *ServerStore) GetByID(ctx context.Context, id int64) (*model.Server, err
 }
 
 func (s *ServerStore) ListByUser(ctx context.Context, userID int64) ([]model.Server, error) {
-	rows, err := s.db.Query(ctx,
-		`SELECT s.id, s.name, s.owner_id, s.icon_url, s.created_at
+	rows, err := querier(ctx, s.db).Query(ctx,
+		`SELECT s.id, s.name, s.owner_id, s.icon_url, s.require_verified_email, s.created_at
 		 FROM servers s
 		 JOIN server_members sm ON s.id = sm.server_id
 		 WHERE sm.user_id = $1
@@ -58,7 +58,7 @@ func (s *ServerStore) ListByUser(ctx context.Context, userID int64) ([]model.Ser
 	var servers []model.Server
 	for rows.Next() {
 		var srv model.Server
-		if err := rows.Scan(&srv.ID, &srv.Name, &srv.OwnerID, &srv.IconURL, &srv.CreatedAt); err != nil {
+		if err := rows.Scan(&srv.ID, &srv.Name, &srv.OwnerID, &srv.IconURL, &srv.RequireVerifiedEmail, &srv.CreatedAt); err != nil {
 			return nil, fmt.Errorf("scan server: %w", err)
 		}
 		servers = append(servers, srv)
@@ -67,7 +67,7 @@ func (s *ServerStore) ListByUser(ctx context.Context, userID int64) ([]model.Ser
 }
 
 func (s *ServerStore) AddMember(ctx context.Context, serverID, userID int64) error {
-	_, err := s.db.Exec(ctx,
+	_, err := querier(ctx, s.db).Exec(ctx,
 		`INSERT INTO server_members (server_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
 		serverID, userID,
 	)
@@ -78,9 +78,9 @@ func (s *ServerStore) AddMember(ctx context.Context, serverID, userID int64) err
 }
 
 func (s *ServerStore) Update(ctx context.Context, server *model.Server) error {
-	_, err := s.db.Exec(ctx,
-		`UPDATE servers SET name = $1, icon_url = $2 WHERE id = $3`,
-		server.Name, server.IconURL, server.ID,
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`UPDATE servers SET name = $1, icon_url = $2, require_verified_email = $3 WHERE id = $4`,
+		server.Name, server.IconURL, server.RequireVerifiedEmail, server.ID,
 	)
 	if err != nil {
 		return fmt.Errorf("update server: %w", err)
@@ -90,7 +90,7 @@ func (s *ServerStore) Update(ctx context.Context, server *model.Server) error {
 
 func (s *ServerStore) IsMember(ctx context.Context, serverID, userID int64) (bool, error) {
 	var exists bool
-	err := s.db.QueryRow(ctx,
+	err := querier(ctx, s.db).QueryRow(ctx,
 		`SELECT EXISTS(SELECT 1 FROM server_members WHERE server_id = $1 AND user_id = $2)`,
 		serverID, userID,
 	).Scan(&exists)
@@ -101,7 +101,7 @@ func (s *ServerStore) IsMember(ctx context.Context, serverID, userID int64) (boo
 }
 
 func (s *ServerStore) RemoveMember(ctx context.Context, serverID, userID int64) error {
-	_, err := s.db.Exec(ctx,
+	_, err := querier(ctx, s.db).Exec(ctx,
 		`DELETE FROM server_members WHERE server_id = $1 AND user_id = $2`,
 		serverID, userID,
 	)
@@ -112,7 +112,7 @@ func (s *ServerStore) RemoveMember(ctx context.Context, serverID, userID int64)
 }
 
 func (s *ServerStore) Delete(ctx context.Context, id int64) error {
-	_, err := s.db.Exec(ctx, `DELETE FROM servers WHERE id = $1`, id)
+	_, err := querier(ctx, s.db).Exec(ctx, `DELETE FROM servers WHERE id = $1`, id)
 	if err != nil {
 		return fmt.Errorf("delete server: %w", err)
 	}
@@ -120,8 +120,8 @@ func (s *ServerStore) Delete(ctx context.Context, id int64) error {
 }
 
 func (s *ServerStore) ListMembers(ctx context.Context, serverID int64) ([]Member, error) {
-	rows, err := s.db.Query(ctx,
-		`SELECT u.id, u.username, u.display_name, u.avatar_url, sm.nickname, sm.joined_at
+	rows, err := querier(ctx, s.db).Query(ctx,
+		`SELECT u.id, u.username, u.display_name, u.avatar_url, sm.nickname, u.bot, sm.mute, sm.deaf, sm.joined_at
 		 FROM server_members sm
 		 JOIN users u ON sm.user_id = u.id
 		 WHERE sm.server_id = $1
@@ -135,10 +135,66 @@ func (s *ServerStore) ListMembers(ctx context.Context, serverID int64) ([]Member
 	var members []Member
 	for rows.Next() {
 		var m Member
-		if err := rows.Scan(&m.UserID, &m.Username, &m.DisplayName, &m.AvatarURL, &m.Nickname, &m.JoinedAt); err != nil {
+		if err := rows.Scan(&m.UserID, &m.Username, &m.DisplayName, &m.AvatarURL, &m.Nickname, &m.Bot, &m.Mute, &m.Deaf, &m.JoinedAt); err != nil {
 			return nil, fmt.Errorf("scan member: %w", err)
 		}
 		members = append(members, m)
 	}
 	return members, nil
 }
+
+// GetMember returns a member of the server, or nil if the user is not one.
+func (s *ServerStore) GetMember(ctx context.Context, serverID, userID int64) (*Member, error) {
+	var m Member
+	err := querier(ctx, s.db).QueryRow(ctx,
+		`SELECT u.id, u.username, u.display_name, u.avatar_url, sm.nickname, u.bot, sm.mute, sm.deaf, sm.joined_at
+		 FROM server_members sm
+		 JOIN users u ON sm.user_id = u.id
+		 WHERE sm.server_id = $1 AND sm.user_id = $2`, serverID, userID,
+	).Scan(&m.UserID, &m.Username, &m.DisplayName, &m.AvatarURL, &m.Nickname, &m.Bot, &m.Mute, &m.Deaf, &m.JoinedAt)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get member: %w", err)
+	}
+	return &m, nil
+}
+
+// SetVoiceModeration sets whether moderators have muted or deafened the
+// member in voice.
+func (s *ServerStore) SetVoiceModeration(ctx context.Context, serverID, userID int64, mute, deaf bool) error {
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`UPDATE server_members SET mute = $1, deaf = $2 WHERE server_id = $3 AND user_id = $4`,
+		mute, deaf, serverID, userID,
+	)
+	if err != nil {
+		return fmt.Errorf("set voice moderation: %w", err)
+	}
+	return nil
+}
+
+// CountMembersByUser returns the member count of every server the user
+// belongs to.
+func (s *ServerStore) CountMembersByUser(ctx context.Context, userID int64) (map[int64]int, error) {
+	rows, err := querier(ctx, s.db).Query(ctx,
+		`SELECT sm.server_id, (SELECT COUNT(*) FROM server_members c WHERE c.server_id = sm.server_id)
+		 FROM server_members sm
+		 WHERE sm.user_id = $1`, userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("count server members: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[int64]int)
+	for rows.Next() {
+		var serverID int64
+		var count int
+		if err := rows.Scan(&serverID, &count); err != nil {
+			return nil, fmt.Errorf("scan server member count: %w", err)
+		}
+		counts[serverID] = count
+	}
+	return counts, nil
+}
@@ -3,6 +3,7 @@ package store
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -18,10 +19,10 @@ func NewUserStore(db *pgxpool.Pool) *UserStore {
 }
 
 func (s *UserStore) Create(ctx context.Context, user *model.User) error {
-	_, err := s.db.Exec(ctx,
-		`INSERT INTO users (id, username, display_name, email, password_hash, status)
-		 VALUES ($1, $2, $3, $4, $5, $6)`,
-		user.ID, user.Username, user.DisplayName, user.Email, user.PasswordHash, user.Status,
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`INSERT INTO users (id, username, display_name, email, password_hash, bot, status)
+		 VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6, $7)`,
+		user.ID, user.Username, user.DisplayName, user.Email, user.PasswordHash, user.Bot, user.Status,
 	)
 	if err != nil {
 		return fmt.Errorf("create user: %w", err)
@@ -31,10 +32,10 @@ func (s *UserStore) Create(ctx context.Context, user *model.User) error {
 
 func (s *UserStore) GetByID(ctx context.Context, id int64) (*model.User, error) {
 	var u model.User
-	err := s.db.QueryRow(ctx,
-		`SELECT id, username, display_name, email, password_hash, avatar_url, status, created_at, updated_at
+	err := querier(ctx, s.db).QueryRow(ctx,
+		`SELECT id, username, display_name, COALESCE(email, ''), email_verified_at, COALESCE(password_hash, ''), avatar_url, bot, status, created_at, updated_at
 		 FROM users WHERE id = $1`, id,
-	).Scan(&u.ID, &u.Username, &u.DisplayName, &u.Email, &u.PasswordHash, &u.AvatarURL, &u.Status, &u.CreatedAt, &u.UpdatedAt)
+	).Scan(&u.ID, &u.Username, &u.DisplayName, &u.Email, &u.EmailVerifiedAt, &u.PasswordHash, &u.AvatarURL, &u.Bot, &u.Status, &u.CreatedAt, &u.UpdatedAt)
 	if err == pgx.ErrNoRows {
 		return nil, nil
 	}
@@ -46,10 +47,10 @@ func (s *UserStore) GetByID(ctx context.Context, id int64) (*model.User, error)
 
 func (s *UserStore) GetByEmail(ctx context.Context, email string) (*model.User, error) {
 	var u model.User
-	err := s.db.QueryRow(ctx,
-		`SELECT id, username, display_name, email, password_hash, avatar_url, status, created_at, updated_at
+	err := querier(ctx, s.db).QueryRow(ctx,
+		`SELECT id, username, display_name, COALESCE(email, ''), email_verified_at, COALESCE(password_hash, ''), avatar_url, bot, status, created_at, updated_at
 		 FROM users WHERE email = $1`, email,
-	).Scan(&u.ID, &u.Username, &u.DisplayName, &u.Email, &u.PasswordHash, &u.AvatarURL, &u.Status, &u.CreatedAt, &u.UpdatedAt)
+	).Scan(&u.ID, &u.Username, &u.DisplayName, &u.Email, &u.EmailVerifiedAt, &u.PasswordHash, &u.AvatarURL, &u.Bot, &u.Status, &u.CreatedAt, &u.UpdatedAt)
 	if err == pgx.ErrNoRows {
 		return nil, nil
 	}
@@ -61,10 +62,10 @@ func (s *UserStore) GetByEmail(ctx context.Context, email string) (*model.User,
 
 func (s *UserStore) GetByUsername(ctx context.Context, username string) (*model.User, error) {
 	var u model.User
-	err := s.db.QueryRow(ctx,
-		`SELECT id, username, display_name, email, password_hash, avatar_url, status, created_at, updated_at
+	err := querier(ctx, s.db).QueryRow(ctx,
+		`SELECT id, username, display_name, COALESCE(email, ''), email_verified_at, COALESCE(password_hash, ''), avatar_url, bot, status, created_at, updated_at
 		 FROM users WHERE username = $1`, username,
-	).Scan(&u.ID, &u.Username, &u.DisplayName, &u.Email, &u.PasswordHash, &u.AvatarURL, &u.Status, &u.CreatedAt, &u.UpdatedAt)
+	).Scan(&u.ID, &u.Username, &u.DisplayName, &u.Email, &u.EmailVerifiedAt, &u.PasswordHash, &u.AvatarURL, &u.Bot, &u.Status, &u.CreatedAt, &u.UpdatedAt)
 	if err == pgx.ErrNoRows {
 		return nil, nil
 	}
@@ -73,3 +74,72 @@ func (s *UserStore) GetByUsername(ctx context.Context, username string) (*model.
 	}
 	return &u, nil
 }
+
+func (s *UserStore) MarkEmailVerified(ctx context.Context, id int64) error {
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`UPDATE users SET email_verified_at = COALESCE(email_verified_at, NOW()), updated_at = NOW() WHERE id = $1`, id,
+	)
+	if err != nil {
+		return fmt.Errorf("mark email verified: %w", err)
+	}
+	return nil
+}
+
+func (s *UserStore) UpdatePassword(ctx context.Context, id int64, passwordHash string) error {
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`UPDATE users SET password_hash = $1, updated_at = NOW() WHERE id = $2`,
+		passwordHash, id,
+	)
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+	return nil
+}
+
+// UpdateStatus sets the status the user chose.
+func (s *UserStore) UpdateStatus(ctx context.Context, id int64, status model.UserStatus) error {
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`UPDATE users SET status = $1, updated_at = NOW() WHERE id = $2`,
+		status, id,
+	)
+	if err != nil {
+		return fmt.Errorf("update user status: %w", err)
+	}
+	return nil
+}
+
+// GetCustomStatus returns the user's custom status, or nil if they have none.
+// It may have expired.
+func (s *UserStore) GetCustomStatus(ctx context.Context, id int64) (*model.CustomStatus, error) {
+	var text *string
+	var cs model.CustomStatus
+	err := querier(ctx, s.db).QueryRow(ctx,
+		`SELECT custom_status_text, custom_status_emoji, custom_status_expires_at FROM users WHERE id = $1`, id,
+	).Scan(&text, &cs.Emoji, &cs.ExpiresAt)
+	if err == pgx.ErrNoRows || (err == nil && text == nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get custom status: %w", err)
+	}
+	cs.Text = *text
+	return &cs, nil
+}
+
+// UpdateCustomStatus sets the user's custom status, or clears it if cs is nil.
+func (s *UserStore) UpdateCustomStatus(ctx context.Context, id int64, cs *model.CustomStatus) error {
+	var text, emoji *string
+	var expiresAt *time.Time
+	if cs != nil {
+		text, emoji, expiresAt = &cs.Text, cs.Emoji, cs.ExpiresAt
+	}
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`UPDATE users SET custom_status_text = $1, custom_status_emoji = $2, custom_status_expires_at = $3, updated_at = NOW()
+		 WHERE id = $4`,
+		text, emoji, expiresAt, id,
+	)
+	if err != nil {
+		return fmt.Errorf("update custom status: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+)
+
+type WebhookStore struct {
+	db *pgxpool.Pool
+}
+
+func NewWebhookStore(db *pgxpool.Pool) *WebhookStore {
+	return &WebhookStore{db: db}
+}
+
+func (s *WebhookStore) Create(ctx context.Context, wh *model.Webhook) error {
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`INSERT INTO webhooks (id, server_id, channel_id, name, avatar_url, token_hash, created_by)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		wh.ID, wh.ServerID, wh.ChannelID, wh.Name, wh.AvatarURL, wh.TokenHash, wh.CreatedBy,
+	)
+	if err != nil {
+		return fmt.Errorf("create webhook: %w", err)
+	}
+	return nil
+}
+
+func (s *WebhookStore) GetByID(ctx context.Context, id int64) (*model.Webhook, error) {
+	var wh model.Webhook
+	err := querier(ctx, s.db).QueryRow(ctx,
+		`SELECT id, server_id, channel_id, name, avatar_url, token_hash, created_by, created_at
+		 FROM webhooks WHERE id = $1`, id,
+	).Scan(&wh.ID, &wh.ServerID, &wh.ChannelID, &wh.Name, &wh.AvatarURL, &wh.TokenHash, &wh.CreatedBy, &wh.CreatedAt)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get webhook: %w", err)
+	}
+	return &wh, nil
+}
+
+func (s *WebhookStore) ListByChannel(ctx context.Context, channelID int64) ([]model.Webhook, error) {
+	return s.list(ctx,
+		`SELECT id, server_id, channel_id, name, avatar_url, token_hash, created_by, created_at
+		 FROM webhooks WHERE channel_id = $1 ORDER BY created_at`, channelID,
+	)
+}
+
+func (s *WebhookStore) ListByServer(ctx context.Context, serverID int64) ([]model.Webhook, error) {
+	return s.list(ctx,
+		`SELECT id, server_id, channel_id, name, avatar_url, token_hash, created_by, created_at
+		 FROM webhooks WHERE server_id = $1 ORDER BY created_at`, serverID,
+	)
+}
+
+func (s *WebhookStore) list(ctx context.Context, query string, arg int64) ([]model.Webhook, error) {
+	rows, err := querier(ctx, s.db).Query(ctx, query, arg)
+	if err != nil {
+		return nil, fmt.Errorf("list webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	var webhooks []model.Webhook
+	for rows.Next() {
+		var wh model.Webhook
+		if err := rows.Scan(&wh.ID, &wh.ServerID, &wh.ChannelID, &wh.Name, &wh.AvatarURL, &wh.TokenHash, &wh.CreatedBy, &wh.CreatedAt); err != nil {
+			return nil, fmt.Errorf("scan webhook: %w", err)
+		}
+		webhooks = append(webhooks, wh)
+	}
+	return webhooks, nil
+}
+
+func (s *WebhookStore) Update(ctx context.Context, wh *model.Webhook) error {
+	_, err := querier(ctx, s.db).Exec(ctx,
+		`UPDATE webhooks SET name = $1, avatar_url = $2, channel_id = $3 WHERE id = $4`,
+		wh.Name, wh.AvatarURL, wh.ChannelID, wh.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("update webhook: %w", err)
+	}
+	return nil
+}
+
+func (s *WebhookStore) UpdateTokenHash(ctx context.Context, id int64, hash string) error {
+	_, err := querier(ctx, s.db).Exec(ctx, `UPDATE webhooks SET token_hash = $1 WHERE id = $2`, hash, id)
+	if err != nil {
+		return fmt.Errorf("update webhook token: %w", err)
+	}
+	return nil
+}
+
+func (s *WebhookStore) Delete(ctx context.Context, id int64) error {
+	_, err := querier(ctx, s.db).Exec(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("delete webhook: %w", err)
+	}
+	return nil
+}
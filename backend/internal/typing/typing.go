@@ -0,0 +1,132 @@
+// Package typing tells the members of a channel who is typing in it.
+package typing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/permission"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Interval is the least time between a user's typing events in a
+	// channel. Clients resend TYPING_START about this often while the user
+	// keeps typing; more frequent calls are ignored.
+	Interval = 5 * time.Second
+	// Timeout is how long clients show that a user is typing after their
+	// last typing event, unless a message from them arrives first.
+	Timeout = 10 * time.Second
+)
+
+var ErrInvalidChannel = errors.New("can only type in text channels")
+
+// Service publishes typing events. Whether a user was recently announced as
+// typing is kept in Redis, so the throttle holds across gateway nodes.
+type Service struct {
+	servers  store.ServerStoreInterface
+	channels store.ChannelStoreInterface
+	perms    *permission.Checker
+	bus      events.PubSub
+	redis    *redis.Client
+}
+
+func NewService(
+	servers store.ServerStoreInterface,
+	channels store.ChannelStoreInterface,
+	perms *permission.Checker,
+	bus events.PubSub,
+	redisClient *redis.Client,
+) *Service {
+	return &Service{
+		servers:  servers,
+		channels: channels,
+		perms:    perms,
+		bus:      bus,
+		redis:    redisClient,
+	}
+}
+
+// typingKey exists while a user's last typing event in a channel is recent
+// enough that another would be throttled.
+func typingKey(channelID, userID int64) string {
+	return "typing:" + strconv.FormatInt(channelID, 10) + ":" + strconv.FormatInt(userID, 10)
+}
+
+// Start announces that the user is typing in the channel, unless they were
+// announced less than Interval ago. The user needs the Send Messages
+// permission.
+func (s *Service) Start(ctx context.Context, channelID, userID int64) error {
+	ch, err := s.channels.GetByID(ctx, channelID)
+	if err != nil {
+		return err
+	}
+	if ch == nil || ch.Type != model.ChannelTypeText {
+		return ErrInvalidChannel
+	}
+	if err := s.perms.Require(ctx, ch.ServerID, userID, model.PermissionSendMessages); err != nil {
+		return err
+	}
+
+	fresh, err := s.redis.SetNX(ctx, typingKey(channelID, userID), 1, Interval).Result()
+	if err != nil {
+		return fmt.Errorf("throttle typing: %w", err)
+	}
+	if !fresh {
+		return nil
+	}
+
+	payload := events.TypingStartPayload{
+		ChannelID: channelID,
+		UserID:    userID,
+		Timestamp: time.Now(),
+	}
+	member, err := s.servers.GetMember(ctx, ch.ServerID, userID)
+	if err != nil {
+		return err
+	}
+	if member != nil {
+		payload.Nickname = member.Nickname
+	}
+	event := events.Event{Type: events.TypingStart, Data: payload}
+	return s.bus.Publish(ctx, fmt.Sprintf("channel:%d", channelID), event)
+}
+
+// Clear forgets that the user is typing in the channel, so the next Start is
+// announced straight away.
+func (s *Service) Clear(ctx context.Context, channelID, userID int64) error {
+	if err := s.redis.Del(ctx, typingKey(channelID, userID)).Err(); err != nil {
+		return fmt.Errorf("clear typing: %w", err)
+	}
+	return nil
+}
+
+// Run clears the typing state of users who send a message, however it is
+// sent, until ctx is done. Clients stop showing a user as typing when their
+// message arrives.
+func (s *Service) Run(ctx context.Context) {
+	s.bus.PSubscribe(ctx, s.handleEvent, "channel:*")
+	<-ctx.Done()
+}
+
+func (s *Service) handleEvent(_ string, event events.Event) {
+	if event.Type != events.MessageCreate {
+		return
+	}
+	msg, ok := event.Data.(*model.Message)
+	if !ok || msg.AuthorID == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Clear(ctx, msg.ChannelID, msg.AuthorID); err != nil {
+		log.Warn().Err(err).Int64("channel_id", msg.ChannelID).Msg("failed to clear typing")
+	}
+}
@@ -0,0 +1,430 @@
+package voice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/rs/zerolog/log"
+)
+
+// peer is one session's peer connection to the SFU. Either side may offer:
+// the client to start and to add or remove its own tracks, the SFU when
+// other users' tracks come and go. If both offer at once, the SFU rolls its
+// offer back and makes it again once the client's is answered.
+type peer struct {
+	sfu       *SFU
+	userID    int64
+	sessionID string
+	serverID  int64
+	channelID int64
+	pc        *webrtc.PeerConnection
+
+	// muted drops the user's audio instead of forwarding it.
+	muted atomic.Bool
+
+	// room, outgoing, the user's audio as forwarded to others, and videos,
+	// the user's videos by source, are guarded by sfu.mu.
+	room     *room
+	outgoing webrtc.TrackLocal
+	videos   map[string]*video
+
+	mu       sync.Mutex
+	deafened bool
+	// tracks holds everyone else's media, and senders the tracks being
+	// sent, which leaves out audio while deafened.
+	tracks  map[trackKey]sending
+	senders map[trackKey]*webrtc.RTPSender
+	// sources maps the mids of the client's tracks to their sources.
+	sources map[string]string
+	// answered is set once the client's first offer is answered; until
+	// then only the client offers.
+	answered bool
+	// negotiate is set when tracks changed since the last offer.
+	negotiate bool
+	// candidates arrived before the remote description they belong to.
+	candidates []webrtc.ICECandidateInit
+}
+
+// trackKey identifies a track sent to a peer by the user it comes from and
+// its source.
+type trackKey struct {
+	userID int64
+	source string
+}
+
+// sending is a track sent to a peer, and how to get a keyframe of it when
+// the client asks for one.
+type sending struct {
+	track    webrtc.TrackLocal
+	keyframe func()
+}
+
+func (f *SFU) newPeer(state *model.VoiceState) (*peer, error) {
+	var cfg webrtc.Configuration
+	if len(f.media.ICEServers) > 0 {
+		cfg.ICEServers = []webrtc.ICEServer{{URLs: f.media.ICEServers}}
+	}
+	pc, err := f.api.NewPeerConnection(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("create peer connection: %w", err)
+	}
+
+	p := &peer{
+		sfu:       f,
+		userID:    state.UserID,
+		sessionID: state.SessionID,
+		serverID:  state.ServerID,
+		channelID: *state.ChannelID,
+		pc:        pc,
+		videos:    make(map[string]*video),
+		deafened:  state.Deafened(),
+		tracks:    make(map[trackKey]sending),
+		senders:   make(map[trackKey]*webrtc.RTPSender),
+		sources:   make(map[string]string),
+	}
+	p.muted.Store(state.Muted())
+
+	pc.OnICECandidate(p.onCandidate)
+	pc.OnTrack(p.onTrack)
+	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		if s == webrtc.PeerConnectionStateFailed || s == webrtc.PeerConnectionStateClosed {
+			f.remove(p)
+		}
+	})
+	return p, nil
+}
+
+// signal sends signaling to the peer's session.
+func (p *peer) signal(info events.VoiceServerInfoPayload) {
+	info.ChannelID = p.channelID
+	info.SessionID = p.sessionID
+	ctx, cancel := context.WithTimeout(context.Background(), signalTimeout)
+	defer cancel()
+	if err := p.sfu.send(ctx, p.userID, info); err != nil {
+		log.Warn().Err(err).Int64("user_id", p.userID).Str("type", info.Type).Msg("failed to send voice signal")
+	}
+}
+
+// handleOffer answers an offer from the client, which maps the mids of the
+// tracks it sends to their sources.
+func (p *peer) handleOffer(sdp string, sources map[string]string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if sources != nil {
+		p.sources = sources
+	}
+
+	if p.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		rollback := webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}
+		if err := p.pc.SetLocalDescription(rollback); err != nil {
+			return fmt.Errorf("roll back voice offer: %w", err)
+		}
+		p.negotiate = true
+	}
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}
+	if err := p.pc.SetRemoteDescription(offer); err != nil {
+		return fmt.Errorf("set voice offer: %w", err)
+	}
+	p.flushCandidatesLocked()
+
+	answer, err := p.pc.CreateAnswer(nil)
+	if err != nil {
+		return fmt.Errorf("create voice answer: %w", err)
+	}
+	if err := p.pc.SetLocalDescription(answer); err != nil {
+		return fmt.Errorf("set voice answer: %w", err)
+	}
+	p.signal(events.VoiceServerInfoPayload{Type: SignalAnswer, SDP: answer.SDP})
+	p.answered = true
+	return p.offerLocked()
+}
+
+func (p *peer) handleAnswer(sdp string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pc.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		return nil // an answer to an offer that was rolled back
+	}
+	answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdp}
+	if err := p.pc.SetRemoteDescription(answer); err != nil {
+		return fmt.Errorf("set voice answer: %w", err)
+	}
+	p.flushCandidatesLocked()
+	return p.offerLocked()
+}
+
+func (p *peer) addCandidate(c webrtc.ICECandidateInit) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pc.RemoteDescription() == nil {
+		p.candidates = append(p.candidates, c)
+		return nil
+	}
+	if err := p.pc.AddICECandidate(c); err != nil {
+		return fmt.Errorf("add ICE candidate: %w", err)
+	}
+	return nil
+}
+
+func (p *peer) flushCandidatesLocked() {
+	for _, c := range p.candidates {
+		if err := p.pc.AddICECandidate(c); err != nil {
+			log.Debug().Err(err).Int64("user_id", p.userID).Msg("failed to add ICE candidate")
+		}
+	}
+	p.candidates = nil
+}
+
+func (p *peer) onCandidate(c *webrtc.ICECandidate) {
+	if c == nil {
+		return // gathering finished
+	}
+	init := c.ToJSON()
+	p.signal(events.VoiceServerInfoPayload{
+		Type: SignalCandidate,
+		Candidate: &events.ICECandidate{
+			Candidate:        init.Candidate,
+			SDPMid:           init.SDPMid,
+			SDPMLineIndex:    init.SDPMLineIndex,
+			UsernameFragment: init.UsernameFragment,
+		},
+	})
+}
+
+// renegotiate offers the client the tracks as they are now, or as soon as
+// negotiation in progress finishes.
+func (p *peer) renegotiate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.negotiate = true
+	if err := p.offerLocked(); err != nil {
+		log.Warn().Err(err).Int64("user_id", p.userID).Msg("failed to renegotiate voice")
+	}
+}
+
+// offerLocked sends an offer if tracks changed and nothing is being
+// negotiated.
+func (p *peer) offerLocked() error {
+	if !p.negotiate || !p.answered || p.pc.SignalingState() != webrtc.SignalingStateStable {
+		return nil
+	}
+	p.negotiate = false
+	offer, err := p.pc.CreateOffer(nil)
+	if err != nil {
+		return fmt.Errorf("create voice offer: %w", err)
+	}
+	if err := p.pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("set voice offer: %w", err)
+	}
+	p.signal(events.VoiceServerInfoPayload{Type: SignalOffer, SDP: offer.SDP})
+	return nil
+}
+
+// onTrack forwards the user's media to the rest of the room.
+func (p *peer) onTrack(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	switch remote.Kind() {
+	case webrtc.RTPCodecTypeAudio:
+		p.forwardAudio(remote)
+	case webrtc.RTPCodecTypeVideo:
+		p.forwardVideo(remote, receiver)
+	}
+}
+
+// forwardAudio forwards the user's audio while they are allowed to be heard.
+func (p *peer) forwardAudio(remote *webrtc.TrackRemote) {
+	local, err := webrtc.NewTrackLocalStaticRTP(remote.Codec().RTPCodecCapability, SourceMicrophone, strconv.FormatInt(p.userID, 10))
+	if err != nil {
+		log.Warn().Err(err).Int64("user_id", p.userID).Msg("failed to create voice track")
+		return
+	}
+	p.sfu.publish(p, local)
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := remote.Read(buf)
+		if err != nil {
+			return
+		}
+		if p.muted.Load() {
+			continue
+		}
+		if _, err := local.Write(buf[:n]); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			return
+		}
+	}
+}
+
+// forwardVideo forwards one layer of the user's camera or screen share, if
+// they have the Share Screen permission, until they lose it. Video from
+// users without it is never read, so it goes no further than the SFU.
+func (p *peer) forwardVideo(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	ctx, cancel := context.WithTimeout(context.Background(), signalTimeout)
+	allowed, err := p.sfu.voice.canShare(ctx, p.serverID, p.userID)
+	cancel()
+	if err != nil {
+		log.Warn().Err(err).Int64("user_id", p.userID).Msg("failed to check video permission")
+		return
+	}
+	if !allowed {
+		log.Debug().Int64("user_id", p.userID).Msg("ignoring video without the share screen permission")
+		return
+	}
+
+	v, l := p.sfu.publishVideo(p, p.videoSource(receiver), remote)
+	if v == nil {
+		return
+	}
+	defer p.sfu.unpublishVideo(p, v, l)
+	for {
+		pkt, _, err := remote.ReadRTP()
+		if err != nil || v.closed() {
+			return // the user has left or lost the permission
+		}
+		v.forward(l, pkt)
+	}
+}
+
+// videoSource returns the source the client gave for the video a receiver
+// gets, which is the camera unless it said the screen.
+func (p *peer) videoSource(receiver *webrtc.RTPReceiver) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, t := range p.pc.GetTransceivers() {
+		if t.Receiver() == receiver {
+			if p.sources[t.Mid()] == SourceScreen {
+				return SourceScreen
+			}
+			break
+		}
+	}
+	return SourceCamera
+}
+
+// addTrack sends another user's media to the peer. keyframe, if not nil,
+// is called when the client asks for a keyframe. The caller renegotiates.
+func (p *peer) addTrack(key trackKey, track webrtc.TrackLocal, keyframe func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tracks[key] = sending{track: track, keyframe: keyframe}
+	if p.deafened && key.source == SourceMicrophone {
+		return
+	}
+	if sender := p.senders[key]; sender != nil {
+		if err := sender.ReplaceTrack(track); err != nil {
+			log.Warn().Err(err).Int64("user_id", p.userID).Msg("failed to replace voice track")
+		}
+		return
+	}
+	p.attachLocked(key, track)
+}
+
+// removeTrack stops sending another user's track to the peer, and reports
+// whether it was being sent. The caller renegotiates.
+func (p *peer) removeTrack(key trackKey) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.tracks, key)
+	return p.detachLocked(key)
+}
+
+// removeTracks stops sending any of another user's media to the peer, and
+// reports whether any was being sent. The caller renegotiates.
+func (p *peer) removeTracks(userID int64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	removed := false
+	for key := range p.tracks {
+		if key.userID == userID {
+			delete(p.tracks, key)
+			removed = p.detachLocked(key) || removed
+		}
+	}
+	return removed
+}
+
+func (p *peer) attachLocked(key trackKey, track webrtc.TrackLocal) {
+	sender, err := p.pc.AddTrack(track)
+	if err != nil {
+		log.Warn().Err(err).Int64("user_id", p.userID).Msg("failed to add voice track")
+		return
+	}
+	p.senders[key] = sender
+	p.negotiate = true
+
+	// Interceptors only see RTCP that is read.
+	go func() {
+		for {
+			pkts, _, err := sender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, pkt := range pkts {
+				switch pkt.(type) {
+				case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+					p.keyframe(key)
+				}
+			}
+		}
+	}()
+}
+
+func (p *peer) detachLocked(key trackKey) bool {
+	sender := p.senders[key]
+	if sender == nil {
+		return false
+	}
+	delete(p.senders, key)
+	if err := p.pc.RemoveTrack(sender); err != nil {
+		log.Debug().Err(err).Int64("user_id", p.userID).Msg("failed to remove voice track")
+	}
+	p.negotiate = true
+	return true
+}
+
+// keyframe asks for a keyframe of a track sent to the peer.
+func (p *peer) keyframe(key trackKey) {
+	p.mu.Lock()
+	keyframe := p.tracks[key].keyframe
+	p.mu.Unlock()
+	if keyframe != nil {
+		keyframe()
+	}
+}
+
+// apply follows a change to the user's voice state: muted users are not
+// forwarded, and deafened users are sent no audio.
+func (p *peer) apply(state *model.VoiceState) {
+	p.muted.Store(state.Muted())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	deafened := state.Deafened()
+	if deafened == p.deafened {
+		return
+	}
+	p.deafened = deafened
+	for key, t := range p.tracks {
+		if key.source != SourceMicrophone {
+			continue
+		}
+		if deafened {
+			p.detachLocked(key)
+		} else {
+			p.attachLocked(key, t.track)
+		}
+	}
+	if err := p.offerLocked(); err != nil {
+		log.Warn().Err(err).Int64("user_id", p.userID).Msg("failed to renegotiate voice")
+	}
+}
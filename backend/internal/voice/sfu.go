@@ -0,0 +1,692 @@
+package voice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+	"github.com/redis/go-redis/v9"
+	"github.com/robwittman/possessive-potato/backend/internal/config"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/permission"
+	"github.com/rs/zerolog/log"
+)
+
+// Signaling message types, in events.VoiceSignalPayload and
+// events.VoiceServerInfoPayload.
+const (
+	SignalReady     = "ready"
+	SignalOffer     = "offer"
+	SignalAnswer    = "answer"
+	SignalCandidate = "candidate"
+	SignalLayer     = "layer"
+)
+
+// Track sources. Clients name the source of each track they send in their
+// offers, and receive each track with its source as the track ID.
+const (
+	SourceMicrophone = "microphone"
+	SourceCamera     = "camera"
+	SourceScreen     = "screen"
+)
+
+const (
+	// hostTTL is how long a node hosts a channel's media without refreshing
+	// its claim, so channels on a node that died move to another.
+	hostTTL = 90 * time.Second
+	// hostRefreshInterval is how often nodes refresh their claims.
+	hostRefreshInterval = 30 * time.Second
+	// signalTimeout bounds handling one signaling message.
+	signalTimeout = 5 * time.Second
+)
+
+// MediaConfig is how the SFU's media is reached.
+type MediaConfig struct {
+	// ICEServers are STUN and TURN URLs, given to clients too.
+	ICEServers []string
+	// PublicIPs replace the node's own addresses in its ICE candidates.
+	PublicIPs []string
+	// UDPPortMin and UDPPortMax bound the ports media is received on. Zero
+	// allows any.
+	UDPPortMin uint16
+	UDPPortMax uint16
+}
+
+// MediaConfigFromConfig reads the media settings from cfg.
+func MediaConfigFromConfig(cfg *config.Config) MediaConfig {
+	return MediaConfig{
+		ICEServers: cfg.VoiceICEServers,
+		PublicIPs:  cfg.VoicePublicIPs,
+		UDPPortMin: uint16(cfg.VoiceUDPPortMin),
+		UDPPortMax: uint16(cfg.VoiceUDPPortMax),
+	}
+}
+
+// SFU is a selective forwarding unit for voice channels, embedded in each
+// gateway node. Each client in a voice channel has one peer connection to
+// it, sending its own audio and any camera video or screen share, and
+// receiving everyone else's, with the sender's ID as the stream ID. Audio
+// is forwarded as is, never mixed or transcoded, and dropped for users who
+// are muted or may not speak. Video is accepted only from users with the
+// Share Screen permission, and stopped if they lose it, in simulcast layers
+// of which each receiver gets one; see video.
+//
+// All of a channel's media goes through one node, which claims the channel
+// in Redis when its first client signals. Clients signal through the
+// gateway, which may be any node; Signal forwards their messages over the
+// event bus to the node hosting their channel, which answers through the
+// user's topic.
+type SFU struct {
+	voice  *Service
+	bus    events.PubSub
+	redis  *redis.Client
+	media  MediaConfig
+	api    *webrtc.API
+	nodeID string
+
+	mu      sync.Mutex
+	sub     events.Subscription
+	rooms   map[int64]*room // by channel
+	peers   map[int64]*peer // by user
+	servers map[int64]int   // rooms hosted per server
+}
+
+// room is a voice channel hosted on this node.
+type room struct {
+	channelID int64
+	serverID  int64
+	peers     map[int64]*peer // by user
+}
+
+func NewSFU(voice *Service, bus events.PubSub, redisClient *redis.Client, media MediaConfig) (*SFU, error) {
+	m := &webrtc.MediaEngine{}
+	if err := registerCodecs(m); err != nil {
+		return nil, err
+	}
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, registry); err != nil {
+		return nil, fmt.Errorf("register interceptors: %w", err)
+	}
+	settings := webrtc.SettingEngine{}
+	if media.UDPPortMin != 0 || media.UDPPortMax != 0 {
+		if err := settings.SetEphemeralUDPPortRange(media.UDPPortMin, media.UDPPortMax); err != nil {
+			return nil, fmt.Errorf("set voice UDP port range: %w", err)
+		}
+	}
+	if len(media.PublicIPs) > 0 {
+		settings.SetNAT1To1IPs(media.PublicIPs, webrtc.ICECandidateTypeHost)
+	}
+
+	return &SFU{
+		voice: voice,
+		bus:   bus,
+		redis: redisClient,
+		media: media,
+		api: webrtc.NewAPI(
+			webrtc.WithMediaEngine(m),
+			webrtc.WithInterceptorRegistry(registry),
+			webrtc.WithSettingEngine(settings),
+		),
+		nodeID:  model.NewID().String(),
+		rooms:   make(map[int64]*room),
+		peers:   make(map[int64]*peer),
+		servers: make(map[int64]int),
+	}, nil
+}
+
+// registerCodecs limits peer connections to the codecs the SFU forwards. The
+// default interceptors enable the header extensions simulcast needs.
+func registerCodecs(m *webrtc.MediaEngine) error {
+	err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1",
+		},
+		PayloadType: 111,
+	}, webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		return fmt.Errorf("register opus: %w", err)
+	}
+
+	err = m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:  webrtc.MimeTypeVP8,
+			ClockRate: 90000,
+			RTCPFeedback: []webrtc.RTCPFeedback{
+				{Type: webrtc.TypeRTCPFBGoogREMB},
+				{Type: webrtc.TypeRTCPFBCCM, Parameter: "fir"},
+				{Type: webrtc.TypeRTCPFBNACK},
+				{Type: webrtc.TypeRTCPFBNACK, Parameter: "pli"},
+			},
+		},
+		PayloadType: 96,
+	}, webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		return fmt.Errorf("register vp8: %w", err)
+	}
+	return nil
+}
+
+func sfuTopic(nodeID string) string { return "sfu:" + nodeID }
+
+// hostKey holds the ID of the node hosting a channel's media.
+func hostKey(channelID int64) string { return "voice_host:" + strconv.FormatInt(channelID, 10) }
+
+// releaseScript deletes KEYS[1] if it is still ARGV[1].
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// extendScript renews KEYS[1] for ARGV[2] milliseconds if it is still
+// ARGV[1], or claims it again if it lapsed. It returns whether the key is
+// ARGV[1]'s.
+var extendScript = redis.NewScript(`
+local node = redis.call('GET', KEYS[1])
+if node == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+if not node then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// host returns the node hosting a channel's media, claiming it for this
+// node if none is.
+func (f *SFU) host(ctx context.Context, channelID int64) (string, error) {
+	key := hostKey(channelID)
+	node, err := f.redis.SetArgs(ctx, key, f.nodeID, redis.SetArgs{Mode: "NX", Get: true, TTL: hostTTL}).Result()
+	if err == redis.Nil {
+		return f.nodeID, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("claim voice channel: %w", err)
+	}
+	return node, nil
+}
+
+// Ready tells a session that has joined a voice channel where its media
+// goes, and which ICE servers to use.
+func (f *SFU) Ready(ctx context.Context, state *model.VoiceState) error {
+	if state.ChannelID == nil {
+		return nil
+	}
+	node, err := f.host(ctx, *state.ChannelID)
+	if err != nil {
+		return err
+	}
+	return f.send(ctx, state.UserID, events.VoiceServerInfoPayload{
+		ChannelID:  *state.ChannelID,
+		SessionID:  state.SessionID,
+		Endpoint:   node,
+		Type:       SignalReady,
+		ICEServers: f.media.ICEServers,
+	})
+}
+
+// Signal forwards signaling from a client to the node hosting its channel.
+// Signaling from a session that is not connected to the channel is dropped
+// before anything claims to host the channel.
+func (f *SFU) Signal(ctx context.Context, sig events.VoiceSignalPayload) error {
+	state, err := f.voice.Get(ctx, sig.UserID)
+	if err != nil {
+		return err
+	}
+	if state == nil || state.SessionID != sig.SessionID || state.ChannelID == nil || *state.ChannelID != sig.ChannelID {
+		return nil
+	}
+	node, err := f.host(ctx, sig.ChannelID)
+	if err != nil {
+		return err
+	}
+	event := events.Event{Type: events.VoiceSignal, Data: sig}
+	if err := f.bus.Publish(ctx, sfuTopic(node), event); err != nil {
+		return fmt.Errorf("forward voice signal: %w", err)
+	}
+	return nil
+}
+
+// send delivers signaling to one of the user's sessions.
+func (f *SFU) send(ctx context.Context, userID int64, info events.VoiceServerInfoPayload) error {
+	info.Endpoint = f.nodeID
+	event := events.Event{Type: events.VoiceServerInfo, Data: info}
+	return f.bus.Publish(ctx, fmt.Sprintf("user:%d", userID), event)
+}
+
+// Run handles signaling for the channels this node hosts, and follows their
+// users' voice states, until ctx is done. It then closes every peer
+// connection.
+func (f *SFU) Run(ctx context.Context) {
+	f.mu.Lock()
+	f.sub = f.bus.Subscribe(ctx, f.handleEvent, sfuTopic(f.nodeID))
+	f.mu.Unlock()
+
+	ticker := time.NewTicker(hostRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			f.close()
+			return
+		case <-ticker.C:
+		}
+		f.refresh(ctx)
+	}
+}
+
+// refresh extends this node's claims on the channels it hosts. Channels
+// another node claimed after this node's claim lapsed are handed over.
+func (f *SFU) refresh(ctx context.Context) {
+	f.mu.Lock()
+	ids := make([]int64, 0, len(f.rooms))
+	for id := range f.rooms {
+		ids = append(ids, id)
+	}
+	f.mu.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+
+	cmds, err := f.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			extendScript.Eval(ctx, pipe, []string{hostKey(id)}, f.nodeID, hostTTL.Milliseconds())
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to refresh hosted voice channels")
+		return
+	}
+	for i, cmd := range cmds {
+		if held, err := cmd.(*redis.Cmd).Int(); err == nil && held == 0 {
+			log.Warn().Int64("channel_id", ids[i]).Msg("voice channel claimed by another node")
+			f.handOver(ctx, ids[i])
+		}
+	}
+}
+
+// handOver closes the peer connections of a channel this node no longer
+// hosts, and tells their sessions to signal again, which reaches the node
+// that does.
+func (f *SFU) handOver(ctx context.Context, channelID int64) {
+	f.mu.Lock()
+	var peers []*peer
+	if r := f.rooms[channelID]; r != nil {
+		for _, p := range r.peers {
+			peers = append(peers, p)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, p := range peers {
+		f.remove(p)
+		state, err := f.voice.Get(ctx, p.userID)
+		if err != nil || state == nil || state.SessionID != p.sessionID {
+			continue
+		}
+		if err := f.Ready(ctx, state); err != nil {
+			log.Warn().Err(err).Int64("user_id", p.userID).Msg("failed to move voice session")
+		}
+	}
+}
+
+func (f *SFU) close() {
+	f.mu.Lock()
+	peers := make([]*peer, 0, len(f.peers))
+	for _, p := range f.peers {
+		peers = append(peers, p)
+	}
+	f.mu.Unlock()
+	for _, p := range peers {
+		f.remove(p)
+	}
+}
+
+func (f *SFU) handleEvent(_ string, event events.Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), signalTimeout)
+	defer cancel()
+
+	switch data := event.Data.(type) {
+	case *events.VoiceSignalPayload:
+		if err := f.handleSignal(ctx, *data); err != nil {
+			log.Warn().Err(err).Int64("user_id", data.UserID).Str("type", data.Type).Msg("failed to handle voice signal")
+		}
+	case *events.VoiceStatePayload:
+		f.follow(data.VoiceState)
+	case *events.ServerMemberUpdatePayload:
+		f.recheckVideo(ctx, data.ServerID, data.UserID)
+	case *model.Role:
+		f.recheckVideo(ctx, data.ServerID, 0)
+	case *events.RoleDeletePayload:
+		f.recheckVideo(ctx, data.ServerID, 0)
+	}
+}
+
+// handleSignal applies a client's signaling to its peer connection. An offer
+// from a session that has not yet got one creates it; the session must hold
+// the user's connection to the channel.
+func (f *SFU) handleSignal(ctx context.Context, sig events.VoiceSignalPayload) error {
+	f.mu.Lock()
+	p := f.peers[sig.UserID]
+	f.mu.Unlock()
+	if p != nil && (p.sessionID != sig.SessionID || p.room.channelID != sig.ChannelID) {
+		if sig.Type != SignalOffer {
+			return nil
+		}
+		f.remove(p)
+		p = nil
+	}
+
+	switch sig.Type {
+	case SignalOffer:
+		if p == nil {
+			var err error
+			if p, err = f.join(ctx, sig); err != nil || p == nil {
+				return err
+			}
+		}
+		return p.handleOffer(sig.SDP, sig.Tracks)
+	case SignalAnswer:
+		if p == nil {
+			return nil
+		}
+		return p.handleAnswer(sig.SDP)
+	case SignalCandidate:
+		if p == nil || sig.Candidate == nil {
+			return nil
+		}
+		return p.addCandidate(webrtc.ICECandidateInit{
+			Candidate:        sig.Candidate.Candidate,
+			SDPMid:           sig.Candidate.SDPMid,
+			SDPMLineIndex:    sig.Candidate.SDPMLineIndex,
+			UsernameFragment: sig.Candidate.UsernameFragment,
+		})
+	case SignalLayer:
+		if p == nil || sig.Layer == nil {
+			return nil
+		}
+		f.setLayer(p, *sig.Layer)
+	}
+	return nil
+}
+
+// join creates a peer connection for a session connected to the channel, or
+// returns nil if it is not.
+func (f *SFU) join(ctx context.Context, sig events.VoiceSignalPayload) (*peer, error) {
+	state, err := f.voice.Get(ctx, sig.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil || state.SessionID != sig.SessionID || state.ChannelID == nil || *state.ChannelID != sig.ChannelID {
+		return nil, nil
+	}
+
+	p, err := f.newPeer(state)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := f.rooms[sig.ChannelID]
+	if r == nil {
+		r = &room{channelID: sig.ChannelID, serverID: state.ServerID, peers: make(map[int64]*peer)}
+		f.rooms[r.channelID] = r
+		f.servers[r.serverID]++
+		if f.servers[r.serverID] == 1 && f.sub != nil {
+			// Follow voice state changes, such as mutes, in the server.
+			if err := f.sub.Add(ctx, fmt.Sprintf("server:%d", r.serverID)); err != nil {
+				log.Warn().Err(err).Int64("server_id", r.serverID).Msg("failed to follow voice states")
+			}
+		}
+	}
+	p.room = r
+	r.peers[p.userID] = p
+	f.peers[p.userID] = p
+
+	// Send the new user everyone else's media once the first offer is
+	// answered.
+	for _, other := range r.peers {
+		if other == p {
+			continue
+		}
+		if other.outgoing != nil {
+			p.addTrack(trackKey{other.userID, SourceMicrophone}, other.outgoing, nil)
+		}
+		for _, v := range other.videos {
+			f.sendVideoLocked(v, p)
+		}
+	}
+	return p, nil
+}
+
+// follow applies a voice state change to the user's peer connection, closing
+// it if they have left the channel or joined from another session.
+func (f *SFU) follow(state model.VoiceState) {
+	f.mu.Lock()
+	p := f.peers[state.UserID]
+	f.mu.Unlock()
+	if p == nil {
+		return
+	}
+	if state.ChannelID == nil || *state.ChannelID != p.room.channelID || state.SessionID != p.sessionID {
+		f.remove(p)
+		return
+	}
+	p.apply(&state)
+}
+
+// publish forwards a user's audio to everyone else in their room.
+func (f *SFU) publish(p *peer, track webrtc.TrackLocal) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.peers[p.userID] != p {
+		return
+	}
+	p.outgoing = track
+	for _, other := range p.room.peers {
+		if other != p {
+			other.addTrack(trackKey{p.userID, SourceMicrophone}, track, nil)
+			other.renegotiate()
+		}
+	}
+}
+
+// publishVideo adds a layer of a user's camera or screen share, and forwards
+// the video to everyone else in their room if the layer is its first. It
+// returns nil if the peer has been removed.
+func (f *SFU) publishVideo(p *peer, source string, remote *webrtc.TrackRemote) (*video, *layer) {
+	f.mu.Lock()
+	if f.peers[p.userID] != p {
+		f.mu.Unlock()
+		return nil, nil
+	}
+	v := p.videos[source]
+	started := v == nil
+	if started {
+		v = newVideo(p, source, remote.Codec().RTPCodecCapability)
+		p.videos[source] = v
+	}
+	l := v.addLayer(remote)
+	if started {
+		for _, other := range p.room.peers {
+			if other != p {
+				f.sendVideoLocked(v, other)
+				other.renegotiate()
+			}
+		}
+	}
+	f.mu.Unlock()
+
+	if started {
+		f.announceVideo(p)
+	}
+	return v, l
+}
+
+// unpublishVideo removes a layer of a user's video that is no longer
+// received, and stops forwarding the video once it has none left.
+func (f *SFU) unpublishVideo(p *peer, v *video, l *layer) {
+	f.mu.Lock()
+	if !v.removeLayer(l) || p.videos[v.source] != v {
+		f.mu.Unlock()
+		return
+	}
+	f.stopVideoLocked(p, v)
+	f.mu.Unlock()
+
+	f.announceVideo(p)
+}
+
+// stopVideoLocked stops forwarding a user's video to the rest of their
+// room. The caller holds f.mu.
+func (f *SFU) stopVideoLocked(p *peer, v *video) {
+	delete(p.videos, v.source)
+	for _, other := range p.room.peers {
+		if other != p && other.removeTrack(trackKey{p.userID, v.source}) {
+			other.renegotiate()
+		}
+	}
+	v.close()
+}
+
+// recheckVideo stops forwarding video from users in a server who have lost
+// the Share Screen permission, after a change to their roles or to the
+// server's. With userID zero, every user sending video there is checked.
+func (f *SFU) recheckVideo(ctx context.Context, serverID, userID int64) {
+	f.mu.Lock()
+	var sharing []*peer
+	for _, p := range f.peers {
+		if p.serverID == serverID && (userID == 0 || p.userID == userID) && len(p.videos) > 0 {
+			sharing = append(sharing, p)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, p := range sharing {
+		allowed, err := f.voice.canShare(ctx, p.serverID, p.userID)
+		if err != nil && !errors.Is(err, permission.ErrNotMember) {
+			log.Warn().Err(err).Int64("user_id", p.userID).Msg("failed to check video permission")
+			continue
+		}
+		if allowed {
+			continue
+		}
+
+		f.mu.Lock()
+		stopped := f.peers[p.userID] == p && len(p.videos) > 0
+		for _, v := range p.videos {
+			f.stopVideoLocked(p, v)
+		}
+		f.mu.Unlock()
+		if stopped {
+			f.announceVideo(p)
+		}
+	}
+}
+
+// sendVideoLocked forwards a video to another peer in its room. The caller
+// holds f.mu, and renegotiates.
+func (f *SFU) sendVideoLocked(v *video, to *peer) {
+	track, err := v.addSink(to.userID)
+	if err != nil {
+		log.Warn().Err(err).Int64("user_id", to.userID).Msg("failed to create video track")
+		return
+	}
+	to.addTrack(trackKey{v.peer.userID, v.source}, track, func() {
+		v.requestKeyframe(to.userID)
+	})
+}
+
+// setLayer chooses which layer of another user's video a peer receives.
+func (f *SFU) setLayer(p *peer, layer events.VideoLayer) {
+	f.mu.Lock()
+	var v *video
+	if sender := p.room.peers[layer.UserID]; sender != nil && sender != p {
+		v = sender.videos[layer.Source]
+	}
+	f.mu.Unlock()
+	if v != nil {
+		v.setLayer(p.userID, layer.RID, layer.MaxBitrate)
+	}
+}
+
+// announceVideo records in the user's voice state which videos they are
+// sending.
+func (f *SFU) announceVideo(p *peer) {
+	f.mu.Lock()
+	camera, screen := p.videos[SourceCamera] != nil, p.videos[SourceScreen] != nil
+	f.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), signalTimeout)
+	defer cancel()
+	if err := f.voice.SetVideo(ctx, p.userID, p.sessionID, camera, screen); err != nil {
+		log.Warn().Err(err).Int64("user_id", p.userID).Msg("failed to announce video")
+	}
+}
+
+// remove closes a peer connection and stops forwarding its media.
+func (f *SFU) remove(p *peer) {
+	f.mu.Lock()
+	if f.peers[p.userID] != p {
+		f.mu.Unlock()
+		return
+	}
+	delete(f.peers, p.userID)
+	r := p.room
+	delete(r.peers, p.userID)
+	sharing := len(p.videos) > 0
+	for _, v := range p.videos {
+		v.close()
+	}
+	clear(p.videos)
+	for _, other := range r.peers {
+		for _, v := range other.videos {
+			v.removeSink(p.userID)
+		}
+		if other.removeTracks(p.userID) {
+			other.renegotiate()
+		}
+	}
+
+	empty := len(r.peers) == 0
+	if empty {
+		delete(f.rooms, r.channelID)
+		f.servers[r.serverID]--
+		if f.servers[r.serverID] == 0 {
+			delete(f.servers, r.serverID)
+			if f.sub != nil {
+				ctx, cancel := context.WithTimeout(context.Background(), signalTimeout)
+				f.sub.Remove(ctx, fmt.Sprintf("server:%d", r.serverID))
+				cancel()
+			}
+		}
+	}
+	f.mu.Unlock()
+
+	if err := p.pc.Close(); err != nil {
+		log.Debug().Err(err).Int64("user_id", p.userID).Msg("failed to close peer connection")
+	}
+	if sharing {
+		f.announceVideo(p)
+	}
+	if empty {
+		ctx, cancel := context.WithTimeout(context.Background(), signalTimeout)
+		defer cancel()
+		if err := releaseScript.Run(ctx, f.redis, []string{hostKey(r.channelID)}, f.nodeID).Err(); err != nil {
+			log.Warn().Err(err).Int64("channel_id", r.channelID).Msg("failed to release voice channel")
+		}
+	}
+}
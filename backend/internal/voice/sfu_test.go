@@ -0,0 +1,392 @@
+package voice
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/redis/go-redis/v9"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/permission"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testServerID  = 100
+	testChannelID = 10
+	// mediaWait bounds how long a test waits for media to arrive.
+	mediaWait = 10 * time.Second
+)
+
+func init() {
+	model.InitSnowflake(0)
+}
+
+// voiceGuild is a server with one voice channel, where members have Connect
+// and Speak unless a test gives them other permissions.
+type voiceGuild struct {
+	mu    sync.Mutex
+	perms map[int64]int64
+}
+
+func (g *voiceGuild) setPerms(userID, perms int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.perms[userID] = perms
+}
+
+type guildServers struct{ store.ServerStoreInterface }
+
+func (guildServers) GetByID(ctx context.Context, id int64) (*model.Server, error) {
+	return &model.Server{ID: id, OwnerID: 1000}, nil
+}
+
+func (guildServers) IsMember(ctx context.Context, serverID, userID int64) (bool, error) {
+	return true, nil
+}
+
+func (guildServers) GetMember(ctx context.Context, serverID, userID int64) (*store.Member, error) {
+	return &store.Member{UserID: userID}, nil
+}
+
+func (guildServers) SetVoiceModeration(ctx context.Context, serverID, userID int64, mute, deaf bool) error {
+	return nil
+}
+
+type guildChannels struct{ store.ChannelStoreInterface }
+
+func (guildChannels) GetByID(ctx context.Context, id int64) (*model.Channel, error) {
+	return &model.Channel{ID: id, ServerID: testServerID, Type: model.ChannelTypeVoice}, nil
+}
+
+type guildRoles struct {
+	store.RoleStoreInterface
+	g *voiceGuild
+}
+
+func (r guildRoles) GetMemberPermissions(ctx context.Context, serverID, userID int64) (int64, error) {
+	r.g.mu.Lock()
+	defer r.g.mu.Unlock()
+	if perms, ok := r.g.perms[userID]; ok {
+		return perms, nil
+	}
+	return model.PermissionConnect | model.PermissionSpeak, nil
+}
+
+type testSFU struct {
+	*SFU
+	guild *voiceGuild
+	bus   events.PubSub
+	ctx   context.Context
+}
+
+// newTestSFU runs an SFU whose signaling goes over an in-memory bus.
+func newTestSFU(t *testing.T) *testSFU {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	bus := events.NewBusWithTransport(events.NewMemoryTransport())
+	g := &voiceGuild{perms: make(map[int64]int64)}
+	perms := permission.NewChecker(guildServers{}, guildRoles{g: g})
+	svc := NewService(guildServers{}, guildChannels{}, perms, bus, rdb)
+	sfu, err := NewSFU(svc, bus, rdb, MediaConfig{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sfu.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	require.Eventually(t, func() bool {
+		sfu.mu.Lock()
+		defer sfu.mu.Unlock()
+		return sfu.sub != nil
+	}, time.Second, 10*time.Millisecond)
+	return &testSFU{SFU: sfu, guild: g, bus: bus, ctx: ctx}
+}
+
+// testPeer is a client connected to the SFU, signaling as the browser
+// client does.
+type testPeer struct {
+	t         *testing.T
+	sfu       *testSFU
+	userID    int64
+	sessionID string
+	pc        *webrtc.PeerConnection
+
+	mu         sync.Mutex
+	closed     bool
+	candidates []webrtc.ICECandidateInit
+}
+
+// joinPeer connects a user to the test channel and creates their peer
+// connection, which offers once offer is called.
+func (f *testSFU) joinPeer(t *testing.T, userID int64) *testPeer {
+	t.Helper()
+	sessionID := "session-" + strconv.FormatInt(userID, 10)
+	_, err := f.voice.Join(f.ctx, userID, sessionID, testChannelID, false, false)
+	require.NoError(t, err)
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	p := &testPeer{t: t, sfu: f, userID: userID, sessionID: sessionID, pc: pc}
+	t.Cleanup(func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.closed = true
+		pc.Close()
+	})
+	f.bus.Subscribe(f.ctx, p.handle, fmt.Sprintf("user:%d", userID))
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		init := c.ToJSON()
+		p.signal(events.VoiceSignalPayload{Type: SignalCandidate, Candidate: &events.ICECandidate{
+			Candidate:     init.Candidate,
+			SDPMid:        init.SDPMid,
+			SDPMLineIndex: init.SDPMLineIndex,
+		}})
+	})
+	return p
+}
+
+func (p *testPeer) signal(sig events.VoiceSignalPayload) {
+	sig.ChannelID = testChannelID
+	sig.UserID = p.userID
+	sig.SessionID = p.sessionID
+	err := p.sfu.Signal(context.Background(), sig)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil && !p.closed {
+		p.t.Errorf("signal %s: %v", sig.Type, err)
+	}
+}
+
+// offer sends the SFU the peer's tracks.
+func (p *testPeer) offer() {
+	p.mu.Lock()
+	offer, err := p.pc.CreateOffer(nil)
+	if err == nil {
+		err = p.pc.SetLocalDescription(offer)
+	}
+	p.mu.Unlock()
+	require.NoError(p.t, err)
+	p.signal(events.VoiceSignalPayload{Type: SignalOffer, SDP: offer.SDP})
+}
+
+func (p *testPeer) handle(_ string, event events.Event) {
+	info, ok := event.Data.(*events.VoiceServerInfoPayload)
+	if !ok || info.SessionID != p.sessionID {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return // the test has finished
+	}
+	switch info.Type {
+	case SignalAnswer:
+		p.setRemoteLocked(webrtc.SDPTypeAnswer, info.SDP)
+	case SignalOffer:
+		if !p.setRemoteLocked(webrtc.SDPTypeOffer, info.SDP) {
+			return
+		}
+		answer, err := p.pc.CreateAnswer(nil)
+		if err == nil {
+			err = p.pc.SetLocalDescription(answer)
+		}
+		if err != nil {
+			p.t.Errorf("answer: %v", err)
+			return
+		}
+		go p.signal(events.VoiceSignalPayload{Type: SignalAnswer, SDP: answer.SDP})
+	case SignalCandidate:
+		c := webrtc.ICECandidateInit{Candidate: info.Candidate.Candidate, SDPMid: info.Candidate.SDPMid, SDPMLineIndex: info.Candidate.SDPMLineIndex}
+		if p.pc.RemoteDescription() == nil {
+			p.candidates = append(p.candidates, c)
+			return
+		}
+		p.pc.AddICECandidate(c)
+	}
+}
+
+func (p *testPeer) setRemoteLocked(sdpType webrtc.SDPType, sdp string) bool {
+	if err := p.pc.SetRemoteDescription(webrtc.SessionDescription{Type: sdpType, SDP: sdp}); err != nil {
+		p.t.Errorf("set remote %s: %v", sdpType, err)
+		return false
+	}
+	for _, c := range p.candidates {
+		p.pc.AddICECandidate(c)
+	}
+	p.candidates = nil
+	return true
+}
+
+// received counts the RTP packets a peer gets on each track, by stream and
+// track ID, which are the sending user and the source.
+type received struct {
+	mu      sync.Mutex
+	packets map[string]int
+	codecs  map[string]string
+}
+
+func (p *testPeer) receive() *received {
+	r := &received{packets: make(map[string]int), codecs: make(map[string]string)}
+	p.pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		key := remote.StreamID() + "/" + remote.ID()
+		r.mu.Lock()
+		r.codecs[key] = remote.Codec().MimeType
+		r.mu.Unlock()
+		for {
+			if _, _, err := remote.ReadRTP(); err != nil {
+				return
+			}
+			r.mu.Lock()
+			r.packets[key]++
+			r.mu.Unlock()
+		}
+	})
+	return r
+}
+
+func (r *received) count(key string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.packets[key]
+}
+
+func (r *received) codec(key string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.codecs[key]
+}
+
+// sendOpus sends a 20 ms Opus frame every 20 ms on a new microphone track
+// until the test ends.
+func (p *testPeer) sendOpus() {
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "client")
+	require.NoError(p.t, err)
+	_, err = p.pc.AddTrack(track)
+	require.NoError(p.t, err)
+
+	done := make(chan struct{})
+	p.t.Cleanup(func() { close(done) })
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// A TOC byte for 20 ms of CELT silence.
+				track.WriteSample(media.Sample{Data: []byte{0xf8, 0xff, 0xfe}, Duration: 20 * time.Millisecond})
+			}
+		}
+	}()
+}
+
+func TestSFUForwardsAudio(t *testing.T) {
+	f := newTestSFU(t)
+	alice, bob := f.joinPeer(t, 1), f.joinPeer(t, 2)
+	alice.sendOpus()
+	bob.sendOpus()
+	fromBob, fromAlice := alice.receive(), bob.receive()
+	alice.offer()
+	bob.offer()
+
+	require.Eventually(t, func() bool {
+		return fromAlice.count("1/"+SourceMicrophone) >= 20 && fromBob.count("2/"+SourceMicrophone) >= 20
+	}, mediaWait, 50*time.Millisecond, "audio not forwarded both ways")
+	assert.Equal(t, webrtc.MimeTypeOpus, fromAlice.codec("1/"+SourceMicrophone))
+	assert.Equal(t, 0, fromAlice.count("2/"+SourceMicrophone), "own audio sent back")
+
+	// Muted users are not forwarded.
+	mute := true
+	require.NoError(t, f.voice.Moderate(f.ctx, 1000, testServerID, 1, &mute, nil))
+	time.Sleep(300 * time.Millisecond) // for the voice state to reach the SFU
+	before := fromAlice.count("1/" + SourceMicrophone)
+	time.Sleep(500 * time.Millisecond)
+	assert.LessOrEqual(t, fromAlice.count("1/"+SourceMicrophone)-before, 1, "muted audio forwarded")
+
+	// Leaving closes the user's peer connection.
+	require.NoError(t, f.voice.Leave(f.ctx, 1, ""))
+	require.Eventually(t, func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.peers[1] == nil && f.peers[2] != nil
+	}, mediaWait, 50*time.Millisecond)
+}
+
+func TestSignalRequiresVoiceState(t *testing.T) {
+	f := newTestSFU(t)
+	_, err := f.voice.Join(f.ctx, 1, "session-1", testChannelID, false, false)
+	require.NoError(t, err)
+
+	for _, sig := range []events.VoiceSignalPayload{
+		{ChannelID: testChannelID + 1, UserID: 1, SessionID: "session-1"},
+		{ChannelID: testChannelID, UserID: 1, SessionID: "session-2"},
+		{ChannelID: testChannelID, UserID: 2, SessionID: "session-2"},
+	} {
+		sig.Type = SignalOffer
+		require.NoError(t, f.Signal(f.ctx, sig))
+		n, err := f.redis.Exists(f.ctx, hostKey(sig.ChannelID)).Result()
+		require.NoError(t, err)
+		assert.Zero(t, n, "channel claimed for %+v", sig)
+	}
+}
+
+func TestRefreshExtendsOnlyOwnClaims(t *testing.T) {
+	f := newTestSFU(t)
+	const lapsed = testChannelID + 1
+	f.mu.Lock()
+	f.rooms[lapsed] = &room{channelID: lapsed, serverID: testServerID, peers: make(map[int64]*peer)}
+	f.mu.Unlock()
+
+	alice := f.joinPeer(t, 1)
+	alice.offer()
+	require.Eventually(t, func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.peers[1] != nil
+	}, mediaWait, 50*time.Millisecond)
+
+	// This node's claim lapsed and another node claimed the channel.
+	require.NoError(t, f.redis.Set(f.ctx, hostKey(testChannelID), "other-node", hostTTL).Err())
+	f.refresh(f.ctx)
+
+	host, err := f.redis.Get(f.ctx, hostKey(testChannelID)).Result()
+	require.NoError(t, err)
+	assert.Equal(t, "other-node", host)
+	f.mu.Lock()
+	assert.Nil(t, f.peers[1], "peer kept on a channel hosted elsewhere")
+	f.mu.Unlock()
+
+	// A claim that lapsed without anyone taking over is claimed again.
+	host, err = f.redis.Get(f.ctx, hostKey(lapsed)).Result()
+	require.NoError(t, err)
+	assert.Equal(t, f.nodeID, host)
+
+	// Its own claims are extended.
+	require.NoError(t, f.redis.Expire(f.ctx, hostKey(lapsed), time.Second).Err())
+	f.refresh(f.ctx)
+	ttl, err := f.redis.TTL(f.ctx, hostKey(lapsed)).Result()
+	require.NoError(t, err)
+	assert.Greater(t, ttl, time.Second)
+}
@@ -0,0 +1,501 @@
+// Package voice tracks who is connected to which voice channel.
+package voice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/permission"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// StateTTL is how long a voice state lasts without its gateway session
+	// refreshing it, so users on a gateway node that died leave on their own.
+	StateTTL = 90 * time.Second
+
+	// sweepInterval is how often expired voice states are removed.
+	sweepInterval = 5 * time.Second
+	// sweepBatch is the most voice states removed per sweep.
+	sweepBatch = 100
+	// swapAttempts bounds retries when a user's voice state keeps changing
+	// underneath an update.
+	swapAttempts = 5
+)
+
+var (
+	ErrInvalidChannel = errors.New("not a voice channel")
+	ErrChannelFull    = errors.New("voice channel is full")
+	ErrNotConnected   = errors.New("user is not connected to voice")
+)
+
+// Service keeps voice states in Redis, so every gateway node and API
+// process sees the same occupants, and announces changes to the server.
+type Service struct {
+	servers  store.ServerStoreInterface
+	channels store.ChannelStoreInterface
+	perms    *permission.Checker
+	bus      events.Publisher
+	redis    *redis.Client
+}
+
+func NewService(
+	servers store.ServerStoreInterface,
+	channels store.ChannelStoreInterface,
+	perms *permission.Checker,
+	bus events.Publisher,
+	redisClient *redis.Client,
+) *Service {
+	return &Service{
+		servers:  servers,
+		channels: channels,
+		perms:    perms,
+		bus:      bus,
+		redis:    redisClient,
+	}
+}
+
+// stateKey holds a user's voice state. channelKey and serverKey hold the
+// IDs of the users connected to a channel and to any channel of a server.
+func stateKey(userID int64) string      { return "voice_state:" + strconv.FormatInt(userID, 10) }
+func channelKey(channelID int64) string { return "voice_channel:" + strconv.FormatInt(channelID, 10) }
+func serverKey(serverID int64) string   { return "voice_server:" + strconv.FormatInt(serverID, 10) }
+
+// expiryKey holds "<user ID>:<session ID>" for each voice state, scored by
+// when it expires.
+const expiryKey = "voice_expiry"
+
+func expiryMember(userID int64, sessionID string) string {
+	return strconv.FormatInt(userID, 10) + ":" + sessionID
+}
+
+// swapScript replaces a user's voice state if it is still ARGV[1] (empty
+// for none), returning -1 if it changed and 0 if the new channel is full.
+// ARGV[2] is the new state, or empty to disconnect; ARGV[4] is the new
+// channel's user limit, or 0. The user's current channel never counts as
+// full.
+var swapScript = redis.NewScript(`
+local cur = redis.call('GET', KEYS[1]) or ''
+if cur ~= ARGV[1] then
+	return -1
+end
+local limit = tonumber(ARGV[4])
+if ARGV[2] ~= '' and limit > 0
+	and redis.call('SISMEMBER', KEYS[4], ARGV[3]) == 0
+	and redis.call('SCARD', KEYS[4]) >= limit then
+	return 0
+end
+if ARGV[1] ~= '' then
+	redis.call('SREM', KEYS[2], ARGV[3])
+	redis.call('SREM', KEYS[3], ARGV[3])
+	redis.call('ZREM', KEYS[6], ARGV[5])
+end
+if ARGV[2] == '' then
+	redis.call('DEL', KEYS[1])
+	return 1
+end
+redis.call('SADD', KEYS[4], ARGV[3])
+redis.call('SADD', KEYS[5], ARGV[3])
+redis.call('SET', KEYS[1], ARGV[2])
+redis.call('ZADD', KEYS[6], ARGV[7], ARGV[6])
+return 1
+`)
+
+// popScript removes and returns up to ARGV[2] members of KEYS[1] scored at
+// or before ARGV[1].
+var popScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, id in ipairs(ids) do
+	redis.call('ZREM', KEYS[1], id)
+end
+return ids
+`)
+
+// Join connects the user's gateway session to a voice channel, moving them
+// out of any other voice channel and taking over from any other session.
+// Joining the channel the user is already in updates their self mute and
+// deafen. Users need the Connect permission, and can join a full channel
+// only if they could move members into it.
+func (s *Service) Join(ctx context.Context, userID int64, sessionID string, channelID int64, selfMute, selfDeaf bool) (*model.VoiceState, error) {
+	ch, err := s.voiceChannel(ctx, channelID)
+	if err != nil {
+		return nil, err
+	}
+	perms, err := s.perms.Effective(ctx, ch.ServerID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !model.HasPermission(perms, model.PermissionConnect) {
+		return nil, permission.ErrMissingPermission
+	}
+	member, err := s.servers.GetMember(ctx, ch.ServerID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if member == nil {
+		return nil, permission.ErrNotMember
+	}
+	limit := ch.UserLimit
+	if model.HasPermission(perms, model.PermissionMoveMembers) {
+		limit = 0
+	}
+
+	return s.swap(ctx, userID, func(cur *model.VoiceState) (*model.VoiceState, int, error) {
+		next := &model.VoiceState{
+			ServerID:  ch.ServerID,
+			ChannelID: &ch.ID,
+			UserID:    userID,
+			SessionID: sessionID,
+			Mute:      member.Mute,
+			Deaf:      member.Deaf,
+			SelfMute:  selfMute,
+			SelfDeaf:  selfDeaf,
+			Suppress:  !model.HasPermission(perms, model.PermissionSpeak),
+		}
+		if cur != nil && cur.SessionID == sessionID && *cur.ChannelID == ch.ID {
+			// Still connected to the SFU, so still sending any video.
+			next.SelfVideo = cur.SelfVideo
+			next.SelfStream = cur.SelfStream
+		}
+		return next, limit, nil
+	})
+}
+
+// SetVideo records whether the user's session is sending camera video and
+// sharing its screen, announcing when either starts or stops. It does
+// nothing if another session holds the user's connection.
+func (s *Service) SetVideo(ctx context.Context, userID int64, sessionID string, video, stream bool) error {
+	_, err := s.swap(ctx, userID, func(cur *model.VoiceState) (*model.VoiceState, int, error) {
+		if cur == nil || cur.SessionID != sessionID || (cur.SelfVideo == video && cur.SelfStream == stream) {
+			return cur, 0, nil
+		}
+		next := *cur
+		next.SelfVideo = video
+		next.SelfStream = stream
+		return &next, 0, nil
+	})
+	return err
+}
+
+// Leave disconnects the user from voice. If sessionID is not empty, the user
+// is disconnected only if that session holds their connection.
+func (s *Service) Leave(ctx context.Context, userID int64, sessionID string) error {
+	_, err := s.swap(ctx, userID, func(cur *model.VoiceState) (*model.VoiceState, int, error) {
+		if cur == nil || (sessionID != "" && cur.SessionID != sessionID) {
+			return cur, 0, nil
+		}
+		return nil, 0, nil
+	})
+	return err
+}
+
+// Moderate server mutes or deafens a member, or lifts it, in every voice
+// channel of the server. A nil mute or deaf is left as it is. The moderator
+// needs the Mute Members or Deafen Members permission.
+func (s *Service) Moderate(ctx context.Context, moderatorID, serverID, userID int64, mute, deaf *bool) error {
+	perms, err := s.perms.Effective(ctx, serverID, moderatorID)
+	if err != nil {
+		return err
+	}
+	if (mute != nil && !model.HasPermission(perms, model.PermissionMuteMembers)) ||
+		(deaf != nil && !model.HasPermission(perms, model.PermissionDeafenMembers)) {
+		return permission.ErrMissingPermission
+	}
+	member, err := s.servers.GetMember(ctx, serverID, userID)
+	if err != nil {
+		return err
+	}
+	if member == nil {
+		return permission.ErrNotMember
+	}
+	if mute != nil {
+		member.Mute = *mute
+	}
+	if deaf != nil {
+		member.Deaf = *deaf
+	}
+	if err := s.servers.SetVoiceModeration(ctx, serverID, userID, member.Mute, member.Deaf); err != nil {
+		return err
+	}
+
+	_, err = s.swap(ctx, userID, func(cur *model.VoiceState) (*model.VoiceState, int, error) {
+		if cur == nil || cur.ServerID != serverID {
+			return cur, 0, nil
+		}
+		next := *cur
+		next.Mute = member.Mute
+		next.Deaf = member.Deaf
+		return &next, 0, nil
+	})
+	return err
+}
+
+// Move moves a member connected to a voice channel of the server to another
+// one, or disconnects them if channelID is nil. The moderator needs the Move
+// Members permission; the channel's user limit does not apply.
+func (s *Service) Move(ctx context.Context, moderatorID, serverID, userID int64, channelID *int64) error {
+	if err := s.perms.Require(ctx, serverID, moderatorID, model.PermissionMoveMembers); err != nil {
+		return err
+	}
+	var suppress bool
+	if channelID != nil {
+		ch, err := s.voiceChannel(ctx, *channelID)
+		if err != nil {
+			return err
+		}
+		if ch.ServerID != serverID {
+			return ErrInvalidChannel
+		}
+		perms, err := s.perms.Effective(ctx, serverID, userID)
+		if err != nil {
+			return err
+		}
+		suppress = !model.HasPermission(perms, model.PermissionSpeak)
+	}
+
+	_, err := s.swap(ctx, userID, func(cur *model.VoiceState) (*model.VoiceState, int, error) {
+		if cur == nil || cur.ServerID != serverID {
+			return nil, 0, ErrNotConnected
+		}
+		if channelID == nil {
+			return nil, 0, nil
+		}
+		next := *cur
+		next.ChannelID = channelID
+		next.Suppress = suppress
+		next.SelfVideo = false
+		next.SelfStream = false
+		return &next, 0, nil
+	})
+	return err
+}
+
+// Get returns the user's voice state, or nil if they are not connected.
+func (s *Service) Get(ctx context.Context, userID int64) (*model.VoiceState, error) {
+	state, _, err := s.load(ctx, userID)
+	return state, err
+}
+
+// Occupants returns the voice states of the users connected to each voice
+// channel of the server, by channel ID.
+func (s *Service) Occupants(ctx context.Context, serverID int64) (map[int64][]model.VoiceState, error) {
+	out := make(map[int64][]model.VoiceState)
+	ids, err := s.redis.SMembers(ctx, serverKey(serverID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("list voice occupants: %w", err)
+	}
+	if len(ids) == 0 {
+		return out, nil
+	}
+
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if userID, err := strconv.ParseInt(id, 10, 64); err == nil {
+			keys = append(keys, stateKey(userID))
+		}
+	}
+	values, err := s.redis.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("get voice states: %w", err)
+	}
+	for _, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue // left since the set was read
+		}
+		var state model.VoiceState
+		if json.Unmarshal([]byte(data), &state) != nil || state.ServerID != serverID || state.ChannelID == nil {
+			continue
+		}
+		out[*state.ChannelID] = append(out[*state.ChannelID], state)
+	}
+	return out, nil
+}
+
+// Refresh keeps the voice states held by gateway sessions from expiring.
+// sessions maps session IDs to their users.
+func (s *Service) Refresh(ctx context.Context, sessions map[string]int64) error {
+	if len(sessions) == 0 {
+		return nil
+	}
+	expires := float64(time.Now().Add(StateTTL).UnixMilli())
+	_, err := s.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for sessionID, userID := range sessions {
+			pipe.ZAddXX(ctx, expiryKey, redis.Z{Score: expires, Member: expiryMember(userID, sessionID)})
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("refresh voice states: %w", err)
+	}
+	return nil
+}
+
+// Run disconnects users whose gateway session stopped refreshing their voice
+// state, until ctx is done. Every process running it shares the work.
+func (s *Service) Run(ctx context.Context) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.sweep(ctx)
+	}
+}
+
+func (s *Service) sweep(ctx context.Context) {
+	now := time.Now().UnixMilli()
+	members, err := popScript.Run(ctx, s.redis, []string{expiryKey}, now, sweepBatch).StringSlice()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to read expired voice states")
+		return
+	}
+	for _, m := range members {
+		rawID, sessionID, _ := strings.Cut(m, ":")
+		userID, err := strconv.ParseInt(rawID, 10, 64)
+		if err != nil {
+			continue
+		}
+		if err := s.Leave(ctx, userID, sessionID); err != nil {
+			log.Warn().Err(err).Int64("user_id", userID).Msg("failed to remove expired voice state")
+		}
+	}
+}
+
+// canShare reports whether the user may send video in the server's voice
+// channels.
+func (s *Service) canShare(ctx context.Context, serverID, userID int64) (bool, error) {
+	perms, err := s.perms.Effective(ctx, serverID, userID)
+	if err != nil {
+		return false, err
+	}
+	return model.HasPermission(perms, model.PermissionShareScreen), nil
+}
+
+func (s *Service) voiceChannel(ctx context.Context, channelID int64) (*model.Channel, error) {
+	ch, err := s.channels.GetByID(ctx, channelID)
+	if err != nil {
+		return nil, err
+	}
+	if ch == nil || ch.Type != model.ChannelTypeVoice {
+		return nil, ErrInvalidChannel
+	}
+	return ch, nil
+}
+
+// load returns the user's voice state and how it is stored.
+func (s *Service) load(ctx context.Context, userID int64) (*model.VoiceState, string, error) {
+	raw, err := s.redis.Get(ctx, stateKey(userID)).Result()
+	if err == redis.Nil {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("get voice state: %w", err)
+	}
+	var state model.VoiceState
+	if err := json.Unmarshal([]byte(raw), &state); err != nil {
+		return nil, "", fmt.Errorf("decode voice state: %w", err)
+	}
+	return &state, raw, nil
+}
+
+// swap replaces the user's voice state with the one fn derives from it, and
+// announces the change. fn also returns the user limit of the new state's
+// channel. It returns the current state unchanged to do nothing, or nil to
+// disconnect. fn is called again if the state changes in the meantime.
+func (s *Service) swap(ctx context.Context, userID int64, fn func(cur *model.VoiceState) (*model.VoiceState, int, error)) (*model.VoiceState, error) {
+	for range swapAttempts {
+		cur, raw, err := s.load(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		next, limit, err := fn(cur)
+		if err != nil {
+			return nil, err
+		}
+		if next == cur {
+			return cur, nil
+		}
+
+		var data []byte
+		if next != nil {
+			if data, err = json.Marshal(next); err != nil {
+				return nil, err
+			}
+			if string(data) == raw {
+				return next, nil
+			}
+		}
+
+		// Keys for a state that does not exist are never touched, but the
+		// script still needs some.
+		oldState, newState := cur, next
+		if oldState == nil {
+			oldState = next
+		}
+		if newState == nil {
+			newState = cur
+		}
+		var oldMember string
+		if cur != nil {
+			oldMember = expiryMember(userID, cur.SessionID)
+		}
+		result, err := swapScript.Run(ctx, s.redis,
+			[]string{
+				stateKey(userID),
+				channelKey(*oldState.ChannelID), serverKey(oldState.ServerID),
+				channelKey(*newState.ChannelID), serverKey(newState.ServerID),
+				expiryKey,
+			},
+			raw, string(data), userID, limit, oldMember,
+			expiryMember(userID, newState.SessionID), time.Now().Add(StateTTL).UnixMilli(),
+		).Int()
+		if err != nil {
+			return nil, fmt.Errorf("update voice state: %w", err)
+		}
+		switch result {
+		case -1:
+			continue
+		case 0:
+			return nil, ErrChannelFull
+		}
+
+		s.announce(ctx, cur, next)
+		return next, nil
+	}
+	return nil, fmt.Errorf("update voice state: changed concurrently %d times", swapAttempts)
+}
+
+// announce publishes a voice state change to the servers it affects.
+func (s *Service) announce(ctx context.Context, prev, next *model.VoiceState) {
+	if prev != nil && (next == nil || next.ServerID != prev.ServerID) {
+		left := *prev
+		left.ChannelID = nil
+		s.publish(ctx, left)
+	}
+	if next != nil {
+		s.publish(ctx, *next)
+	}
+}
+
+func (s *Service) publish(ctx context.Context, state model.VoiceState) {
+	event := events.Event{
+		Type: events.VoiceStateUpdate,
+		Data: events.VoiceStatePayload{VoiceState: state},
+	}
+	if err := s.bus.Publish(ctx, fmt.Sprintf("server:%d", state.ServerID), event); err != nil {
+		log.Warn().Err(err).Int64("user_id", state.UserID).Msg("failed to publish voice state")
+	}
+}
@@ -0,0 +1,355 @@
+package voice
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// measureInterval is how often layer bitrates are measured and
+	// receivers moved to the layers that now suit them.
+	measureInterval = time.Second
+	// keyframeInterval is the least time between keyframe requests for a
+	// layer.
+	keyframeInterval = 500 * time.Millisecond
+	// frameTicks is one frame at 30 fps on the 90 kHz video clock, the gap
+	// left between timestamps when a receiver switches layers.
+	frameTicks = 90000 / 30
+)
+
+// video is a user's camera or screen share, received in one or more
+// simulcast layers and forwarded to everyone else in the room. Each receiver
+// gets one layer at a time through a track of its own, so that switching
+// layers keeps its sequence numbers and timestamps continuous. Receivers
+// switch on the new layer's next keyframe, which is requested from the
+// sender.
+//
+// Receivers get the layer they asked for by RID, or else the best layer
+// within the bitrate they asked for, going by what each layer was last
+// measured at. Layers the sender has stopped sending, as browsers do when
+// they are short of bandwidth, are passed over.
+type video struct {
+	peer   *peer
+	source string
+	codec  webrtc.RTPCodecCapability
+	done   chan struct{}
+
+	mu     sync.Mutex
+	layers map[string]*layer // by RID, "" without simulcast
+	sinks  map[int64]*sink   // by receiving user
+}
+
+// layer is one simulcast layer of a video.
+type layer struct {
+	rid  string
+	ssrc uint32
+	// bytes is what was received since the last measurement, and bitrate
+	// what was received per second at it.
+	bytes    int
+	bitrate  int
+	keyframe time.Time // last requested
+}
+
+// sink is a video as forwarded to one receiver.
+type sink struct {
+	track *sinkTrack
+	// bound is set once the track is bound to the receiver's connection.
+	// Packets written before then are dropped, so nothing is forwarded
+	// until the first keyframe after it.
+	bound bool
+	// rid and maxBitrate are what the receiver asked for.
+	rid        string
+	maxBitrate int
+	// current is the layer being forwarded, and target the layer to switch
+	// to at its next keyframe.
+	current *layer
+	target  *layer
+	// started is set once anything has been forwarded. Packets are
+	// forwarded with the offsets added, and lastSeq and lastTS are the
+	// latest forwarded.
+	started   bool
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+}
+
+// sinkTrack is a sink's track, which reports when it is bound to the
+// receiver's connection.
+type sinkTrack struct {
+	*webrtc.TrackLocalStaticRTP
+	onBind func()
+}
+
+func (t *sinkTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	params, err := t.TrackLocalStaticRTP.Bind(ctx)
+	if err == nil {
+		t.onBind()
+	}
+	return params, err
+}
+
+func newVideo(p *peer, source string, codec webrtc.RTPCodecCapability) *video {
+	v := &video{
+		peer:   p,
+		source: source,
+		codec:  codec,
+		done:   make(chan struct{}),
+		layers: make(map[string]*layer),
+		sinks:  make(map[int64]*sink),
+	}
+	go v.measure()
+	return v
+}
+
+// close stops measuring the video.
+func (v *video) close() {
+	close(v.done)
+}
+
+// closed reports whether the video is no longer forwarded.
+func (v *video) closed() bool {
+	select {
+	case <-v.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (v *video) addLayer(remote *webrtc.TrackRemote) *layer {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	l := &layer{rid: remote.RID(), ssrc: uint32(remote.SSRC())}
+	v.layers[l.rid] = l
+	for _, s := range v.sinks {
+		v.retargetLocked(s)
+	}
+	return l
+}
+
+// removeLayer removes a layer that is no longer received, and reports
+// whether none are left.
+func (v *video) removeLayer(l *layer) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.layers[l.rid] == l {
+		delete(v.layers, l.rid)
+	}
+	for _, s := range v.sinks {
+		if s.current == l {
+			s.current = nil
+		}
+		if s.target == l {
+			s.target = nil
+		}
+		v.retargetLocked(s)
+	}
+	return len(v.layers) == 0
+}
+
+// addSink starts forwarding the video to a receiver, returning the track
+// to send it.
+func (v *video) addSink(userID int64) (webrtc.TrackLocal, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(v.codec, v.source, strconv.FormatInt(v.peer.userID, 10))
+	if err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s := &sink{}
+	s.track = &sinkTrack{TrackLocalStaticRTP: track, onBind: func() { v.bindSink(s) }}
+	v.sinks[userID] = s
+	v.retargetLocked(s)
+	return s.track, nil
+}
+
+// bindSink lets a sink start, asking for a keyframe to start it on.
+func (v *video) bindSink(s *sink) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s.bound = true
+	if s.current == nil && s.target != nil {
+		v.keyframeLocked(s.target)
+	}
+}
+
+func (v *video) removeSink(userID int64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.sinks, userID)
+}
+
+// setLayer chooses the layer a receiver gets: the one with rid if it is
+// not empty and being received, otherwise the best within maxBitrate bits
+// per second, or the best of all if it is zero.
+func (v *video) setLayer(userID int64, rid string, maxBitrate int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s := v.sinks[userID]
+	if s == nil {
+		return
+	}
+	s.rid = rid
+	s.maxBitrate = maxBitrate
+	v.retargetLocked(s)
+}
+
+// requestKeyframe asks the sender for a keyframe of the layer a receiver
+// gets, for when the receiver has lost the picture.
+func (v *video) requestKeyframe(userID int64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s := v.sinks[userID]; s != nil && s.current != nil {
+		v.keyframeLocked(s.current)
+	}
+}
+
+// forward sends a packet of a layer to the receivers getting it, and
+// switches receivers waiting for the layer over to it if the packet starts
+// a keyframe.
+func (v *video) forward(l *layer, pkt *rtp.Packet) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	l.bytes += len(pkt.Payload)
+
+	keyframe := isKeyframe(pkt)
+	for _, s := range v.sinks {
+		if s.current != l {
+			if s.target != l || !keyframe || !s.bound {
+				continue
+			}
+			s.switchTo(l, pkt)
+		}
+		out := *pkt
+		out.SequenceNumber += s.seqOffset
+		out.Timestamp += s.tsOffset
+		if err := s.track.WriteRTP(&out); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			log.Debug().Err(err).Int64("user_id", v.peer.userID).Msg("failed to forward video")
+		}
+		if int16(out.SequenceNumber-s.lastSeq) > 0 {
+			s.lastSeq = out.SequenceNumber
+		}
+		if int32(out.Timestamp-s.lastTS) > 0 {
+			s.lastTS = out.Timestamp
+		}
+	}
+}
+
+// switchTo makes a layer the one forwarded to the receiver, continuing its
+// sequence numbers and timestamps from the previous layer's.
+func (s *sink) switchTo(l *layer, pkt *rtp.Packet) {
+	if s.started {
+		s.seqOffset = s.lastSeq + 1 - pkt.SequenceNumber
+		s.tsOffset = s.lastTS + frameTicks - pkt.Timestamp
+	} else {
+		s.lastSeq = pkt.SequenceNumber
+		s.lastTS = pkt.Timestamp
+	}
+	s.started = true
+	s.current = l
+}
+
+// measure updates the bitrates of the layers every measureInterval, moving
+// receivers to the layers that now suit them, until the video is closed.
+func (v *video) measure() {
+	ticker := time.NewTicker(measureInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-v.done:
+			return
+		case now := <-ticker.C:
+			v.mu.Lock()
+			elapsed := now.Sub(last).Seconds()
+			last = now
+			for _, l := range v.layers {
+				l.bitrate = int(float64(l.bytes*8) / elapsed)
+				l.bytes = 0
+			}
+			for _, s := range v.sinks {
+				v.retargetLocked(s)
+			}
+			v.mu.Unlock()
+		}
+	}
+}
+
+// retargetLocked picks the layer a receiver should get, asking for a
+// keyframe of it if the receiver is to switch.
+func (v *video) retargetLocked(s *sink) {
+	s.target = v.chooseLocked(s)
+	if s.target != nil && s.target != s.current {
+		v.keyframeLocked(s.target)
+	}
+}
+
+func (v *video) chooseLocked(s *sink) *layer {
+	if l := v.layers[s.rid]; s.rid != "" && l != nil {
+		return l
+	}
+	var best, lowest *layer
+	for _, l := range v.layers {
+		if l.bitrate == 0 {
+			continue // not being sent, or not yet measured
+		}
+		if lowest == nil || l.bitrate < lowest.bitrate {
+			lowest = l
+		}
+		if (s.maxBitrate == 0 || l.bitrate <= s.maxBitrate) && (best == nil || l.bitrate > best.bitrate) {
+			best = l
+		}
+	}
+	if best == nil {
+		best = lowest
+	}
+	if best != nil {
+		return best
+	}
+
+	// Nothing measured yet: keep to the layer already chosen, or take any.
+	if s.target != nil {
+		return s.target
+	}
+	for _, l := range v.layers {
+		if best == nil || l.rid < best.rid {
+			best = l
+		}
+	}
+	return best
+}
+
+// keyframeLocked asks the sender for a keyframe of a layer, unless one was
+// asked for very recently.
+func (v *video) keyframeLocked(l *layer) {
+	now := time.Now()
+	if now.Sub(l.keyframe) < keyframeInterval {
+		return
+	}
+	l.keyframe = now
+	pli := &rtcp.PictureLossIndication{MediaSSRC: l.ssrc}
+	if err := v.peer.pc.WriteRTCP([]rtcp.Packet{pli}); err != nil {
+		log.Debug().Err(err).Int64("user_id", v.peer.userID).Msg("failed to request keyframe")
+	}
+}
+
+// isKeyframe reports whether a VP8 packet starts a keyframe.
+func isKeyframe(pkt *rtp.Packet) bool {
+	var vp8 codecs.VP8Packet
+	payload, err := vp8.Unmarshal(pkt.Payload)
+	if err != nil || vp8.S != 1 || vp8.PID != 0 || len(payload) == 0 {
+		return false
+	}
+	// The first bit of the frame tag is clear on keyframes.
+	return payload[0]&0x01 == 0
+}
@@ -0,0 +1,262 @@
+package voice
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var vp8 = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+
+// vp8Packet is a one-packet VP8 frame of a layer, marked with the layer's
+// RID so receivers can tell which they got.
+func vp8Packet(rid string, seq uint16, ts uint32, keyframe bool, size int) *rtp.Packet {
+	tag := byte(0x01) // an interframe
+	if keyframe {
+		tag = 0x00
+	}
+	payload := make([]byte, max(size, 3))
+	payload[0] = 0x10 // a payload descriptor starting partition 0
+	payload[1] = tag
+	payload[2] = rid[0]
+	return &rtp.Packet{
+		Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, Timestamp: ts},
+		Payload: payload,
+	}
+}
+
+func TestSinkSwitchTo(t *testing.T) {
+	low, high := &layer{rid: "q"}, &layer{rid: "f"}
+	s := &sink{}
+
+	// The first layer is forwarded as it is.
+	s.switchTo(low, vp8Packet("q", 500, 90000, true, 0))
+	assert.Equal(t, low, s.current)
+	assert.Zero(t, s.seqOffset)
+	assert.Zero(t, s.tsOffset)
+	assert.Equal(t, uint16(500), s.lastSeq)
+
+	// The next layer continues one packet and one frame on.
+	s.lastSeq, s.lastTS = 510, 120000
+	s.switchTo(high, vp8Packet("f", 40000, 7000, true, 0))
+	assert.Equal(t, high, s.current)
+	assert.Equal(t, uint16(511), 40000+s.seqOffset)
+	assert.Equal(t, uint32(120000+frameTicks), 7000+s.tsOffset)
+
+	// Offsets wrap around with the sequence numbers and timestamps.
+	s.lastSeq, s.lastTS = 65535, 4294967000
+	s.switchTo(low, vp8Packet("q", 3, 100, true, 0))
+	assert.Equal(t, uint16(0), 3+s.seqOffset)
+	assert.Equal(t, uint32(2704), 100+s.tsOffset)
+}
+
+func TestVideoSwitchesLayersOnKeyframes(t *testing.T) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer pc.Close()
+	v := newVideo(&peer{userID: 1, pc: pc}, SourceCamera, vp8)
+	defer v.close()
+	low, high := &layer{rid: "q"}, &layer{rid: "f"}
+	v.layers = map[string]*layer{"q": low, "f": high}
+	_, err = v.addSink(2)
+	require.NoError(t, err)
+	v.setLayer(2, "q", 0)
+	s := v.sinks[2]
+	s.bound = true
+
+	v.forward(low, vp8Packet("q", 10, 1000, false, 0))
+	assert.Nil(t, s.current, "started on an interframe")
+	v.forward(low, vp8Packet("q", 11, 4000, true, 0))
+	assert.Equal(t, low, s.current)
+	v.forward(low, vp8Packet("q", 12, 7000, false, 0))
+
+	v.setLayer(2, "f", 0)
+	assert.Equal(t, high, s.target)
+	v.forward(high, vp8Packet("f", 900, 50000, false, 0))
+	assert.Equal(t, low, s.current, "switched on an interframe")
+	v.forward(low, vp8Packet("q", 13, 10000, false, 0))
+	v.forward(high, vp8Packet("f", 901, 53000, true, 0))
+	assert.Equal(t, high, s.current)
+	assert.Equal(t, uint16(14), s.lastSeq)
+	assert.Equal(t, uint32(10000+frameTicks), s.lastTS)
+
+	v.forward(low, vp8Packet("q", 14, 13000, false, 0))
+	assert.Equal(t, uint16(14), s.lastSeq, "old layer still forwarded")
+	v.forward(high, vp8Packet("f", 902, 56000, false, 0))
+	assert.Equal(t, uint16(15), s.lastSeq)
+	assert.Equal(t, uint32(16000), s.lastTS)
+}
+
+// simulcast sends VP8 in a low layer, q, and a high one, f, with keyframes
+// every few frames, until the test ends.
+func (p *testPeer) simulcast() {
+	low, err := webrtc.NewTrackLocalStaticRTP(vp8, "video", "client", webrtc.WithRTPStreamID("q"))
+	require.NoError(p.t, err)
+	high, err := webrtc.NewTrackLocalStaticRTP(vp8, "video", "client", webrtc.WithRTPStreamID("f"))
+	require.NoError(p.t, err)
+	sender, err := p.pc.AddTrack(low)
+	require.NoError(p.t, err)
+	require.NoError(p.t, sender.AddEncoding(high))
+
+	// The SFU tells layers apart by these header extensions.
+	var midID, ridID uint8
+	for _, ext := range sender.GetParameters().HeaderExtensions {
+		switch ext.URI {
+		case "urn:ietf:params:rtp-hdrext:sdes:mid":
+			midID = uint8(ext.ID)
+		case "urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id":
+			ridID = uint8(ext.ID)
+		}
+	}
+
+	done := make(chan struct{})
+	p.t.Cleanup(func() { close(done) })
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			// Layers number packets and frames independently, and keyframes
+			// fall at different times in each.
+			for _, l := range []struct {
+				track *webrtc.TrackLocalStaticRTP
+				seq   uint16
+				ts    uint32
+				size  int
+				key   int
+			}{
+				{low, 1000, 100000, 50, 0},
+				{high, 60000, 4000000000, 400, 5},
+			} {
+				pkt := vp8Packet(l.track.RID(), l.seq+uint16(i), l.ts+uint32(i*frameTicks), (i+l.key)%10 == 0, l.size)
+				pkt.Header.SetExtension(midID, []byte("0"))
+				pkt.Header.SetExtension(ridID, []byte(l.track.RID()))
+				l.track.WriteRTP(pkt)
+			}
+		}
+	}()
+}
+
+// frame is a video packet as received.
+type frame struct {
+	rid      string
+	seq      uint16
+	ts       uint32
+	keyframe bool
+}
+
+type receivedVideo struct {
+	mu     sync.Mutex
+	frames []frame
+}
+
+// receiveVideo collects the packets of a user's camera video.
+func (p *testPeer) receiveVideo(userID string) *receivedVideo {
+	r := &receivedVideo{}
+	p.pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if remote.StreamID() != userID || remote.ID() != SourceCamera {
+			return
+		}
+		for {
+			pkt, _, err := remote.ReadRTP()
+			if err != nil {
+				return
+			}
+			if len(pkt.Payload) < 3 {
+				continue
+			}
+			r.mu.Lock()
+			r.frames = append(r.frames, frame{string(pkt.Payload[2]), pkt.SequenceNumber, pkt.Timestamp, isKeyframe(pkt)})
+			r.mu.Unlock()
+		}
+	})
+	return r
+}
+
+func (r *receivedVideo) snapshot() []frame {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]frame(nil), r.frames...)
+}
+
+// from returns how many frames of a layer arrived since the first n.
+func (r *receivedVideo) from(n int, rid string) int {
+	count := 0
+	for _, f := range r.snapshot()[min(n, len(r.snapshot())):] {
+		if f.rid == rid {
+			count++
+		}
+	}
+	return count
+}
+
+func TestSFUForwardsSimulcastVideo(t *testing.T) {
+	f := newTestSFU(t)
+	f.guild.setPerms(1, model.PermissionConnect|model.PermissionSpeak|model.PermissionShareScreen)
+	alice, bob := f.joinPeer(t, 1), f.joinPeer(t, 2)
+	alice.simulcast()
+	_, err := bob.pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+	require.NoError(t, err)
+	video := bob.receiveVideo("1")
+	alice.offer()
+	bob.offer()
+
+	// Bob gets the high layer once both have been measured.
+	require.Eventually(t, func() bool {
+		return video.from(0, "f") >= 10
+	}, mediaWait, 50*time.Millisecond, "video not forwarded")
+
+	// He switches to the low layer and back, each at a keyframe.
+	setLayer := func(rid string) int {
+		n := len(video.snapshot())
+		bob.signal(events.VoiceSignalPayload{Type: SignalLayer, Layer: &events.VideoLayer{UserID: 1, Source: SourceCamera, RID: rid}})
+		return n
+	}
+	n := setLayer("q")
+	require.Eventually(t, func() bool { return video.from(n, "q") >= 5 }, mediaWait, 50*time.Millisecond, "not switched to q")
+	n = setLayer("f")
+	require.Eventually(t, func() bool { return video.from(n, "f") >= 5 }, mediaWait, 50*time.Millisecond, "not switched to f")
+
+	// The layers reach him as one stream, continuous across switches.
+	frames := video.snapshot()
+	assert.True(t, frames[0].keyframe, "started on an interframe")
+	layers := []string{frames[0].rid}
+	for i := 1; i < len(frames); i++ {
+		prev, cur := frames[i-1], frames[i]
+		assert.Equal(t, prev.seq+1, cur.seq, "sequence number gap at frame %d", i)
+		assert.Equal(t, prev.ts+frameTicks, cur.ts, "timestamp gap at frame %d", i)
+		if cur.rid != prev.rid {
+			layers = append(layers, cur.rid)
+			assert.True(t, cur.keyframe, "switched to %s on an interframe", cur.rid)
+		}
+	}
+	// He may have started on whichever layer arrived first.
+	assert.Equal(t, []string{"f", "q", "f"}, layers[max(len(layers)-3, 0):])
+
+	// Losing the Share Screen permission stops the video.
+	f.guild.setPerms(1, model.PermissionConnect|model.PermissionSpeak)
+	require.NoError(t, f.bus.Publish(f.ctx, "server:100", events.Event{Type: events.RoleUpdate, Data: &model.Role{ID: 1, ServerID: testServerID}}))
+	require.Eventually(t, func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return len(f.peers[1].videos) == 0
+	}, mediaWait, 50*time.Millisecond, "video not stopped")
+	time.Sleep(200 * time.Millisecond)
+	n = len(video.snapshot())
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, n, len(video.snapshot()), "video forwarded without the permission")
+	state, err := f.voice.Get(f.ctx, 1)
+	require.NoError(t, err)
+	assert.False(t, state.SelfVideo)
+}
@@ -0,0 +1,187 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return body
+}
+
+func TestTranslateSlack(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    ExecuteParams
+	}{
+		{
+			fixture: "slack_blocks.json",
+			want: ExecuteParams{
+				Content: "## Deploy finished\n\n" +
+					"**api** v1.4.2 is live on [production](https://status.example.com) & staging\n" +
+					"**Duration** 3m12s\n" +
+					"~~Rollback~~ not needed\n\n" +
+					"---\n\n" +
+					"-# Triggered by robw · https://ci.example.com/runs/42",
+				Username:  "Deploy Bot",
+				AvatarURL: "https://example.com/deploy.png",
+			},
+		},
+		{
+			fixture: "slack_attachments.json",
+			want: ExecuteParams{
+				Content: "New alert from [Alertmanager](https://alerts.example.com)\n\n" +
+					"**1 alert** is firing\n" +
+					"**[HighLatency](https://alerts.example.com/1)**\n" +
+					"p99 latency is above 500ms\n" +
+					"**Severity:** critical\n" +
+					"**Service:** [api](https://grafana.example.com/d/api)\n" +
+					"-# Alertmanager\n\n" +
+					"Silence with /silence HighLatency",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			got, err := TranslateSlack(readFixture(t, tt.fixture))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestTranslateSlackInvalid(t *testing.T) {
+	_, err := TranslateSlack([]byte(`{"text": 1}`))
+	assert.Error(t, err)
+}
+
+func TestTranslateGitHub(t *testing.T) {
+	tests := []struct {
+		event   string
+		fixture string
+		want    ExecuteParams
+	}{
+		{
+			event:   "push",
+			fixture: "github_push.json",
+			want: ExecuteParams{
+				Content: "**octocat** pushed [2 commits](https://github.com/octo/hello/compare/6113728f27ae...0d1a26e67d8f) to `main` of [octo/hello](https://github.com/octo/hello)\n" +
+					"[`a10867b`](https://github.com/octo/hello/commit/a10867b14bb761a232cd80139fbd4c0d33264240) Fix login redirect — octocat\n" +
+					"[`0d1a26e`](https://github.com/octo/hello/commit/0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c) Update README — Mona Lisa",
+				Username:  githubUsername,
+				AvatarURL: "https://avatars.githubusercontent.com/u/583231",
+			},
+		},
+		{
+			event:   "pull_request",
+			fixture: "github_pull_request.json",
+			want: ExecuteParams{
+				Content: "**monalisa** merged pull request [#7 Add dark mode](https://github.com/octo/hello/pull/7) in [octo/hello](https://github.com/octo/hello)\n" +
+					"`dark-mode` → `main`",
+				Username:  githubUsername,
+				AvatarURL: "https://avatars.githubusercontent.com/u/2",
+			},
+		},
+		{
+			event:   "issues",
+			fixture: "github_issues.json",
+			want: ExecuteParams{
+				Content:   "**hubot** opened issue [#12 Crash on startup](https://github.com/octo/hello/issues/12) in [octo/hello](https://github.com/octo/hello)",
+				Username:  githubUsername,
+				AvatarURL: "https://avatars.githubusercontent.com/u/3",
+			},
+		},
+		{
+			event:   "workflow_run",
+			fixture: "github_workflow_run.json",
+			want: ExecuteParams{
+				Content:   "❌ Workflow **CI** [#562](https://github.com/octo/hello/actions/runs/30433642) timed out on `main` of [octo/hello](https://github.com/octo/hello)",
+				Username:  githubUsername,
+				AvatarURL: "https://avatars.githubusercontent.com/u/583231",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.event, func(t *testing.T) {
+			got, err := TranslateGitHub(tt.event, readFixture(t, tt.fixture))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestTranslateGitHubIgnored(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		body  string
+	}{
+		{"ping", "ping", `{"zen": "Keep it logically awesome."}`},
+		{"tag push", "push", `{"ref": "refs/tags/v1.0.0", "commits": [{"id": "a"}]}`},
+		{"empty push", "push", `{"ref": "refs/heads/main", "commits": []}`},
+		{"labeled pull request", "pull_request", `{"action": "labeled"}`},
+		{"edited issue", "issues", `{"action": "edited"}`},
+		{"requested workflow run", "workflow_run", `{"action": "requested"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := TranslateGitHub(tt.event, []byte(tt.body))
+			assert.ErrorIs(t, err, ErrIgnoredEvent)
+		})
+	}
+}
+
+func TestTranslateGitHubTruncatesLongPushes(t *testing.T) {
+	body := `{"ref": "refs/heads/main", "forced": true, "commits": [` +
+		strings.Repeat(`{"id": "abcdef0123", "message": "m", "author": {"name": "n"}},`, 6) +
+		`{"id": "abcdef0123", "message": "m", "author": {"name": "n"}}], "sender": {"login": "octocat"}}`
+	got, err := TranslateGitHub("push", []byte(body))
+	require.NoError(t, err)
+	assert.Contains(t, got.Content, "**octocat** force-pushed [7 commits]")
+	assert.Equal(t, maxPushCommits, strings.Count(got.Content, "`abcdef0`"))
+	assert.True(t, strings.HasSuffix(got.Content, "\n…and 2 more"))
+}
+
+func TestVerifyGitHubSignature(t *testing.T) {
+	body := readFixture(t, "github_push.json")
+	mac := hmac.New(sha256.New, []byte("webhook-token"))
+	mac.Write(body)
+	valid := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name   string
+		secret string
+		body   []byte
+		header string
+		ok     bool
+	}{
+		{"valid", "webhook-token", body, valid, true},
+		{"wrong secret", "other-token", body, valid, false},
+		{"tampered body", "webhook-token", append([]byte(" "), body...), valid, false},
+		{"missing prefix", "webhook-token", body, strings.TrimPrefix(valid, "sha256="), false},
+		{"sha1", "webhook-token", body, "sha1=" + strings.TrimPrefix(valid, "sha256="), false},
+		{"not hex", "webhook-token", body, "sha256=zz", false},
+		{"empty", "webhook-token", body, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyGitHubSignature(tt.secret, tt.body, tt.header)
+			if tt.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidSignature)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const githubUsername = "GitHub"
+
+// maxPushCommits is how many commits a push message lists before summarizing.
+const maxPushCommits = 5
+
+var (
+	ErrInvalidSignature = errors.New("invalid X-Hub-Signature-256")
+
+	// ErrIgnoredEvent is returned for GitHub events and actions that are
+	// acknowledged but not posted, such as ping or PR label changes.
+	ErrIgnoredEvent = errors.New("event ignored")
+)
+
+// VerifyGitHubSignature checks an X-Hub-Signature-256 header against the body.
+// The secret configured in GitHub must be the webhook's token.
+func VerifyGitHubSignature(secret string, body []byte, header string) error {
+	sig, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return ErrInvalidSignature
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+type githubUser struct {
+	Login     string `json:"login"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+type githubRepo struct {
+	FullName string `json:"full_name"`
+	HTMLURL  string `json:"html_url"`
+}
+
+type githubCommit struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+	URL     string `json:"url"`
+	Author  struct {
+		Name     string `json:"name"`
+		Username string `json:"username"`
+	} `json:"author"`
+}
+
+type githubPush struct {
+	Ref        string         `json:"ref"`
+	Compare    string         `json:"compare"`
+	Forced     bool           `json:"forced"`
+	Deleted    bool           `json:"deleted"`
+	Commits    []githubCommit `json:"commits"`
+	Repository githubRepo     `json:"repository"`
+	Sender     githubUser     `json:"sender"`
+}
+
+type githubPullRequestEvent struct {
+	Action      string `json:"action"`
+	PullRequest struct {
+		Number  int    `json:"number"`
+		Title   string `json:"title"`
+		HTMLURL string `json:"html_url"`
+		Merged  bool   `json:"merged"`
+		Draft   bool   `json:"draft"`
+		Head    struct {
+			Ref string `json:"ref"`
+		} `json:"head"`
+		Base struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+	} `json:"pull_request"`
+	Repository githubRepo `json:"repository"`
+	Sender     githubUser `json:"sender"`
+}
+
+type githubIssuesEvent struct {
+	Action string `json:"action"`
+	Issue  struct {
+		Number  int    `json:"number"`
+		Title   string `json:"title"`
+		HTMLURL string `json:"html_url"`
+	} `json:"issue"`
+	Repository githubRepo `json:"repository"`
+	Sender     githubUser `json:"sender"`
+}
+
+type githubWorkflowRunEvent struct {
+	Action      string `json:"action"`
+	WorkflowRun struct {
+		Name       string `json:"name"`
+		HeadBranch string `json:"head_branch"`
+		HTMLURL    string `json:"html_url"`
+		Conclusion string `json:"conclusion"`
+		RunNumber  int    `json:"run_number"`
+	} `json:"workflow_run"`
+	Repository githubRepo `json:"repository"`
+	Sender     githubUser `json:"sender"`
+}
+
+// TranslateGitHub converts a GitHub webhook delivery into a native post.
+// event is the X-GitHub-Event header. Unsupported events and uninteresting
+// actions return ErrIgnoredEvent.
+func TranslateGitHub(event string, body []byte) (ExecuteParams, error) {
+	var (
+		content string
+		sender  githubUser
+		err     error
+	)
+
+	switch event {
+	case "push":
+		var p githubPush
+		if err := json.Unmarshal(body, &p); err != nil {
+			return ExecuteParams{}, fmt.Errorf("invalid github payload: %w", err)
+		}
+		content, err = formatPush(p)
+		sender = p.Sender
+	case "pull_request":
+		var p githubPullRequestEvent
+		if err := json.Unmarshal(body, &p); err != nil {
+			return ExecuteParams{}, fmt.Errorf("invalid github payload: %w", err)
+		}
+		content, err = formatPullRequest(p)
+		sender = p.Sender
+	case "issues":
+		var p githubIssuesEvent
+		if err := json.Unmarshal(body, &p); err != nil {
+			return ExecuteParams{}, fmt.Errorf("invalid github payload: %w", err)
+		}
+		content, err = formatIssue(p)
+		sender = p.Sender
+	case "workflow_run":
+		var p githubWorkflowRunEvent
+		if err := json.Unmarshal(body, &p); err != nil {
+			return ExecuteParams{}, fmt.Errorf("invalid github payload: %w", err)
+		}
+		content, err = formatWorkflowRun(p)
+		sender = p.Sender
+	default:
+		return ExecuteParams{}, ErrIgnoredEvent
+	}
+	if err != nil {
+		return ExecuteParams{}, err
+	}
+
+	return ExecuteParams{
+		Content:   truncate(content),
+		Username:  githubUsername,
+		AvatarURL: sender.AvatarURL,
+	}, nil
+}
+
+func formatPush(p githubPush) (string, error) {
+	branch := strings.TrimPrefix(p.Ref, "refs/heads/")
+	if strings.HasPrefix(p.Ref, "refs/tags/") {
+		return "", ErrIgnoredEvent
+	}
+	repo := repoLink(p.Repository)
+
+	if p.Deleted {
+		return fmt.Sprintf("**%s** deleted branch `%s` of %s", p.Sender.Login, branch, repo), nil
+	}
+	if len(p.Commits) == 0 {
+		return "", ErrIgnoredEvent
+	}
+
+	verb := "pushed"
+	if p.Forced {
+		verb = "force-pushed"
+	}
+	noun := "commits"
+	if len(p.Commits) == 1 {
+		noun = "commit"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "**%s** %s [%d %s](%s) to `%s` of %s",
+		p.Sender.Login, verb, len(p.Commits), noun, p.Compare, branch, repo)
+	for i, c := range p.Commits {
+		if i == maxPushCommits {
+			fmt.Fprintf(&b, "\n…and %d more", len(p.Commits)-maxPushCommits)
+			break
+		}
+		title, _, _ := strings.Cut(c.Message, "\n")
+		author := c.Author.Username
+		if author == "" {
+			author = c.Author.Name
+		}
+		fmt.Fprintf(&b, "\n[`%s`](%s) %s — %s", shortSHA(c.ID), c.URL, title, author)
+	}
+	return b.String(), nil
+}
+
+func formatPullRequest(p githubPullRequestEvent) (string, error) {
+	pr := p.PullRequest
+	var verb string
+	switch p.Action {
+	case "opened":
+		verb = "opened"
+		if pr.Draft {
+			verb = "opened draft"
+		}
+	case "closed":
+		verb = "closed"
+		if pr.Merged {
+			verb = "merged"
+		}
+	case "reopened":
+		verb = "reopened"
+	case "ready_for_review":
+		verb = "marked ready for review"
+	default:
+		return "", ErrIgnoredEvent
+	}
+
+	return fmt.Sprintf("**%s** %s pull request [#%d %s](%s) in %s\n`%s` → `%s`",
+		p.Sender.Login, verb, pr.Number, pr.Title, pr.HTMLURL, repoLink(p.Repository),
+		pr.Head.Ref, pr.Base.Ref,
+	), nil
+}
+
+func formatIssue(p githubIssuesEvent) (string, error) {
+	switch p.Action {
+	case "opened", "closed", "reopened":
+	default:
+		return "", ErrIgnoredEvent
+	}
+	return fmt.Sprintf("**%s** %s issue [#%d %s](%s) in %s",
+		p.Sender.Login, p.Action, p.Issue.Number, p.Issue.Title, p.Issue.HTMLURL, repoLink(p.Repository),
+	), nil
+}
+
+func formatWorkflowRun(p githubWorkflowRunEvent) (string, error) {
+	if p.Action != "completed" {
+		return "", ErrIgnoredEvent
+	}
+	run := p.WorkflowRun
+
+	icon := "⚪"
+	switch run.Conclusion {
+	case "success":
+		icon = "✅"
+	case "failure", "timed_out", "startup_failure":
+		icon = "❌"
+	case "cancelled":
+		icon = "🚫"
+	}
+
+	return fmt.Sprintf("%s Workflow **%s** [#%d](%s) %s on `%s` of %s",
+		icon, run.Name, run.RunNumber, run.HTMLURL, strings.ReplaceAll(run.Conclusion, "_", " "),
+		run.HeadBranch, repoLink(p.Repository),
+	), nil
+}
+
+func repoLink(r githubRepo) string {
+	return fmt.Sprintf("[%s](%s)", r.FullName, r.HTMLURL)
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
@@ -0,0 +1,173 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/rs/zerolog/log"
+)
+
+// maxBodySize bounds incoming webhook payloads.
+const maxBodySize = 1 << 20
+
+// Handler serves the public, token-authenticated execute endpoints. Mount it
+// under /api/v1/webhooks.
+type Handler struct {
+	service *Service
+}
+
+func NewHandler(service *Service) *Handler {
+	return &Handler{service: service}
+}
+
+func (h *Handler) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Post("/{webhookID}/{token}", h.execute)
+	r.Post("/{webhookID}/{token}/slack", h.executeSlack)
+	r.Post("/{webhookID}/{token}/github", h.executeGitHub)
+	return r
+}
+
+type executeRequest struct {
+	Content   string `json:"content"`
+	Username  string `json:"username"`
+	AvatarURL string `json:"avatar_url"`
+}
+
+// execute posts a message. By default it responds 204; with ?wait=true it
+// responds with the created message.
+func (h *Handler) execute(w http.ResponseWriter, r *http.Request) {
+	wh, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+	var req executeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	h.post(w, r, wh, ExecuteParams{
+		Content:   req.Content,
+		Username:  req.Username,
+		AvatarURL: req.AvatarURL,
+	}, nil)
+}
+
+// executeSlack accepts Slack's incoming-webhook format and, like Slack,
+// responds with a plain-text "ok".
+func (h *Handler) executeSlack(w http.ResponseWriter, r *http.Request) {
+	wh, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	params, err := TranslateSlack(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	h.post(w, r, wh, params, func() {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok"))
+	})
+}
+
+// executeGitHub accepts GitHub webhook deliveries. The delivery must be
+// signed with the webhook token as the secret.
+func (h *Handler) executeGitHub(w http.ResponseWriter, r *http.Request) {
+	wh, ok := h.authenticate(w, r)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if err := VerifyGitHubSignature(chi.URLParam(r, "token"), body, r.Header.Get("X-Hub-Signature-256")); err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	params, err := TranslateGitHub(r.Header.Get("X-GitHub-Event"), body)
+	if errors.Is(err, ErrIgnoredEvent) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	h.post(w, r, wh, params, nil)
+}
+
+// authenticate checks the webhook ID and token in the URL, writing an error
+// response if they are invalid.
+func (h *Handler) authenticate(w http.ResponseWriter, r *http.Request) (*model.Webhook, bool) {
+	webhookID, err := strconv.ParseInt(chi.URLParam(r, "webhookID"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusNotFound, ErrNotFound.Error())
+		return nil, false
+	}
+	wh, err := h.service.Authenticate(r.Context(), webhookID, chi.URLParam(r, "token"))
+	if err != nil {
+		writeServiceError(w, err)
+		return nil, false
+	}
+	return wh, true
+}
+
+// post executes params through wh. On success it responds with the message
+// if ?wait=true, otherwise by calling respond, or with 204 if respond is nil.
+func (h *Handler) post(w http.ResponseWriter, r *http.Request, wh *model.Webhook, params ExecuteParams, respond func()) {
+	msg, err := h.service.Execute(r.Context(), wh, params)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	switch {
+	case r.URL.Query().Get("wait") == "true":
+		writeJSON(w, http.StatusOK, msg)
+	case respond != nil:
+		respond()
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeServiceError(w http.ResponseWriter, err error) {
+	var rl *RateLimitedError
+	switch {
+	case errors.As(err, &rl):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rl.RetryAfter.Seconds()))))
+		writeError(w, http.StatusTooManyRequests, err.Error())
+	case errors.Is(err, ErrNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrEmptyContent), errors.Is(err, ErrContentTooLong), errors.Is(err, ErrInvalidName):
+		writeError(w, http.StatusBadRequest, err.Error())
+	default:
+		log.Error().Err(err).Msg("webhook execute failed")
+		writeError(w, http.StatusInternalServerError, "internal error")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,324 @@
+package webhook
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/robwittman/possessive-potato/backend/internal/auth"
+	"github.com/robwittman/possessive-potato/backend/internal/events"
+	"github.com/robwittman/possessive-potato/backend/internal/model"
+	"github.com/robwittman/possessive-potato/backend/internal/outbox"
+	"github.com/robwittman/possessive-potato/backend/internal/permission"
+	"github.com/robwittman/possessive-potato/backend/internal/store"
+)
+
+const (
+	// RateLimit is how many messages a single webhook may post per RateLimitWindow.
+	RateLimit       = 30
+	RateLimitWindow = time.Minute
+
+	MaxContentLength = 2000
+	MaxNameLength    = 80
+)
+
+var (
+	ErrNotFound       = errors.New("unknown webhook")
+	ErrInvalidChannel = errors.New("webhooks can only post to text channels")
+	ErrInvalidName    = fmt.Errorf("webhook name must be 1-%d characters", MaxNameLength)
+	ErrEmptyContent   = errors.New("cannot send an empty message")
+	ErrContentTooLong = fmt.Errorf("message content must be at most %d characters", MaxContentLength)
+)
+
+// RateLimitedError is returned when a webhook has posted too many messages.
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("webhook rate limited, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+// Service manages incoming webhooks and executes them into channel messages.
+type Service struct {
+	webhooks  store.WebhookStoreInterface
+	channels  store.ChannelStoreInterface
+	messages  store.MessageStoreInterface
+	perms     *permission.Checker
+	tx        store.TxManagerInterface
+	outbox    events.Publisher
+	redis     *redis.Client
+	publicURL string
+}
+
+func NewService(
+	webhooks store.WebhookStoreInterface,
+	channels store.ChannelStoreInterface,
+	messages store.MessageStoreInterface,
+	perms *permission.Checker,
+	tx store.TxManagerInterface,
+	outbox events.Publisher,
+	redisClient *redis.Client,
+	publicURL string,
+) *Service {
+	return &Service{
+		webhooks:  webhooks,
+		channels:  channels,
+		messages:  messages,
+		perms:     perms,
+		tx:        tx,
+		outbox:    outbox,
+		redis:     redisClient,
+		publicURL: publicURL,
+	}
+}
+
+// Create adds a webhook to a text channel. The secret token is returned once;
+// only its hash is stored.
+func (s *Service) Create(ctx context.Context, actorID, channelID int64, name string, avatarURL *string) (*model.Webhook, string, error) {
+	if err := validateName(name); err != nil {
+		return nil, "", err
+	}
+	ch, err := s.textChannel(ctx, channelID)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := s.perms.Require(ctx, ch.ServerID, actorID, model.PermissionManageWebhooks); err != nil {
+		return nil, "", err
+	}
+
+	token, hash, err := auth.GenerateSecret("")
+	if err != nil {
+		return nil, "", err
+	}
+	wh := &model.Webhook{
+		ID:        model.NewID().Int64(),
+		ServerID:  ch.ServerID,
+		ChannelID: ch.ID,
+		Name:      name,
+		AvatarURL: avatarURL,
+		TokenHash: hash,
+		CreatedBy: &actorID,
+		CreatedAt: time.Now(),
+	}
+	if err := s.webhooks.Create(ctx, wh); err != nil {
+		return nil, "", err
+	}
+	return wh, token, nil
+}
+
+// ListByChannel returns a channel's webhooks if the actor may manage them.
+func (s *Service) ListByChannel(ctx context.Context, actorID, channelID int64) ([]model.Webhook, error) {
+	ch, err := s.channels.GetByID(ctx, channelID)
+	if err != nil {
+		return nil, err
+	}
+	if ch == nil {
+		return nil, ErrNotFound
+	}
+	if err := s.perms.Require(ctx, ch.ServerID, actorID, model.PermissionManageWebhooks); err != nil {
+		return nil, err
+	}
+	return s.webhooks.ListByChannel(ctx, channelID)
+}
+
+// UpdateParams holds the webhook fields to change; nil fields are left alone.
+type UpdateParams struct {
+	Name      *string
+	AvatarURL *string
+	ChannelID *int64
+}
+
+func (s *Service) Update(ctx context.Context, actorID, webhookID int64, params UpdateParams) (*model.Webhook, error) {
+	wh, err := s.managed(ctx, actorID, webhookID)
+	if err != nil {
+		return nil, err
+	}
+
+	if params.Name != nil {
+		if err := validateName(*params.Name); err != nil {
+			return nil, err
+		}
+		wh.Name = *params.Name
+	}
+	if params.AvatarURL != nil {
+		wh.AvatarURL = params.AvatarURL
+		if *params.AvatarURL == "" {
+			wh.AvatarURL = nil
+		}
+	}
+	if params.ChannelID != nil {
+		ch, err := s.textChannel(ctx, *params.ChannelID)
+		if err != nil {
+			return nil, err
+		}
+		if ch.ServerID != wh.ServerID {
+			return nil, ErrInvalidChannel
+		}
+		wh.ChannelID = ch.ID
+	}
+
+	if err := s.webhooks.Update(ctx, wh); err != nil {
+		return nil, err
+	}
+	return wh, nil
+}
+
+// RegenerateToken invalidates the webhook's URL and returns a new token.
+func (s *Service) RegenerateToken(ctx context.Context, actorID, webhookID int64) (string, error) {
+	wh, err := s.managed(ctx, actorID, webhookID)
+	if err != nil {
+		return "", err
+	}
+	token, hash, err := auth.GenerateSecret("")
+	if err != nil {
+		return "", err
+	}
+	if err := s.webhooks.UpdateTokenHash(ctx, wh.ID, hash); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *Service) Delete(ctx context.Context, actorID, webhookID int64) error {
+	wh, err := s.managed(ctx, actorID, webhookID)
+	if err != nil {
+		return err
+	}
+	return s.webhooks.Delete(ctx, wh.ID)
+}
+
+// ExecuteURL is the secret URL that posts to the webhook.
+func (s *Service) ExecuteURL(wh *model.Webhook, token string) string {
+	return fmt.Sprintf("%s/api/v1/webhooks/%d/%s", s.publicURL, wh.ID, token)
+}
+
+// Authenticate looks up a webhook by ID and checks its secret token.
+func (s *Service) Authenticate(ctx context.Context, webhookID int64, token string) (*model.Webhook, error) {
+	wh, err := s.webhooks.GetByID(ctx, webhookID)
+	if err != nil {
+		return nil, err
+	}
+	if wh == nil || subtle.ConstantTimeCompare([]byte(wh.TokenHash), []byte(auth.HashToken(token))) != 1 {
+		return nil, ErrNotFound
+	}
+	return wh, nil
+}
+
+// ExecuteParams is a single post through a webhook. Username and AvatarURL
+// override the webhook's defaults for this message only.
+type ExecuteParams struct {
+	Content   string
+	Username  string
+	AvatarURL string
+}
+
+// Execute posts a message to the webhook's channel, attributed to the webhook,
+// and publishes MessageCreate to the channel's subscribers through the outbox,
+// in the same transaction as the message.
+func (s *Service) Execute(ctx context.Context, wh *model.Webhook, params ExecuteParams) (*model.Message, error) {
+	content := strings.TrimSpace(params.Content)
+	if content == "" {
+		return nil, ErrEmptyContent
+	}
+	if utf8.RuneCountInString(content) > MaxContentLength {
+		return nil, ErrContentTooLong
+	}
+
+	name := wh.Name
+	if params.Username != "" {
+		if err := validateName(params.Username); err != nil {
+			return nil, err
+		}
+		name = params.Username
+	}
+	avatarURL := wh.AvatarURL
+	if params.AvatarURL != "" {
+		avatarURL = &params.AvatarURL
+	}
+
+	if err := s.checkRateLimit(ctx, wh.ID); err != nil {
+		return nil, err
+	}
+
+	msg := &model.Message{
+		ID:               model.NewID().Int64(),
+		ChannelID:        wh.ChannelID,
+		WebhookID:        &wh.ID,
+		WebhookName:      &name,
+		WebhookAvatarURL: avatarURL,
+		Content:          content,
+		CreatedAt:        time.Now(),
+	}
+	msg.Author = msg.WebhookAuthor()
+
+	err := s.tx.InTx(ctx, func(ctx context.Context) error {
+		if err := s.messages.Create(ctx, msg); err != nil {
+			return err
+		}
+		event := events.Event{
+			Type: events.MessageCreate,
+			Data: msg,
+			Key:  outbox.Key(events.MessageCreate, msg.ID),
+		}
+		return s.outbox.Publish(ctx, fmt.Sprintf("channel:%d", msg.ChannelID), event)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// checkRateLimit counts a post against the webhook's fixed window.
+func (s *Service) checkRateLimit(ctx context.Context, webhookID int64) error {
+	key := fmt.Sprintf("webhook_rate:%d", webhookID)
+	pipe := s.redis.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	pipe.ExpireNX(ctx, key, RateLimitWindow)
+	ttl := pipe.PTTL(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("check webhook rate limit: %w", err)
+	}
+	if incr.Val() > RateLimit {
+		return &RateLimitedError{RetryAfter: ttl.Val()}
+	}
+	return nil
+}
+
+func (s *Service) managed(ctx context.Context, actorID, webhookID int64) (*model.Webhook, error) {
+	wh, err := s.webhooks.GetByID(ctx, webhookID)
+	if err != nil {
+		return nil, err
+	}
+	if wh == nil {
+		return nil, ErrNotFound
+	}
+	if err := s.perms.Require(ctx, wh.ServerID, actorID, model.PermissionManageWebhooks); err != nil {
+		return nil, err
+	}
+	return wh, nil
+}
+
+func (s *Service) textChannel(ctx context.Context, channelID int64) (*model.Channel, error) {
+	ch, err := s.channels.GetByID(ctx, channelID)
+	if err != nil {
+		return nil, err
+	}
+	if ch == nil || ch.Type != model.ChannelTypeText {
+		return nil, ErrInvalidChannel
+	}
+	return ch, nil
+}
+
+func validateName(name string) error {
+	n := utf8.RuneCountInString(strings.TrimSpace(name))
+	if n == 0 || n > MaxNameLength {
+		return ErrInvalidName
+	}
+	return nil
+}
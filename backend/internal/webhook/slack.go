@@ -0,0 +1,158 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// SlackPayload is the subset of Slack's incoming-webhook JSON we understand.
+type SlackPayload struct {
+	Text        string            `json:"text"`
+	Username    string            `json:"username"`
+	IconURL     string            `json:"icon_url"`
+	Blocks      []slackBlock      `json:"blocks"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackBlock struct {
+	Type     string      `json:"type"`
+	Text     *slackText  `json:"text"`
+	Fields   []slackText `json:"fields"`
+	Elements []slackText `json:"elements"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+type slackAttachment struct {
+	Fallback  string       `json:"fallback"`
+	Pretext   string       `json:"pretext"`
+	Title     string       `json:"title"`
+	TitleLink string       `json:"title_link"`
+	Text      string       `json:"text"`
+	Fields    []slackField `json:"fields"`
+	Footer    string       `json:"footer"`
+}
+
+var (
+	slackLinkWithLabel = regexp.MustCompile(`<((?:https?|mailto):[^|>]+)\|([^>]+)>`)
+	slackLink          = regexp.MustCompile(`<((?:https?|mailto):[^>]+)>`)
+	slackBold          = regexp.MustCompile(`(^|[\s(])\*([^*\n]+)\*`)
+	slackStrike        = regexp.MustCompile(`(^|[\s(])~([^~\n]+)~`)
+)
+
+// TranslateSlack converts a Slack incoming-webhook payload into a native post.
+// Blocks take precedence over text, as in Slack; attachments are appended.
+func TranslateSlack(body []byte) (ExecuteParams, error) {
+	var p SlackPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return ExecuteParams{}, fmt.Errorf("invalid slack payload: %w", err)
+	}
+
+	var parts []string
+	if len(p.Blocks) > 0 {
+		parts = append(parts, renderSlackBlocks(p.Blocks)...)
+	} else if p.Text != "" {
+		parts = append(parts, slackToMarkdown(p.Text))
+	}
+	for _, a := range p.Attachments {
+		if s := renderSlackAttachment(a); s != "" {
+			parts = append(parts, s)
+		}
+	}
+
+	return ExecuteParams{
+		Content:   truncate(strings.Join(parts, "\n\n")),
+		Username:  p.Username,
+		AvatarURL: p.IconURL,
+	}, nil
+}
+
+func renderSlackBlocks(blocks []slackBlock) []string {
+	var out []string
+	for _, b := range blocks {
+		switch b.Type {
+		case "header":
+			if b.Text != nil {
+				out = append(out, "## "+slackToMarkdown(b.Text.Text))
+			}
+		case "section":
+			var lines []string
+			if b.Text != nil {
+				lines = append(lines, slackToMarkdown(b.Text.Text))
+			}
+			for _, f := range b.Fields {
+				lines = append(lines, slackToMarkdown(f.Text))
+			}
+			if len(lines) > 0 {
+				out = append(out, strings.Join(lines, "\n"))
+			}
+		case "context":
+			var texts []string
+			for _, e := range b.Elements {
+				if e.Text != "" {
+					texts = append(texts, slackToMarkdown(e.Text))
+				}
+			}
+			if len(texts) > 0 {
+				out = append(out, "-# "+strings.Join(texts, " · "))
+			}
+		case "divider":
+			out = append(out, "---")
+		}
+	}
+	return out
+}
+
+func renderSlackAttachment(a slackAttachment) string {
+	var lines []string
+	if a.Pretext != "" {
+		lines = append(lines, slackToMarkdown(a.Pretext))
+	}
+	switch {
+	case a.Title != "" && a.TitleLink != "":
+		lines = append(lines, fmt.Sprintf("**[%s](%s)**", a.Title, a.TitleLink))
+	case a.Title != "":
+		lines = append(lines, "**"+a.Title+"**")
+	}
+	if a.Text != "" {
+		lines = append(lines, slackToMarkdown(a.Text))
+	}
+	for _, f := range a.Fields {
+		lines = append(lines, fmt.Sprintf("**%s:** %s", f.Title, slackToMarkdown(f.Value)))
+	}
+	if a.Footer != "" {
+		lines = append(lines, "-# "+slackToMarkdown(a.Footer))
+	}
+	if len(lines) == 0 && a.Fallback != "" {
+		lines = append(lines, slackToMarkdown(a.Fallback))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// slackToMarkdown converts Slack mrkdwn to the markdown our clients render.
+func slackToMarkdown(s string) string {
+	s = slackLinkWithLabel.ReplaceAllString(s, "[$2]($1)")
+	s = slackLink.ReplaceAllString(s, "$1")
+	s = slackBold.ReplaceAllString(s, "$1**$2**")
+	s = slackStrike.ReplaceAllString(s, "$1~~$2~~")
+	return html.UnescapeString(s)
+}
+
+func truncate(s string) string {
+	r := []rune(s)
+	if len(r) <= MaxContentLength {
+		return s
+	}
+	return string(r[:MaxContentLength-1]) + "…"
+}
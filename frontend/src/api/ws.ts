@@ -1,72 +1,262 @@
-import type { GatewayEvent } from '../types';
+import {
+  GatewayCloseCode,
+  GatewayIntents,
+  type Activity,
+  type CustomStatus,
+  type GatewayEvent,
+  type User,
+  type VideoLayer,
+  type VoiceSignalPayload,
+} from '../types';
+
+// The gateway sends every event for the user's servers that these cover, so
+// views filter events by channel rather than subscribing to them.
+const INTENTS =
+  GatewayIntents.Messages |
+  GatewayIntents.Members |
+  GatewayIntents.Presence |
+  GatewayIntents.Typing |
+  GatewayIntents.Voice;
+
+// Reconnect delays back off exponentially up to the cap, and each is a random
+// fraction of that so clients dropped together do not return together.
+const RECONNECT_BASE_MS = 1000;
+const RECONNECT_MAX_MS = 30000;
+// When the server asks us to move nodes it has already spread its clients
+// out, so only a short delay is needed.
+const MOVE_MAX_MS = 1000;
+
+// The server shows the user away once none of their connections has reported
+// activity for a while; report it at most this often.
+const ACTIVITY_INTERVAL_MS = 60000;
+const ACTIVITY_EVENTS = ['pointerdown', 'keydown'] as const;
+
+// Matches the server's typing throttle; it ignores anything more frequent.
+const TYPING_INTERVAL_MS = 5000;
 
 type EventHandler = (event: GatewayEvent) => void;
+type ResyncHandler = () => void;
 
 class WebSocketClient {
   private ws: WebSocket | null = null;
   private handlers: EventHandler[] = [];
+  private resyncHandlers: ResyncHandler[] = [];
   private reconnectTimer: ReturnType<typeof setTimeout> | null = null;
   private token: string | null = null;
+  private attempts = 0;
+  private lastActivity = 0;
+  private typingSent = new Map<string, number>();
+
+  // The server closes connections that miss heartbeats, and a heartbeat
+  // that is never acknowledged means the connection is dead.
+  private heartbeatTimer: ReturnType<typeof setTimeout> | null = null;
+  private heartbeatAcked = true;
+
+  // Resume state: the server numbers every event, and after a reconnect
+  // replays whatever was sent after the last one we saw.
+  private sessionId: string | null = null;
+  private seq = 0;
 
   connect(token: string) {
     this.token = token;
+    ACTIVITY_EVENTS.forEach((e) => window.addEventListener(e, this.onActivity));
     this.doConnect();
   }
 
+  private onActivity = () => {
+    const now = Date.now();
+    if (now - this.lastActivity < ACTIVITY_INTERVAL_MS) return;
+    this.lastActivity = now;
+    this.send({ op: 'PRESENCE_UPDATE', d: { idle: false } });
+  };
+
+  /** Sets the status the user chose. */
+  setStatus(status: Exclude<User['status'], 'offline'>) {
+    this.send({ op: 'PRESENCE_UPDATE', d: { status } });
+  }
+
+  /** Sets the user's custom status, or clears it if null. */
+  setCustomStatus(customStatus: CustomStatus | null) {
+    this.send({ op: 'PRESENCE_UPDATE', d: { custom_status: customStatus } });
+  }
+
+  /**
+   * Says the user is typing in a channel. Call it on every keystroke; it
+   * sends at most once per TYPING_INTERVAL_MS.
+   */
+  startTyping(channelId: string) {
+    const now = Date.now();
+    if (now - (this.typingSent.get(channelId) ?? 0) < TYPING_INTERVAL_MS) return;
+    this.typingSent.set(channelId, now);
+    this.send({ op: 'TYPING_START', d: { channel_id: channelId } });
+  }
+
+  /**
+   * Joins a voice channel, or moves to it from another, and sets self mute
+   * and deafen. Sending the current channel again only updates those.
+   */
+  joinVoice(channelId: string, selfMute = false, selfDeaf = false) {
+    this.send({
+      op: 'VOICE_STATE_UPDATE',
+      d: { channel_id: channelId, self_mute: selfMute, self_deaf: selfDeaf },
+    });
+  }
+
+  leaveVoice() {
+    this.send({ op: 'VOICE_STATE_UPDATE', d: { channel_id: null } });
+  }
+
+  /** Sends WebRTC signaling for the voice connection; answers arrive as VOICE_SERVER_INFO. */
+  sendVoiceSignal(signal: Omit<VoiceSignalPayload, 'user_id' | 'session_id'>) {
+    this.send({ op: 'VOICE_SIGNAL', d: signal });
+  }
+
+  /**
+   * Chooses the simulcast layer received of another user's camera or screen
+   * share: by RID, or the best within a bitrate, such as the
+   * availableIncomingBitrate the peer connection reports.
+   */
+  setVideoLayer(channelId: string, layer: VideoLayer) {
+    this.sendVoiceSignal({ channel_id: channelId, type: 'layer', layer });
+  }
+
+  /** Replaces the activities this connection shows. */
+  setActivities(activities: Omit<Activity, 'started_at'>[]) {
+    this.send({ op: 'PRESENCE_UPDATE', d: { activities } });
+  }
+
   private doConnect() {
     if (!this.token) return;
 
     const protocol = window.location.protocol === 'https:' ? 'wss' : 'ws';
     const url = `${protocol}://${window.location.host}/ws?token=${this.token}`;
-    this.ws = new WebSocket(url);
+    const ws = new WebSocket(url);
+    this.ws = ws;
 
-    this.ws.onopen = () => {
+    ws.onopen = () => {
       console.log('[WS] connected');
+      if (this.sessionId) {
+        this.send({ op: 'RESUME', d: { session_id: this.sessionId, seq: this.seq } });
+      } else {
+        this.send({ op: 'IDENTIFY', d: { intents: INTENTS } });
+      }
     };
 
-    this.ws.onmessage = (e) => {
+    ws.onmessage = (e) => {
+      let event: GatewayEvent;
       try {
-        const event: GatewayEvent = JSON.parse(e.data);
-        this.handlers.forEach((h) => h(event));
+        event = JSON.parse(e.data);
       } catch {
-        // ignore malformed messages
+        return; // ignore malformed messages
       }
+      if (event.q) this.seq = event.q;
+
+      switch (event.t) {
+        case 'HELLO':
+          this.startHeartbeat(event.d.heartbeat_interval);
+          break;
+        case 'HEARTBEAT_ACK':
+          this.heartbeatAcked = true;
+          break;
+        case 'READY':
+          this.sessionId = event.d.session_id;
+          this.seq = 0;
+          this.attempts = 0;
+          break;
+        case 'RESUMED':
+          this.attempts = 0;
+          break;
+        case 'INVALID_SESSION':
+          // Events were missed and cannot be replayed; identify again so
+          // the new session follows the same events, and after its READY
+          // views must re-fetch.
+          this.sessionId = null;
+          this.seq = 0;
+          this.send({ op: 'IDENTIFY', d: { intents: INTENTS } });
+          this.resyncHandlers.forEach((h) => h());
+          break;
+      }
+      this.handlers.forEach((h) => h(event));
     };
 
-    this.ws.onclose = () => {
+    ws.onclose = (e) => {
+      if (this.ws !== ws) return;
+      this.stopHeartbeat();
+      switch (e.code) {
+        case GatewayCloseCode.SessionReplaced:
+          // Another connection took over the session.
+          console.log('[WS] session resumed elsewhere');
+          return;
+        case GatewayCloseCode.SessionInvalidated:
+          this.sessionId = null;
+          this.seq = 0;
+          break;
+      }
       console.log('[WS] disconnected, reconnecting...');
-      this.scheduleReconnect();
+      this.scheduleReconnect(e.code === GatewayCloseCode.Reconnect);
     };
 
-    this.ws.onerror = () => {
-      this.ws?.close();
+    ws.onerror = () => {
+      ws.close();
     };
   }
 
-  private scheduleReconnect() {
-    if (this.reconnectTimer) return;
+  private startHeartbeat(interval: number) {
+    this.stopHeartbeat();
+    this.heartbeatAcked = true;
+    const beat = () => {
+      if (!this.heartbeatAcked) {
+        // A dead connection may take a long time to report closing, so
+        // abandon it rather than wait.
+        console.log('[WS] heartbeat not acknowledged, reconnecting...');
+        const ws = this.ws;
+        this.ws = null;
+        ws?.close();
+        this.scheduleReconnect();
+        return;
+      }
+      this.heartbeatAcked = false;
+      this.send({ op: 'HEARTBEAT', d: this.seq });
+      this.heartbeatTimer = setTimeout(beat, interval);
+    };
+    // Jitter the first beat so clients that connected together do not
+    // heartbeat together.
+    this.heartbeatTimer = setTimeout(beat, interval * Math.random());
+  }
+
+  private stopHeartbeat() {
+    if (this.heartbeatTimer) {
+      clearTimeout(this.heartbeatTimer);
+      this.heartbeatTimer = null;
+    }
+  }
+
+  private scheduleReconnect(moving = false) {
+    if (this.reconnectTimer || !this.token) return;
+    const cap = moving
+      ? MOVE_MAX_MS
+      : Math.min(RECONNECT_MAX_MS, RECONNECT_BASE_MS * 2 ** this.attempts);
+    this.attempts++;
     this.reconnectTimer = setTimeout(() => {
       this.reconnectTimer = null;
       this.doConnect();
-    }, 3000);
+    }, cap * Math.random());
   }
 
   disconnect() {
+    ACTIVITY_EVENTS.forEach((e) => window.removeEventListener(e, this.onActivity));
     this.token = null;
+    this.sessionId = null;
+    this.seq = 0;
+    this.attempts = 0;
+    this.stopHeartbeat();
     if (this.reconnectTimer) {
       clearTimeout(this.reconnectTimer);
       this.reconnectTimer = null;
     }
-    this.ws?.close();
+    const ws = this.ws;
     this.ws = null;
-  }
-
-  subscribe(channelID: string) {
-    this.send({ op: 'SUBSCRIBE', d: { channel_id: channelID } });
-  }
-
-  unsubscribe(channelID: string) {
-    this.send({ op: 'UNSUBSCRIBE', d: { channel_id: channelID } });
+    ws?.close();
   }
 
   onEvent(handler: EventHandler) {
@@ -76,6 +266,14 @@ class WebSocketClient {
     };
   }
 
+  /** Registers a handler called when missed events could not be replayed. */
+  onResync(handler: ResyncHandler) {
+    this.resyncHandlers.push(handler);
+    return () => {
+      this.resyncHandlers = this.resyncHandlers.filter((h) => h !== handler);
+    };
+  }
+
   private send(data: unknown) {
     if (this.ws?.readyState === WebSocket.OPEN) {
       this.ws.send(JSON.stringify(data));
@@ -26,29 +26,26 @@ export function MessageView() {
     }
 
     fetchMessages(activeChannelId);
-    wsClient.subscribe(activeChannelId);
 
     const unsub = wsClient.onEvent((event: GatewayEvent) => {
       switch (event.t) {
         case 'MESSAGE_CREATE':
-          addMessage(event.d as Message);
+          if (event.d.channel_id === activeChannelId) addMessage(event.d as Message);
           break;
-        case 'MESSAGE_UPDATE': {
-          const data = event.d as { id: string; content: string };
-          updateMessage(data.id, data.content);
+        case 'MESSAGE_UPDATE':
+          if (event.d.channel_id === activeChannelId) updateMessage(event.d.id, event.d.content);
           break;
-        }
-        case 'MESSAGE_DELETE': {
-          const data = event.d as { id: string };
-          removeMessage(data.id);
+        case 'MESSAGE_DELETE':
+          if (event.d.channel_id === activeChannelId) removeMessage(event.d.id);
           break;
-        }
       }
     });
 
+    const unsubResync = wsClient.onResync(() => fetchMessages(activeChannelId));
+
     return () => {
-      wsClient.unsubscribe(activeChannelId);
       unsub();
+      unsubResync();
     };
   }, [activeChannelId, fetchMessages, addMessage, updateMessage, removeMessage, clear]);
 
@@ -83,8 +80,9 @@ export function MessageView() {
           <p className="text-gray-500 text-center">No messages yet. Say something!</p>
         )}
         {messages.map((msg) => {
-          const member = memberMap.get(msg.author_id);
-          const authorName = member?.name ?? msg.author_id;
+          const member = msg.author_id ? memberMap.get(msg.author_id) : undefined;
+          const authorName =
+            member?.name ?? msg.author?.display_name ?? msg.author_id ?? 'Unknown';
           const initial = authorName[0]?.toUpperCase() ?? '?';
           return (
             <div key={msg.id} className="group hover:bg-gray-600/30 px-2 py-1 rounded flex gap-3">
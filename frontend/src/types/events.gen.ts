@@ -0,0 +1,303 @@
+// Code generated by eventgen from backend/internal/events. DO NOT EDIT.
+
+export type ChannelType = string;
+
+export interface Channel {
+  id: string;
+  server_id: string;
+  name: string;
+  type: ChannelType;
+  position: number;
+  topic: string | null;
+  user_limit: number;
+  created_at: string;
+}
+
+export type HeartbeatAckPayload = Record<string, never>;
+
+export interface HelloPayload {
+  heartbeat_interval: number;
+}
+
+export type InteractionType = number;
+
+export type CommandOptionType = number;
+
+export interface InteractionOption {
+  name: string;
+  type: CommandOptionType;
+  value: unknown;
+}
+
+export interface InteractionCommand {
+  id: string;
+  name: string;
+  options: InteractionOption[];
+}
+
+export interface Interaction {
+  id: string;
+  application_id: string;
+  type: InteractionType;
+  token?: string;
+  server_id?: string;
+  channel_id?: string;
+  user_id?: string;
+  command?: InteractionCommand;
+  created_at: string;
+}
+
+export interface InteractionDeferredPayload {
+  interaction_id: string;
+  application_id: string;
+  channel_id: string;
+  user_id: string;
+}
+
+export interface InvalidSessionPayload {
+  resumable: boolean;
+}
+
+export interface MessageAuthor {
+  id: string;
+  username: string;
+  display_name: string;
+  avatar_url: string | null;
+  bot: boolean;
+  webhook?: boolean;
+}
+
+export interface Message {
+  id: string;
+  channel_id: string;
+  author_id?: string;
+  webhook_id?: string;
+  content: string;
+  thread_id?: string;
+  edited_at?: string;
+  created_at: string;
+  author?: MessageAuthor;
+  flags?: number;
+}
+
+export interface MessageDeletePayload {
+  id: string;
+  channel_id: string;
+}
+
+export type UserStatus = string;
+
+export interface CustomStatus {
+  text: string;
+  emoji: string | null;
+  expires_at: string | null;
+}
+
+export type ActivityType = string;
+
+export interface Activity {
+  type: ActivityType;
+  name: string;
+  started_at: string;
+}
+
+export interface PresenceUpdatePayload {
+  user_id: string;
+  status: UserStatus;
+  custom_status: CustomStatus | null;
+  activities: Activity[];
+}
+
+export interface ReadyPayload {
+  session_id: string;
+  user_id: string;
+}
+
+export type ReconnectPayload = Record<string, never>;
+
+export type ResumedPayload = Record<string, never>;
+
+export interface Role {
+  id: string;
+  server_id: string;
+  name: string;
+  permissions: number;
+  color: string | null;
+  position: number;
+  managed: boolean;
+}
+
+export interface RoleDeletePayload {
+  id: string;
+  server_id: string;
+}
+
+export interface Server {
+  id: string;
+  name: string;
+  owner_id: string;
+  icon_url: string | null;
+  require_verified_email: boolean;
+  created_at: string;
+}
+
+export interface ServerDeletePayload {
+  id: string;
+}
+
+export interface ServerMemberAddPayload {
+  server_id: string;
+  user_id: string;
+  username: string;
+  display_name: string;
+  avatar_url: string | null;
+  nickname: string | null;
+  bot: boolean;
+  joined_at: string;
+}
+
+export interface ServerMemberRemovePayload {
+  server_id: string;
+  user_id: string;
+}
+
+export interface ServerMemberUpdatePayload {
+  server_id: string;
+  user_id: string;
+  nickname: string | null;
+  role_ids: string[];
+}
+
+export interface SessionInvalidatePayload {
+  token_id?: string;
+  session_id?: string;
+}
+
+export interface Thread {
+  id: string;
+  channel_id: string;
+  parent_message_id: string;
+  name: string;
+  created_by: string;
+  archived: boolean;
+  created_at: string;
+}
+
+export interface TypingStartPayload {
+  channel_id: string;
+  user_id: string;
+  nickname: string | null;
+  timestamp: string;
+}
+
+export interface ICECandidate {
+  candidate: string;
+  sdp_mid: string | null;
+  sdp_mline_index: number | null;
+  username_fragment: string | null;
+}
+
+export interface VoiceServerInfoPayload {
+  channel_id: string;
+  session_id: string;
+  endpoint: string;
+  type: string;
+  sdp?: string;
+  candidate?: ICECandidate;
+  ice_servers?: string[];
+}
+
+export interface VideoLayer {
+  user_id: string;
+  source: string;
+  rid?: string;
+  max_bitrate?: number;
+}
+
+export interface VoiceSignalPayload {
+  channel_id: string;
+  user_id: string;
+  session_id: string;
+  type: string;
+  sdp?: string;
+  candidate?: ICECandidate;
+  tracks?: Record<string, string>;
+  layer?: VideoLayer;
+}
+
+export interface VoiceStatePayload {
+  server_id: string;
+  channel_id: string | null;
+  user_id: string;
+  session_id: string;
+  mute: boolean;
+  deaf: boolean;
+  self_mute: boolean;
+  self_deaf: boolean;
+  suppress: boolean;
+  self_video: boolean;
+  self_stream: boolean;
+}
+
+/** Payload of each gateway event type. */
+export interface GatewayEventMap {
+  CHANNEL_CREATE: Channel;
+  CHANNEL_DELETE: Channel;
+  CHANNEL_UPDATE: Channel;
+  HEARTBEAT_ACK: HeartbeatAckPayload;
+  HELLO: HelloPayload;
+  INTERACTION_CREATE: Interaction;
+  INTERACTION_DEFERRED: InteractionDeferredPayload;
+  INVALID_SESSION: InvalidSessionPayload;
+  MESSAGE_CREATE: Message;
+  MESSAGE_DELETE: MessageDeletePayload;
+  MESSAGE_UPDATE: Message;
+  PRESENCE_UPDATE: PresenceUpdatePayload;
+  READY: ReadyPayload;
+  RECONNECT: ReconnectPayload;
+  RESUMED: ResumedPayload;
+  ROLE_CREATE: Role;
+  ROLE_DELETE: RoleDeletePayload;
+  ROLE_UPDATE: Role;
+  SERVER_CREATE: Server;
+  SERVER_DELETE: ServerDeletePayload;
+  SERVER_MEMBER_ADD: ServerMemberAddPayload;
+  SERVER_MEMBER_REMOVE: ServerMemberRemovePayload;
+  SERVER_MEMBER_UPDATE: ServerMemberUpdatePayload;
+  SERVER_UPDATE: Server;
+  SESSION_INVALIDATE: SessionInvalidatePayload;
+  THREAD_CREATE: Thread;
+  THREAD_UPDATE: Thread;
+  TYPING_START: TypingStartPayload;
+  VOICE_SERVER_INFO: VoiceServerInfoPayload;
+  VOICE_SIGNAL: VoiceSignalPayload;
+  VOICE_STATE_UPDATE: VoiceStatePayload;
+}
+
+export type GatewayEventType = keyof GatewayEventMap;
+
+/** Close codes the gateway ends connections with. */
+export const GatewayCloseCode = {
+  UnknownError: 4000,
+  SessionReplaced: 4001,
+  SessionInvalidated: 4002,
+  SlowConsumer: 4003,
+  SessionTimedOut: 4004,
+  Reconnect: 4005,
+  DecodeError: 4006,
+} as const;
+
+/** A gateway event, discriminated by its type. */
+export type GatewayEvent = {
+  [T in GatewayEventType]: {
+    t: T;
+    d: GatewayEventMap[T];
+    /** Payload version. */
+    v?: number;
+    s?: string;
+    /** Sequence number within the gateway session. */
+    q?: number;
+    /** Idempotency key; repeats of an event share it. */
+    k?: string;
+  };
+}[GatewayEventType];
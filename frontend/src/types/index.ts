@@ -3,8 +3,10 @@ export interface User {
   username: string;
   display_name: string;
   email: string;
+  email_verified_at?: string | null;
   avatar_url: string | null;
-  status: 'online' | 'offline' | 'away' | 'dnd';
+  bot?: boolean;
+  status: 'online' | 'offline' | 'away' | 'dnd' | 'invisible';
   created_at: string;
   updated_at: string;
 }
@@ -14,6 +16,7 @@ export interface Server {
   name: string;
   owner_id: string;
   icon_url: string | null;
+  require_verified_email?: boolean;
   created_at: string;
 }
 
@@ -24,17 +27,70 @@ export interface Channel {
   type: 'text' | 'voice';
   position: number;
   topic: string | null;
+  user_limit: number;
   created_at: string;
 }
 
 export interface Message {
   id: string;
   channel_id: string;
-  author_id: string;
+  author_id?: string;
+  webhook_id?: string;
   content: string;
   thread_id?: string;
   edited_at?: string;
   created_at: string;
+  author?: MessageAuthor;
+  flags?: number;
+}
+
+export const MessageFlags = {
+  Ephemeral: 1 << 6,
+} as const;
+
+export interface MessageAuthor {
+  id: string;
+  username: string;
+  display_name: string;
+  avatar_url: string | null;
+  bot: boolean;
+  webhook?: boolean;
+}
+
+export const CommandOptionType = {
+  String: 3,
+  Integer: 4,
+  User: 6,
+  Channel: 7,
+  Role: 8,
+} as const;
+
+export interface CommandOption {
+  type: number;
+  name: string;
+  description: string;
+  required?: boolean;
+}
+
+export interface ApplicationCommand {
+  id: string;
+  application_id: string;
+  server_id?: string;
+  name: string;
+  description: string;
+  options: CommandOption[];
+  default_member_permissions: string | null;
+  created_at: string;
+}
+
+export interface Webhook {
+  id: string;
+  server_id: string;
+  channel_id: string;
+  name: string;
+  avatar_url: string | null;
+  created_by?: string;
+  created_at: string;
 }
 
 export interface Thread {
@@ -70,6 +126,7 @@ export interface Role {
   permissions: number;
   color: string | null;
   position: number;
+  managed?: boolean;
 }
 
 export interface Member {
@@ -78,9 +135,24 @@ export interface Member {
   display_name: string;
   avatar_url: string | null;
   nickname: string | null;
+  bot?: boolean;
+  mute: boolean;
+  deaf: boolean;
   joined_at: string;
 }
 
+export interface APIToken {
+  id: string;
+  user_id: string;
+  name: string;
+  token_prefix: string;
+  scopes: string[];
+  server_id?: string;
+  expires_at: string | null;
+  last_used_at: string | null;
+  created_at: string;
+}
+
 export const Permissions = {
   Admin: 1 << 0,
   ManageServer: 1 << 1,
@@ -94,6 +166,10 @@ export const Permissions = {
   Connect: 1 << 9,
   Speak: 1 << 10,
   ShareScreen: 1 << 11,
+  ManageWebhooks: 1 << 12,
+  MuteMembers: 1 << 13,
+  DeafenMembers: 1 << 14,
+  MoveMembers: 1 << 15,
 } as const;
 
 export const PermissionLabels: Record<number, string> = {
@@ -109,10 +185,28 @@ export const PermissionLabels: Record<number, string> = {
   [Permissions.Connect]: 'Connect',
   [Permissions.Speak]: 'Speak',
   [Permissions.ShareScreen]: 'Share Screen',
+  [Permissions.ManageWebhooks]: 'Manage Webhooks',
+  [Permissions.MuteMembers]: 'Mute Members',
+  [Permissions.DeafenMembers]: 'Deafen Members',
+  [Permissions.MoveMembers]: 'Move Members',
 };
 
-export interface GatewayEvent {
-  t: string;
-  d: unknown;
-  s?: string;
-}
+export type {
+  Activity,
+  CustomStatus,
+  GatewayEvent,
+  GatewayEventMap,
+  GatewayEventType,
+  VideoLayer,
+  VoiceSignalPayload,
+} from './events.gen';
+export { GatewayCloseCode } from './events.gen';
+
+/** Optional event groups requested in IDENTIFY. */
+export const GatewayIntents = {
+  Messages: 1 << 0,
+  Members: 1 << 1,
+  Presence: 1 << 2,
+  Typing: 1 << 3,
+  Voice: 1 << 4,
+} as const;